@@ -2,90 +2,152 @@
 package agent
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gbbr/gomez/dkim"
 	"github.com/gbbr/gomez/mailbox"
 	"github.com/gbbr/jamon"
 )
 
 type cronJob struct {
-	config jamon.Group
-	dq     mailbox.Dequeuer
-	done   chan report
-	failed chan report
-	retry  chan report
+	config  jamon.Group
+	dq      mailbox.Dequeuer
+	signers map[string]*dkim.Signer // DKIM signers by sender domain
+	sealer  *dkim.Signer            // ARC signer of forwarded messages
+	done    chan report
+	failed  chan report
+	retry   chan report
 }
 
 type report struct {
-	msgID  uint64
-	rcpt   []*mail.Address
-	reason error
+	msgID     uint64
+	rcpt      []*mail.Address
+	reason    error
+	forwarded bool // notification requests were passed on
 }
 
+// Start runs the delivery agent, which dequeues and sends out mail every
+// 'pause' seconds. Messages from domains which have a DKIM key configured
+// are signed before being sent, as described by loadSigners, and messages
+// which users forward from other domains are sealed with ARC sets for the
+// domain set by 'arc.domain'. Aggregate DMARC reports are sent every 'dmarc.interval'
+// seconds (default 86400, a day).
 func Start(dq mailbox.Dequeuer, conf jamon.Group) error {
+	return StartContext(context.Background(), dq, conf)
+}
+
+// StartContext is like Start, but stops once the given context is done. A
+// delivery round which is in progress is completed and flushed first.
+func StartContext(ctx context.Context, dq mailbox.Dequeuer, conf jamon.Group) error {
 	pause, err := strconv.Atoi(conf.Get("pause"))
 	if err != nil {
 		log.Fatal("agent/pause configuration is not numeric")
 	}
+	signers, err := loadSigners(conf)
+	if err != nil {
+		return err
+	}
+	sealer, err := loadSealer(conf, signers)
+	if err != nil {
+		return err
+	}
 	cron := cronJob{
-		dq:     dq,
-		config: conf,
-		failed: make(chan report),
-		done:   make(chan report),
-		retry:  make(chan report),
+		dq:      dq,
+		config:  conf,
+		signers: signers,
+		sealer:  sealer,
 	}
-	for {
-		time.Sleep(time.Duration(pause) * time.Second)
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Duration(pause) * time.Second):
+		}
 
 		jobs, err := cron.dq.Dequeue()
 		if err != nil {
 			log.Printf("error dequeuing: %s", err)
 			continue
 		}
+		cron.deliver(jobs)
+		cron.reportDMARC()
+	}
+	return nil
+}
+
+// reportDMARC sends the aggregate DMARC reports of the results recorded
+// since the last reports, once the 'dmarc.interval' has passed. The time of
+// the last reports is kept by the dequeuer. A zero interval disables the
+// reports.
+func (cron *cronJob) reportDMARC() {
+	interval := time.Duration(cron.intFlag("dmarc.interval", 86400)) * time.Second
+	if interval <= 0 {
+		return
+	}
+	if err := cron.dq.ReportDMARC(interval); err != nil {
+		log.Printf("error sending DMARC reports: %s", err)
+	}
+}
+
+// deliver sends out all jobs concurrently, one connection per host, and
+// reports the results to the dequeuer. Once all reports are processed,
+// the dequeuer is flushed.
+func (cron *cronJob) deliver(jobs map[string]mailbox.Package) {
+	cron.done = make(chan report)
+	cron.retry = make(chan report)
+	cron.failed = make(chan report)
 
-		go func() {
-			for {
-				select {
-				case r, more := <-cron.done:
-					if !more {
-						return
-					}
-					dq.Delivered(r.msgID, r.rcpt)
-				case r := <-cron.retry:
-					dq.Retry(r.msgID, r.rcpt, r.reason)
-				case r := <-cron.failed:
-					dq.Failed(r.msgID, r.rcpt, r.reason)
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		for {
+			select {
+			case r, more := <-cron.done:
+				if !more {
+					return
 				}
+				cron.dq.Delivered(r.msgID, r.rcpt, r.forwarded)
+			case r := <-cron.retry:
+				cron.dq.Retry(r.msgID, r.rcpt, r.reason)
+			case r := <-cron.failed:
+				cron.dq.Failed(r.msgID, r.rcpt, r.reason)
 			}
-		}()
-
-		var wg sync.WaitGroup
-		wg.Add(len(jobs))
-		for host, pkg := range jobs {
-			go func() {
-				defer wg.Done()
-				cron.deliverTo(host, pkg)
-			}()
 		}
-		wg.Wait()
-		close(cron.done)
-		dq.Flush()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(len(jobs))
+	for host, pkg := range jobs {
+		go func(host string, pkg mailbox.Package) {
+			defer wg.Done()
+			cron.deliverTo(host, pkg)
+		}(host, pkg)
 	}
-	return nil
+	wg.Wait()
+	close(cron.done)
+	<-reported
+	cron.dq.Flush()
 }
 
 func (cron *cronJob) deliverTo(host string, pkg mailbox.Package) {
 	client, err := cron.getSMTPClient(host)
 	if err != nil {
-		// cron.log <- err
+		// Release the jobs right away instead of waiting for their
+		// lease on the queue to expire.
+		for msg, all := range pkg {
+			cron.retry <- report{msgID: msg.ID, rcpt: all, reason: err}
+		}
 		return
 	}
 	defer func() {
@@ -93,38 +155,195 @@ func (cron *cronJob) deliverTo(host string, pkg mailbox.Package) {
 			log.Printf("error quitting client: %s", err)
 		}
 	}()
+	dsn, _ := client.Extension("DSN")
+	utf8, _ := client.Extension("SMTPUTF8")
 	for msg, all := range pkg {
-		if err := client.Mail(msg.From().String()); err != nil {
-			cron.retry <- report{msgID: msg.ID, rcpt: all, reason: err}
+		cron.send(client, msg, all, dsn, utf8)
+	}
+}
+
+// send delivers msg to the given recipients in one transaction on client,
+// reporting the outcome for each of them. Recipients refused with a 5xx
+// reply have failed, while those which get a 4xx reply or a network error
+// are retried. A transaction which does not complete is reset, so that the
+// connection can be used for the next message.
+func (cron *cronJob) send(client *smtp.Client, msg *mailbox.Message, all []*mail.Address, dsn, utf8 bool) {
+	abort := func(rcpt []*mail.Address, err error) {
+		cron.reject(msg.ID, rcpt, err)
+		client.Reset()
+	}
+	if !utf8 && needsUTF8(msg) {
+		cron.failed <- report{msgID: msg.ID, rcpt: all, reason: errNoUTF8}
+		return
+	}
+	if msg.Binary && !acceptsBinary(client) {
+		cron.failed <- report{msgID: msg.ID, rcpt: all, reason: errNoBinary}
+		return
+	}
+	if err := sendMail(client, msg, dsn); err != nil {
+		abort(all, err)
+		return
+	}
+	ok := report{msgID: msg.ID, rcpt: make([]*mail.Address, 0, len(all)), forwarded: dsn}
+	for _, rcpt := range all {
+		if user, _ := mailbox.SplitUserHost(rcpt); !utf8 && !mailbox.IsASCII(user) {
+			cron.failed <- report{msgID: msg.ID, rcpt: []*mail.Address{rcpt}, reason: errNoUTF8}
 			continue
 		}
-		ok := report{msgID: msg.ID, rcpt: make([]*mail.Address, 0, len(all))}
-		for _, rcpt := range all {
-			if err := client.Rcpt(rcpt.String()); err != nil {
-				cron.failed <- report{msg.ID, []*mail.Address{rcpt}, err}
-				continue
-			}
-			ok.rcpt = append(ok.rcpt, rcpt)
-		}
-		w, err := client.Data()
-		if err != nil {
-			ok.reason = err
-			cron.retry <- ok
+		if err := sendRcpt(client, msg, rcpt, dsn); err != nil {
+			cron.reject(msg.ID, []*mail.Address{rcpt}, err)
 			continue
 		}
-		_, err = fmt.Fprint(w, msg.Raw)
+		ok.rcpt = append(ok.rcpt, rcpt)
+	}
+	if len(ok.rcpt) == 0 {
+		client.Reset()
+		return
+	}
+	if err := sendData(client, cron.seal(msg, cron.sign(msg)), msg.Binary); err != nil {
+		abort(ok.rcpt, err)
+		return
+	}
+	cron.done <- ok
+}
+
+// reject reports recipients whose delivery did not succeed because of err.
+// They have failed if the host replied with a permanent (5xx) error, and
+// are retried otherwise.
+func (cron *cronJob) reject(id uint64, rcpt []*mail.Address, err error) {
+	r := report{msgID: id, rcpt: rcpt, reason: err}
+	if e, ok := err.(*textproto.Error); ok && e.Code/100 == 5 {
+		cron.failed <- r
+		return
+	}
+	cron.retry <- r
+}
+
+// errNoUTF8 is reported for recipients of messages which can not be delivered
+// because the receiving host does not support SMTPUTF8.
+var errNoUTF8 = errors.New("5.6.7 Remote host does not support SMTPUTF8, " +
+	"the message can not be delivered without it")
+
+// errNoBinary is reported for recipients of binary messages which can not be
+// delivered because the receiving host does not accept them. RFC 3030 3
+// forbids sending them with DATA.
+var errNoBinary = errors.New("5.6.3 Remote host does not support BINARYMIME, " +
+	"the message can not be delivered without it")
+
+// acceptsBinary reports whether the host accepts binary messages, which are
+// sent using BDAT, as per RFC 3030 3.
+func acceptsBinary(c *smtp.Client) bool {
+	chunking, _ := c.Extension("CHUNKING")
+	binary, _ := c.Extension("BINARYMIME")
+	return chunking && binary
+}
+
+// needsUTF8 reports whether msg can not be downgraded to be delivered without
+// SMTPUTF8, because the local part of its sender or its headers contain UTF-8.
+// International domain names are always sent in their ASCII form.
+func needsUTF8(msg *mailbox.Message) bool {
+	if !msg.UTF8 {
+		return false
+	}
+	header := msg.Raw
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := strings.Index(header, sep); i != -1 {
+			header = header[:i]
+			break
+		}
+	}
+	user, _ := mailbox.SplitUserHost(msg.From())
+	return !mailbox.IsASCII(user) || !mailbox.IsASCII(header)
+}
+
+// asciiDomain returns the address with its domain converted to the IDNA ASCII
+// form, which every host understands.
+func asciiDomain(addr string) string {
+	user, host := mailbox.SplitUserHost(&mail.Address{Address: addr})
+	if host == "" {
+		return addr
+	}
+	return user + "@" + host
+}
+
+// sendMail issues the MAIL command for msg, with the parameters supported by
+// the host: BODY=BINARYMIME for binary messages or BODY=8BITMIME, SMTPUTF8
+// for messages which were submitted using it and, if the host supports DSN,
+// the RET and ENVID parameters of RFC 3461.
+func sendMail(c *smtp.Client, msg *mailbox.Message, dsn bool) error {
+	cmd := fmt.Sprintf("MAIL FROM:<%s>", asciiDomain(msg.From().Address))
+	if msg.Binary {
+		cmd += " BODY=BINARYMIME"
+	} else if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok && msg.UTF8 {
+		cmd += " SMTPUTF8"
+	}
+	if dsn && msg.Ret != "" {
+		cmd += " RET=" + msg.Ret
+	}
+	if dsn && msg.EnvID != "" {
+		cmd += " ENVID=" + msg.EnvID
+	}
+	return command(c, 250, cmd)
+}
+
+// sendRcpt issues the RCPT command for rcpt. If the host supports DSN, the
+// NOTIFY and ORCPT parameters of the recipient are passed on.
+func sendRcpt(c *smtp.Client, msg *mailbox.Message, rcpt *mail.Address, dsn bool) error {
+	cmd := fmt.Sprintf("RCPT TO:<%s>", asciiDomain(rcpt.Address))
+	req := msg.RcptDSN(rcpt)
+	if dsn && req.Notify != "" {
+		cmd += " NOTIFY=" + req.Notify
+	}
+	if dsn && req.ORcpt != "" {
+		cmd += " ORCPT=" + req.ORcpt
+	}
+	return command(c, 25, cmd)
+}
+
+// sendData transfers the message data. Binary messages are sent as a single
+// chunk using BDAT, as per RFC 3030, so that their content is passed on as
+// it is, while all others are sent using DATA.
+func sendData(c *smtp.Client, data string, binary bool) error {
+	if !binary {
+		w, err := c.Data()
 		if err != nil {
-			ok.reason = err
-			cron.retry <- ok
-			continue
+			return err
 		}
-		if err = w.Close(); err != nil {
-			ok.reason = err
-			cron.retry <- ok
-			continue
+		if _, err := fmt.Fprint(w, data); err != nil {
+			return err
 		}
-		cron.done <- ok
+		return w.Close()
+	}
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	_, err := fmt.Fprintf(c.Text.W, "BDAT %d LAST\r\n%s", len(data), data)
+	if err == nil {
+		err = c.Text.W.Flush()
 	}
+	c.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// command sends a command to the host and reads its reply, which is expected
+// to start with the given code.
+func command(c *smtp.Client, expect int, cmd string) error {
+	id, err := c.Text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expect)
+	return err
 }
 
 var errFailedHost = errors.New("failed connecting to MX hosts after all tries")
@@ -134,19 +353,29 @@ var lookupMX = func(host string) ([]*net.MX, error) {
 	return net.LookupMX(host)
 }
 
+// getSMTPClient connects to the first available MX host of the given domain.
+// The number of attempts, the connection timeout and the name used to greet
+// the host are taken from the 'mx.retry', 'mx.timeout' and 'hello' flags.
 func (cron *cronJob) getSMTPClient(host string) (*smtp.Client, error) {
 	MXs, err := lookupMX(host)
 	if err != nil {
 		return nil, err
 	}
-	for retry := 0; retry < 2; retry++ {
+	retries := cron.intFlag("mx.retry", 2)
+	timeout := time.Duration(cron.intFlag("mx.timeout", 5)) * time.Second
+	for retry := 0; retry < retries; retry++ {
 		for _, mx := range MXs {
-			conn, err := net.DialTimeout("tcp", mx.Host+":25", 5*time.Second)
+			conn, err := net.DialTimeout("tcp", mx.Host+":25", timeout)
 			if err != nil {
 				continue
 			}
-			client, err := smtp.NewClient(conn, "mecca.local")
+			client, err := smtp.NewClient(conn, mx.Host)
 			if err != nil {
+				conn.Close()
+				continue
+			}
+			if err := client.Hello(cron.hello()); err != nil {
+				client.Close()
 				continue
 			}
 			return client, nil
@@ -154,3 +383,21 @@ func (cron *cronJob) getSMTPClient(host string) (*smtp.Client, error) {
 	}
 	return nil, errFailedHost
 }
+
+// hello returns the name used to identify with remote hosts.
+func (cron *cronJob) hello() string {
+	if cron.config.Has("hello") {
+		return cron.config.Get("hello")
+	}
+	return "localhost"
+}
+
+// intFlag returns the numeric value of a configuration flag, or def if
+// the flag is not set or is not numeric.
+func (cron *cronJob) intFlag(name string, def int) int {
+	n, err := strconv.Atoi(cron.config.Get(name))
+	if err != nil {
+		return def
+	}
+	return n
+}
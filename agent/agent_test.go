@@ -1,6 +1,22 @@
 package agent
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
 
 func TestAgent_deliverTo(t *testing.T) {
 	//var cron cronJob
@@ -8,3 +24,369 @@ func TestAgent_deliverTo(t *testing.T) {
 	//return []*net.MX{{Host: "localhost"}}, nil
 	//}
 }
+
+// testHost returns a client connected to a host which advertises the given
+// EHLO reply. The host accepts n commands and sends them on the returned
+// channel.
+func testHost(t *testing.T, ehlo string, n int) (*smtp.Client, <-chan []string) {
+	cc, sc := net.Pipe()
+	got := make(chan []string)
+	go func() {
+		srv := textproto.NewConn(sc)
+		defer srv.Close()
+		var cmds []string
+		srv.PrintfLine("220 mx.b.com")
+		srv.ReadLine()
+		srv.PrintfLine("%s", ehlo)
+		for i := 0; i < n; i++ {
+			line, _ := srv.ReadLine()
+			cmds = append(cmds, line)
+			srv.PrintfLine("250 Ok")
+		}
+		got <- cmds
+	}()
+	client, err := smtp.NewClient(cc, "mx.b.com")
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+	return client, got
+}
+
+// scriptedHost returns a client connected to a host which advertises the
+// given EHLO reply and answers each command with the next of the given
+// replies. Message data following a 354 reply is read up to its final dot and
+// BDAT chunks are read along with their command. The commands are sent on the
+// returned channel once all replies are used.
+func scriptedHost(t *testing.T, ehlo string, replies ...string) (*smtp.Client, <-chan []string) {
+	cc, sc := net.Pipe()
+	got := make(chan []string, 1)
+	go func() {
+		srv := textproto.NewConn(sc)
+		defer srv.Close()
+		var cmds []string
+		srv.PrintfLine("220 mx.b.com")
+		srv.ReadLine()
+		srv.PrintfLine("%s", ehlo)
+		data := false
+		for _, reply := range replies {
+			if data {
+				srv.ReadDotLines()
+				cmds = append(cmds, ".")
+			} else {
+				line, _ := srv.ReadLine()
+				cmds = append(cmds, line)
+				var size int
+				if _, err := fmt.Sscanf(line, "BDAT %d", &size); err == nil {
+					chunk := make([]byte, size)
+					io.ReadFull(srv.R, chunk)
+					cmds = append(cmds, string(chunk))
+				}
+			}
+			srv.PrintfLine("%s", reply)
+			data = strings.HasPrefix(reply, "354")
+		}
+		got <- cmds
+	}()
+	client, err := smtp.NewClient(cc, "mx.b.com")
+	if err != nil {
+		t.Fatalf("Error creating client: %s", err)
+	}
+	return client, got
+}
+
+// It should retry recipients which get temporary errors and fail those which
+// get permanent ones, resetting transactions which do not complete.
+func TestCronJob_send(t *testing.T) {
+	a, b := &mail.Address{Address: "a@b.com"}, &mail.Address{Address: "b@b.com"}
+	msg := &mailbox.Message{ID: 1, Raw: "Subject: Hi\r\n\r\nHello\r\n"}
+	msg.SetFrom(&mail.Address{Address: "jane@doe.com"})
+
+	for i, test := range []struct {
+		replies             []string
+		cmds                []string
+		done, retry, failed []*mail.Address
+	}{
+		{
+			[]string{"250 Ok", "250 Ok", "250 Ok", "354 Go", "250 Ok"},
+			[]string{"MAIL FROM:<jane@doe.com>", "RCPT TO:<a@b.com>", "RCPT TO:<b@b.com>", "DATA", "."},
+			[]*mail.Address{a, b}, nil, nil,
+		},
+		{
+			[]string{"451 Greylisted", "250 Ok"},
+			[]string{"MAIL FROM:<jane@doe.com>", "RSET"},
+			nil, []*mail.Address{a, b}, nil,
+		},
+		{
+			[]string{"550 Sender refused", "250 Ok"},
+			[]string{"MAIL FROM:<jane@doe.com>", "RSET"},
+			nil, nil, []*mail.Address{a, b},
+		},
+		{
+			[]string{"250 Ok", "450 Mailbox busy", "550 No such user", "250 Ok"},
+			[]string{"MAIL FROM:<jane@doe.com>", "RCPT TO:<a@b.com>", "RCPT TO:<b@b.com>", "RSET"},
+			nil, []*mail.Address{a}, []*mail.Address{b},
+		},
+		{
+			[]string{"250 Ok", "250 Ok", "452 Too many recipients", "354 Go", "554 Rejected", "250 Ok"},
+			[]string{"MAIL FROM:<jane@doe.com>", "RCPT TO:<a@b.com>", "RCPT TO:<b@b.com>", "DATA", ".", "RSET"},
+			nil, []*mail.Address{b}, []*mail.Address{a},
+		},
+	} {
+		client, got := scriptedHost(t, "250 mx.b.com", test.replies...)
+		cron := cronJob{
+			done:   make(chan report, 3),
+			retry:  make(chan report, 3),
+			failed: make(chan report, 3),
+		}
+		cron.send(client, msg, []*mail.Address{a, b}, false, false)
+		close(cron.done)
+		close(cron.retry)
+		close(cron.failed)
+		if cmds := <-got; !reflect.DeepEqual(cmds, test.cmds) {
+			t.Errorf("%d: expected %q, got %q", i, test.cmds, cmds)
+		}
+		for name, c := range map[string]struct {
+			ch   chan report
+			want []*mail.Address
+		}{
+			"delivered": {cron.done, test.done},
+			"retried":   {cron.retry, test.retry},
+			"failed":    {cron.failed, test.failed},
+		} {
+			var rcpt []*mail.Address
+			for r := range c.ch {
+				rcpt = append(rcpt, r.rcpt...)
+			}
+			if !reflect.DeepEqual(rcpt, c.want) {
+				t.Errorf("%d: expected %v %s, got %v", i, c.want, name, rcpt)
+			}
+		}
+		client.Close()
+	}
+}
+
+// It should send binary messages with BDAT to hosts which accept them and
+// fail them for all others.
+func TestCronJob_send_binary(t *testing.T) {
+	a := &mail.Address{Address: "a@b.com"}
+	msg := &mailbox.Message{ID: 1, Raw: "Subject: Hi\r\n\r\n\x00\x01\r\n", Binary: true}
+	msg.SetFrom(&mail.Address{Address: "jane@doe.com"})
+
+	for i, test := range []struct {
+		ehlo         string
+		replies      []string
+		cmds         []string
+		done, failed []*mail.Address
+	}{
+		{
+			"250-mx.b.com\r\n250-CHUNKING\r\n250-8BITMIME\r\n250 BINARYMIME",
+			[]string{"250 Ok", "250 Ok", "250 Ok"},
+			[]string{"MAIL FROM:<jane@doe.com> BODY=BINARYMIME", "RCPT TO:<a@b.com>",
+				"BDAT 19 LAST", msg.Raw},
+			[]*mail.Address{a}, nil,
+		},
+		{
+			"250-mx.b.com\r\n250-8BITMIME\r\n250 BINARYMIME",
+			nil, nil, nil, []*mail.Address{a},
+		},
+		{
+			"250-mx.b.com\r\n250-8BITMIME\r\n250 CHUNKING",
+			nil, nil, nil, []*mail.Address{a},
+		},
+	} {
+		client, got := scriptedHost(t, test.ehlo, test.replies...)
+		cron := cronJob{
+			done:   make(chan report, 1),
+			retry:  make(chan report, 1),
+			failed: make(chan report, 1),
+		}
+		cron.send(client, msg, []*mail.Address{a}, false, false)
+		if cmds := <-got; !reflect.DeepEqual(cmds, test.cmds) {
+			t.Errorf("%d: expected %q, got %q", i, test.cmds, cmds)
+		}
+		close(cron.done)
+		close(cron.failed)
+		var done, failed []*mail.Address
+		for r := range cron.done {
+			done = append(done, r.rcpt...)
+		}
+		for r := range cron.failed {
+			if r.reason != errNoBinary {
+				t.Errorf("%d: expected %v, got %v", i, errNoBinary, r.reason)
+			}
+			failed = append(failed, r.rcpt...)
+		}
+		if !reflect.DeepEqual(done, test.done) || !reflect.DeepEqual(failed, test.failed) {
+			t.Errorf("%d: expected %v delivered and %v failed, got %v and %v",
+				i, test.done, test.failed, done, failed)
+		}
+		client.Close()
+	}
+}
+
+// It should pass on the notification requests of a message to hosts which
+// support DSN, and only to those.
+func TestSendMail_DSN(t *testing.T) {
+	msg := &mailbox.Message{Ret: "HDRS", EnvID: "QQ314"}
+	msg.SetFrom(&mail.Address{Address: "jane@doe.com"})
+	to := &mail.Address{Address: "bob@b.com"}
+	msg.SetRcptDSN(to, mailbox.RcptDSN{Notify: "SUCCESS,FAILURE", ORcpt: "rfc822;bob@b.com"})
+
+	for _, test := range []struct {
+		ext    string
+		expect []string
+	}{
+		{"250-mx.b.com\r\n250-8BITMIME\r\n250 DSN", []string{
+			"MAIL FROM:<jane@doe.com> BODY=8BITMIME RET=HDRS ENVID=QQ314",
+			"RCPT TO:<bob@b.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;bob@b.com",
+		}},
+		{"250 mx.b.com", []string{
+			"MAIL FROM:<jane@doe.com>",
+			"RCPT TO:<bob@b.com>",
+		}},
+	} {
+		client, got := testHost(t, test.ext, 2)
+		dsn, _ := client.Extension("DSN")
+		if err := sendMail(client, msg, dsn); err != nil {
+			t.Errorf("Error on MAIL: %s", err)
+		}
+		if err := sendRcpt(client, msg, to, dsn); err != nil {
+			t.Errorf("Error on RCPT: %s", err)
+		}
+		if cmds := <-got; !reflect.DeepEqual(cmds, test.expect) {
+			t.Errorf("Expected %q, got %q", test.expect, cmds)
+		}
+		client.Close()
+	}
+}
+
+// It should send SMTPUTF8 messages to hosts which support it and send
+// international domain names in their ASCII form.
+func TestSendMail_UTF8(t *testing.T) {
+	msg := &mailbox.Message{UTF8: true}
+	msg.SetFrom(&mail.Address{Address: "jane@bücher.de"})
+	to := &mail.Address{Address: "bob@例子.广告"}
+
+	for _, test := range []struct {
+		ext    string
+		expect []string
+	}{
+		{"250-mx.b.com\r\n250 SMTPUTF8", []string{
+			"MAIL FROM:<jane@xn--bcher-kva.de> SMTPUTF8",
+			"RCPT TO:<bob@xn--fsqu00a.xn--4rr70v>",
+		}},
+		{"250 mx.b.com", []string{
+			"MAIL FROM:<jane@xn--bcher-kva.de>",
+			"RCPT TO:<bob@xn--fsqu00a.xn--4rr70v>",
+		}},
+	} {
+		client, got := testHost(t, test.ext, 2)
+		if err := sendMail(client, msg, false); err != nil {
+			t.Errorf("Error on MAIL: %s", err)
+		}
+		if err := sendRcpt(client, msg, to, false); err != nil {
+			t.Errorf("Error on RCPT: %s", err)
+		}
+		if cmds := <-got; !reflect.DeepEqual(cmds, test.expect) {
+			t.Errorf("Expected %q, got %q", test.expect, cmds)
+		}
+		client.Close()
+	}
+}
+
+func TestNeedsUTF8(t *testing.T) {
+	for _, test := range []struct {
+		utf8      bool
+		from, raw string
+		expect    bool
+	}{
+		{false, "jörg@b.de", "Subject: Grüße\r\n\r\nBody", false},
+		{true, "jane@bücher.de", "Subject: Hi\r\n\r\nGrüße", false},
+		{true, "jörg@b.de", "Subject: Hi\r\n\r\nBody", true},
+		{true, "jane@b.de", "Subject: Grüße\n\nBody", true},
+	} {
+		msg := &mailbox.Message{UTF8: test.utf8, Raw: test.raw}
+		msg.SetFrom(&mail.Address{Address: test.from})
+		if got := needsUTF8(msg); got != test.expect {
+			t.Errorf("%s %q: expected %t, got %t", test.from, test.raw, test.expect, got)
+		}
+	}
+}
+
+// It should flush the dequeuer after every round, even when no
+// host could be reached, in which case all jobs are retried.
+func TestCronJob_deliver_Flush(t *testing.T) {
+	lookupMX = func(host string) ([]*net.MX, error) {
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupMX = net.LookupMX }()
+
+	var flushed, retried int
+	cron := cronJob{dq: &mailbox.MockDequeuer{
+		FlushMock: func() { flushed++ },
+		RetryMock: func(uint64, []*mail.Address, error) { retried++ },
+	}}
+	jobs := map[string]mailbox.Package{
+		"a.com": mailbox.Package{&mailbox.Message{ID: 1}: nil},
+		"b.com": mailbox.Package{&mailbox.Message{ID: 2}: nil},
+	}
+
+	cron.deliver(jobs)
+	cron.deliver(jobs)
+	if flushed != 2 || retried != 4 {
+		t.Errorf("Expected 2 flushes and 4 retries, got %d and %d", flushed, retried)
+	}
+}
+
+// It should ask for DMARC reports with the configured interval, unless
+// disabled.
+func TestCronJob_reportDMARC(t *testing.T) {
+	var reports []time.Duration
+	dq := &mailbox.MockDequeuer{ReportDMARCMock: func(interval time.Duration) error {
+		reports = append(reports, interval)
+		return nil
+	}}
+	for _, test := range []struct {
+		interval string
+		want     []time.Duration
+	}{
+		{"60", []time.Duration{time.Minute}},
+		{"", []time.Duration{24 * time.Hour}},
+		{"0", nil},
+	} {
+		reports = nil
+		cron := cronJob{dq: dq, config: jamon.Group{"dmarc.interval": test.interval}}
+		cron.reportDMARC()
+		if !reflect.DeepEqual(reports, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.interval, test.want, reports)
+		}
+	}
+}
+
+// It should complete and flush the round in progress before stopping.
+func TestStartContext_Shutdown(t *testing.T) {
+	lookupMX = func(host string) ([]*net.MX, error) {
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupMX = net.LookupMX }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var dequeued, flushed int
+	err := StartContext(ctx, &mailbox.MockDequeuer{
+		DequeueMock: func() (map[string]mailbox.Package, error) {
+			dequeued++
+			cancel()
+			return map[string]mailbox.Package{
+				"a.com": mailbox.Package{&mailbox.Message{ID: 1}: nil},
+			}, nil
+		},
+		RetryMock:       func(uint64, []*mail.Address, error) {},
+		FlushMock:       func() { flushed++ },
+		ReportDMARCMock: func(time.Duration) error { return nil },
+	}, jamon.Group{"pause": "0"})
+
+	if err != nil || dequeued != 1 || flushed != 1 {
+		t.Errorf("Expected 1 round and nil error, got %d dequeues, %d flushes and %v",
+			dequeued, flushed, err)
+	}
+}
@@ -0,0 +1,160 @@
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/gbbr/gomez/dkim"
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// loadSigners returns the DKIM signers configured for each sender domain.
+// A domain is signed for when both its 'dkim.<domain>.selector' and its
+// 'dkim.<domain>.key' flags are set, the latter being the path to a PEM
+// encoded private key. The signed header fields are the colon separated
+// names in 'dkim.headers', or dkim.DefaultHeaders if it is not set.
+func loadSigners(conf jamon.Group) (map[string]*dkim.Signer, error) {
+	var headers []string
+	if h := conf.Get("dkim.headers"); h != "" {
+		for _, name := range strings.Split(h, ":") {
+			if name = strings.TrimSpace(name); name != "" {
+				headers = append(headers, name)
+			}
+		}
+	}
+	signers := make(map[string]*dkim.Signer)
+	for flag, selector := range conf {
+		if !strings.HasPrefix(flag, "dkim.") || !strings.HasSuffix(flag, ".selector") {
+			continue
+		}
+		domain := strings.TrimSuffix(strings.TrimPrefix(flag, "dkim."), ".selector")
+		path := conf.Get("dkim." + domain + ".key")
+		if path == "" {
+			return nil, fmt.Errorf("agent/dkim.%s.key is not set", domain)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := dkim.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("agent/dkim.%s.key: %s", domain, err)
+		}
+		domain = mailbox.NormalizeHost(domain)
+		signers[domain] = &dkim.Signer{
+			Domain:   domain,
+			Selector: selector,
+			Key:      key,
+			Headers:  headers,
+		}
+	}
+	return signers, nil
+}
+
+// signer returns the DKIM signer configured for the domain of the From
+// header of msg, or of its envelope sender when the header can not be read,
+// or nil if there is none.
+func (cron *cronJob) signer(msg *mailbox.Message) *dkim.Signer {
+	if len(cron.signers) == 0 {
+		return nil
+	}
+	from := msg.From()
+	if m, err := msg.Parse(); err == nil {
+		if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+			from = addr
+		}
+	}
+	if from == nil {
+		return nil
+	}
+	_, host := mailbox.SplitUserHost(from)
+	return cron.signers[host]
+}
+
+// sign returns the raw message with a DKIM signature prepended, if a signer
+// is configured for it, as returned by signer. Otherwise, or if signing
+// fails, the message is returned as it is.
+func (cron *cronJob) sign(msg *mailbox.Message) string {
+	s := cron.signer(msg)
+	if s == nil {
+		return msg.Raw
+	}
+	sig, err := s.Sign(msg.Raw)
+	if err != nil {
+		log.Printf("error signing message %d: %s", msg.ID, err)
+		return msg.Raw
+	}
+	return sig + "\r\n" + msg.Raw
+}
+
+// loadSealer returns the signer which seals forwarded messages with ARC sets,
+// or nil if none is configured. The signing domain is set by 'arc.domain',
+// which must have a DKIM key configured, as described by loadSigners.
+func loadSealer(conf jamon.Group, signers map[string]*dkim.Signer) (*dkim.Signer, error) {
+	if !conf.Has("arc.domain") {
+		return nil, nil
+	}
+	s, ok := signers[mailbox.NormalizeHost(conf.Get("arc.domain"))]
+	if !ok {
+		return nil, fmt.Errorf("agent/arc.domain %s has no DKIM key", conf.Get("arc.domain"))
+	}
+	return s, nil
+}
+
+// seal returns raw, which is the data of msg, with an ARC set prepended, as
+// per RFC 8617, if msg is forwarded. Forwarded messages are those relayed
+// for authenticated users which were not written in a domain that we sign
+// for, such as messages which users redirect, and whose authors' signatures
+// may not survive the changes. They carry the topmost Authentication-Results
+// header whose authserv-id is the one recorded on msg when it was received,
+// which records the authenticated user and the result of validating the ARC
+// chain which the message arrived with. For all other messages, or if sealing
+// fails, raw is returned as it is.
+func (cron *cronJob) seal(msg *mailbox.Message, raw string) string {
+	if cron.sealer == nil || cron.signer(msg) != nil {
+		return raw
+	}
+	if msg.AuthservID == "" {
+		// Not received by the SMTP server, or received without checks.
+		return raw
+	}
+	m, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return raw
+	}
+	for _, ar := range m.Header["Authentication-Results"] {
+		if authservID := strings.SplitN(ar, ";", 2)[0]; !strings.EqualFold(strings.TrimSpace(authservID), msg.AuthservID) {
+			continue
+		}
+		var cv, user string
+		for _, r := range strings.Split(ar, ";") {
+			for _, f := range strings.Fields(r) {
+				switch {
+				case strings.HasPrefix(f, "arc="):
+					cv = strings.TrimPrefix(f, "arc=")
+				case strings.HasPrefix(f, "smtp.auth="):
+					user = strings.TrimPrefix(f, "smtp.auth=")
+				}
+			}
+		}
+		if user == "" || cv == "" {
+			// Not relayed for a user, or sent without checks.
+			return raw
+		}
+		if cv != dkim.Pass && cv != dkim.None {
+			cv = dkim.Fail
+		}
+		set, err := cron.sealer.Seal(raw, ar, cv)
+		if err != nil {
+			log.Printf("error sealing message %d: %s", msg.ID, err)
+			return raw
+		}
+		return set + "\r\n" + raw
+	}
+	log.Printf("not sealing message %d: no Authentication-Results from %s", msg.ID, msg.AuthservID)
+	return raw
+}
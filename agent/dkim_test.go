@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gbbr/gomez/dkim"
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+type keyTable map[string]string
+
+func (k keyTable) LookupTXT(name string) ([]string, error) {
+	return []string{k[name]}, nil
+}
+
+// testKey writes a new Ed25519 private key into dir, returning its path and
+// the TXT record publishing its public key.
+func testKey(t *testing.T, dir string) (string, string) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+func TestLoadSigners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, _ := testKey(t, dir)
+
+	signers, err := loadSigners(jamon.Group{
+		"dkim.headers":             "From: To :Subject",
+		"dkim.A.com.selector":      "s1",
+		"dkim.A.com.key":           path,
+		"dkim.mail.b.com.selector": "s2",
+		"dkim.mail.b.com.key":      path,
+		"mx.retry":                 "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 || signers["a.com"] == nil || signers["mail.b.com"] == nil {
+		t.Fatalf("Expected signers for a.com and mail.b.com, got %v", signers)
+	}
+	if s := signers["a.com"]; s.Domain != "a.com" || s.Selector != "s1" ||
+		!reflect.DeepEqual(s.Headers, []string{"From", "To", "Subject"}) {
+		t.Errorf("Unexpected signer %+v", s)
+	}
+
+	for _, conf := range []jamon.Group{
+		{"dkim.a.com.selector": "s1"},
+		{"dkim.a.com.selector": "s1", "dkim.a.com.key": filepath.Join(dir, "missing.pem")},
+		{"dkim.a.com.selector": "s1", "dkim.a.com.key": dir},
+	} {
+		if _, err := loadSigners(conf); err == nil {
+			t.Errorf("Expected error for %v", conf)
+		}
+	}
+}
+
+// It should sign messages by the domain of their From header, and leave
+// others as they are.
+func TestCronJob_sign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, record := testKey(t, dir)
+	signers, err := loadSigners(jamon.Group{"dkim.a.com.selector": "s1", "dkim.a.com.key": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron := cronJob{signers: signers}
+	keys := keyTable{"s1._domainkey.a.com": record}
+
+	for _, test := range []struct {
+		from, raw string
+		signed    bool
+	}{
+		{"bounce@b.com", "From: Jane <jane@A.com>\r\nSubject: Hi\r\n\r\nHello\r\n", true},
+		{"jane@a.com", "Subject: Hi\r\n\r\nHello\r\n", true},
+		{"jane@a.com", "From: bob@b.com\r\n\r\nHello\r\n", false},
+		{"jane@c.com", "Subject: Hi\r\n\r\nHello\r\n", false},
+	} {
+		msg := &mailbox.Message{Raw: test.raw}
+		msg.SetFrom(&mail.Address{Address: test.from})
+		got := cron.sign(msg)
+		if !test.signed {
+			if got != test.raw {
+				t.Errorf("Expected %q unsigned, got %q", test.raw, got)
+			}
+			continue
+		}
+		if !strings.HasSuffix(got, "\r\n"+test.raw) {
+			t.Errorf("Expected signature prepended to %q, got %q", test.raw, got)
+		}
+		if r := dkim.Verify(got, keys); len(r) != 1 || r[0].Status != dkim.Pass {
+			t.Errorf("Expected signature of %q to pass, got %+v", test.raw, r)
+		}
+	}
+}
+
+func TestLoadSealer(t *testing.T) {
+	signers := map[string]*dkim.Signer{"a.com": {Domain: "a.com"}}
+	if s, err := loadSealer(jamon.Group{}, signers); s != nil || err != nil {
+		t.Errorf("Expected no sealer, got %v (%v)", s, err)
+	}
+	if s, err := loadSealer(jamon.Group{"arc.domain": "A.com"}, signers); s != signers["a.com"] || err != nil {
+		t.Errorf("Expected sealer of a.com, got %v (%v)", s, err)
+	}
+	if _, err := loadSealer(jamon.Group{"arc.domain": "b.com"}, signers); err == nil {
+		t.Error("Expected error for domain without key")
+	}
+}
+
+// It should seal messages which users forward from other domains, and leave
+// others as they are.
+func TestCronJob_seal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, record := testKey(t, dir)
+	conf := jamon.Group{"hello": "localhost", "arc.domain": "a.com", "dkim.a.com.selector": "s1", "dkim.a.com.key": path}
+	signers, err := loadSigners(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := loadSealer(conf, signers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cron := cronJob{config: conf, signers: signers, sealer: sealer}
+	keys := keyTable{"s1._domainkey.a.com": record}
+
+	body := "From: bob@b.com\r\nTo: list@a.com\r\nSubject: Hi\r\n\r\nHello\r\n"
+	for _, test := range []struct {
+		raw, authservID string
+		sealed          string
+	}{
+		{"Authentication-Results: mx.a.com;\r\n\tauth=pass smtp.auth=jane@a.com;\r\n\tdkim=none;\r\n\tarc=none\r\n" + body, "mx.a.com", dkim.Pass},
+		{"Authentication-Results: MX.a.com; auth=pass smtp.auth=jane@a.com; dkim=none; arc=fail (incomplete ARC set)\r\n" +
+			"ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=b.com; s=s1; b=AAAA\r\n" + body, "mx.a.com", dkim.Fail},
+		{"Authentication-Results: mx.a.com; spf=pass smtp.mailfrom=b.com; dkim=none; arc=none\r\n" + body, "mx.a.com", ""},
+		{"Authentication-Results: mx.a.com; auth=pass smtp.auth=jane@a.com; dkim=none\r\n" + body, "mx.a.com", ""},
+		{"Authentication-Results: mx.b.com; auth=pass smtp.auth=jane@a.com; arc=none\r\n" + body, "mx.a.com", ""},
+		{"Authentication-Results: mx.a.com; auth=pass smtp.auth=jane@a.com; arc=none\r\n" + body, "", ""},
+		{"Authentication-Results: mx.a.com; auth=pass smtp.auth=jane@a.com; arc=none\r\n" +
+			"From: jane@a.com\r\n\r\nHello\r\n", "mx.a.com", ""},
+		{body, "mx.a.com", ""},
+	} {
+		msg := &mailbox.Message{ID: 1, Raw: test.raw, AuthservID: test.authservID}
+		msg.SetFrom(&mail.Address{Address: "jane@a.com"})
+		got := cron.seal(msg, test.raw)
+		if test.sealed == "" {
+			if got != test.raw {
+				t.Errorf("Expected %q unsealed, got %q", test.raw, got)
+			}
+			continue
+		}
+		if !strings.HasSuffix(got, "\r\n"+test.raw) || !strings.Contains(got, "ARC-Authentication-Results: i=") {
+			t.Errorf("Expected ARC set prepended to %q, got %q", test.raw, got)
+		}
+		if r := dkim.VerifyARC(got, keys); r.Status != test.sealed {
+			t.Errorf("Expected chain of %q to %s, got %+v", test.raw, test.sealed, r)
+		}
+	}
+}
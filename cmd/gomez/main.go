@@ -0,0 +1,220 @@
+// Command gomez runs the Gomez mail system: the SMTP server which receives
+// mail, the agent which delivers queued mail to remote hosts and the POP3
+// and IMAP servers which give users access to their mail, all backed by the
+// same mailbox.
+//
+// Usage:
+//
+//	gomez [-config file] <command>
+//
+// The commands are:
+//
+//	start   runs the SMTP server, the delivery agent and the POP3 and IMAP servers
+//	smtp    runs only the SMTP server
+//	agent   runs only the delivery agent
+//	pop3    runs only the POP3 server
+//	imap    runs only the IMAP server
+//	help    prints this message
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gbbr/gomez/agent"
+	"github.com/gbbr/gomez/imap"
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/gomez/pop3"
+	"github.com/gbbr/gomez/smtp"
+	"github.com/gbbr/jamon"
+)
+
+// store is the mailbox as used by the services.
+type store interface {
+	mailbox.Enqueuer
+	mailbox.Dequeuer
+	mailbox.Interface
+	mailbox.Store
+	Close() error
+}
+
+// A service runs one of the system's components, until it fails or until
+// the context is done, in which case it shuts down gracefully.
+type service func(ctx context.Context, mb store, cfg jamon.Config) error
+
+// services maps service names to their implementation.
+var services = map[string]service{
+	"smtp": func(ctx context.Context, mb store, cfg jamon.Config) error {
+		return smtp.StartContext(ctx, mb, cfg.Group("smtp"))
+	},
+	"agent": func(ctx context.Context, mb store, cfg jamon.Config) error {
+		return agent.StartContext(ctx, mb, cfg.Group("agent"))
+	},
+	"pop3": func(ctx context.Context, mb store, cfg jamon.Config) error {
+		return pop3.StartContext(ctx, mb, cfg.Group("pop3"))
+	},
+	"imap": func(ctx context.Context, mb store, cfg jamon.Config) error {
+		return imap.StartContext(ctx, mb, cfg.Group("imap"))
+	},
+}
+
+// commands maps each command to the services that it runs.
+var commands = map[string][]string{
+	"start": {"smtp", "agent", "pop3", "imap"},
+	"smtp":  {"smtp"},
+	"agent": {"agent"},
+	"pop3":  {"pop3"},
+	"imap":  {"imap"},
+}
+
+var configFile = flag.String("config", "config/defaults.conf", "configuration file")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	name := flag.Arg(0)
+	if name == "help" {
+		usage()
+		return
+	}
+	list, ok := commands[name]
+	if !ok || flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	cfg, err := loadConfig(*configFile, list)
+	if err != nil {
+		log.Fatalf("error loading configuration: %s", err)
+	}
+	mb, err := mailbox.New(dbString(cfg.Group("mailbox")))
+	if err != nil {
+		log.Fatalf("error opening mailbox: %s", err)
+	}
+	defer mb.Close()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, len(list))
+	for _, name := range list {
+		go func(name string) {
+			if err := services[name](ctx, mb, cfg); err != nil {
+				errc <- fmt.Errorf("%s: %s", name, err)
+				return
+			}
+			errc <- nil
+		}(name)
+	}
+	// A service which stops with an error stops the others, which are still
+	// given the time to finish their work.
+	pending, failed := len(list), false
+	select {
+	case s := <-sig:
+		log.Printf("received %s, shutting down", s)
+	case err := <-errc:
+		pending--
+		if err != nil {
+			log.Printf("stopped: %s", err)
+			failed = true
+		}
+	}
+	cancel()
+	// Wait for all services to finish their work before the mailbox is
+	// closed. A second signal stops right away.
+	for ; pending > 0; pending-- {
+		select {
+		case err := <-errc:
+			if err != nil {
+				log.Printf("stopped: %s", err)
+				failed = true
+			}
+		case s := <-sig:
+			log.Printf("received %s, stopping", s)
+			return
+		}
+	}
+	if failed {
+		mb.Close()
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Usage: gomez [-config file] <%s|help>\n\n", strings.Join(names, "|"))
+	flag.PrintDefaults()
+}
+
+// errConfig is returned when a configuration group required by a
+// service is missing.
+var errConfig = errors.New("missing configuration group")
+
+// loadConfig loads the configuration file and validates that it holds the
+// groups needed by the given services. It also applies the settings which
+// are global to the mailbox package.
+func loadConfig(file string, list []string) (jamon.Config, error) {
+	cfg, err := jamon.LoadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range append(list, "mailbox") {
+		if !cfg.HasGroup(name) {
+			return nil, fmt.Errorf("%s [%s]", errConfig, name)
+		}
+	}
+	mb := cfg.Group("mailbox")
+	for key, v := range map[string]*time.Duration{
+		"retry.interval": &mailbox.RetryInterval,
+		"retry.max":      &mailbox.MaxRetryInterval,
+		"lease":          &mailbox.LeaseDuration,
+		"queue.lifetime": &mailbox.QueueLifetime,
+	} {
+		if !mb.Has(key) {
+			continue
+		}
+		n, err := strconv.Atoi(mb.Get(key))
+		if err != nil {
+			return nil, fmt.Errorf("mailbox/%s is not numeric", key)
+		}
+		*v = time.Duration(n) * time.Second
+	}
+	if host := cfg.Group("smtp").Get("host"); host != "" {
+		mailbox.Hostname = host
+	}
+	return cfg, nil
+}
+
+// dbString builds a connection string for the mailbox from the 'db.*'
+// settings in its configuration group.
+func dbString(cfg jamon.Group) string {
+	var params []string
+	for _, p := range []struct{ key, param string }{
+		{"db.host", "host"},
+		{"db.port", "port"},
+		{"db.user", "user"},
+		{"db.password", "password"},
+		{"db.name", "dbname"},
+		{"db.sslmode", "sslmode"},
+	} {
+		if cfg.Has(p.key) {
+			params = append(params, p.param+"="+cfg.Get(p.key))
+		}
+	}
+	return strings.Join(params, " ")
+}
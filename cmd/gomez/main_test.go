@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+func TestDBString(t *testing.T) {
+	for _, test := range []struct {
+		Config jamon.Group
+		Expect string
+	}{
+		{jamon.Group{}, ""},
+		{jamon.Group{"db.user": "gabe", "db.name": "gomez", "db.sslmode": "disable"},
+			"user=gabe dbname=gomez sslmode=disable"},
+		{jamon.Group{"db.host": "db.local", "db.port": "5433", "db.user": "gabe",
+			"db.password": "secret", "db.name": "gomez", "db.schema": "schema.sql"},
+			"host=db.local port=5433 user=gabe password=secret dbname=gomez"},
+	} {
+		if got := dbString(test.Config); got != test.Expect {
+			t.Errorf("Expected '%s', got '%s'", test.Expect, got)
+		}
+	}
+}
+
+// writeConfig writes the given configuration to a temporary file and
+// returns its name.
+func writeConfig(t *testing.T, cfg string) string {
+	f, err := ioutil.TempFile("", "gomez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	file := writeConfig(t, "[smtp]\nhost=mecca.local\n\n[mailbox]\nretry.interval=60\nlease=30\nqueue.lifetime=3600\n")
+	defer os.Remove(file)
+
+	if _, err := loadConfig(file, commands["start"]); err == nil {
+		t.Error("Expected error for missing [agent] group")
+	}
+
+	cfg, err := loadConfig(file, commands["smtp"])
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cfg.Group("smtp").Get("host") != "mecca.local" {
+		t.Error("Did not load [smtp] group")
+	}
+	if mailbox.RetryInterval != time.Minute || mailbox.LeaseDuration != 30*time.Second ||
+		mailbox.QueueLifetime != time.Hour {
+		t.Errorf("Did not apply mailbox settings, got %s, %s and %s",
+			mailbox.RetryInterval, mailbox.LeaseDuration, mailbox.QueueLifetime)
+	}
+	if mailbox.Hostname != "mecca.local" {
+		t.Errorf("Expected mailbox hostname mecca.local, got %s", mailbox.Hostname)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	if _, err := loadConfig("missing.conf", nil); err == nil {
+		t.Error("Expected error for missing file")
+	}
+
+	file := writeConfig(t, "[mailbox]\nretry.max=forever\n")
+	defer os.Remove(file)
+	if _, err := loadConfig(file, nil); err == nil {
+		t.Error("Expected error for non-numeric setting")
+	}
+}
+
+func TestCommands_Services(t *testing.T) {
+	for cmd, list := range commands {
+		for _, name := range list {
+			if _, ok := services[name]; !ok {
+				t.Errorf("Command %s uses unknown service %s", cmd, name)
+			}
+		}
+	}
+}
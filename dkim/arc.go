@@ -0,0 +1,316 @@
+package dkim
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxInstances is the most ARC sets a message may carry, as per RFC 8617
+// 4.2.1.
+const maxInstances = 50
+
+// Header fields of an ARC set, as per RFC 8617 4.1.
+const (
+	arcResults   = "ARC-Authentication-Results"
+	arcSignature = "ARC-Message-Signature"
+	arcSeal      = "ARC-Seal"
+)
+
+// Reasons for which an ARC chain does not validate or can not be extended.
+var (
+	errChainSyntax  = errors.New("malformed ARC set")
+	errChainLimit   = errors.New("too many ARC sets")
+	errChainMissing = errors.New("incomplete ARC set")
+	errChainStatus  = errors.New("wrong chain validation status")
+	errChainFailed  = errors.New("chain already failed")
+)
+
+// ChainResult holds the outcome of validating the ARC chain of a message.
+type ChainResult struct {
+	// Status is None, Pass or Fail.
+	Status string
+	// Err is the reason for which the chain did not pass, or nil.
+	Err error
+	// Instance is the instance of the most recent ARC set, or 0 if there
+	// are none.
+	Instance int
+}
+
+// arcSet holds the header fields of one instance of an ARC set. A valid set
+// has exactly one of each.
+type arcSet struct {
+	results, signature, seal []header
+}
+
+// complete reports whether the set holds exactly one of each field.
+func (set *arcSet) complete() bool {
+	return set != nil && len(set.results) == 1 && len(set.signature) == 1 && len(set.seal) == 1
+}
+
+// arcSets groups the ARC header fields of a message by their instance and
+// returns the highest instance found.
+func arcSets(headers []header) (map[int]*arcSet, int, error) {
+	sets := make(map[int]*arcSet)
+	n := 0
+	for _, h := range headers {
+		name := strings.ToLower(h.name)
+		if name != strings.ToLower(arcResults) && name != strings.ToLower(arcSignature) &&
+			name != strings.ToLower(arcSeal) {
+			continue
+		}
+		i, err := instance(h)
+		if err != nil {
+			return nil, 0, err
+		}
+		if sets[i] == nil {
+			sets[i] = new(arcSet)
+		}
+		switch name {
+		case strings.ToLower(arcResults):
+			sets[i].results = append(sets[i].results, h)
+		case strings.ToLower(arcSignature):
+			sets[i].signature = append(sets[i].signature, h)
+		default:
+			sets[i].seal = append(sets[i].seal, h)
+		}
+		if i > n {
+			n = i
+		}
+	}
+	return sets, n, nil
+}
+
+// instance returns the value of the i= tag of an ARC header field. In
+// ARC-Authentication-Results it is the only tag, preceding the results.
+func instance(h header) (int, error) {
+	value := h.text[strings.IndexByte(h.text, ':')+1:]
+	if strings.EqualFold(h.name, arcResults) {
+		value = strings.SplitN(value, ";", 2)[0]
+	}
+	for _, spec := range strings.Split(value, ";") {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "i" {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || i < 1 || i > maxInstances {
+			return 0, errChainSyntax
+		}
+		return i, nil
+	}
+	return 0, errChainSyntax
+}
+
+// sealTags returns the tags of the ARC-Seal of a complete set.
+func (set *arcSet) sealTags() (map[string]string, error) {
+	text := set.seal[0].text
+	tags, err := parseTags(text[strings.IndexByte(text, ':')+1:])
+	if err != nil {
+		return nil, errChainSyntax
+	}
+	return tags, nil
+}
+
+// VerifyARC validates the ARC chain of the message, following RFC 8617 5.2,
+// and looks up keys using r. Only the most recent ARC-Message-Signature is
+// verified, while all ARC-Seals must verify. Lines of the message may end in
+// either CRLF or LF.
+func VerifyARC(raw string, r Resolver) ChainResult {
+	headers, body := splitMessage(raw)
+	sets, n, err := arcSets(headers)
+	if err != nil {
+		return ChainResult{Status: Fail, Err: err}
+	}
+	if n == 0 {
+		return ChainResult{Status: None}
+	}
+	res := ChainResult{Status: Fail, Instance: n}
+	seals := make([]map[string]string, n+1)
+	for i := 1; i <= n; i++ {
+		if !sets[i].complete() {
+			res.Err = errChainMissing
+			return res
+		}
+		if seals[i], err = sets[i].sealTags(); err != nil {
+			res.Err = err
+			return res
+		}
+	}
+	if seals[n]["cv"] == Fail {
+		res.Err = errChainFailed
+		return res
+	}
+	for i := 1; i <= n; i++ {
+		want := Pass
+		if i == 1 {
+			want = None
+		}
+		if seals[i]["cv"] != want {
+			res.Err = errChainStatus
+			return res
+		}
+	}
+	if res.Err = verifySignature(sets[n].signature[0], headers, body, r); res.Err != nil {
+		return res
+	}
+	for i := n; i >= 1; i-- {
+		if res.Err = verifySeal(sets, i, seals[i], r); res.Err != nil {
+			return res
+		}
+	}
+	res.Status = Pass
+	return res
+}
+
+// verifySignature verifies an ARC-Message-Signature, which works like a
+// DKIM-Signature but has no v= tag and uses i= for its instance, as per
+// RFC 8617 4.1.2.
+func verifySignature(sig header, headers []header, body string, r Resolver) error {
+	tags, err := parseTags(sig.text[strings.IndexByte(sig.text, ':')+1:])
+	if err != nil {
+		return errSyntax
+	}
+	for _, t := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			return errSyntax
+		}
+	}
+	headerCanon, bodyCanon, ok := parseCanon(tags["c"])
+	if !ok {
+		return errSyntax
+	}
+	var names []string
+	for _, name := range strings.Split(tags["h"], ":") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(stripSpace(tags["bh"]))
+	if err != nil {
+		return errSyntax
+	}
+	if h := sha256.Sum256([]byte(canonBody(body, bodyCanon))); string(h[:]) != string(bodyHash) {
+		return errBodyHash
+	}
+	data := signedHeaders(headers, names, headerCanon)
+	data += strings.TrimSuffix(canonHeader(header{name: sig.name, text: stripSignature(sig.text)}, headerCanon), "\r\n")
+	return verifyData(r, tags, data)
+}
+
+// verifySeal verifies the ARC-Seal of instance i, given its tags.
+func verifySeal(sets map[int]*arcSet, i int, tags map[string]string, r Resolver) error {
+	for _, t := range []string{"a", "b", "d", "s"} {
+		if tags[t] == "" {
+			return errSyntax
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		// RFC 8617 4.1.3: seals must not list the fields they sign.
+		return errSyntax
+	}
+	return verifyData(r, tags, sealData(sets, i, sets[i].seal[0].text))
+}
+
+// sealData returns the data signed by the ARC-Seal of instance i, whose text
+// is given. As per RFC 8617 5.1.1, these are the ARC sets from the first one
+// up to i, in relaxed canonical form, with the b= tag of the seal emptied.
+func sealData(sets map[int]*arcSet, i int, seal string) string {
+	var data string
+	for j := 1; j <= i; j++ {
+		data += canonHeader(sets[j].results[0], relaxed)
+		data += canonHeader(sets[j].signature[0], relaxed)
+		if j < i {
+			data += canonHeader(sets[j].seal[0], relaxed)
+		}
+	}
+	return data + strings.TrimSuffix(canonHeader(header{name: arcSeal, text: stripSignature(seal)}, relaxed), "\r\n")
+}
+
+// verifyData verifies that the b= tag signs data, using the key named by the
+// d= and s= tags.
+func verifyData(r Resolver, tags map[string]string, data string) error {
+	algorithm := strings.ToLower(tags["a"])
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return errAlgorithm
+	}
+	sig, err := base64.StdEncoding.DecodeString(stripSpace(tags["b"]))
+	if err != nil {
+		return errSyntax
+	}
+	domain := strings.ToLower(strings.TrimSuffix(tags["d"], "."))
+	key, err := lookupKey(r, tags["s"], domain, algorithm)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(data))
+	if !key.verify(hash[:], sig) {
+		return errSignature
+	}
+	return nil
+}
+
+// Seal returns a new ARC set for the message, following RFC 8617 5.1, as
+// the ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results header
+// fields, without the final CRLF. The set records authResults, which is an
+// Authentication-Results value starting with the authserv-id, and cv, the
+// status of the chain as validated on receipt. Chains which already failed
+// are not extended.
+func (s *Signer) Seal(raw, authResults, cv string) (string, error) {
+	headers, _ := splitMessage(raw)
+	sets, n, err := arcSets(headers)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case n >= maxInstances:
+		return "", errChainLimit
+	case n == 0:
+		cv = None
+	case cv != Pass && cv != Fail:
+		return "", errChainStatus
+	}
+	if n > 0 && sets[n].complete() {
+		if tags, err := sets[n].sealTags(); err == nil && tags["cv"] == Fail {
+			return "", errChainFailed
+		}
+	}
+	if cv == Pass {
+		for j := 1; j <= n; j++ {
+			if !sets[j].complete() {
+				return "", errChainMissing
+			}
+		}
+	}
+	algorithm, err := s.algorithm()
+	if err != nil {
+		return "", err
+	}
+	i := n + 1
+	results := fmt.Sprintf("%s: i=%d; %s", arcResults, i, authResults)
+	signature, err := s.signMessage(raw, arcSignature, fmt.Sprintf("i=%d", i))
+	if err != nil {
+		return "", err
+	}
+	seal := fmt.Sprintf("%s: i=%d; a=%s; cv=%s; d=%s; s=%s;\r\n\tt=%d;\r\n\tb=",
+		arcSeal, i, algorithm, cv, s.Domain, s.Selector, now().Unix())
+
+	set := &arcSet{
+		results:   []header{{name: arcResults, text: results}},
+		signature: []header{{name: arcSignature, text: signature}},
+	}
+	var data string
+	if cv == Fail {
+		// RFC 8617 5.1.1: a failed chain is only sealed over the new set.
+		data = sealData(map[int]*arcSet{1: set}, 1, seal)
+	} else {
+		sets[i] = set
+		data = sealData(sets, i, seal)
+	}
+	sig, err := s.signData(data)
+	if err != nil {
+		return "", err
+	}
+	return seal + sig + "\r\n" + signature + "\r\n" + results, nil
+}
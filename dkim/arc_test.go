@@ -0,0 +1,85 @@
+package dkim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// It should extend ARC chains which validate through each forwarding host
+// and stop validating when the message or an earlier set is changed.
+func TestSigner_Seal(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := keyTable{
+		"arc._domainkey.a.test": "k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+		"arc._domainkey.b.test": "k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub),
+	}
+	first := &Signer{Domain: "a.test", Selector: "arc", Key: key}
+	second := &Signer{Domain: "b.test", Selector: "arc", Key: key}
+	msg := "From: a@c.test\r\nTo: list@a.test\r\nSubject: Hi\r\n\r\nHello\r\n"
+	if r := VerifyARC(msg, keys); r.Status != None {
+		t.Fatalf("Expected none for unsealed message, got %+v", r)
+	}
+
+	set, err := first.Seal(msg, "a.test; spf=pass smtp.mailfrom=c.test", Fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(set, "cv=none") || !strings.Contains(set, "ARC-Authentication-Results: i=1; a.test; spf=pass") {
+		t.Errorf("Expected first set with cv=none, got %q", set)
+	}
+	once := set + "\r\n" + msg
+	if r := VerifyARC(once, keys); r.Status != Pass || r.Instance != 1 {
+		t.Fatalf("Expected pass for instance 1, got %+v", r)
+	}
+
+	set, err = second.Seal(once, "b.test; arc=pass", Pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice := set + "\r\n" + once
+	if r := VerifyARC(twice, keys); r.Status != Pass || r.Instance != 2 {
+		t.Fatalf("Expected pass for instance 2, got %+v", r)
+	}
+	if r := VerifyARC(strings.Replace(twice, "\r\n", "\n", -1), keys); r.Status != Pass {
+		t.Errorf("Expected pass with LF line endings, got %+v", r)
+	}
+
+	seal1 := regexp.MustCompile(`ARC-Seal: i=1;[^\n]*\r\n(\t[^\n]*\r\n)*`)
+	for name, test := range map[string]struct {
+		raw string
+		err error
+	}{
+		"changed body":    {strings.Replace(twice, "Hello", "Bye", 1), errBodyHash},
+		"changed results": {strings.Replace(twice, "spf=pass", "spf=fail", 1), errSignature},
+		"missing seal":    {seal1.ReplaceAllString(twice, ""), errChainMissing},
+		"bad instance":    {strings.Replace(twice, "ARC-Seal: i=2", "ARC-Seal: i=x", 1), errChainSyntax},
+		"no key":          {strings.Replace(twice, "d=b.test", "d=x.test", -1), errNoKey},
+	} {
+		if r := VerifyARC(test.raw, keys); r.Status != Fail || r.Err != test.err {
+			t.Errorf("%s: expected fail with %v, got %+v", name, test.err, r)
+		}
+	}
+
+	// Failed chains are sealed as such, after which they end.
+	set, err = second.Seal(strings.Replace(once, "Hello", "Bye", 1), "b.test; arc=fail", Fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := set + "\r\n" + strings.Replace(once, "Hello", "Bye", 1)
+	if r := VerifyARC(failed, keys); r.Status != Fail || r.Err != errChainFailed {
+		t.Errorf("Expected failed chain, got %+v", r)
+	}
+	if _, err := first.Seal(failed, "a.test; arc=fail", Fail); err != errChainFailed {
+		t.Errorf("Expected %v, got %v", errChainFailed, err)
+	}
+	if _, err := first.Seal(once, "a.test; arc=none", None); err != errChainStatus {
+		t.Errorf("Expected %v, got %v", errChainStatus, err)
+	}
+}
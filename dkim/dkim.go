@@ -0,0 +1,213 @@
+// Package dkim creates and verifies DomainKeys Identified Mail signatures
+// (RFC 6376) using the rsa-sha256 and ed25519-sha256 (RFC 8463) algorithms.
+// Signatures are verified with relaxed or simple canonicalization, and are
+// created with relaxed canonicalization. It also validates and extends
+// Authenticated Received Chains (RFC 8617), which carry authentication
+// results across forwarding hosts.
+package dkim
+
+import (
+	"errors"
+	"strings"
+)
+
+// Resolver looks up the TXT records holding public keys. It is satisfied by
+// the net package's Resolver, as well as by local key tables.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// Results of a verification, as named by RFC 8601 2.7.1.
+const (
+	None      = "none"
+	Pass      = "pass"
+	Fail      = "fail"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// errTagSyntax is returned when a tag-list can not be parsed.
+var errTagSyntax = errors.New("malformed tag-list")
+
+// parseTags parses a tag-list, as per RFC 6376 3.2. Tag names are case
+// sensitive, and whitespace around tags and values is removed.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		kv := strings.SplitN(spec, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" {
+			return nil, errTagSyntax
+		}
+		if _, ok := tags[name]; ok {
+			return nil, errTagSyntax
+		}
+		tags[name] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+// stripSpace removes all whitespace from s, such as the folding whitespace
+// within base64 values.
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// header is a header field, holding its name and its full text, including
+// any folding but not the final CRLF.
+type header struct {
+	name string
+	text string
+}
+
+// splitMessage splits a message into its header fields, from top to bottom,
+// and its body. Lines may end in either CRLF or LF, and are returned ending
+// in CRLF.
+func splitMessage(raw string) ([]header, string) {
+	raw = strings.Replace(raw, "\r\n", "\n", -1)
+	var headers []header
+	for raw != "" {
+		line := raw
+		if i := strings.IndexByte(raw, '\n'); i != -1 {
+			line = raw[:i]
+			raw = raw[i+1:]
+		} else {
+			raw = ""
+		}
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if n := len(headers); n > 0 {
+				headers[n-1].text += "\r\n" + line
+			}
+			continue
+		}
+		name := line
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			name = line[:i]
+		}
+		headers = append(headers, header{name: strings.TrimSpace(name), text: line})
+	}
+	return headers, strings.Replace(raw, "\n", "\r\n", -1)
+}
+
+// Canonicalization algorithms, as per RFC 6376 3.4.
+const (
+	simple  = "simple"
+	relaxed = "relaxed"
+)
+
+// canonHeader returns the canonical form of a header field, ending in CRLF.
+func canonHeader(h header, canon string) string {
+	if canon == simple {
+		return h.text + "\r\n"
+	}
+	value := h.text[len(h.name):]
+	value = strings.TrimLeft(value, " \t")
+	value = strings.TrimPrefix(value, ":")
+	value = strings.Replace(value, "\r\n", "", -1)
+	return strings.ToLower(h.name) + ":" + strings.TrimSpace(compressSpace(value)) + "\r\n"
+}
+
+// canonBody returns the canonical form of a message body.
+func canonBody(body, canon string) string {
+	lines := strings.Split(body, "\r\n")
+	if canon == relaxed {
+		for i, l := range lines {
+			lines[i] = strings.TrimRight(compressSpace(l), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canon == relaxed {
+			return ""
+		}
+		return "\r\n"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// compressSpace replaces each run of spaces and tabs in s with a single
+// space.
+func compressSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(s[i])
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// parseCanon parses the c= tag of a signature into its header and body
+// algorithms, as per RFC 6376 3.5.
+func parseCanon(c string) (string, string, bool) {
+	if c == "" {
+		return simple, simple, true
+	}
+	parts := strings.SplitN(strings.ToLower(c), "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, simple)
+	}
+	for _, p := range parts {
+		if p != simple && p != relaxed {
+			return "", "", false
+		}
+	}
+	return parts[0], parts[1], true
+}
+
+// signedHeaders returns the canonical form of the header fields named by
+// the h= tag of a signature. Fields are taken from the bottom up, each at
+// most once, and names which have no field left are skipped, as per
+// RFC 6376 5.4.2.
+func signedHeaders(headers []header, names []string, canon string) string {
+	used := make(map[int]bool)
+	var b strings.Builder
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(headers[i].name, name) {
+				used[i] = true
+				b.WriteString(canonHeader(headers[i], canon))
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// stripSignature returns the signature header field with the value of its
+// b= tag removed, as it is hashed, as per RFC 6376 3.7.
+func stripSignature(text string) string {
+	i := strings.IndexByte(text, ':') + 1
+	specs := strings.Split(text[i:], ";")
+	for j, spec := range specs {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			specs[j] = kv[0] + "="
+		}
+	}
+	return text[:i] + strings.Join(specs, ";")
+}
@@ -0,0 +1,89 @@
+package dkim
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The example of RFC 6376 3.4.5.
+const canonExample = "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+
+func TestCanonicalization(t *testing.T) {
+	headers, body := splitMessage(canonExample)
+	if len(headers) != 2 {
+		t.Fatalf("Expected 2 headers, got %v", headers)
+	}
+	for _, test := range []struct {
+		canon, header, body string
+	}{
+		{relaxed, "a:X\r\nb:Y Z\r\n", " C\r\nD E\r\n"},
+		{simple, "A: X\r\nB : Y\t\r\n\tZ  \r\n", " C \r\nD \t E\r\n"},
+	} {
+		h := canonHeader(headers[0], test.canon) + canonHeader(headers[1], test.canon)
+		if h != test.header {
+			t.Errorf("%s: expected header %q, got %q", test.canon, test.header, h)
+		}
+		if b := canonBody(body, test.canon); b != test.body {
+			t.Errorf("%s: expected body %q, got %q", test.canon, test.body, b)
+		}
+	}
+	for _, test := range []struct {
+		body, canon, want string
+	}{
+		{"", simple, "\r\n"},
+		{"", relaxed, ""},
+		{"\r\n\r\n", relaxed, ""},
+		{"Hi", simple, "Hi\r\n"},
+		{"Hi \t", relaxed, "Hi\r\n"},
+	} {
+		if got := canonBody(test.body, test.canon); got != test.want {
+			t.Errorf("%q %s: expected %q, got %q", test.body, test.canon, test.want, got)
+		}
+	}
+}
+
+func TestSplitMessage_LF(t *testing.T) {
+	headers, body := splitMessage("A: 1\n\tcont\nB: 2\n\nbody\nend")
+	want := []header{{"A", "A: 1\r\n\tcont"}, {"B", "B: 2"}}
+	if !reflect.DeepEqual(headers, want) || body != "body\r\nend" {
+		t.Errorf("Got %q %q", headers, body)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" v=1; a = rsa-sha256 ;\r\n\tb=ab\r\n cd;")
+	want := map[string]string{"v": "1", "a": "rsa-sha256", "b": "ab\r\n cd"}
+	if err != nil || !reflect.DeepEqual(tags, want) {
+		t.Errorf("Expected %v, got %v (%v)", want, tags, err)
+	}
+	for _, s := range []string{"v=1; v=2", "v", "=1"} {
+		if _, err := parseTags(s); err != errTagSyntax {
+			t.Errorf("%q: expected error, got %v", s, err)
+		}
+	}
+}
+
+func TestParseCanon(t *testing.T) {
+	for _, test := range []struct {
+		c, header, body string
+		ok              bool
+	}{
+		{"", simple, simple, true},
+		{"relaxed", relaxed, simple, true},
+		{"Relaxed/relaxed", relaxed, relaxed, true},
+		{"simple/loose", "", "", false},
+	} {
+		h, b, ok := parseCanon(test.c)
+		if h != test.header || b != test.body || ok != test.ok {
+			t.Errorf("%q: expected %s/%s %t, got %s/%s %t", test.c, test.header, test.body, test.ok, h, b, ok)
+		}
+	}
+}
+
+func TestStripSignature(t *testing.T) {
+	in := "DKIM-Signature: v=1; bh=abc=;\r\n b=def\r\n ghi=; d=x"
+	want := "DKIM-Signature: v=1; bh=abc=;\r\n b=; d=x"
+	if got := stripSignature(in); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,137 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultHeaders are the header fields signed when a Signer has none set.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Signer signs messages on behalf of a domain.
+type Signer struct {
+	// Domain is the signing domain (d= tag).
+	Domain string
+	// Selector is the name of the key within the domain (s= tag).
+	Selector string
+	// Key is the private key, which must be an *rsa.PrivateKey or an
+	// ed25519.PrivateKey.
+	Key crypto.Signer
+	// Headers are the names of the signed header fields. From is always
+	// signed. Fields which are named but missing from a message are signed
+	// as empty, so that they can not be added later.
+	Headers []string
+}
+
+// errKeyType is returned when a key is neither an RSA nor an Ed25519 key.
+var errKeyType = errors.New("unsupported key type")
+
+// Sign returns the DKIM-Signature header field for the message, without
+// the final CRLF, using relaxed canonicalization. The time of signing is
+// recorded in the t= tag.
+func (s *Signer) Sign(raw string) (string, error) {
+	return s.signMessage(raw, "DKIM-Signature", "v=1")
+}
+
+// signMessage returns a header field with the given name which signs the
+// message like a DKIM-Signature does, and whose tag-list starts with the
+// given tag.
+func (s *Signer) signMessage(raw, name, first string) (string, error) {
+	algorithm, err := s.algorithm()
+	if err != nil {
+		return "", err
+	}
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+	if !hasItem(strings.Join(names, ":"), "From") {
+		names = append([]string{"From"}, names...)
+	}
+	headers, body := splitMessage(raw)
+	bodyHash := sha256.Sum256([]byte(canonBody(body, relaxed)))
+	text := fmt.Sprintf("%s: %s; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		name, first, algorithm, s.Domain, s.Selector, now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	data := signedHeaders(headers, names, relaxed)
+	data += strings.TrimSuffix(canonHeader(header{name: name, text: text}, relaxed), "\r\n")
+	sig, err := s.signData(data)
+	if err != nil {
+		return "", err
+	}
+	return text + sig, nil
+}
+
+// algorithm returns the name of the signing algorithm used with the key.
+func (s *Signer) algorithm() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errKeyType
+}
+
+// signData returns the signature of the SHA-256 hash of data, in its folded
+// base64 form.
+func (s *Signer) signData(data string) (string, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := s.Key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	hash := sha256.Sum256([]byte(data))
+	sig, err := s.Key.Sign(rand.Reader, hash[:], opts)
+	if err != nil {
+		return "", err
+	}
+	return fold(base64.StdEncoding.EncodeToString(sig), 72), nil
+}
+
+// fold splits s into lines of at most n characters, joined by folding
+// whitespace.
+func fold(s string, n int) string {
+	var lines []string
+	for len(s) > n {
+		lines = append(lines, s[:n])
+		s = s[n:]
+	}
+	return strings.Join(append(lines, s), "\r\n\t")
+}
+
+// ParsePrivateKey parses a PEM encoded private key, which may be an RSA key
+// in its PKCS #1 form, or an RSA or Ed25519 key in its PKCS #8 form.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, errKeyType
+}
@@ -0,0 +1,83 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+// It should create signatures which verify, with both algorithms, and which
+// break when a signed field is changed.
+func TestSigner_Sign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := keyTable{
+		"rsa._domainkey.a.test": "v=DKIM1; p=" + base64.StdEncoding.EncodeToString(rsaPub),
+		"ed._domainkey.a.test":  "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+	}
+	msg := "From: a@a.test\r\nTo: b@b.test\r\nSubject:  Hi \r\n\r\nHello  \r\n\r\n"
+	for _, s := range []*Signer{
+		{Domain: "a.test", Selector: "rsa", Key: rsaKey},
+		{Domain: "a.test", Selector: "ed", Key: edKey, Headers: []string{"Subject", "To"}},
+	} {
+		sig, err := s.Sign(msg)
+		if err != nil {
+			t.Fatalf("%s: %s", s.Selector, err)
+		}
+		if !strings.Contains(sig, "h=From:") {
+			t.Errorf("%s: expected From to be signed, got %q", s.Selector, sig)
+		}
+		signed := sig + "\r\n" + msg
+		if r := Verify(signed, keys); len(r) != 1 || r[0].Status != Pass {
+			t.Errorf("%s: expected pass, got %+v", s.Selector, r)
+		}
+		// Relaying may change whitespace and line endings.
+		relayed := strings.Replace(strings.Replace(signed, "\r\n", "\n", -1), "Subject:  Hi", "Subject: Hi", 1)
+		if r := Verify(relayed, keys); len(r) != 1 || r[0].Status != Pass {
+			t.Errorf("%s: expected pass after relaying, got %+v", s.Selector, r)
+		}
+		if r := Verify(strings.Replace(signed, "To: b@b.test", "To: c@c.test", 1), keys); len(r) != 1 || r[0].Status != Fail {
+			t.Errorf("%s: expected fail with changed field, got %+v", s.Selector, r)
+		}
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8 := func(k crypto.Signer) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	for _, data := range [][]byte{pkcs1, pkcs8(rsaKey), pkcs8(edKey)} {
+		if _, err := ParsePrivateKey(data); err != nil {
+			t.Errorf("Expected key to parse, got %s", err)
+		}
+	}
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Error("Expected error")
+	}
+}
@@ -0,0 +1,290 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSignatures is the most signatures of a message which are verified.
+const maxSignatures = 5
+
+// minRSABits is the smallest RSA key accepted, as per RFC 8301 3.2.
+const minRSABits = 1024
+
+// now returns the current time. It is replaced in tests.
+var now = time.Now
+
+// Reasons for which a signature does not verify.
+var (
+	errSyntax       = errors.New("malformed signature")
+	errVersion      = errors.New("unsupported version")
+	errAlgorithm    = errors.New("unsupported algorithm")
+	errFromUnsigned = errors.New("From field not signed")
+	errIdentity     = errors.New("identity does not match domain")
+	errExpired      = errors.New("signature expired")
+	errBodyLength   = errors.New("body shorter than l= tag")
+	errNoKey        = errors.New("no key for signature")
+	errKeyRevoked   = errors.New("key revoked")
+	errKeySyntax    = errors.New("malformed key record")
+	errKeyTooSmall  = errors.New("key too small")
+	errKeyLookup    = errors.New("key unavailable")
+	errBodyHash     = errors.New("body hash did not verify")
+	errSignature    = errors.New("signature did not verify")
+)
+
+// Result holds the outcome of verifying one signature.
+type Result struct {
+	// Status is Pass, Fail, TempError or PermError.
+	Status string
+	// Err is the reason for which the signature did not pass, or nil.
+	Err error
+	// Domain is the signing domain (d= tag).
+	Domain string
+	// Selector is the selector of the key (s= tag).
+	Selector string
+	// Identity is the agent or user identifier (i= tag).
+	Identity string
+	// Signature is the signature data (b= tag), without whitespace.
+	Signature string
+}
+
+// Verify verifies the DKIM-Signature header fields of the message, looking
+// up keys using r, and returns their results from the topmost down. It
+// returns nil if the message is not signed. Lines of the message may end in
+// either CRLF or LF.
+func Verify(raw string, r Resolver) []Result {
+	headers, body := splitMessage(raw)
+	var results []Result
+	for _, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == maxSignatures {
+			break
+		}
+		results = append(results, verify(h, headers, body, r))
+	}
+	return results
+}
+
+// verify verifies a single signature, following RFC 6376 6.1.
+func verify(sig header, headers []header, body string, r Resolver) Result {
+	tags, err := parseTags(sig.text[strings.IndexByte(sig.text, ':')+1:])
+	if err != nil {
+		return Result{Status: PermError, Err: errSyntax}
+	}
+	res := Result{
+		Domain:    tags["d"],
+		Selector:  tags["s"],
+		Identity:  tags["i"],
+		Signature: stripSpace(tags["b"]),
+	}
+	permError := func(err error) Result {
+		res.Status, res.Err = PermError, err
+		return res
+	}
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			return permError(errSyntax)
+		}
+	}
+	if tags["v"] != "1" {
+		return permError(errVersion)
+	}
+	algorithm := strings.ToLower(tags["a"])
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return permError(errAlgorithm)
+	}
+	headerCanon, bodyCanon, ok := parseCanon(tags["c"])
+	if !ok {
+		return permError(errSyntax)
+	}
+	var names []string
+	fromSigned := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		fromSigned = fromSigned || strings.EqualFold(name, "From")
+		names = append(names, name)
+	}
+	if !fromSigned {
+		return permError(errFromUnsigned)
+	}
+	domain := strings.ToLower(strings.TrimSuffix(res.Domain, "."))
+	if res.Identity == "" {
+		res.Identity = "@" + res.Domain
+	}
+	i := strings.LastIndex(res.Identity, "@")
+	if i == -1 {
+		return permError(errSyntax)
+	}
+	idDomain := strings.ToLower(res.Identity[i+1:])
+	if idDomain != domain && !strings.HasSuffix(idDomain, "."+domain) {
+		return permError(errIdentity)
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permError(errSyntax)
+		}
+		if expires < now().Unix() {
+			return permError(errExpired)
+		}
+	}
+	if q, ok := tags["q"]; ok && !strings.Contains(strings.ToLower(q), "dns/txt") {
+		return permError(errSyntax)
+	}
+	sigData, err := base64.StdEncoding.DecodeString(res.Signature)
+	if err != nil {
+		return permError(errSyntax)
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(stripSpace(tags["bh"]))
+	if err != nil {
+		return permError(errSyntax)
+	}
+
+	key, err := lookupKey(r, res.Selector, domain, algorithm)
+	switch {
+	case err == errKeyLookup:
+		res.Status, res.Err = TempError, err
+		return res
+	case err != nil:
+		return permError(err)
+	case key.strict && idDomain != domain:
+		return permError(errIdentity)
+	}
+
+	canonical := canonBody(body, bodyCanon)
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		switch {
+		case err != nil || n < 0:
+			return permError(errSyntax)
+		case n > len(canonical):
+			return permError(errBodyLength)
+		}
+		canonical = canonical[:n]
+	}
+	if h := sha256.Sum256([]byte(canonical)); string(h[:]) != string(bodyHash) {
+		res.Status, res.Err = Fail, errBodyHash
+		return res
+	}
+
+	data := signedHeaders(headers, names, headerCanon)
+	data += strings.TrimSuffix(canonHeader(header{name: sig.name, text: stripSignature(sig.text)}, headerCanon), "\r\n")
+	hash := sha256.Sum256([]byte(data))
+	if !key.verify(hash[:], sigData) {
+		res.Status, res.Err = Fail, errSignature
+		return res
+	}
+	res.Status = Pass
+	return res
+}
+
+// publicKey is a key published by a signer.
+type publicKey struct {
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+	strict  bool // strict is set by the "s" flag, requiring i= to use the d= domain
+}
+
+// verify reports whether sig is a valid signature of the given SHA-256 hash.
+func (k publicKey) verify(hash, sig []byte) bool {
+	if k.rsa != nil {
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, hash, sig) == nil
+	}
+	return ed25519.Verify(k.ed25519, hash, sig)
+}
+
+// lookupKey retrieves the key of the given selector and domain, as per
+// RFC 6376 3.6.2, checking that it may be used with the algorithm.
+func lookupKey(r Resolver, selector, domain, algorithm string) (publicKey, error) {
+	txts, err := r.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		if de, ok := err.(*net.DNSError); ok && de.IsNotFound {
+			return publicKey{}, errNoKey
+		}
+		return publicKey{}, errKeyLookup
+	}
+	if len(txts) == 0 {
+		return publicKey{}, errNoKey
+	}
+	// Only the first record is used, as RFC 6376 3.6.2.2 allows.
+	tags, err := parseTags(txts[0])
+	switch {
+	case err != nil:
+		return publicKey{}, errKeySyntax
+	case tags["v"] != "" && tags["v"] != "DKIM1":
+		return publicKey{}, errKeySyntax
+	case tags["h"] != "" && !hasItem(tags["h"], "sha256"):
+		return publicKey{}, errAlgorithm
+	case tags["s"] != "" && !hasItem(tags["s"], "*") && !hasItem(tags["s"], "email"):
+		return publicKey{}, errKeySyntax
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return publicKey{}, errKeySyntax
+	}
+	if p = stripSpace(p); p == "" {
+		return publicKey{}, errKeyRevoked
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return publicKey{}, errKeySyntax
+	}
+	key := publicKey{strict: hasItem(tags["t"], "s")}
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	switch {
+	case keyType == "rsa" && algorithm == "rsa-sha256":
+		if key.rsa, err = parseRSAKey(data); err != nil {
+			return publicKey{}, err
+		}
+	case keyType == "ed25519" && algorithm == "ed25519-sha256":
+		if len(data) != ed25519.PublicKeySize {
+			return publicKey{}, errKeySyntax
+		}
+		key.ed25519 = ed25519.PublicKey(data)
+	default:
+		return publicKey{}, errAlgorithm
+	}
+	return key, nil
+}
+
+// parseRSAKey parses an RSA public key, which is published in its
+// SubjectPublicKeyInfo form, or sometimes in its PKCS #1 form.
+func parseRSAKey(data []byte) (*rsa.PublicKey, error) {
+	var key *rsa.PublicKey
+	if k, err := x509.ParsePKIXPublicKey(data); err == nil {
+		key, _ = k.(*rsa.PublicKey)
+	} else if k, err := x509.ParsePKCS1PublicKey(data); err == nil {
+		key = k
+	}
+	switch {
+	case key == nil:
+		return nil, errKeySyntax
+	case key.N.BitLen() < minRSABits:
+		return nil, errKeyTooSmall
+	}
+	return key, nil
+}
+
+// hasItem reports whether the colon separated list holds the given item.
+func hasItem(list, item string) bool {
+	for _, v := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(v), item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyTable is a Resolver which answers from a local table of key records.
+// Names which are not in the table are not found, except for those in the
+// temp.test domain, which fail temporarily.
+type keyTable map[string]string
+
+func (k keyTable) LookupTXT(name string) ([]string, error) {
+	if strings.HasSuffix(name, ".temp.test") {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	if rec, ok := k[name]; ok {
+		return []string{rec}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// The ed25519-sha256 example of RFC 8463 Appendix A.
+const rfc8463Message = `DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;
+ d=football.example.com; i=@football.example.com;
+ q=dns/txt; s=brisbane; t=1528637909; h=from : to :
+ subject : date : message-id : from : subject : date;
+ bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;
+ b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus
+ Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==
+From: Joe SixPack <joe@football.example.com>
+To: Suzie Q <suzie@shopping.example.net>
+Subject: Is dinner ready?
+Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)
+Message-ID: <20030712040037.46341.5F8J@football.example.com>
+
+Hi.
+
+We lost the game.  Are you hungry yet?
+
+Joe.
+`
+
+var rfc8463Keys = keyTable{
+	"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+}
+
+func TestVerify_RFC8463(t *testing.T) {
+	results := Verify(rfc8463Message, rfc8463Keys)
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %v", results)
+	}
+	if r := results[0]; r.Status != Pass || r.Selector != "brisbane" ||
+		r.Domain != "football.example.com" || r.Identity != "@football.example.com" {
+		t.Errorf("Expected pass, got %+v", r)
+	}
+
+	tampered := strings.Replace(rfc8463Message, "hungry", "thirsty", 1)
+	for _, r := range Verify(tampered, rfc8463Keys) {
+		if r.Status != Fail || r.Err != errBodyHash {
+			t.Errorf("%s: expected body hash failure, got %+v", r.Selector, r)
+		}
+	}
+	tampered = strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1)
+	for _, r := range Verify(tampered, rfc8463Keys) {
+		if r.Status != Fail || r.Err != errSignature {
+			t.Errorf("%s: expected signature failure, got %+v", r.Selector, r)
+		}
+	}
+	// Relaxed canonicalization tolerates changes in whitespace.
+	reformatted := strings.Replace(rfc8463Message, "Subject: Is dinner", "subject:   Is  dinner", 1)
+	for _, r := range Verify(reformatted, rfc8463Keys) {
+		if r.Status != Pass {
+			t.Errorf("%s: expected pass, got %+v", r.Selector, r)
+		}
+	}
+}
+
+// testSign signs a message with the given tags, returning it with the
+// DKIM-Signature field prepended.
+func testSign(t *testing.T, msg, tags string, key crypto.Signer) string {
+	headers, body := splitMessage(msg)
+	parsed, _ := parseTags(tags)
+	hc, bc, _ := parseCanon(parsed["c"])
+	canonical := canonBody(body, bc)
+	if l, err := strconv.Atoi(parsed["l"]); err == nil && l <= len(canonical) {
+		canonical = canonical[:l]
+	}
+	bh := sha256.Sum256([]byte(canonical))
+	sig := header{name: "DKIM-Signature", text: "DKIM-Signature: " + tags + "; bh=" + base64.StdEncoding.EncodeToString(bh[:]) + "; b="}
+	data := signedHeaders(headers, strings.Split(parsed["h"], ":"), hc)
+	data += strings.TrimSuffix(canonHeader(sig, hc), "\r\n")
+	hash := sha256.Sum256([]byte(data))
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	b, err := key.Sign(rand.Reader, hash[:], opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig.text + base64.StdEncoding.EncodeToString(b) + "\r\n" + msg
+}
+
+func TestVerify_Errors(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(2000, 0) }
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the size of a key below the minimum is looked at.
+	smallKey := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 511), E: 65537}
+	pkix := func(k *rsa.PublicKey) string {
+		der, _ := x509.MarshalPKIXPublicKey(k)
+		return base64.StdEncoding.EncodeToString(der)
+	}
+	keys := keyTable{
+		"s._domainkey.a.test":       "v=DKIM1; p=" + pkix(&rsaKey.PublicKey),
+		"pkcs1._domainkey.a.test":   "p=" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)),
+		"strict._domainkey.a.test":  "t=s; p=" + pkix(&rsaKey.PublicKey),
+		"revoked._domainkey.a.test": "v=DKIM1; p=",
+		"small._domainkey.a.test":   "p=" + pkix(smallKey),
+		"ed._domainkey.a.test":      "k=ed25519; p=" + pkix(&rsaKey.PublicKey),
+		"sha1._domainkey.a.test":    "h=sha1; p=" + pkix(&rsaKey.PublicKey),
+	}
+	msg := "From: a@a.test\r\nSubject: Hi\r\n\r\nHello\r\n"
+	base := "v=1; a=rsa-sha256; c=relaxed/simple; d=a.test; h=From:Subject"
+	for _, test := range []struct {
+		tags   string
+		key    *rsa.PrivateKey
+		status string
+		err    error
+	}{
+		{base + "; s=s", rsaKey, Pass, nil},
+		{base + "; s=pkcs1; i=user@sub.a.test", rsaKey, Pass, nil},
+		{base + "; s=s; x=3000; t=1000", rsaKey, Pass, nil},
+		{base + "; s=s; l=2", rsaKey, Pass, nil},
+		{base + "; s=s; x=1000", rsaKey, PermError, errExpired},
+		{base + "; s=s; l=100", rsaKey, PermError, errBodyLength},
+		{base + "; s=s; i=@b.test", rsaKey, PermError, errIdentity},
+		{base + "; s=strict; i=@sub.a.test", rsaKey, PermError, errIdentity},
+		{base + "; s=revoked", rsaKey, PermError, errKeyRevoked},
+		{base + "; s=small", rsaKey, PermError, errKeyTooSmall},
+		{base + "; s=ed", rsaKey, PermError, errAlgorithm},
+		{base + "; s=sha1", rsaKey, PermError, errAlgorithm},
+		{base + "; s=missing", rsaKey, PermError, errNoKey},
+		{"v=1; a=rsa-sha256; d=temp.test; h=From; s=s", rsaKey, TempError, errKeyLookup},
+		{"v=1; a=rsa-sha256; d=a.test; h=Subject; s=s", rsaKey, PermError, errFromUnsigned},
+		{"v=2; a=rsa-sha256; d=a.test; h=From; s=s", rsaKey, PermError, errVersion},
+		{"v=1; a=rsa-sha1; d=a.test; h=From; s=s", rsaKey, PermError, errAlgorithm},
+		{"v=1; a=rsa-sha256; d=a.test; h=From", rsaKey, PermError, errSyntax},
+		{"v=1; a=rsa-sha256; c=loose; d=a.test; h=From; s=s", rsaKey, PermError, errSyntax},
+	} {
+		signed := testSign(t, msg, test.tags, test.key)
+		r := Verify(signed, keys)
+		if len(r) != 1 || r[0].Status != test.status || r[0].Err != test.err {
+			t.Errorf("%s: expected %s (%v), got %+v", test.tags, test.status, test.err, r)
+		}
+	}
+}
+
+func TestVerify_Ed25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := keyTable{"ed._domainkey.a.test": "k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+	msg := "From: a@a.test\nSubject: Hi\n\nHello\n"
+	signed := testSign(t, msg, "v=1; a=ed25519-sha256; d=a.test; h=from:subject:subject; s=ed", priv)
+	if r := Verify(signed, keys); len(r) != 1 || r[0].Status != Pass {
+		t.Errorf("Expected pass, got %+v", r)
+	}
+	// The unused occurrence of Subject in h= guards against added fields.
+	added := "Subject: Buy now\r\n" + strings.Replace(signed, "\r\n", "\n", -1)
+	if r := Verify(added, keys); len(r) != 1 || r[0].Status != Fail {
+		t.Errorf("Expected fail, got %+v", r)
+	}
+	if r := Verify(msg, keys); r != nil {
+		t.Errorf("Expected no results, got %+v", r)
+	}
+}
@@ -0,0 +1,410 @@
+package imap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+// delimiter separates the hierarchy levels of folder names.
+const delimiter = "/"
+
+// RFC 3501 6.1.1. CAPABILITY
+func cmdCAPABILITY(c *session, tag string, args []field) error {
+	if err := c.untagged("CAPABILITY %s", capabilities); err != nil {
+		return err
+	}
+	return c.reply(tag, "OK", "CAPABILITY completed")
+}
+
+// RFC 3501 6.1.2. NOOP
+// In the selected state, the client is notified about new messages.
+func cmdNOOP(c *session, tag string, args []field) error {
+	if err := c.update(); err != nil {
+		return err
+	}
+	return c.reply(tag, "OK", "NOOP completed")
+}
+
+// RFC 3501 6.1.3. LOGOUT
+func cmdLOGOUT(c *session, tag string, args []field) error {
+	c.untagged("BYE %s Gomez IMAP signing off", c.host.config.Get("host"))
+	c.reply(tag, "OK", "LOGOUT completed")
+	return io.EOF
+}
+
+// RFC 3501 6.2.3. LOGIN userid password
+func cmdLOGIN(c *session, tag string, args []field) error {
+	switch {
+	case c.State != stateNotAuthenticated:
+		return c.reply(tag, "BAD", "Already logged in")
+	case len(args) != 2 || args[0].isList || args[1].isList:
+		return c.reply(tag, "BAD", "Syntax: LOGIN userid password")
+	}
+	addr := c.host.user(args[0].str)
+	ok, err := c.host.mailbox.Authenticate(addr, args[1].str)
+	if err != nil {
+		log.Printf("error authenticating %s: %s", addr.Address, err)
+		return c.reply(tag, "NO", "[UNAVAILABLE] Unable to authenticate, try again later")
+	}
+	if !ok {
+		return c.reply(tag, "NO", "[AUTHENTICATIONFAILED] Invalid credentials")
+	}
+	c.User = addr
+	c.State = stateAuthenticated
+	return c.reply(tag, "OK", "[CAPABILITY %s] LOGIN completed", capabilities)
+}
+
+// RFC 3501 6.3.8. LIST reference mailbox
+func cmdLIST(c *session, tag string, args []field) error {
+	switch {
+	case c.State == stateNotAuthenticated:
+		return c.reply(tag, "NO", "Log in first")
+	case len(args) != 2 || args[0].isList || args[1].isList:
+		return c.reply(tag, "BAD", "Syntax: LIST reference mailbox")
+	}
+	if args[1].str == "" {
+		// Requests the hierarchy delimiter and the root name.
+		if err := c.untagged(`LIST (\Noselect) %s ""`, quote(delimiter)); err != nil {
+			return err
+		}
+		return c.reply(tag, "OK", "LIST completed")
+	}
+	pattern := listPattern(args[0].str + args[1].str)
+	folders, err := c.host.mailbox.Folders(c.User)
+	if err != nil {
+		log.Printf("error listing folders of %s: %s", c.User.Address, err)
+		return c.reply(tag, "NO", "[UNAVAILABLE] Unable to list folders")
+	}
+	for _, f := range folders {
+		if !pattern.MatchString(f.Name) {
+			continue
+		}
+		if err := c.untagged("LIST () %s %s", quote(delimiter), quote(f.Name)); err != nil {
+			return err
+		}
+	}
+	return c.reply(tag, "OK", "LIST completed")
+}
+
+// listPattern converts a LIST pattern into a regular expression. The "*"
+// wildcard matches any characters, while "%" does not match the hierarchy
+// delimiter. The name INBOX is case-insensitive.
+func listPattern(pattern string) *regexp.Regexp {
+	if len(pattern) >= 5 && strings.EqualFold(pattern[:5], "INBOX") {
+		pattern = "INBOX" + pattern[5:]
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, "%", "[^"+delimiter+"]*", -1)
+	return regexp.MustCompile("^" + expr + "$")
+}
+
+// RFC 3501 6.3.1. SELECT mailbox
+func cmdSELECT(c *session, tag string, args []field) error {
+	return c.selectFolder(tag, args, false)
+}
+
+// RFC 3501 6.3.2. EXAMINE mailbox
+func cmdEXAMINE(c *session, tag string, args []field) error {
+	return c.selectFolder(tag, args, true)
+}
+
+// selectFolder selects a folder, in read-only mode if readOnly is true.
+func (c *session) selectFolder(tag string, args []field, readOnly bool) error {
+	switch {
+	case c.State == stateNotAuthenticated:
+		return c.reply(tag, "NO", "Log in first")
+	case len(args) != 1 || args[0].isList:
+		return c.reply(tag, "BAD", "Syntax: SELECT mailbox")
+	}
+	// A failed attempt deselects the current folder.
+	c.State, c.Folder, c.Items = stateAuthenticated, nil, nil
+
+	folder, err := c.host.mailbox.Folder(c.User, args[0].str)
+	if err == mailbox.ErrNoFolder {
+		return c.reply(tag, "NO", "[NONEXISTENT] No such folder")
+	}
+	if err != nil {
+		log.Printf("error selecting %s of %s: %s", args[0].str, c.User.Address, err)
+		return c.reply(tag, "NO", "[UNAVAILABLE] Unable to select folder")
+	}
+	items, err := c.host.mailbox.Items(c.User, folder.Name, 0)
+	if err != nil {
+		log.Printf("error selecting %s of %s: %s", folder.Name, c.User.Address, err)
+		return c.reply(tag, "NO", "[UNAVAILABLE] Unable to select folder")
+	}
+	c.State, c.Folder, c.Items, c.ReadOnly = stateSelected, folder, items, readOnly
+
+	permanent, mode := flagList(systemFlags), "READ-WRITE"
+	if readOnly {
+		permanent, mode = "()", "READ-ONLY"
+	}
+	unseen := 0
+	for i, item := range items {
+		if !hasFlag(item, `\Seen`) {
+			unseen = i + 1
+			break
+		}
+	}
+	for _, line := range []string{
+		"FLAGS " + flagList(systemFlags),
+		"OK [PERMANENTFLAGS " + permanent + "] Limited",
+		fmt.Sprintf("%d EXISTS", len(items)),
+		"0 RECENT",
+		fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", folder.UIDValidity),
+		fmt.Sprintf("OK [UIDNEXT %d] Predicted next UID", folder.UIDNext),
+	} {
+		if err := c.untagged("%s", line); err != nil {
+			return err
+		}
+	}
+	if unseen > 0 {
+		if err := c.untagged("OK [UNSEEN %d] First unseen", unseen); err != nil {
+			return err
+		}
+	}
+	return c.reply(tag, "OK", "[%s] SELECT completed", mode)
+}
+
+// RFC 3501 6.4.2. CLOSE
+// Messages marked as \Deleted are removed, unless the folder is read-only.
+func cmdCLOSE(c *session, tag string, args []field) error {
+	if c.State != stateSelected {
+		return c.reply(tag, "NO", "No folder selected")
+	}
+	if !c.ReadOnly {
+		if _, err := c.expunge(); err != nil {
+			log.Printf("error expunging %s of %s: %s", c.Folder.Name, c.User.Address, err)
+		}
+	}
+	c.State, c.Folder, c.Items = stateAuthenticated, nil, nil
+	return c.reply(tag, "OK", "CLOSE completed")
+}
+
+// RFC 3501 6.4.3. EXPUNGE
+func cmdEXPUNGE(c *session, tag string, args []field) error {
+	switch {
+	case c.State != stateSelected:
+		return c.reply(tag, "NO", "No folder selected")
+	case c.ReadOnly:
+		return c.reply(tag, "NO", "[READ-ONLY] Folder is read-only")
+	}
+	removed, err := c.expunge()
+	if err != nil {
+		log.Printf("error expunging %s of %s: %s", c.Folder.Name, c.User.Address, err)
+		return c.reply(tag, "NO", "[UNAVAILABLE] Unable to expunge")
+	}
+	// Sequence numbers are reported from the highest, so that each one is
+	// valid at the time the client processes it.
+	for i := len(removed) - 1; i >= 0; i-- {
+		if err := c.untagged("%d EXPUNGE", removed[i]); err != nil {
+			return err
+		}
+	}
+	return c.reply(tag, "OK", "EXPUNGE completed")
+}
+
+// expunge removes the messages of the selected folder which are marked as
+// \Deleted and returns their sequence numbers, in ascending order.
+func (c *session) expunge() ([]int, error) {
+	var (
+		ids     []uint64
+		removed []int
+		kept    []*mailbox.FolderItem
+	)
+	for i, item := range c.Items {
+		if hasFlag(item, `\Deleted`) {
+			ids = append(ids, item.ID)
+			removed = append(removed, i+1)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if err := c.host.mailbox.Remove(c.User, ids); err != nil {
+		return nil, err
+	}
+	c.Items = kept
+	return removed, nil
+}
+
+// RFC 3501 6.4.6. STORE sequence-set item value
+func cmdSTORE(c *session, tag string, args []field) error {
+	return c.store(tag, args, false)
+}
+
+// store alters the flags of the messages in a sequence set. If uid is true,
+// the set holds UIDs.
+func (c *session) store(tag string, args []field, uid bool) error {
+	switch {
+	case c.State != stateSelected:
+		return c.reply(tag, "NO", "No folder selected")
+	case len(args) < 3 || args[0].isList || args[1].isList:
+		return c.reply(tag, "BAD", "Syntax: STORE sequence-set item value")
+	case c.ReadOnly:
+		return c.reply(tag, "NO", "[READ-ONLY] Folder is read-only")
+	}
+	set, err := parseSeqSet(args[0].str)
+	if err != nil {
+		return c.reply(tag, "BAD", "%s", err)
+	}
+	item := strings.ToUpper(args[1].str)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		return c.reply(tag, "BAD", "Unknown item %s", args[1].str)
+	}
+	var flags []string
+	values := args[2:]
+	if len(values) == 1 && values[0].isList {
+		values = values[0].list
+	}
+	for _, f := range values {
+		if f.isList || !validFlag(f.str) {
+			return c.reply(tag, "BAD", "Invalid flag")
+		}
+		flags = append(flags, normalizeFlag(f.str))
+	}
+
+	for _, n := range c.selection(set, uid) {
+		msg := c.Items[n-1]
+		updated := applyFlags(msg.Flags, flags, item)
+		if err := c.host.mailbox.SetFlags(c.User, msg.ID, updated); err != nil {
+			log.Printf("error storing flags of %d for %s: %s", msg.ID, c.User.Address, err)
+			return c.reply(tag, "NO", "[UNAVAILABLE] Unable to store flags")
+		}
+		msg.Flags = updated
+		if silent {
+			continue
+		}
+		resp := "FLAGS " + flagList(msg.Flags)
+		if uid {
+			resp = fmt.Sprintf("UID %d %s", msg.UID, resp)
+		}
+		if err := c.untagged("%d FETCH (%s)", n, resp); err != nil {
+			return err
+		}
+	}
+	return c.reply(tag, "OK", "STORE completed")
+}
+
+// validFlag reports whether the given flag may be stored. Keywords must be
+// atoms, and \Recent is managed by the server.
+func validFlag(flag string) bool {
+	if strings.HasPrefix(flag, `\`) {
+		return normalizeFlag(flag) != flag || contains(systemFlags, flag)
+	}
+	return flag != "" && !strings.ContainsAny(flag, `[]\`)
+}
+
+// applyFlags returns the flags which result from altering the current ones
+// using the given STORE item (FLAGS, +FLAGS or -FLAGS).
+func applyFlags(current, flags []string, item string) []string {
+	var result []string
+	switch item {
+	case "FLAGS":
+		result = []string{}
+	case "+FLAGS":
+		result = append([]string{}, current...)
+	case "-FLAGS":
+		result = []string{}
+		for _, f := range current {
+			if !containsFold(flags, f) {
+				result = append(result, f)
+			}
+		}
+		return result
+	}
+	for _, f := range flags {
+		if !containsFold(result, f) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether list contains s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 3501 6.4.8. UID command arguments
+func cmdUID(c *session, tag string, args []field) error {
+	if len(args) == 0 || args[0].isList {
+		return c.reply(tag, "BAD", "Syntax: UID command arguments")
+	}
+	switch strings.ToUpper(args[0].str) {
+	case "FETCH":
+		return c.fetch(tag, args[1:], true)
+	case "STORE":
+		return c.store(tag, args[1:], true)
+	case "SEARCH":
+		return c.search(tag, args[1:], true)
+	}
+	return c.reply(tag, "BAD", "Unknown command UID %s", args[0].str)
+}
+
+// RFC 2177 3. IDLE
+// While idling, the selected folder is checked for new messages every
+// 'idle.poll' seconds (default 30) until the client sends DONE.
+func cmdIDLE(c *session, tag string, args []field) error {
+	if c.State == stateNotAuthenticated {
+		return c.reply(tag, "NO", "Log in first")
+	}
+	if err := c.text.PrintfLine("+ idling"); err != nil {
+		return err
+	}
+	type result struct {
+		line string
+		err  error
+	}
+	// The client may idle until the autologout timer expires, while a server
+	// which is shutting down ends the read right away.
+	c.host.active.idle(c)
+	done := make(chan result, 1)
+	go func() {
+		line, err := c.text.ReadLine()
+		done <- result{line, err}
+	}()
+	ticker := time.NewTicker(c.host.idlePoll())
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-done:
+			switch {
+			case r.err != nil:
+				return r.err
+			case !strings.EqualFold(r.line, "DONE"):
+				return c.reply(tag, "BAD", "Expected DONE")
+			}
+			return c.reply(tag, "OK", "IDLE terminated")
+		case <-ticker.C:
+			if err := c.update(); err != nil {
+				return err
+			}
+		}
+	}
+}
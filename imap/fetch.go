@@ -0,0 +1,428 @@
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// fetchItem is a parsed FETCH data item.
+type fetchItem struct {
+	// Name of the item, such as FLAGS, ENVELOPE or BODY.
+	name string
+	// Section of a BODY item.
+	section section
+	// Peek is true for BODY.PEEK, which does not set the \Seen flag.
+	peek bool
+	// Partial fetches are given by an offset and a length. A length of -1
+	// stands for the whole data.
+	offset, length int
+}
+
+// section identifies a part of a message, as in BODY[1.2.HEADER].
+type section struct {
+	// Part numbers, starting at 1. An empty list refers to the message.
+	parts []int
+	// Spec is one of "", HEADER, HEADER.FIELDS, HEADER.FIELDS.NOT, TEXT
+	// and MIME.
+	spec string
+	// Header field names, for HEADER.FIELDS and HEADER.FIELDS.NOT.
+	fields []string
+	// Text is the section as given by the client, used in responses.
+	text string
+}
+
+// fetchMacros expand to lists of items.
+var fetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+}
+
+// RFC 3501 6.4.5. FETCH sequence-set items
+func cmdFETCH(c *session, tag string, args []field) error {
+	return c.fetch(tag, args, false)
+}
+
+// fetch retrieves data about the messages in a sequence set. If uid is true,
+// the set holds UIDs and the UID of each message is always returned.
+func (c *session) fetch(tag string, args []field, uid bool) error {
+	switch {
+	case c.State != stateSelected:
+		return c.reply(tag, "NO", "No folder selected")
+	case len(args) != 2 || args[0].isList:
+		return c.reply(tag, "BAD", "Syntax: FETCH sequence-set items")
+	}
+	set, err := parseSeqSet(args[0].str)
+	if err != nil {
+		return c.reply(tag, "BAD", "%s", err)
+	}
+	var names []string
+	if args[1].isList {
+		for _, f := range args[1].list {
+			if f.isList {
+				return c.reply(tag, "BAD", "Syntax: FETCH sequence-set items")
+			}
+			names = append(names, f.str)
+		}
+	} else if macro, ok := fetchMacros[strings.ToUpper(args[1].str)]; ok {
+		names = macro
+	} else {
+		names = []string{args[1].str}
+	}
+	var items []fetchItem
+	if uid {
+		items = append(items, fetchItem{name: "UID"})
+	}
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return c.reply(tag, "BAD", "%s", err)
+		}
+		if uid && item.name == "UID" {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	for _, n := range c.selection(set, uid) {
+		if err := c.fetchMessage(n, items); err != nil {
+			return err
+		}
+	}
+	return c.reply(tag, "OK", "FETCH completed")
+}
+
+// fetchMessage sends the requested items of the message with the given
+// sequence number.
+func (c *session) fetchMessage(n int, items []fetchItem) error {
+	msg := c.Items[n-1]
+	raw := crlf(msg.Raw)
+	var (
+		resp  []string
+		flags bool
+		seen  bool
+	)
+	for _, item := range items {
+		switch item.name {
+		case "UID":
+			resp = append(resp, fmt.Sprintf("UID %d", msg.UID))
+		case "FLAGS":
+			flags = true
+			resp = append(resp, "FLAGS "+flagList(msg.Flags))
+		case "INTERNALDATE":
+			resp = append(resp, fmt.Sprintf("INTERNALDATE %q", msg.Date.Format(dateTimeFormat)))
+		case "RFC822.SIZE":
+			resp = append(resp, fmt.Sprintf("RFC822.SIZE %d", len(raw)))
+		case "ENVELOPE":
+			resp = append(resp, "ENVELOPE "+envelope(raw))
+		case "RFC822":
+			seen = true
+			resp = append(resp, "RFC822 "+literal(raw))
+		case "RFC822.HEADER":
+			resp = append(resp, "RFC822.HEADER "+literal(sectionData(raw, section{spec: "HEADER"})))
+		case "RFC822.TEXT":
+			seen = true
+			resp = append(resp, "RFC822.TEXT "+literal(sectionData(raw, section{spec: "TEXT"})))
+		case "BODY":
+			seen = seen || !item.peek
+			data := sectionData(raw, item.section)
+			name := "BODY[" + item.section.text + "]"
+			if item.length >= 0 || item.offset > 0 {
+				data = partial(data, item.offset, item.length)
+				name += fmt.Sprintf("<%d>", item.offset)
+			}
+			resp = append(resp, name+" "+literal(data))
+		}
+	}
+	if seen && !c.ReadOnly && !hasFlag(msg, `\Seen`) {
+		updated := append(append([]string{}, msg.Flags...), `\Seen`)
+		if err := c.host.mailbox.SetFlags(c.User, msg.ID, updated); err != nil {
+			log.Printf("error storing flags of %d for %s: %s", msg.ID, c.User.Address, err)
+		} else {
+			msg.Flags = updated
+			if !flags {
+				resp = append(resp, "FLAGS "+flagList(msg.Flags))
+			}
+		}
+	}
+	return c.untagged("%d FETCH (%s)", n, strings.Join(resp, " "))
+}
+
+// parseFetchItem parses a single FETCH data item.
+func parseFetchItem(s string) (fetchItem, error) {
+	upper := strings.ToUpper(s)
+	switch upper {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE",
+		"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return fetchItem{name: upper, length: -1}, nil
+	}
+	item := fetchItem{name: "BODY", length: -1}
+	switch {
+	case strings.HasPrefix(upper, "BODY["):
+		s = s[len("BODY["):]
+	case strings.HasPrefix(upper, "BODY.PEEK["):
+		item.peek = true
+		s = s[len("BODY.PEEK["):]
+	default:
+		return item, fmt.Errorf("unsupported fetch item %s", s)
+	}
+	end := strings.LastIndex(s, "]")
+	if end == -1 {
+		return item, fmt.Errorf("bad fetch item %s", s)
+	}
+	sec, err := parseSection(s[:end])
+	if err != nil {
+		return item, err
+	}
+	item.section = sec
+	if rest := s[end+1:]; rest != "" {
+		var o, l int
+		if _, err := fmt.Sscanf(rest, "<%d.%d>", &o, &l); err != nil || o < 0 || l <= 0 {
+			return item, fmt.Errorf("bad partial %s", rest)
+		}
+		item.offset, item.length = o, l
+	}
+	return item, nil
+}
+
+// parseSection parses the section specification of a BODY item.
+func parseSection(s string) (section, error) {
+	sec := section{text: strings.ToUpper(s)}
+	rest := s
+	for rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+		i := strings.IndexByte(rest, '.')
+		if i == -1 {
+			i = len(rest)
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n == 0 {
+			return sec, fmt.Errorf("bad section %s", s)
+		}
+		sec.parts = append(sec.parts, n)
+		rest = strings.TrimPrefix(rest[i:], ".")
+	}
+	spec := strings.ToUpper(rest)
+	if i := strings.IndexByte(spec, ' '); i != -1 {
+		spec = spec[:i]
+	}
+	switch spec {
+	case "", "HEADER", "TEXT":
+	case "MIME":
+		if len(sec.parts) == 0 {
+			return sec, fmt.Errorf("bad section %s", s)
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		list := strings.TrimSpace(rest[len(spec):])
+		if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+			return sec, fmt.Errorf("bad section %s", s)
+		}
+		sec.fields = strings.Fields(list[1 : len(list)-1])
+		if len(sec.fields) == 0 {
+			return sec, fmt.Errorf("bad section %s", s)
+		}
+	default:
+		return sec, fmt.Errorf("bad section %s", s)
+	}
+	if spec != strings.ToUpper(rest) && len(sec.fields) == 0 {
+		return sec, fmt.Errorf("bad section %s", s)
+	}
+	sec.spec = spec
+	return sec, nil
+}
+
+// sectionData returns the data of a section of the given message.
+func sectionData(raw string, sec section) string {
+	entity := raw
+	for _, n := range sec.parts {
+		header, body := splitEntity(entity)
+		boundary, ok := multipartBoundary(header)
+		switch {
+		case ok:
+			parts := splitParts(body, boundary)
+			if n > len(parts) {
+				return ""
+			}
+			entity = parts[n-1]
+		case n == 1:
+			// The only part of a non-multipart entity is its body, which
+			// has no header of its own.
+			entity = "\r\n" + body
+		default:
+			return ""
+		}
+	}
+	header, body := splitEntity(entity)
+	switch sec.spec {
+	case "HEADER", "MIME":
+		return header
+	case "TEXT":
+		return body
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		return headerFields(header, sec.fields, sec.spec == "HEADER.FIELDS.NOT")
+	}
+	if len(sec.parts) > 0 {
+		return body
+	}
+	return entity
+}
+
+// splitEntity splits an entity into its header, including the blank line
+// which ends it, and its body.
+func splitEntity(entity string) (string, string) {
+	if strings.HasPrefix(entity, "\r\n") {
+		return "\r\n", entity[2:]
+	}
+	if i := strings.Index(entity, "\r\n\r\n"); i != -1 {
+		return entity[:i+4], entity[i+4:]
+	}
+	return entity, ""
+}
+
+// multipartBoundary returns the boundary of a multipart entity, given its
+// header.
+func multipartBoundary(header string) (string, bool) {
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(header))).ReadMIMEHeader()
+	if err != nil && len(h) == 0 {
+		return "", false
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// splitParts splits the body of a multipart entity into its parts.
+func splitParts(body, boundary string) []string {
+	delim := "--" + boundary
+	var parts []string
+	start := -1
+	for pos := 0; pos < len(body); {
+		i := strings.Index(body[pos:], delim)
+		if i == -1 {
+			break
+		}
+		i += pos
+		if i > 0 && body[i-1] != '\n' {
+			pos = i + len(delim)
+			continue
+		}
+		if start >= 0 {
+			parts = append(parts, strings.TrimSuffix(body[start:i], "\r\n"))
+		}
+		if strings.HasPrefix(body[i+len(delim):], "--") {
+			break
+		}
+		nl := strings.Index(body[i:], "\r\n")
+		if nl == -1 {
+			break
+		}
+		start = i + nl + 2
+		pos = start
+	}
+	return parts
+}
+
+// headerFields returns the header fields with the given names, or all other
+// fields if not is true, followed by a blank line.
+func headerFields(header string, names []string, not bool) string {
+	var b strings.Builder
+	keep := false
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" || line == "\r\n" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := strings.IndexByte(line, ':'); i != -1 {
+				name = strings.TrimSpace(line[:i])
+			}
+			keep = containsFold(names, name) != not
+		}
+		if keep {
+			b.WriteString(line)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// partial returns a substring of data, as requested by a partial fetch.
+func partial(data string, offset, length int) string {
+	if offset >= len(data) {
+		return ""
+	}
+	data = data[offset:]
+	if length >= 0 && length < len(data) {
+		data = data[:length]
+	}
+	return data
+}
+
+// envelope returns the ENVELOPE structure of a message.
+func envelope(raw string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return "(NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL)"
+	}
+	h := msg.Header
+	from := addressList(h.Get("From"))
+	sender, replyTo := addressList(h.Get("Sender")), addressList(h.Get("Reply-To"))
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		nstring(h.Get("Date")), nstring(h.Get("Subject")),
+		from, sender, replyTo,
+		addressList(h.Get("To")), addressList(h.Get("Cc")), addressList(h.Get("Bcc")),
+		nstring(h.Get("In-Reply-To")), nstring(h.Get("Message-Id")))
+}
+
+// addressList formats a header's addresses for an ENVELOPE.
+func addressList(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil || len(list) == 0 {
+		return "NIL"
+	}
+	var b strings.Builder
+	b.WriteString("(")
+	for _, addr := range list {
+		name := addr.Name
+		if strings.IndexFunc(name, func(r rune) bool { return r > 0x7f }) != -1 {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		user, host := addr.Address, ""
+		if i := strings.LastIndex(user, "@"); i != -1 {
+			user, host = user[:i], user[i+1:]
+		}
+		fmt.Fprintf(&b, "(%s NIL %s %s)", nstring(name), nstring(user), nstring(host))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// literal returns data as an IMAP literal.
+func literal(data string) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
+
+// crlf returns the message with all lines ending in CRLF, including the
+// last one.
+func crlf(raw string) string {
+	raw = strings.Replace(strings.Replace(raw, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	if !strings.HasSuffix(raw, "\r\n") {
+		raw += "\r\n"
+	}
+	return raw
+}
@@ -0,0 +1,129 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+)
+
+const multipartMessage = "From: Jane <jane@doe.com>\r\n" +
+	"Subject: Parts\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"xx\"\r\n" +
+	"\r\n" +
+	"Preamble\r\n" +
+	"--xx\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"First part\r\n" +
+	"--xx\r\n" +
+	"Content-Type: multipart/alternative; boundary=yy\r\n" +
+	"\r\n" +
+	"--yy\r\n" +
+	"\r\n" +
+	"Nested\r\n" +
+	"--yy--\r\n" +
+	"--xx--\r\n"
+
+func TestParseFetchItem(t *testing.T) {
+	for _, test := range []struct {
+		in     string
+		expect fetchItem
+	}{
+		{"flags", fetchItem{name: "FLAGS", length: -1}},
+		{"BODY[]", fetchItem{name: "BODY", length: -1}},
+		{"BODY.PEEK[TEXT]<10.20>", fetchItem{
+			name: "BODY", peek: true, offset: 10, length: 20,
+			section: section{spec: "TEXT", text: "TEXT"},
+		}},
+		{"body[1.2.mime]", fetchItem{name: "BODY", length: -1,
+			section: section{parts: []int{1, 2}, spec: "MIME", text: "1.2.MIME"},
+		}},
+		{"BODY[HEADER.FIELDS (Date From)]", fetchItem{name: "BODY", length: -1,
+			section: section{spec: "HEADER.FIELDS", fields: []string{"Date", "From"}, text: "HEADER.FIELDS (DATE FROM)"},
+		}},
+	} {
+		got, err := parseFetchItem(test.in)
+		if err != nil || !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.in, test.expect, got, err)
+		}
+	}
+	for _, bad := range []string{
+		"BODYSTRUCTURE", "BODY[", "BODY[MIME]", "BODY[0]", "BODY[TEXT junk]",
+		"BODY[HEADER.FIELDS]", "BODY[HEADER.FIELDS ()]", "BODY[]<1>", "BODY[]<0.0>",
+	} {
+		if _, err := parseFetchItem(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestSectionData(t *testing.T) {
+	for _, test := range []struct {
+		section string
+		expect  string
+	}{
+		{"", multipartMessage},
+		{"HEADER.FIELDS (SUBJECT)", "Subject: Parts\r\n\r\n"},
+		{"HEADER.FIELDS.NOT (FROM CONTENT-TYPE)", "Subject: Parts\r\n\r\n"},
+		{"1", "First part"},
+		{"1.MIME", "Content-Type: text/plain\r\n\r\n"},
+		{"2.1", "Nested"},
+		{"2.1.1", "Nested"},
+		{"3", ""},
+		{"1.2", ""},
+	} {
+		sec, err := parseSection(test.section)
+		if err != nil {
+			t.Fatalf("%s: %s", test.section, err)
+		}
+		if got := sectionData(multipartMessage, sec); got != test.expect {
+			t.Errorf("[%s]: expected %q, got %q", test.section, test.expect, got)
+		}
+	}
+}
+
+func TestPartial(t *testing.T) {
+	for _, test := range []struct {
+		offset, length int
+		expect         string
+	}{
+		{0, -1, "abcdef"},
+		{2, 3, "cde"},
+		{4, 10, "ef"},
+		{6, 1, ""},
+	} {
+		if got := partial("abcdef", test.offset, test.length); got != test.expect {
+			t.Errorf("<%d.%d>: expected %q, got %q", test.offset, test.length, test.expect, got)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	raw := crlf("Date: Mon, 2 Jan 2006 15:04:05 -0700\n" +
+		"Subject: Say \"hi\"\n" +
+		"From: Jane Doe <jane@doe.com>\n" +
+		"To: bob@example.com, \"Ann\" <ann@example.com>\n" +
+		"Message-Id: <1@doe.com>\n" +
+		"\n" +
+		"Body")
+	expect := `("Mon, 2 Jan 2006 15:04:05 -0700" "Say \"hi\"" ` +
+		`(("Jane Doe" NIL "jane" "doe.com")) (("Jane Doe" NIL "jane" "doe.com")) (("Jane Doe" NIL "jane" "doe.com")) ` +
+		`((NIL NIL "bob" "example.com")("Ann" NIL "ann" "example.com")) NIL NIL NIL "<1@doe.com>")`
+	if got := envelope(raw); got != expect {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expect, got)
+	}
+	if got := envelope("bogus"); got != "(NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL)" {
+		t.Errorf("Expected empty envelope, got %s", got)
+	}
+}
+
+func TestCRLF(t *testing.T) {
+	for _, test := range []struct{ in, expect string }{
+		{"a\nb", "a\r\nb\r\n"},
+		{"a\r\nb\r\n", "a\r\nb\r\n"},
+		{"", "\r\n"},
+	} {
+		if got := crlf(test.in); got != test.expect {
+			t.Errorf("crlf(%q): expected %q, got %q", test.in, test.expect, got)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// field is a parsed command argument. It is either an atom, a string (quoted
+// or literal) or a parenthesized list of fields.
+type field struct {
+	// Value of an atom or string.
+	str string
+	// Fields within a list.
+	list []field
+	// isList is true if the field is a parenthesized list.
+	isList bool
+}
+
+// errSyntax is returned when a command can not be parsed.
+var errSyntax = errors.New("syntax error")
+
+// parser reads the arguments of a command. Commands may span several lines
+// when they contain literals, in which case the literal function is called
+// to obtain the literal's data and the line which follows it.
+type parser struct {
+	line    string
+	pos     int
+	literal func(size int, sync bool) (data, next string, err error)
+}
+
+// fields parses fields until the end of the command, or until the end of the
+// current list when inList is true.
+func (p *parser) fields(inList bool) ([]field, error) {
+	var list []field
+	for {
+		if p.pos >= len(p.line) {
+			if inList {
+				return nil, errSyntax
+			}
+			return list, nil
+		}
+		if len(list) > 0 || inList && p.line[p.pos] == ')' {
+			switch p.line[p.pos] {
+			case ')':
+				if !inList {
+					return nil, errSyntax
+				}
+				p.pos++
+				return list, nil
+			case ' ':
+				p.pos++
+			default:
+				return nil, errSyntax
+			}
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+}
+
+// field parses a single field at the current position.
+func (p *parser) field() (field, error) {
+	if p.pos >= len(p.line) {
+		return field{}, errSyntax
+	}
+	switch p.line[p.pos] {
+	case '(':
+		p.pos++
+		list, err := p.fields(true)
+		return field{list: list, isList: true}, err
+	case '"':
+		return p.quoted()
+	case '{':
+		return p.literalField()
+	}
+	return p.atom()
+}
+
+// atom parses an atom. Atoms may contain a bracketed section, such as in
+// BODY[HEADER.FIELDS (DATE FROM)], which can hold spaces and parentheses.
+func (p *parser) atom() (field, error) {
+	start, depth := p.pos, 0
+loop:
+	for ; p.pos < len(p.line); p.pos++ {
+		switch c := p.line[p.pos]; {
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == ' ' || c == '(' || c == ')':
+			break loop
+		case c == '"' || c == '{' || c < ' ' || c == 0x7f:
+			return field{}, errSyntax
+		}
+	}
+	if p.pos == start || depth > 0 {
+		return field{}, errSyntax
+	}
+	return field{str: p.line[start:p.pos]}, nil
+}
+
+// quoted parses a quoted string.
+func (p *parser) quoted() (field, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.line); p.pos++ {
+		switch c := p.line[p.pos]; c {
+		case '"':
+			p.pos++
+			return field{str: b.String()}, nil
+		case '\\':
+			p.pos++
+			if p.pos == len(p.line) {
+				return field{}, errSyntax
+			}
+			b.WriteByte(p.line[p.pos])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return field{}, errSyntax
+}
+
+// literalField parses a literal, which must end the current line. Literals
+// are announced as {size}, or as {size+} when no continuation request is
+// expected by the client (RFC 2088).
+func (p *parser) literalField() (field, error) {
+	end := strings.IndexByte(p.line[p.pos:], '}')
+	if end == -1 || p.pos+end+1 != len(p.line) || p.literal == nil {
+		return field{}, errSyntax
+	}
+	spec := p.line[p.pos+1 : p.pos+end]
+	sync := !strings.HasSuffix(spec, "+")
+	size, err := strconv.Atoi(strings.TrimSuffix(spec, "+"))
+	if err != nil || size < 0 {
+		return field{}, errSyntax
+	}
+	data, next, err := p.literal(size, sync)
+	if err != nil {
+		return field{}, err
+	}
+	p.line, p.pos = next, 0
+	return field{str: data}, nil
+}
+
+// seqSet is a parsed sequence set, such as "1:4,7,9:*".
+type seqSet []seqRange
+
+// seqRange is a range of numbers within a sequence set. A value of 0 stands
+// for "*", the largest number in use.
+type seqRange struct{ from, to uint32 }
+
+// parseSeqSet parses a sequence set.
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, ":", 2)
+		from, err := parseSeqNumber(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = parseSeqNumber(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{from, to})
+	}
+	return set, nil
+}
+
+// parseSeqNumber parses a non-zero number or "*", which is returned as 0.
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("bad sequence number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// contains reports whether n is within the set, given that max is the
+// largest number in use.
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		from, to := r.from, r.to
+		if from == 0 {
+			from = max
+		}
+		if to == 0 {
+			to = max
+		}
+		if from > to {
+			from, to = to, from
+		}
+		if n >= from && n <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// dateFormat is the format of dates within SEARCH criteria.
+const dateFormat = "2-Jan-2006"
+
+// dateTimeFormat is the format of INTERNALDATE.
+const dateTimeFormat = "02-Jan-2006 15:04:05 -0700"
+
+// parseDate parses a date within SEARCH criteria.
+func parseDate(s string) (time.Time, error) {
+	return time.Parse(dateFormat, s)
+}
+
+// quote returns s as an IMAP string: quoted when possible, otherwise as a
+// literal.
+func quote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c > 0x7f {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// nstring returns s as an IMAP string, or NIL if it is empty.
+func nstring(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return quote(s)
+}
@@ -0,0 +1,122 @@
+package imap
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParser_Fields(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		expect []field
+		err    error
+	}{
+		{"INBOX", []field{{str: "INBOX"}}, nil},
+		{`"" "*"`, []field{{str: ""}, {str: "*"}}, nil},
+		{`"a \"b\" \\c"`, []field{{str: `a "b" \c`}}, nil},
+		{"1:* (FLAGS BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.10>)", []field{
+			{str: "1:*"},
+			{isList: true, list: []field{{str: "FLAGS"}, {str: "BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.10>"}}},
+		}, nil},
+		{`OR (SEEN FROM "x") ()`, []field{
+			{str: "OR"},
+			{isList: true, list: []field{{str: "SEEN"}, {str: "FROM"}, {str: "x"}}},
+			{isList: true},
+		}, nil},
+		{"(a", nil, errSyntax},
+		{"a)", nil, errSyntax},
+		{"a  b", nil, errSyntax},
+		{`"open`, nil, errSyntax},
+		{"BODY[TEXT", nil, errSyntax},
+		{"a {3}x", nil, errSyntax},
+	} {
+		p := &parser{line: test.line}
+		got, err := p.fields(false)
+		if err != test.err || !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%q: expected %+v (%v), got %+v (%v)", test.line, test.expect, test.err, got, err)
+		}
+	}
+}
+
+func TestParser_Literal(t *testing.T) {
+	var calls []bool
+	lines := map[int]string{3: ` {2+}`, 2: ` "pw"`}
+	p := &parser{
+		line: "jane {3}",
+		literal: func(size int, sync bool) (string, string, error) {
+			calls = append(calls, sync)
+			data := "abcdef"[:size]
+			return data, lines[size], nil
+		},
+	}
+	got, err := p.fields(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []field{{str: "jane"}, {str: "abc"}, {str: "ab"}, {str: "pw"}}
+	if !reflect.DeepEqual(got, expect) || !reflect.DeepEqual(calls, []bool{true, false}) {
+		t.Errorf("Expected %+v, got %+v (sync %v)", expect, got, calls)
+	}
+
+	errTooLarge := errors.New("too large")
+	p = &parser{
+		line:    "{100}",
+		literal: func(int, bool) (string, string, error) { return "", "", errTooLarge },
+	}
+	if _, err := p.fields(false); err != errTooLarge {
+		t.Errorf("Expected literal error, got %v", err)
+	}
+}
+
+func TestSeqSet(t *testing.T) {
+	for _, test := range []struct {
+		set      string
+		max      uint32
+		contains []uint32
+		lacks    []uint32
+	}{
+		{"1", 5, []uint32{1}, []uint32{2, 5}},
+		{"2:4,7", 9, []uint32{2, 3, 4, 7}, []uint32{1, 5, 8}},
+		{"3:*", 5, []uint32{3, 4, 5}, []uint32{2}},
+		{"*:3", 5, []uint32{3, 4, 5}, []uint32{2}},
+		{"*", 8, []uint32{8}, []uint32{7}},
+		{"9:*", 5, []uint32{5, 6, 9}, []uint32{4, 10}},
+	} {
+		set, err := parseSeqSet(test.set)
+		if err != nil {
+			t.Fatalf("%s: %s", test.set, err)
+		}
+		for _, n := range test.contains {
+			if !set.contains(n, test.max) {
+				t.Errorf("%s (max %d) should contain %d", test.set, test.max, n)
+			}
+		}
+		for _, n := range test.lacks {
+			if set.contains(n, test.max) {
+				t.Errorf("%s (max %d) should not contain %d", test.set, test.max, n)
+			}
+		}
+	}
+	for _, bad := range []string{"", "0", "1:", "a", "1,,2", "-1"} {
+		if _, err := parseSeqSet(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, test := range []struct{ in, expect string }{
+		{"INBOX", `"INBOX"`},
+		{`a "b" \c`, `"a \"b\" \\c"`},
+		{"two\r\nlines", "{10}\r\ntwo\r\nlines"},
+		{"héllo", "{6}\r\nhéllo"},
+	} {
+		if got := quote(test.in); got != test.expect {
+			t.Errorf("quote(%q): expected %q, got %q", test.in, test.expect, got)
+		}
+	}
+	if nstring("") != "NIL" {
+		t.Error("Expected NIL for empty string")
+	}
+}
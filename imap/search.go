@@ -0,0 +1,308 @@
+package imap
+
+import (
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+// criterion reports whether the message with the given sequence number
+// matches a SEARCH criterion.
+type criterion func(c *session, n int, msg *mailbox.FolderItem) bool
+
+// RFC 3501 6.4.4. SEARCH [CHARSET charset] criteria
+func cmdSEARCH(c *session, tag string, args []field) error {
+	return c.search(tag, args, false)
+}
+
+// search replies with the sequence numbers of the messages matching the
+// given criteria, or with their UIDs if uid is true.
+func (c *session) search(tag string, args []field, uid bool) error {
+	if c.State != stateSelected {
+		return c.reply(tag, "NO", "No folder selected")
+	}
+	if len(args) >= 2 && !args[0].isList && strings.EqualFold(args[0].str, "CHARSET") {
+		if cs := strings.ToUpper(args[1].str); cs != "US-ASCII" && cs != "UTF-8" {
+			return c.reply(tag, "NO", "[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return c.reply(tag, "BAD", "Syntax: SEARCH criteria")
+	}
+	match, err := parseCriteria(args)
+	if err != nil {
+		return c.reply(tag, "BAD", "%s", err)
+	}
+	var found []string
+	for i, msg := range c.Items {
+		if !match(c, i+1, msg) {
+			continue
+		}
+		if uid {
+			found = append(found, strconv.FormatUint(uint64(msg.UID), 10))
+		} else {
+			found = append(found, strconv.Itoa(i+1))
+		}
+	}
+	resp := "SEARCH"
+	if len(found) > 0 {
+		resp += " " + strings.Join(found, " ")
+	}
+	if err := c.untagged("%s", resp); err != nil {
+		return err
+	}
+	return c.reply(tag, "OK", "SEARCH completed")
+}
+
+// parseCriteria parses a list of search keys, which must all match.
+func parseCriteria(args []field) (criterion, error) {
+	var all []criterion
+	for len(args) > 0 {
+		crit, rest, err := parseCriterion(args)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, crit)
+		args = rest
+	}
+	return func(c *session, n int, msg *mailbox.FolderItem) bool {
+		for _, crit := range all {
+			if !crit(c, n, msg) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// flagKeys map search keys to the flag which they test for, and to whether
+// the flag must be set.
+var flagKeys = map[string]struct {
+	flag string
+	set  bool
+}{
+	"ANSWERED":   {`\Answered`, true},
+	"DELETED":    {`\Deleted`, true},
+	"DRAFT":      {`\Draft`, true},
+	"FLAGGED":    {`\Flagged`, true},
+	"SEEN":       {`\Seen`, true},
+	"UNANSWERED": {`\Answered`, false},
+	"UNDELETED":  {`\Deleted`, false},
+	"UNDRAFT":    {`\Draft`, false},
+	"UNFLAGGED":  {`\Flagged`, false},
+	"UNSEEN":     {`\Seen`, false},
+}
+
+// headerKeys map search keys to the header field which they search in.
+var headerKeys = map[string]string{
+	"BCC":     "Bcc",
+	"CC":      "Cc",
+	"FROM":    "From",
+	"SUBJECT": "Subject",
+	"TO":      "To",
+}
+
+// parseCriterion parses the search key at the beginning of args, returning
+// the remaining arguments.
+func parseCriterion(args []field) (criterion, []field, error) {
+	arg, args := args[0], args[1:]
+	if arg.isList {
+		crit, err := parseCriteria(arg.list)
+		return crit, args, err
+	}
+	// need returns the next n arguments, which must be strings.
+	need := func(n int) ([]string, error) {
+		if len(args) < n {
+			return nil, fmt.Errorf("missing argument for %s", arg.str)
+		}
+		var list []string
+		for _, f := range args[:n] {
+			if f.isList {
+				return nil, fmt.Errorf("bad argument for %s", arg.str)
+			}
+			list = append(list, f.str)
+		}
+		args = args[n:]
+		return list, nil
+	}
+	key := strings.ToUpper(arg.str)
+	if f, ok := flagKeys[key]; ok {
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			return hasFlag(msg, f.flag) == f.set
+		}, args, nil
+	}
+	if name, ok := headerKeys[key]; ok {
+		v, err := need(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return headerContains(name, v[0]), args, nil
+	}
+	switch key {
+	case "ALL", "OLD":
+		// Messages are never recent, as \Recent is not supported.
+		return func(*session, int, *mailbox.FolderItem) bool { return true }, args, nil
+	case "NEW", "RECENT":
+		return func(*session, int, *mailbox.FolderItem) bool { return false }, args, nil
+	case "KEYWORD", "UNKEYWORD":
+		v, err := need(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			return hasFlag(msg, v[0]) == (key == "KEYWORD")
+		}, args, nil
+	case "HEADER":
+		v, err := need(2)
+		if err != nil {
+			return nil, nil, err
+		}
+		return headerContains(v[0], v[1]), args, nil
+	case "BODY", "TEXT":
+		v, err := need(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			raw := crlf(msg.Raw)
+			if key == "BODY" {
+				_, raw = splitEntity(raw)
+			}
+			return containsFoldString(raw, v[0])
+		}, args, nil
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		v, err := need(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		date, err := parseDate(v[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad date %s", v[0])
+		}
+		return dateCriterion(key, date), args, nil
+	case "LARGER", "SMALLER":
+		v, err := need(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		size, err := strconv.Atoi(v[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad size %s", v[0])
+		}
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			if key == "LARGER" {
+				return len(crlf(msg.Raw)) > size
+			}
+			return len(crlf(msg.Raw)) < size
+		}, args, nil
+	case "UID":
+		v, err := need(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		set, err := parseSeqSet(v[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			return set.contains(msg.UID, c.maxUID())
+		}, args, nil
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("missing argument for NOT")
+		}
+		crit, rest, err := parseCriterion(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			return !crit(c, n, msg)
+		}, rest, nil
+	case "OR":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("missing argument for OR")
+		}
+		a, rest, err := parseCriterion(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, fmt.Errorf("missing argument for OR")
+		}
+		b, rest, err := parseCriterion(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(c *session, n int, msg *mailbox.FolderItem) bool {
+			return a(c, n, msg) || b(c, n, msg)
+		}, rest, nil
+	}
+	// Otherwise, the key must be a sequence set.
+	set, err := parseSeqSet(arg.str)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown search key %s", arg.str)
+	}
+	return func(c *session, n int, msg *mailbox.FolderItem) bool {
+		return set.contains(uint32(n), uint32(len(c.Items)))
+	}, args, nil
+}
+
+// headerContains returns a criterion which matches messages that have the
+// given header field containing s. An empty s matches any message which has
+// the field.
+func headerContains(name, s string) criterion {
+	return func(c *session, n int, msg *mailbox.FolderItem) bool {
+		m, err := mail.ReadMessage(strings.NewReader(crlf(msg.Raw)))
+		if err != nil {
+			return false
+		}
+		values, ok := m.Header[textproto.CanonicalMIMEHeaderKey(name)]
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if containsFoldString(v, s) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// dateCriterion returns a criterion which compares the date of a message,
+// disregarding the time of day, with the given date. The SENT* keys use the
+// Date header, while the others use the date when the message was received.
+func dateCriterion(key string, date time.Time) criterion {
+	return func(c *session, n int, msg *mailbox.FolderItem) bool {
+		t := msg.Date
+		if strings.HasPrefix(key, "SENT") {
+			m, err := mail.ReadMessage(strings.NewReader(crlf(msg.Raw)))
+			if err != nil {
+				return false
+			}
+			if t, err = m.Header.Date(); err != nil {
+				return false
+			}
+		}
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		switch strings.TrimPrefix(key, "SENT") {
+		case "BEFORE":
+			return day.Before(date)
+		case "ON":
+			return day.Equal(date)
+		default:
+			return !day.Before(date)
+		}
+	}
+}
+
+// containsFoldString reports whether s contains substr, ignoring case.
+func containsFoldString(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
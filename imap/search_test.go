@@ -0,0 +1,83 @@
+package imap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+func TestParseCriteria(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2016, 3, d, 12, 0, 0, 0, time.UTC) }
+	c := &session{Items: []*mailbox.FolderItem{
+		{
+			Message: &mailbox.Message{Raw: "From: jane@doe.com\nSubject: Lunch\nDate: 1 Mar 2016 10:00 +0000\n\nPizza?"},
+			UID:     3, Flags: []string{`\Seen`}, Date: day(2),
+		},
+		{
+			Message: &mailbox.Message{Raw: "From: bob@doe.com\nSubject: Re: Lunch\nX-Priority: 1\n\nSure, at noon."},
+			UID:     5, Flags: []string{`\Seen`, `\Flagged`, "$Work"}, Date: day(3),
+		},
+		{
+			Message: &mailbox.Message{Raw: "From: ann@example.com\nTo: jane@doe.com\n\nHello Jane"},
+			UID:     9, Date: day(5),
+		},
+	}}
+	for _, test := range []struct {
+		criteria string
+		expect   []int
+	}{
+		{"ALL", []int{1, 2, 3}},
+		{"NEW", nil},
+		{"SEEN", []int{1, 2}},
+		{"unseen", []int{3}},
+		{"FLAGGED KEYWORD $work", []int{2}},
+		{"UNKEYWORD $Work", []int{1, 3}},
+		{`FROM "DOE.COM"`, []int{1, 2}},
+		{"TO jane", []int{3}},
+		{"SUBJECT lunch NOT SUBJECT re:", []int{1}},
+		{`HEADER X-Priority ""`, []int{2}},
+		{"BODY jane", []int{3}},
+		{"TEXT jane", []int{1, 3}},
+		{"BEFORE 3-Mar-2016", []int{1}},
+		{"ON 3-Mar-2016", []int{2}},
+		{"SINCE 3-Mar-2016", []int{2, 3}},
+		{"SENTON 1-Mar-2016", []int{1}},
+		{"LARGER 72", []int{1}},
+		{"SMALLER 72", []int{3}},
+		{"UID 4:*", []int{2, 3}},
+		{"2:*", []int{2, 3}},
+		{"OR UID 3 (SEEN 3)", []int{1}},
+		{"OR 1 OR 2 3 NOT 2", []int{1, 3}},
+	} {
+		p := &parser{line: test.criteria}
+		args, err := p.fields(false)
+		if err != nil {
+			t.Fatalf("%s: %s", test.criteria, err)
+		}
+		match, err := parseCriteria(args)
+		if err != nil {
+			t.Fatalf("%s: %s", test.criteria, err)
+		}
+		var got []int
+		for i, msg := range c.Items {
+			if match(c, i+1, msg) {
+				got = append(got, i+1)
+			}
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: expected %v, got %v", test.criteria, test.expect, got)
+		}
+	}
+
+	for _, bad := range []string{
+		"FROM", "HEADER Subject", "BEFORE 2016-03-01", "LARGER x", "UID x", "NOT", "OR SEEN", "BOGUS", "(FROM)",
+	} {
+		p := &parser{line: bad}
+		args, _ := p.fields(false)
+		if _, err := parseCriteria(args); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
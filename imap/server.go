@@ -0,0 +1,184 @@
+// Package imap implements an IMAP4rev1 server (RFC 3501) which gives users
+// access to the messages in their mailbox folders.
+//
+// The server supports the LOGIN, LIST, SELECT, EXAMINE, FETCH, STORE, SEARCH,
+// EXPUNGE and CLOSE commands, along with their UID variants, and the IDLE
+// extension (RFC 2177).
+package imap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// Host server instance.
+type server struct {
+	spec    commandSpec
+	config  jamon.Group
+	mailbox mailbox.Store
+	active  *tracker // open sessions
+}
+
+// commandSpec holds a set of supported commands, mapping names to actions.
+// Actions receive the command's tag and its parsed arguments.
+type commandSpec map[string]func(c *session, tag string, args []field) error
+
+// ErrMinConfig is returned when the minimum configuration is not passed to the server.
+// A listen address (host:port) passed via the 'listen' and a 'host' is required.
+var ErrMinConfig = errors.New("Minimum config not met. Need at least 'listen' and 'host'")
+
+// capabilities lists the capabilities of the server.
+const capabilities = "IMAP4rev1 LITERAL+ IDLE"
+
+// Start initiates a new IMAP server given a mailbox store and a configuration.
+// Sessions which send nothing within 'timeout' seconds (default 1800, which
+// RFC 3501 5.4 gives as the least an autologout timer may allow) are closed.
+func Start(mb mailbox.Store, cfg jamon.Group) error {
+	return StartContext(context.Background(), mb, cfg)
+}
+
+// StartContext is like Start, but shuts the server down once the given context
+// is done. The server then stops accepting connections and closes idle
+// sessions, including those in IDLE, while sessions which are in the middle of
+// a command are given 'shutdown.timeout' seconds (default 30) to complete it.
+// It returns nil once all sessions have ended.
+func StartContext(ctx context.Context, mb mailbox.Store, cfg jamon.Group) error {
+	if !cfg.Has("listen") || !cfg.Has("host") {
+		return ErrMinConfig
+	}
+	ln, err := net.Listen("tcp", cfg.Get("listen"))
+	if err != nil {
+		return err
+	}
+	srv := newServer(mb, cfg)
+	srv.active = newTracker()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				srv.active.shutdown(srv.seconds("shutdown.timeout", 30))
+				return nil
+			}
+			log.Printf("Error accepting an incoming connection: %s\r\n", err)
+			continue
+		}
+		srv.active.add()
+		go srv.createSession(conn)
+	}
+}
+
+// newServer returns a server supporting all implemented commands.
+func newServer(mb mailbox.Store, cfg jamon.Group) server {
+	return server{
+		mailbox: mb,
+		config:  cfg,
+		spec: commandSpec{
+			"CAPABILITY": cmdCAPABILITY,
+			"NOOP":       cmdNOOP,
+			"LOGOUT":     cmdLOGOUT,
+			"LOGIN":      cmdLOGIN,
+			"LIST":       cmdLIST,
+			"SELECT":     cmdSELECT,
+			"EXAMINE":    cmdEXAMINE,
+			"CLOSE":      cmdCLOSE,
+			"EXPUNGE":    cmdEXPUNGE,
+			"FETCH":      cmdFETCH,
+			"STORE":      cmdSTORE,
+			"SEARCH":     cmdSEARCH,
+			"UID":        cmdUID,
+			"IDLE":       cmdIDLE,
+		},
+	}
+}
+
+// createSession creates a new session based on the given connection. When
+// the server is tracking sessions, add must be called beforehand.
+func (s server) createSession(conn net.Conn) {
+	defer conn.Close()
+	c := &session{
+		State:   stateNotAuthenticated,
+		host:    s,
+		text:    textproto.NewConn(conn),
+		conn:    conn,
+		timeout: s.seconds("timeout", 1800),
+	}
+	s.active.track(c)
+	defer s.active.done(c)
+	c.untagged("OK [CAPABILITY %s] %s Gomez IMAP ready", capabilities, s.config.Get("host"))
+	c.serve()
+}
+
+// run parses and executes a command in the context of a session. Commands
+// consist of a tag, a case-insensitive name and optional arguments.
+func (s server) run(c *session, line string) error {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || parts[0] == "" || strings.ContainsAny(parts[0], `+(){%*"\`) {
+		return c.untagged("BAD Syntax: tag command [arguments]")
+	}
+	tag, name := parts[0], strings.ToUpper(parts[1])
+	command, ok := s.spec[name]
+	if !ok {
+		return c.reply(tag, "BAD", "Unknown command %s", name)
+	}
+	var args []field
+	if len(parts) == 3 {
+		p := &parser{line: parts[2], literal: c.readLiteral}
+		var err error
+		if args, err = p.fields(false); err != nil {
+			if err == errSyntax || err == errLiteral {
+				return c.reply(tag, "BAD", "%s: %s", name, err)
+			}
+			return err
+		}
+	}
+	return command(c, tag, args)
+}
+
+// user returns the address of a user logging in with the given name. Names
+// which lack a host are considered to be local to the server's host.
+func (s server) user(name string) *mail.Address {
+	if !strings.Contains(name, "@") {
+		name = fmt.Sprintf("%s@%s", name, s.config.Get("host"))
+	}
+	return &mail.Address{Address: name}
+}
+
+// seconds returns the duration set by a configuration flag in seconds, or def
+// seconds if the flag is not set or is not numeric. Zero disables a timeout.
+func (s server) seconds(flag string, def int) time.Duration {
+	n, err := strconv.Atoi(s.config.Get(flag))
+	if err != nil || n < 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// idlePoll returns the interval at which folders are checked for new
+// messages while a client is idling.
+func (s server) idlePoll() time.Duration {
+	n, err := strconv.Atoi(s.config.Get("idle.poll"))
+	if err != nil || n <= 0 {
+		n = 30
+	}
+	return time.Duration(n) * time.Second
+}
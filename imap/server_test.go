@@ -0,0 +1,317 @@
+package imap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// getTestSession returns the client end of a session which is being served
+// by a server using the given store.
+func getTestSession(t *testing.T, mb mailbox.Store, cfg jamon.Group) *textproto.Conn {
+	cfg["host"] = "mecca.local"
+	srv := newServer(mb, cfg)
+	cc, sc := net.Pipe()
+	go srv.createSession(sc)
+	client := textproto.NewConn(cc)
+	if line, err := client.ReadLine(); err != nil || !strings.HasSuffix(line, "mecca.local Gomez IMAP ready") {
+		t.Fatalf("Bad greeting %q (%v)", line, err)
+	}
+	return client
+}
+
+// exchange sends a tagged command and returns all lines received up to, and
+// including, the tagged completion result.
+func exchange(t *testing.T, c *textproto.Conn, tag, cmd string) []string {
+	if err := c.PrintfLine("%s %s", tag, cmd); err != nil {
+		t.Fatalf("Error sending %s: %s", cmd, err)
+	}
+	var lines []string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			t.Fatalf("Error reading reply to %s: %s", cmd, err)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, tag+" ") {
+			return lines
+		}
+	}
+}
+
+// testStore returns a store holding a few messages in the INBOX of
+// jane@mecca.local, which records removed messages.
+func testStore(removed *[]uint64) *mailbox.MockStore {
+	date := time.Date(2016, 3, 1, 10, 0, 0, 0, time.UTC)
+	items := []*mailbox.FolderItem{
+		{
+			Message: &mailbox.Message{ID: 10, Raw: "From: Bob <bob@doe.com>\nSubject: Hi\n\nHello"},
+			UID:     1, Flags: []string{`\Seen`}, Date: date,
+		},
+		{
+			Message: &mailbox.Message{ID: 20, Raw: "From: ann@doe.com\nSubject: Lunch\n\nPizza?"},
+			UID:     4, Flags: []string{}, Date: date,
+		},
+	}
+	inbox := &mailbox.Folder{Name: "INBOX", UIDValidity: 7, UIDNext: 5}
+	return &mailbox.MockStore{
+		AuthenticateMock: func(addr *mail.Address, pass string) (bool, error) {
+			return addr.Address == "jane@mecca.local" && pass == "pass word", nil
+		},
+		FoldersMock: func(*mail.Address) ([]*mailbox.Folder, error) {
+			return []*mailbox.Folder{inbox, {Name: "Archive/2016"}}, nil
+		},
+		FolderMock: func(addr *mail.Address, name string) (*mailbox.Folder, error) {
+			if !strings.EqualFold(name, "INBOX") {
+				return nil, mailbox.ErrNoFolder
+			}
+			copy := *inbox
+			return &copy, nil
+		},
+		ItemsMock: func(addr *mail.Address, folder string, since uint32) ([]*mailbox.FolderItem, error) {
+			var list []*mailbox.FolderItem
+			for _, item := range items {
+				if item.UID > since {
+					copy := *item
+					copy.Flags = append([]string{}, item.Flags...)
+					list = append(list, &copy)
+				}
+			}
+			return list, nil
+		},
+		SetFlagsMock: func(addr *mail.Address, id uint64, flags []string) error {
+			for _, item := range items {
+				if item.ID == id {
+					item.Flags = flags
+				}
+			}
+			return nil
+		},
+		RemoveMock: func(addr *mail.Address, ids []uint64) error {
+			*removed = append(*removed, ids...)
+			var kept []*mailbox.FolderItem
+			for _, item := range items {
+				if !containsID(ids, item.ID) {
+					kept = append(kept, item)
+				}
+			}
+			items = kept
+			return nil
+		},
+	}
+}
+
+func TestServer_Session(t *testing.T) {
+	var removed []uint64
+	c := getTestSession(t, testStore(&removed), jamon.Group{})
+	defer c.Close()
+
+	for i, test := range []struct {
+		cmd    string
+		expect []string
+	}{
+		{"CAPABILITY", []string{"* CAPABILITY " + capabilities, "a0 OK CAPABILITY completed"}},
+		{"SELECT INBOX", []string{"a1 NO Log in first"}},
+		{"LOGIN jane wrong", []string{"a2 NO [AUTHENTICATIONFAILED] Invalid credentials"}},
+		{`LOGIN jane "pass word"`, []string{"a3 OK [CAPABILITY " + capabilities + "] LOGIN completed"}},
+		{`LIST "" ""`, []string{`* LIST (\Noselect) "/" ""`, "a4 OK LIST completed"}},
+		{`LIST "" *`, []string{`* LIST () "/" "INBOX"`, `* LIST () "/" "Archive/2016"`, "a5 OK LIST completed"}},
+		{`LIST "" %`, []string{`* LIST () "/" "INBOX"`, "a6 OK LIST completed"}},
+		{"SELECT Drafts", []string{"a7 NO [NONEXISTENT] No such folder"}},
+		{"FETCH 1 FLAGS", []string{"a8 NO No folder selected"}},
+		{"SELECT inbox", []string{
+			`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`,
+			`* OK [PERMANENTFLAGS (\Answered \Flagged \Deleted \Seen \Draft)] Limited`,
+			"* 2 EXISTS",
+			"* 0 RECENT",
+			"* OK [UIDVALIDITY 7] UIDs valid",
+			"* OK [UIDNEXT 5] Predicted next UID",
+			"* OK [UNSEEN 2] First unseen",
+			"a9 OK [READ-WRITE] SELECT completed",
+		}},
+		{"FETCH 1:* (UID FLAGS RFC822.SIZE)", []string{
+			`* 1 FETCH (UID 1 FLAGS (\Seen) RFC822.SIZE 47)`,
+			"* 2 FETCH (UID 4 FLAGS () RFC822.SIZE 45)",
+			"a10 OK FETCH completed",
+		}},
+		{"FETCH 2 (BODY.PEEK[HEADER.FIELDS (SUBJECT)] INTERNALDATE)", []string{
+			"* 2 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {18}",
+			`Subject: Lunch`,
+			``,
+			` INTERNALDATE "01-Mar-2016 10:00:00 +0000")`,
+			"a11 OK FETCH completed",
+		}},
+		{"UID FETCH 4 BODY[TEXT]<0.5>", []string{
+			"* 2 FETCH (UID 4 BODY[TEXT]<0> {5}",
+			`Pizza FLAGS (\Seen))`,
+			"a12 OK FETCH completed",
+		}},
+		{"SEARCH UNSEEN", []string{"* SEARCH", "a13 OK SEARCH completed"}},
+		{"UID SEARCH FROM ann", []string{"* SEARCH 4", "a14 OK SEARCH completed"}},
+		{`STORE 1 +FLAGS (\Deleted $Later)`, []string{
+			`* 1 FETCH (FLAGS (\Seen \Deleted $Later))`,
+			"a15 OK STORE completed",
+		}},
+		{`UID STORE 4 FLAGS.SILENT (\flagged)`, []string{"a16 OK STORE completed"}},
+		{`STORE 1 -FLAGS ($later)`, []string{`* 1 FETCH (FLAGS (\Seen \Deleted))`, "a17 OK STORE completed"}},
+		{`STORE 1 FLAGS (\Recent)`, []string{"a18 BAD Invalid flag"}},
+		{`SEARCH OR DELETED FLAGGED`, []string{"* SEARCH 1 2", "a19 OK SEARCH completed"}},
+		{"EXPUNGE", []string{"* 1 EXPUNGE", "a20 OK EXPUNGE completed"}},
+		{"FETCH * (UID FLAGS)", []string{`* 1 FETCH (UID 4 FLAGS (\Flagged))`, "a21 OK FETCH completed"}},
+		{"EXAMINE INBOX", []string{
+			`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`,
+			"* OK [PERMANENTFLAGS ()] Limited",
+			"* 1 EXISTS",
+			"* 0 RECENT",
+			"* OK [UIDVALIDITY 7] UIDs valid",
+			"* OK [UIDNEXT 5] Predicted next UID",
+			"* OK [UNSEEN 1] First unseen",
+			"a22 OK [READ-ONLY] SELECT completed",
+		}},
+		{`STORE 1 +FLAGS (\Deleted)`, []string{"a23 NO [READ-ONLY] Folder is read-only"}},
+		{"CLOSE", []string{"a24 OK CLOSE completed"}},
+		{"FETCH 1 (BOGUS)", []string{"a25 NO No folder selected"}},
+		{"BOGUS", []string{"a26 BAD Unknown command BOGUS"}},
+		{"LIST (", []string{"a27 BAD LIST: syntax error"}},
+		{"LOGOUT", []string{"* BYE mecca.local Gomez IMAP signing off", "a28 OK LOGOUT completed"}},
+	} {
+		if got := exchange(t, c, fmt.Sprintf("a%d", i), test.cmd); !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: expected\n%q\ngot\n%q", test.cmd, test.expect, got)
+		}
+	}
+	if !reflect.DeepEqual(removed, []uint64{10}) {
+		t.Errorf("Expected message 10 to be removed, got %v", removed)
+	}
+}
+
+// containsID reports whether ids contains id.
+func containsID(ids []uint64, id uint64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// It should notify idling clients about new messages.
+func TestServer_Session_Idle(t *testing.T) {
+	var removed []uint64
+	mb := testStore(&removed)
+	items := mb.ItemsMock
+	polls := 0
+	mb.ItemsMock = func(addr *mail.Address, folder string, since uint32) ([]*mailbox.FolderItem, error) {
+		if polls++; polls == 3 {
+			return []*mailbox.FolderItem{{Message: &mailbox.Message{ID: 30}, UID: 6}}, nil
+		}
+		return items(addr, folder, since)
+	}
+	c := getTestSession(t, mb, jamon.Group{"idle.poll": "1"})
+	defer c.Close()
+
+	exchange(t, c, "a1", `LOGIN jane@mecca.local "pass word"`)
+	exchange(t, c, "a2", "SELECT INBOX")
+	c.PrintfLine("a3 IDLE")
+	for _, expect := range []string{"+ idling", "* 3 EXISTS"} {
+		if line, err := c.ReadLine(); line != expect {
+			t.Fatalf("Expected %q, got %q (%v)", expect, line, err)
+		}
+	}
+	c.PrintfLine("DONE")
+	if line, _ := c.ReadLine(); line != "a3 OK IDLE terminated" {
+		t.Errorf("Expected IDLE to end, got %q", line)
+	}
+	if got := exchange(t, c, "a4", "UID SEARCH ALL"); got[0] != "* SEARCH 1 4 6" {
+		t.Errorf("Expected new message to be selected, got %q", got)
+	}
+}
+
+// It should log out clients which send nothing in time, also while idling.
+func TestServer_Session_Timeout(t *testing.T) {
+	var removed []uint64
+	c := getTestSession(t, testStore(&removed), jamon.Group{"timeout": "1"})
+	defer c.Close()
+
+	exchange(t, c, "a1", `LOGIN jane@mecca.local "pass word"`)
+	c.PrintfLine("a2 IDLE")
+	start := time.Now()
+	for _, expect := range []string{"+ idling", "* BYE Autologout; idle for too long"} {
+		if line, err := c.ReadLine(); line != expect {
+			t.Fatalf("Expected %q, got %q (%v)", expect, line, err)
+		}
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+		t.Errorf("Session closed after %s", d)
+	}
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestServer_Start_Error(t *testing.T) {
+	if Start(&mailbox.MockStore{}, jamon.Group{"listen": ":1143"}) != ErrMinConfig {
+		t.Error("ErrMinConfig not returned")
+	}
+	if Start(&mailbox.MockStore{}, jamon.Group{"host": "wha", "listen": "bad_addr"}) == nil {
+		t.Error("Expected error")
+	}
+}
+
+// It should stop accepting connections and log out the open sessions, also
+// those which are idling, once the context is done.
+func TestServer_StartContext(t *testing.T) {
+	var removed []uint64
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- StartContext(ctx, testStore(&removed),
+			jamon.Group{"host": "mecca.local", "listen": "127.0.0.1:2143"})
+	}()
+
+	var c *textproto.Conn
+	start := time.Now()
+	for {
+		var err error
+		c, err = textproto.Dial("tcp", "127.0.0.1:2143")
+		if err == nil {
+			if line, _ := c.ReadLine(); !strings.HasPrefix(line, "* OK") {
+				t.Errorf("Bad greeting: %s", line)
+			}
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal(err)
+		}
+	}
+	defer c.Close()
+
+	exchange(t, c, "a1", `LOGIN jane@mecca.local "pass word"`)
+	exchange(t, c, "a2", "SELECT INBOX")
+	c.PrintfLine("a3 IDLE")
+	if line, _ := c.ReadLine(); line != "+ idling" {
+		t.Fatalf("Expected IDLE to start, got %q", line)
+	}
+
+	cancel()
+	if line, _ := c.ReadLine(); line != "* BYE Server shutting down" {
+		t.Errorf("Expected shutdown, got %q", line)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected nil, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Server did not stop")
+	}
+}
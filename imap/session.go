@@ -0,0 +1,195 @@
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+const (
+	// stateNotAuthenticated is the initial state. The client must identify
+	// using LOGIN.
+	stateNotAuthenticated = iota
+	// stateAuthenticated is entered once the client has logged in. A folder
+	// must be selected before its messages can be accessed.
+	stateAuthenticated
+	// stateSelected is entered once a folder is selected.
+	stateSelected
+)
+
+// session holds information about an IMAP session.
+type session struct {
+	// The current state of the session. A session can be in the following
+	// states: stateNotAuthenticated, stateAuthenticated and stateSelected.
+	State int
+	// The authenticated user, or nil.
+	User *mail.Address
+	// The selected folder, or nil.
+	Folder *mailbox.Folder
+	// ReadOnly is true when the folder was selected using EXAMINE.
+	ReadOnly bool
+	// The messages in the selected folder, by sequence number starting at 1.
+	Items []*mailbox.FolderItem
+
+	host    server          // Host server instance
+	text    *textproto.Conn // Textproto wrapper of network connection
+	conn    net.Conn        // Network connection
+	timeout time.Duration   // autologout time, or 0
+}
+
+// maxLiteral is the largest literal accepted within a command.
+const maxLiteral = 64 * 1024
+
+// errLiteral is returned when a literal exceeds maxLiteral.
+var errLiteral = errors.New("literal too large")
+
+// untagged sends an untagged response.
+func (c *session) untagged(format string, args ...interface{}) error {
+	return c.text.PrintfLine("* "+format, args...)
+}
+
+// reply sends the tagged completion result of a command, which is either
+// OK, NO or BAD.
+func (c *session) reply(tag, status, format string, args ...interface{}) error {
+	return c.text.PrintfLine(tag+" "+status+" "+format, args...)
+}
+
+// serve listens for incoming commands and runs them on the host instance.
+// Sessions are logged out when the client sends nothing in time, or when the
+// server shuts down while they are waiting for the client.
+func (c *session) serve() {
+	for {
+		if c.host.active.idle(c) {
+			c.untagged("BYE Server shutting down")
+			return
+		}
+		line, err := c.text.ReadLine()
+		if err == nil {
+			c.host.active.busy(c)
+			err = c.host.run(c, line)
+		}
+		if err != nil {
+			switch {
+			case err == io.EOF:
+			case c.host.active.isClosing():
+				c.untagged("BYE Server shutting down")
+			case isTimeout(err):
+				c.untagged("BYE Autologout; idle for too long")
+			default:
+				log.Printf("Error processing I/O: %s\r\n", err)
+			}
+			return
+		}
+	}
+}
+
+// isTimeout reports whether err was caused by a deadline being exceeded.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// readLiteral reads a literal of the given size and the line which follows
+// it. If sync is true, the client is first asked to send the literal.
+func (c *session) readLiteral(size int, sync bool) (string, string, error) {
+	if size > maxLiteral {
+		if !sync {
+			io.CopyN(ioutil.Discard, c.text.R, int64(size))
+			c.text.ReadLine()
+		}
+		return "", "", errLiteral
+	}
+	if sync {
+		if err := c.text.PrintfLine("+ Ready for literal data"); err != nil {
+			return "", "", err
+		}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.text.R, buf); err != nil {
+		return "", "", err
+	}
+	next, err := c.text.ReadLine()
+	return string(buf), next, err
+}
+
+// update checks the selected folder for new messages and notifies the
+// client about them.
+func (c *session) update() error {
+	if c.State != stateSelected {
+		return nil
+	}
+	var last uint32
+	if n := len(c.Items); n > 0 {
+		last = c.Items[n-1].UID
+	}
+	items, err := c.host.mailbox.Items(c.User, c.Folder.Name, last)
+	if err != nil {
+		log.Printf("error updating %s of %s: %s", c.Folder.Name, c.User.Address, err)
+		return nil
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	c.Items = append(c.Items, items...)
+	c.Folder.UIDNext = items[len(items)-1].UID + 1
+	return c.untagged("%d EXISTS", len(c.Items))
+}
+
+// maxUID returns the largest UID in the selected folder.
+func (c *session) maxUID() uint32 {
+	if len(c.Items) == 0 {
+		return 0
+	}
+	return c.Items[len(c.Items)-1].UID
+}
+
+// selection returns the sequence numbers of the messages which are within
+// the given set. If uid is true, the set holds UIDs.
+func (c *session) selection(set seqSet, uid bool) []int {
+	var list []int
+	for i, item := range c.Items {
+		if uid && set.contains(item.UID, c.maxUID()) ||
+			!uid && set.contains(uint32(i+1), uint32(len(c.Items))) {
+			list = append(list, i+1)
+		}
+	}
+	return list
+}
+
+// systemFlags are the flags which are supported and stored permanently.
+var systemFlags = []string{`\Answered`, `\Flagged`, `\Deleted`, `\Seen`, `\Draft`}
+
+// normalizeFlag returns the canonical form of a system flag. Other flags
+// (keywords) are returned as they are.
+func normalizeFlag(flag string) string {
+	for _, f := range systemFlags {
+		if strings.EqualFold(f, flag) {
+			return f
+		}
+	}
+	return flag
+}
+
+// hasFlag reports whether the item has the given flag.
+func hasFlag(item *mailbox.FolderItem, flag string) bool {
+	for _, f := range item.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// flagList formats a list of flags as an IMAP list.
+func flagList(flags []string) string {
+	return fmt.Sprintf("(%s)", strings.Join(flags, " "))
+}
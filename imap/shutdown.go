@@ -0,0 +1,142 @@
+package imap
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tracker keeps account of the server's open sessions, so that they may be
+// ended when the server shuts down. All methods are safe to call on a nil
+// tracker, in which case they only set the sessions' deadlines.
+type tracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	conns   map[*session]*trackedConn
+	closing bool
+}
+
+// trackedConn is the state of a session, as seen by the tracker.
+type trackedConn struct {
+	conn net.Conn
+	// idle is true while the session is waiting for a command, or for the
+	// end of IDLE.
+	idle bool
+}
+
+func newTracker() *tracker {
+	return &tracker{conns: make(map[*session]*trackedConn)}
+}
+
+// add registers a new connection. It must be called before the session is
+// started, and must be followed by a call to done when it ends.
+func (tr *tracker) add() {
+	if tr == nil {
+		return
+	}
+	tr.wg.Add(1)
+}
+
+// track starts watching the session's connection.
+func (tr *tracker) track(c *session) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.conns[c] = &trackedConn{conn: c.conn}
+}
+
+// done marks the session as ended.
+func (tr *tracker) done(c *session) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	delete(tr.conns, c)
+	tr.mu.Unlock()
+	tr.wg.Done()
+}
+
+// idle marks the session as waiting for the client and gives the client the
+// session's timeout to send it. It reports whether the server is shutting
+// down, in which case the read fails right away.
+func (tr *tracker) idle(c *session) bool {
+	if tr != nil {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		if tc, ok := tr.conns[c]; ok {
+			tc.idle = true
+		}
+		if tr.closing {
+			c.conn.SetReadDeadline(time.Now())
+			return true
+		}
+	}
+	var d time.Time
+	if c.timeout > 0 {
+		d = time.Now().Add(c.timeout)
+	}
+	c.conn.SetReadDeadline(d)
+	return false
+}
+
+// busy marks the session as processing a command.
+func (tr *tracker) busy(c *session) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tc, ok := tr.conns[c]; ok {
+		tc.idle = false
+	}
+}
+
+// isClosing reports whether the server is shutting down.
+func (tr *tracker) isClosing() bool {
+	if tr == nil {
+		return false
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.closing
+}
+
+// shutdown ends all sessions. Sessions waiting for the client are interrupted
+// right away, while those processing a command (such as reading a literal)
+// are given until the grace period expires to finish. Connections which are
+// still open shortly after that are closed. It returns once all sessions have
+// ended.
+func (tr *tracker) shutdown(grace time.Duration) {
+	if tr == nil {
+		return
+	}
+	deadline := time.Now().Add(grace)
+	tr.mu.Lock()
+	tr.closing = true
+	for _, tc := range tr.conns {
+		if tc.idle {
+			tc.conn.SetReadDeadline(time.Now())
+		} else {
+			tc.conn.SetDeadline(deadline)
+		}
+	}
+	tr.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		tr.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(grace + time.Second):
+		tr.mu.Lock()
+		for _, tc := range tr.conns {
+			tc.conn.Close()
+		}
+		tr.mu.Unlock()
+		<-finished
+	}
+}
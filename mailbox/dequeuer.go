@@ -1,8 +1,11 @@
-// This is still a draft. Work in progress.
 package mailbox
 
 import (
+	"database/sql"
+	"errors"
+	"log"
 	"net/mail"
+	"time"
 
 	"github.com/lib/pq"
 )
@@ -11,27 +14,61 @@ import (
 // retrieved when dequeing.
 var MaxHostsPerDequeue = 50
 
+// LeaseDuration is the time for which dequeued items are reserved for the
+// dequeuing agent. If the agent does not report back within this time, the
+// items become available to other agents again.
+var LeaseDuration = 15 * time.Minute
+
+// RetryInterval is the time to wait before the first retry of a delivery
+// that failed temporarily. Every subsequent attempt doubles the wait, up
+// to MaxRetryInterval.
+var (
+	RetryInterval    = 5 * time.Minute
+	MaxRetryInterval = 4 * time.Hour
+)
+
+// QueueLifetime is the time after which a message which could not be
+// delivered is given up on and returned to its sender, as suggested by
+// RFC 5321 4.5.4.1.
+var QueueLifetime = 5 * 24 * time.Hour
+
+// maxBackoff is the largest number of doublings of RetryInterval, which
+// keeps the wait from overflowing before MaxRetryInterval is applied.
+const maxBackoff = 30
+
 // A Package is a set of messages mapped to the recipients that
 // they need to be delivered to.
 type Package map[*Message][]*mail.Address
 
+// Dequeuer is used by the delivery agent to retrieve jobs from the queue
+// and to report their outcome.
 type Dequeuer interface {
 	// Dequeue pulls up to n hosts for delivery and sorts them
 	// mapped by the host to package.
 	Dequeue() (map[string]Package, error)
-
+	// Retry reschedules a delivery that failed temporarily.
 	Retry(id uint64, list []*mail.Address, reason error)
+	// Failed removes a delivery that failed permanently and notifies
+	// the sender.
 	Failed(id uint64, list []*mail.Address, reason error)
-	Delivered(id uint64, list []*mail.Address)
+	// Delivered marks a delivery as successful. Forwarded reports whether
+	// the notification requests were passed on to the receiving host.
+	Delivered(id uint64, list []*mail.Address, forwarded bool)
+	// Flush commits all deliveries marked as successful.
 	Flush()
+	// ReportDMARC sends the aggregate reports of the DMARC results recorded
+	// since the last reports, once the given interval has passed since them.
+	ReportDMARC(interval time.Duration) error
 }
 
 // Dequeue returns jobs from the queue. It maps hosts to the packages
 // that need to be delivered to them. If anything goes wrong, Dequeue
 // returns an error. Dequeue will never return more hosts than the
-// current MaxHostsPerDequeue value.
+// current MaxHostsPerDequeue value. Returned jobs are leased for
+// LeaseDuration, so that other agents sharing the queue skip them.
 func (mb mailBox) Dequeue() (map[string]Package, error) {
-	rows, err := mb.dequeueStmt.Query(MaxHostsPerDequeue)
+	rows, err := mb.dequeueStmt.Query(
+		MaxHostsPerDequeue, mb.owner, LeaseDuration.Seconds())
 	if err != nil {
 		return nil, err
 	}
@@ -40,14 +77,19 @@ func (mb mailBox) Dequeue() (map[string]Package, error) {
 	cache := make(map[uint64]*Message)
 	for rows.Next() {
 		var row struct {
-			User, Host  string
-			Date        pq.NullTime
-			Attempts    int
-			MID         uint64
-			MRaw, MFrom string
+			User, Host     string
+			Date           pq.NullTime
+			Attempts       int
+			Notify, ORcpt  string
+			MID            uint64
+			MRaw, MFrom    string
+			MRet, MEnvID   string
+			MUTF8, MBinary bool
+			MAuthservID    string
 		}
 		err := rows.Scan(&row.Host, &row.MID, &row.User, &row.Date,
-			&row.Attempts, &row.MRaw, &row.MFrom)
+			&row.Attempts, &row.Notify, &row.ORcpt,
+			&row.MRaw, &row.MFrom, &row.MRet, &row.MEnvID, &row.MUTF8, &row.MBinary, &row.MAuthservID)
 		if err != nil {
 			return jobs, err
 		}
@@ -57,10 +99,15 @@ func (mb mailBox) Dequeue() (map[string]Package, error) {
 		msg, ok := cache[row.MID]
 		if !ok {
 			msg = &Message{
-				ID:  row.MID,
-				Raw: row.MRaw,
+				ID:         row.MID,
+				Raw:        row.MRaw,
+				Ret:        row.MRet,
+				EnvID:      row.MEnvID,
+				UTF8:       row.MUTF8,
+				Binary:     row.MBinary,
+				AuthservID: row.MAuthservID,
 			}
-			addr, err := mail.ParseAddress(row.MFrom)
+			addr, err := ParsePath(row.MFrom)
 			if err != nil {
 				return nil, err
 			}
@@ -70,22 +117,345 @@ func (mb mailBox) Dequeue() (map[string]Package, error) {
 		if jobs[row.Host][msg] == nil {
 			jobs[row.Host][msg] = make([]*mail.Address, 0, 1)
 		}
-		dest, err := mail.ParseAddress(row.User + "@" + row.Host)
-		if err != nil {
-			return nil, err
-		}
+		// The user was taken from a parsed address, but may not be valid
+		// on its own when it was quoted or contains UTF-8.
+		dest := &mail.Address{Address: row.User + "@" + row.Host}
+		msg.SetRcptDSN(dest, RcptDSN{row.Notify, row.ORcpt})
 		jobs[row.Host][msg] = append(jobs[row.Host][msg], dest)
 	}
 	return jobs, nil
 }
 
+// Retry reschedules delivery of message id to the given recipients, using
+// exponential backoff based on the number of previous attempts. The reason
+// is stored as the queue item's last error and the lease is released. On
+// the first retry, recipients which requested it are reported as delayed.
+// Recipients which have been queued for longer than QueueLifetime have
+// failed instead.
 func (mb *mailBox) Retry(id uint64, list []*mail.Address, reason error) {
+	q := &queueUpdate{id: id, rcpt: list, reason: reason, owner: mb.owner, action: actionDelayed}
+	if err := mb.newTransaction(q).do(scheduleRetry, loadReported); err != nil {
+		log.Printf("error scheduling retry for message %d: %s", id, err)
+		return
+	}
+	mb.notify(q)
+	if len(q.expired) > 0 {
+		mb.Failed(id, q.expired, expiredError{reason})
+	}
+}
+
+// expiredError is the reason reported for recipients of messages which were
+// not delivered within QueueLifetime. It holds the last error.
+type expiredError struct{ last error }
+
+func (e expiredError) Error() string {
+	msg := "4.4.7 Delivery time expired"
+	if e.last != nil {
+		msg += ", last error: " + e.last.Error()
+	}
+	return msg
+}
+
+// queueUpdate is the context of a dataTransaction which modifies the
+// queue items of a message.
+type queueUpdate struct {
+	id     uint64
+	rcpt   []*mail.Address
+	reason error
+	owner  string // lease owner
+
+	// action is the delivery status notification action which the update
+	// reports to the recipients in notify, who requested it. It is empty
+	// if no notifications are sent. The reported message is loaded into
+	// msg by loadReported.
+	action string
+	notify []*mail.Address
+	msg    *Message
+	dsn    map[string]RcptDSN
+
+	// expired holds the recipients of a retry which are past QueueLifetime.
+	expired []*mail.Address
+}
+
+// reset discards the recipients recorded by an earlier attempt of the
+// transaction, which was rolled back.
+func (q *queueUpdate) reset() {
+	q.notify, q.dsn, q.msg, q.expired = nil, nil, nil, nil
 }
 
+// record adds rcpt to the reported recipients if it requested to be notified
+// about the update's action.
+func (q *queueUpdate) record(rcpt *mail.Address, dsn RcptDSN) {
+	if q.action == "" || !dsn.Wants(notifyEvent(q.action)) {
+		return
+	}
+	if q.dsn == nil {
+		q.dsn = make(map[string]RcptDSN)
+	}
+	q.notify = append(q.notify, rcpt)
+	q.dsn[rcpt.Address] = dsn
+}
+
+// scheduleRetry is a dataTransaction action that increments the attempts and
+// sets the next attempt for each queue item of a queueUpdate. Items which are
+// retried for the first time are recorded for notification, and those which
+// are past QueueLifetime are recorded as expired.
+func scheduleRetry(tx *sql.Tx, ctx interface{}) error {
+	q, ok := ctx.(*queueUpdate)
+	if !ok {
+		return errors.New("Expecting *queueUpdate in func scheduleRetry.")
+	}
+	q.reset()
+	stmt, err := tx.Prepare(`
+		UPDATE queue SET
+			attempts = COALESCE(attempts, 0) + 1,
+			last_error = $4,
+			next_attempt = NOW() + LEAST(
+				$5 * power(2, LEAST(COALESCE(attempts, 0), $8)), $6) * interval '1 second',
+			lease_owner = NULL,
+			lease_expires = NULL
+		WHERE message_id=$1 AND "user"=$2 AND host=$3
+		AND (lease_owner IS NULL OR lease_owner=$7)
+		RETURNING attempts, notify, orcpt, date_added < NOW() - $9 * interval '1 second'`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var reason string
+	if q.reason != nil {
+		reason = q.reason.Error()
+	}
+	for _, rcpt := range q.rcpt {
+		var (
+			attempts int
+			dsn      RcptDSN
+			expired  bool
+		)
+		u, h := SplitUserHost(rcpt)
+		err = stmt.QueryRow(q.id, u, h, reason,
+			RetryInterval.Seconds(), MaxRetryInterval.Seconds(), q.owner,
+			maxBackoff, QueueLifetime.Seconds()).
+			Scan(&attempts, &dsn.Notify, &dsn.ORcpt, &expired)
+		switch {
+		case err == sql.ErrNoRows:
+			continue
+		case err != nil:
+			return err
+		case expired:
+			q.expired = append(q.expired, rcpt)
+		case attempts == 1:
+			q.record(rcpt, dsn)
+		}
+	}
+	return nil
+}
+
+// Failed removes message id from the queue for the given recipients and sends
+// a delivery status notification back to the sender for those recipients that
+// requested it, unless the message was itself a notification (it has a null
+// Return-Path).
 func (mb *mailBox) Failed(id uint64, list []*mail.Address, reason error) {
+	q := &queueUpdate{id: id, rcpt: list, reason: reason, owner: mb.owner, action: actionFailed}
+	if err := mb.newTransaction(q).do(removeQueued, loadReported, collectGarbage); err != nil {
+		log.Printf("error removing failed message %d: %s", id, err)
+		return
+	}
+	mb.notify(q)
+}
+
+// loadReported is a dataTransaction action that loads the message of one or
+// more queueUpdates which have recipients to notify. It must run before the
+// message is garbage collected. Notifications are never sent about messages
+// with a null Return-Path.
+func loadReported(tx *sql.Tx, ctx interface{}) error {
+	var list []*queueUpdate
+	switch q := ctx.(type) {
+	case *queueUpdate:
+		list = []*queueUpdate{q}
+	case []*queueUpdate:
+		list = q
+	default:
+		return errors.New("Expecting *queueUpdate or []*queueUpdate in func loadReported.")
+	}
+	for _, q := range list {
+		if len(q.notify) == 0 {
+			continue
+		}
+		var from string
+		msg := &Message{ID: q.id}
+		err := tx.
+			QueryRow(`SELECT "from", raw, ret, envid FROM messages WHERE id=$1`, q.id).
+			Scan(&from, &msg.Raw, &msg.Ret, &msg.EnvID)
+		if err != nil {
+			return err
+		}
+		addr, err := ParsePath(from)
+		if err != nil {
+			return err
+		}
+		if IsNullPath(addr) {
+			q.notify = nil
+			continue
+		}
+		msg.SetFrom(addr)
+		for _, rcpt := range q.notify {
+			msg.SetRcptDSN(rcpt, q.dsn[rcpt.Address])
+		}
+		q.msg = msg
+	}
+	return nil
+}
+
+// notify sends the delivery status notification of a committed queueUpdate
+// to the sender, if any of its recipients requested it.
+func (mb *mailBox) notify(q *queueUpdate) {
+	if q.msg == nil || len(q.notify) == 0 {
+		return
+	}
+	err := mb.report(deliveryReport{
+		msg:    q.msg,
+		rcpt:   q.notify,
+		action: q.action,
+		reason: q.reason,
+		date:   time.Now(),
+	})
+	if err != nil {
+		log.Printf("error reporting message %d as %s to %s: %s", q.id, q.action, q.msg.From(), err)
+	}
+}
+
+// report enqueues a delivery status notification addressed to the Return-Path
+// of the reported message.
+func (mb *mailBox) report(r deliveryReport) error {
+	id, err := mb.GUID()
+	if err != nil {
+		return err
+	}
+	dsn := &Message{ID: id, Raw: r.compose(id), UTF8: !IsASCII(r.msg.From().Address)}
+	dsn.SetFrom(new(mail.Address))
+	switch rcpt := r.msg.From(); mb.Query(rcpt) {
+	case QuerySuccess:
+		dsn.AddInbound(rcpt)
+	case QueryNotLocal:
+		dsn.AddOutbound(rcpt)
+	case QueryNotFound:
+		return errors.New("no such local user")
+	default:
+		return errors.New("error querying for address")
+	}
+	return mb.Enqueue(dsn)
+}
+
+// removeQueued is a dataTransaction action that deletes the queue items of
+// a queueUpdate and records them for notification. Items leased by another
+// agent are left alone.
+func removeQueued(tx *sql.Tx, ctx interface{}) error {
+	q, ok := ctx.(*queueUpdate)
+	if !ok {
+		return errors.New("Expecting *queueUpdate in func removeQueued.")
+	}
+	q.reset()
+	stmt, err := tx.Prepare(`
+		DELETE FROM queue WHERE message_id=$1 AND "user"=$2 AND host=$3
+		AND (lease_owner IS NULL OR lease_owner=$4)
+		RETURNING notify, orcpt`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, rcpt := range q.rcpt {
+		var dsn RcptDSN
+		u, h := SplitUserHost(rcpt)
+		err = stmt.QueryRow(q.id, u, h, q.owner).Scan(&dsn.Notify, &dsn.ORcpt)
+		switch {
+		case err == sql.ErrNoRows:
+			continue
+		case err != nil:
+			return err
+		}
+		q.record(rcpt, dsn)
+	}
+	return nil
+}
+
+// Delivered marks message id as delivered to the given recipients. The
+// queue is not updated until Flush is called. Unless the notification
+// requests were forwarded to the receiving host, recipients which asked
+// for it are reported as relayed once flushed.
+func (mb *mailBox) Delivered(id uint64, list []*mail.Address, forwarded bool) {
+	q := &queueUpdate{id: id, rcpt: list, owner: mb.owner, action: actionRelayed}
+	if forwarded {
+		q.action = ""
+	}
+	mb.delivered.Lock()
+	defer mb.delivered.Unlock()
+	mb.delivered.items = append(mb.delivered.items, q)
+}
+
+// Flush removes all messages marked as delivered from the queue within a
+// single transaction. Messages that are no longer referenced by the queue
+// or by any inbox are deleted.
+func (mb *mailBox) Flush() {
+	mb.delivered.Lock()
+	defer mb.delivered.Unlock()
+	if len(mb.delivered.items) == 0 {
+		return
+	}
+	err := mb.newTransaction(mb.delivered.items).do(removeDelivered, loadReported, collectGarbage)
+	if err != nil {
+		log.Printf("error flushing delivered messages: %s", err)
+		return
+	}
+	for _, q := range mb.delivered.items {
+		mb.notify(q)
+	}
+	mb.delivered.items = nil
 }
 
-func (mb *mailBox) Delivered(id uint64, list []*mail.Address) {
+// removeDelivered is a dataTransaction action that deletes the queue items
+// of a list of queueUpdates.
+func removeDelivered(tx *sql.Tx, ctx interface{}) error {
+	list, ok := ctx.([]*queueUpdate)
+	if !ok {
+		return errors.New("Expecting []*queueUpdate in func removeDelivered.")
+	}
+	for _, q := range list {
+		if err := removeQueued(tx, q); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (mb *mailBox) Flush() {}
+// collectGarbage is a dataTransaction action that deletes the messages of
+// one or more queueUpdates, or of an inboxUpdate, when they are not referenced
+// by the queue or by any inbox anymore.
+func collectGarbage(tx *sql.Tx, ctx interface{}) error {
+	var ids []uint64
+	switch q := ctx.(type) {
+	case *queueUpdate:
+		ids = []uint64{q.id}
+	case []*queueUpdate:
+		for _, u := range q {
+			ids = append(ids, u.id)
+		}
+	case *inboxUpdate:
+		ids = q.ids
+	default:
+		return errors.New("Expecting *queueUpdate, []*queueUpdate or *inboxUpdate in func collectGarbage.")
+	}
+	stmt, err := tx.Prepare(`
+		DELETE FROM messages WHERE id=$1
+		AND NOT EXISTS (SELECT 1 FROM queue WHERE message_id=$1)
+		AND NOT EXISTS (SELECT 1 FROM mailbox WHERE message_id=$1)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range ids {
+		if _, err = stmt.Exec(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,19 +1,40 @@
 package mailbox
 
-import "net/mail"
+import (
+	"net/mail"
+	"time"
+)
 
-//var _ Dequeuer = (*MockDequeuer)(nil)
+var _ Dequeuer = (*MockDequeuer)(nil)
 
 // MockDequeuer is a configurable mock for the Dequeuer interface.
 type MockDequeuer struct {
-	DequeueMock func() (map[string]Package, error)
-	ReportMock  func(id uint64, succeeded []*mail.Address, failed []*mail.Address) error
+	DequeueMock     func() (map[string]Package, error)
+	RetryMock       func(id uint64, list []*mail.Address, reason error)
+	FailedMock      func(id uint64, list []*mail.Address, reason error)
+	DeliveredMock   func(id uint64, list []*mail.Address, forwarded bool)
+	FlushMock       func()
+	ReportDMARCMock func(interval time.Duration) error
 }
 
 func (m MockDequeuer) Dequeue() (map[string]Package, error) {
 	return m.DequeueMock()
 }
 
-func (m MockDequeuer) Report(id uint64, succeeded []*mail.Address, failed []*mail.Address) error {
-	return m.ReportMock(id, succeeded, failed)
+func (m MockDequeuer) Retry(id uint64, list []*mail.Address, reason error) {
+	m.RetryMock(id, list, reason)
+}
+
+func (m MockDequeuer) Failed(id uint64, list []*mail.Address, reason error) {
+	m.FailedMock(id, list, reason)
+}
+
+func (m MockDequeuer) Delivered(id uint64, list []*mail.Address, forwarded bool) {
+	m.DeliveredMock(id, list, forwarded)
+}
+
+func (m MockDequeuer) Flush() { m.FlushMock() }
+
+func (m MockDequeuer) ReportDMARC(interval time.Duration) error {
+	return m.ReportDMARCMock(interval)
 }
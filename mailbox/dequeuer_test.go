@@ -1,11 +1,16 @@
 package mailbox
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/mail"
+	"net/textproto"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Maps message to destination by ID.
@@ -148,6 +153,10 @@ func TestDequeuer_Dequeue(t *testing.T) {
 	} {
 		setupDequeuerTest(pb, ts.msgSetup)
 		for _, tt := range ts.want {
+			// Release leases from the previous run
+			if _, err := pb.db.Exec(`UPDATE queue SET lease_owner=NULL, lease_expires=NULL`); err != nil {
+				t.Fatalf("error releasing leases: %s", err)
+			}
 			MaxHostsPerDequeue = tt.N
 			jobs, err := pb.Dequeue()
 			if tt.HasErr {
@@ -280,3 +289,469 @@ func setupDequeuerTest(mb *mailBox, msgs []queueItem) {
 		chk(err)
 	}
 }
+
+func TestDequeuer_Retry(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb.Close()
+
+	setupDequeuerTest(pb, []queueItem{
+		{1, "jane@doe.com", "12:00"},
+		{1, "adam@doe.com", "12:00"},
+		{2, "jim@bree.com", "12:01"},
+	})
+
+	RetryInterval, MaxRetryInterval = time.Minute, 3*time.Minute
+	reason := errors.New("451 4.3.0 Try again later")
+
+	type row struct {
+		Attempts  int
+		LastError string
+		Wait      time.Duration
+	}
+	getRow := func(mid uint64, user, host string) row {
+		var r row
+		var wait float64
+		err := pb.db.QueryRow(`
+			SELECT attempts, last_error, EXTRACT(EPOCH FROM next_attempt - NOW())
+			FROM queue WHERE message_id=$1 AND "user"=$2 AND host=$3`,
+			mid, user, host).Scan(&r.Attempts, &r.LastError, &wait)
+		if err != nil {
+			t.Fatalf("error reading queue row: %s", err)
+		}
+		r.Wait = time.Duration(wait) * time.Second
+		return r
+	}
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		pb.Retry(1, addrList("jane@doe.com"), reason)
+		got := getRow(1, "jane", "doe.com")
+		if got.LastError != reason.Error() {
+			t.Errorf("Expected last error '%s', got '%s'", reason, got.LastError)
+		}
+		if got.Wait < want-5*time.Second || got.Wait > want {
+			t.Errorf("After %d attempts expected wait of %s, got %s", got.Attempts, want, got.Wait)
+		}
+	}
+	if got := getRow(1, "jane", "doe.com"); got.Attempts != 4 {
+		t.Errorf("Expected 4 attempts, got %d", got.Attempts)
+	}
+
+	// The wait does not overflow after many attempts.
+	if _, err := pb.db.Exec(`UPDATE queue SET attempts=5000 WHERE message_id=1 AND "user"='jane'`); err != nil {
+		t.Fatalf("error setting attempts: %s", err)
+	}
+	pb.Retry(1, addrList("jane@doe.com"), reason)
+	if got := getRow(1, "jane", "doe.com"); got.Wait < MaxRetryInterval-5*time.Second {
+		t.Errorf("Expected wait of %s, got %s", MaxRetryInterval, got.Wait)
+	}
+
+	// Items that are waiting for a retry must not be dequeued.
+	MaxHostsPerDequeue = 50
+	jobs, err := pb.Dequeue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := map[string]PackageByID{
+		"doe.com":  PackageByID{1: addrList("adam@doe.com")},
+		"bree.com": PackageByID{2: addrList("jim@bree.com")},
+	}
+	if got, same := compareResults(jobs, want); !same {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+
+	// Items queued for longer than QueueLifetime fail instead.
+	pb.Flush()
+	_, err = pb.db.Exec(`UPDATE queue SET date_added=NOW() - interval '6 days', lease_owner=NULL`)
+	if err != nil {
+		t.Fatalf("error aging queue: %s", err)
+	}
+	pb.Retry(2, addrList("jim@bree.com"), reason)
+	var n int
+	if err := pb.db.QueryRow(`SELECT COUNT(*) FROM queue WHERE message_id=2`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("Expected expired item to be removed, got %d (%v)", n, err)
+	}
+}
+
+func TestExpiredError(t *testing.T) {
+	err := expiredError{errors.New("451 4.3.0 Try again later")}
+	r := deliveryReport{action: actionFailed, reason: err}
+	if r.status() != "4.4.7" || !strings.HasSuffix(err.Error(), "last error: 451 4.3.0 Try again later") {
+		t.Errorf("Unexpected status %s for %q", r.status(), err)
+	}
+}
+
+func TestDequeuer_Failed(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb.Close()
+
+	setupDequeuerTest(pb, []queueItem{
+		{1, "jane@doe.com", "12:00"},
+		{1, "adam@doe.com", "12:00"},
+	})
+	_, err = pb.db.Exec(`
+		INSERT INTO users (id, username, host) VALUES (1, 'from', 'addre.ss');
+		INSERT INTO messages VALUES (2, '<>', 'bob@doe.com', 'BOUNCE');
+		INSERT INTO queue VALUES ('doe.com', 2, 'bob', NOW(), 0);`)
+	if err != nil {
+		t.Fatalf("error setting up test: %s", err)
+	}
+
+	countRows := func(query string, args ...interface{}) int {
+		var n int
+		if err := pb.db.QueryRow(query, args...).Scan(&n); err != nil {
+			t.Fatalf("error counting rows: %s", err)
+		}
+		return n
+	}
+
+	pb.Failed(1, addrList("jane@doe.com"), &textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+	if n := countRows(`SELECT COUNT(*) FROM queue WHERE message_id=1`); n != 1 {
+		t.Errorf("Expected 1 queue item left for message 1, got %d", n)
+	}
+
+	// The sender is local, so the report is delivered to its inbox.
+	var raw, from string
+	err = pb.db.QueryRow(`
+		SELECT raw, "from" FROM messages
+		INNER JOIN mailbox ON mailbox.message_id=messages.id
+		WHERE mailbox.user_id=1`).Scan(&raw, &from)
+	if err != nil {
+		t.Fatalf("Expected bounce in sender's inbox: %s", err)
+	}
+	if from != "<>" || !strings.Contains(raw, "Final-Recipient: rfc822; jane@doe.com") {
+		t.Errorf("Bad bounce from %s: %s", from, raw)
+	}
+
+	// Notifications are never bounced.
+	pb.Failed(2, addrList("bob@doe.com"), &textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+	if n := countRows(`SELECT COUNT(*) FROM queue WHERE message_id=2`); n != 0 {
+		t.Errorf("Expected no queue items for message 2, got %d", n)
+	}
+	if n := countRows(`SELECT COUNT(*) FROM mailbox`); n != 1 {
+		t.Errorf("Expected only one bounce, got %d", n)
+	}
+}
+
+// It should notify the sender according to the requests of each recipient.
+func TestDequeuer_Notify(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb.Close()
+
+	setupDequeuerTest(pb, []queueItem{
+		{1, "jane@doe.com", "12:00"},
+		{1, "adam@doe.com", "12:00"},
+		{1, "jim@bree.com", "12:00"},
+		{1, "ann@bree.com", "12:00"},
+	})
+	_, err = pb.db.Exec(`
+		INSERT INTO users (id, username, host) VALUES (1, 'from', 'addre.ss');
+		UPDATE messages SET ret='FULL', envid='QQ314' WHERE id=1;
+		UPDATE queue SET notify='NEVER' WHERE "user"='jane';
+		UPDATE queue SET notify='DELAY,FAILURE' WHERE "user"='adam';
+		UPDATE queue SET notify='SUCCESS', orcpt='rfc822;jim@bree.com' WHERE "user"='jim';
+		UPDATE queue SET notify='SUCCESS' WHERE "user"='ann';`)
+	if err != nil {
+		t.Fatalf("error setting up test: %s", err)
+	}
+
+	reports := func() []string {
+		var list []string
+		rows, err := pb.db.Query(`
+			SELECT raw FROM messages
+			INNER JOIN mailbox ON mailbox.message_id=messages.id
+			WHERE mailbox.user_id=1 ORDER BY messages.id`)
+		if err != nil {
+			t.Fatalf("error reading reports: %s", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var raw string
+			rows.Scan(&raw)
+			list = append(list, raw)
+		}
+		return list
+	}
+
+	reason := &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}
+	pb.Failed(1, addrList("jane@doe.com"), reason)
+	if n := len(reports()); n != 0 {
+		t.Errorf("Expected no report for NOTIFY=NEVER, got %d", n)
+	}
+
+	pb.Retry(1, addrList("adam@doe.com"), errors.New("timeout"))
+	pb.Retry(1, addrList("adam@doe.com"), errors.New("timeout"))
+	if r := reports(); len(r) != 1 || !strings.Contains(r[0], "Action: delayed") {
+		t.Fatalf("Expected a single delay report, got %q", r)
+	}
+
+	pb.Failed(1, addrList("adam@doe.com"), reason)
+	r := reports()
+	if len(r) != 2 || !strings.Contains(r[1], "Action: failed") ||
+		!strings.Contains(r[1], "Content-Type: message/rfc822") {
+		t.Fatalf("Expected a failure report with the full message, got %q", r)
+	}
+
+	pb.Delivered(1, addrList("jim@bree.com"), false)
+	pb.Delivered(1, addrList("ann@bree.com"), true)
+	pb.Flush()
+	r = reports()
+	if len(r) != 3 {
+		t.Fatalf("Expected a single success report, got %q", r)
+	}
+	for _, want := range []string{
+		"Original-Envelope-Id: QQ314",
+		"Original-Recipient: rfc822;jim@bree.com",
+		"Action: relayed",
+	} {
+		if !strings.Contains(r[2], want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, r[2])
+		}
+	}
+	if strings.Contains(r[2], "ann@bree.com") {
+		t.Errorf("Did not expect report for forwarded recipient:\n%s", r[2])
+	}
+}
+
+func TestDequeuer_Dequeue_NullPath(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb.Close()
+
+	CleanDB(pb.db)
+	_, err = pb.db.Exec(`
+		INSERT INTO messages VALUES (2, '<>', 'bob@doe.com', 'BOUNCE');
+		INSERT INTO queue VALUES ('doe.com', 2, 'bob', NOW(), 0);`)
+	if err != nil {
+		t.Fatalf("error setting up test: %s", err)
+	}
+
+	MaxHostsPerDequeue = 1
+	jobs, err := pb.Dequeue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for msg := range jobs["doe.com"] {
+		if !IsNullPath(msg.From()) {
+			t.Errorf("Expected null path, got %s", msg.From())
+		}
+		return
+	}
+	t.Error("Message with null path was not dequeued")
+}
+
+func TestDequeuer_Delivered_Flush(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb.Close()
+
+	setupDequeuerTest(pb, []queueItem{
+		{1, "jane@doe.com", "12:00"},
+		{1, "adam@doe.com", "12:00"},
+		{2, "jim@bree.com", "12:01"},
+		{3, "ann@bree.com", "12:02"},
+	})
+	_, err = pb.db.Exec(`
+		INSERT INTO users (id, username, host) VALUES (1, 'ann', 'local.host');
+		INSERT INTO mailbox VALUES (1, 3);`)
+	if err != nil {
+		t.Fatalf("error setting up test: %s", err)
+	}
+
+	countRows := func(query string) int {
+		var n int
+		if err := pb.db.QueryRow(query).Scan(&n); err != nil {
+			t.Fatalf("error counting rows: %s", err)
+		}
+		return n
+	}
+
+	pb.Delivered(1, addrList("jane@doe.com"), false)
+	pb.Delivered(2, addrList("jim@bree.com"), false)
+	pb.Delivered(3, addrList("ann@bree.com"), false)
+	if n := countRows(`SELECT COUNT(*) FROM queue`); n != 4 {
+		t.Errorf("Expected queue to be untouched before Flush, got %d items", n)
+	}
+
+	pb.Flush()
+	if n := countRows(`SELECT COUNT(*) FROM queue`); n != 1 {
+		t.Errorf("Expected 1 queue item after Flush, got %d", n)
+	}
+	if len(pb.delivered.items) != 0 {
+		t.Errorf("Expected buffer to be emptied, got %d items", len(pb.delivered.items))
+	}
+
+	// Message 1 is still queued and message 3 is still in an inbox.
+	for id, want := range map[int]int{1: 1, 2: 0, 3: 1} {
+		n := countRows(fmt.Sprintf(`SELECT COUNT(*) FROM messages WHERE id=%d`, id))
+		if n != want {
+			t.Errorf("Expected %d rows for message %d, got %d", want, id, n)
+		}
+	}
+
+	// Flushing again is a no-op.
+	pb.Flush()
+}
+
+// It should not report recipients twice when a flush is retried after its
+// transaction was rolled back.
+func TestDequeuer_Flush_Rollback(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb.Close()
+
+	setupDequeuerTest(pb, []queueItem{{1, "jim@bree.com", "12:00"}})
+	if _, err = pb.db.Exec(`UPDATE queue SET notify='SUCCESS'`); err != nil {
+		t.Fatalf("error setting up test: %s", err)
+	}
+
+	list := []*queueUpdate{{id: 1, rcpt: addrList("jim@bree.com"), owner: pb.owner, action: actionRelayed}}
+	tx, err := pb.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := removeDelivered(tx, list); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	if err := pb.newTransaction(list).do(removeDelivered, loadReported); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(list[0].notify); n != 1 {
+		t.Errorf("Expected 1 recipient to notify, got %d", n)
+	}
+}
+
+func TestDequeuer_Mock(t *testing.T) {
+	var called []string
+	var dq Dequeuer = &MockDequeuer{
+		DequeueMock:   func() (map[string]Package, error) { called = append(called, "Dequeue"); return nil, nil },
+		RetryMock:     func(uint64, []*mail.Address, error) { called = append(called, "Retry") },
+		FailedMock:    func(uint64, []*mail.Address, error) { called = append(called, "Failed") },
+		DeliveredMock: func(uint64, []*mail.Address, bool) { called = append(called, "Delivered") },
+		FlushMock:     func() { called = append(called, "Flush") },
+		ReportDMARCMock: func(time.Duration) error {
+			called = append(called, "ReportDMARC")
+			return nil
+		},
+	}
+
+	dq.Dequeue()
+	dq.Retry(1, nil, nil)
+	dq.Failed(1, nil, nil)
+	dq.Delivered(1, nil, false)
+	dq.Flush()
+	dq.ReportDMARC(time.Hour)
+
+	if want := []string{"Dequeue", "Retry", "Failed", "Delivered", "Flush", "ReportDMARC"}; !reflect.DeepEqual(called, want) {
+		t.Errorf("Expected calls %v, got %v", want, called)
+	}
+}
+
+func TestDequeuer_Lease(t *testing.T) {
+	EnsureTestDB()
+
+	pb1, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb1.Close()
+	pb2, err := New(dbString)
+	if err != nil {
+		t.Fatalf("error starting server: %s", err)
+	}
+	defer pb2.Close()
+
+	if pb1.owner == pb2.owner {
+		t.Fatalf("Expected distinct owners, got %s", pb1.owner)
+	}
+
+	setupDequeuerTest(pb1, []queueItem{
+		{1, "jane@doe.com", "12:00"},
+		{2, "jim@bree.com", "12:01"},
+	})
+
+	MaxHostsPerDequeue = 1
+	jobs, err := pb1.Dequeue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want := map[string]PackageByID{"doe.com": PackageByID{1: addrList("jane@doe.com")}}
+	if got, same := compareResults(jobs, want); !same {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+
+	// The second agent skips the items leased by the first.
+	MaxHostsPerDequeue = 50
+	jobs, err = pb2.Dequeue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want = map[string]PackageByID{"bree.com": PackageByID{2: addrList("jim@bree.com")}}
+	if got, same := compareResults(jobs, want); !same {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+
+	// Nothing is left for anyone.
+	if jobs, err = pb1.Dequeue(); err != nil || len(jobs) != 0 {
+		t.Errorf("Expected no jobs, got %+v (%v)", jobs, err)
+	}
+
+	// Only the lease owner may reschedule an item.
+	pb2.Retry(1, addrList("jane@doe.com"), errors.New("temporary"))
+	var owner string
+	err = pb1.db.QueryRow(`SELECT lease_owner FROM queue WHERE message_id=1`).Scan(&owner)
+	if err != nil || owner != pb1.owner {
+		t.Errorf("Expected lease to stay with %s, got %s (%v)", pb1.owner, owner, err)
+	}
+
+	// Nor remove it.
+	pb2.Failed(1, addrList("jane@doe.com"), errors.New("permanent"))
+	pb2.Delivered(1, addrList("jane@doe.com"), true)
+	pb2.Flush()
+	var n int
+	if err := pb1.db.QueryRow(`SELECT COUNT(*) FROM queue WHERE message_id=1`).Scan(&n); err != nil || n != 1 {
+		t.Errorf("Expected item to remain queued, got %d (%v)", n, err)
+	}
+
+	// Expired leases (e.g. from a crashed agent) are picked up again.
+	_, err = pb1.db.Exec(`UPDATE queue SET lease_expires=NOW() - interval '1 minute' WHERE message_id=1`)
+	if err != nil {
+		t.Fatalf("error expiring lease: %s", err)
+	}
+	jobs, err = pb2.Dequeue()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	want = map[string]PackageByID{"doe.com": PackageByID{1: addrList("jane@doe.com")}}
+	if got, same := compareResults(jobs, want); !same {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,410 @@
+package mailbox
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DMARCResult holds the outcome of evaluating a received message against
+// the DMARC policy of the domain in its From header, as needed for the
+// aggregate reports of RFC 7489 7.2.
+type DMARCResult struct {
+	// Domain is the domain which published the policy. It is the domain of
+	// the From header or its organizational domain.
+	Domain string
+	// Policy is the policy as published by the domain.
+	Policy DMARCPolicy
+	// RUA holds the addresses which aggregate reports are sent to.
+	RUA []string
+	// SourceIP is the IP address of the client which sent the message.
+	SourceIP string
+	// HeaderFrom and EnvelopeFrom are the domains of the From header and of
+	// the envelope sender.
+	HeaderFrom, EnvelopeFrom string
+	// Disposition is the policy applied to the message: none, quarantine
+	// or reject.
+	Disposition string
+	// DKIM and SPF are pass if the respective check passed for a domain
+	// aligned with the From domain, and fail otherwise.
+	DKIM, SPF string
+	// DKIMAuth holds the results of all DKIM signatures of the message.
+	DKIMAuth []DMARCAuth
+	// SPFAuth holds the result of the SPF check of the sender.
+	SPFAuth DMARCAuth
+	// Date when the message was received.
+	Date time.Time
+}
+
+// DMARCPolicy holds the tags of a published DMARC record, as per RFC 7489
+// 6.3.
+type DMARCPolicy struct {
+	// P and SP are the policies requested for the domain and for its
+	// subdomains: none, quarantine or reject.
+	P, SP string
+	// Pct is the percentage of failing messages to apply the policy to.
+	Pct int
+	// ADKIM and ASPF are the alignment modes, "r" (relaxed) or "s" (strict).
+	ADKIM, ASPF string
+}
+
+// DMARCAuth is the result of a DKIM signature or of an SPF check.
+type DMARCAuth struct {
+	// Domain which was authenticated.
+	Domain string
+	// Selector of the DKIM key, or the scope of the SPF check, which is
+	// mfrom or helo.
+	Selector string
+	// Result of the check, such as pass or fail.
+	Result string
+}
+
+// RecordDMARC stores the result of a DMARC evaluation until it is reported.
+func (mb mailBox) RecordDMARC(r *DMARCResult) error {
+	auth := make([]string, 0, len(r.DKIMAuth))
+	for _, a := range r.DKIMAuth {
+		auth = append(auth, a.Domain+":"+a.Selector+":"+a.Result)
+	}
+	_, err := mb.db.Exec(`
+		INSERT INTO dmarc_results
+		(domain, p, sp, pct, adkim, aspf, rua, source_ip, header_from, envelope_from,
+		disposition, dkim, spf, dkim_auth, spf_domain, spf_scope, spf_result, date_added)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)`,
+		r.Domain, r.Policy.P, r.Policy.SP, r.Policy.Pct, r.Policy.ADKIM, r.Policy.ASPF,
+		strings.Join(r.RUA, ","), r.SourceIP, r.HeaderFrom, r.EnvelopeFrom,
+		r.Disposition, r.DKIM, r.SPF, strings.Join(auth, ","),
+		r.SPFAuth.Domain, r.SPFAuth.Selector, r.SPFAuth.Result, r.Date)
+	return err
+}
+
+// ReportDMARC sends aggregate reports of the DMARC results recorded since
+// the last reports, one for each domain, to the addresses which the domain
+// asked for, once interval has passed since the last reports. The time of
+// the last reports is kept in the database, and reported results are removed
+// in the same transaction which queues the reports, so that they are
+// reported exactly once, even when the reports are sent by several agents.
+func (mb *mailBox) ReportDMARC(interval time.Duration) error {
+	r := &dmarcReporting{mb: mb, now: time.Now(), interval: interval}
+	return mb.newTransaction(r).do(dueDMARC, takeDMARC, enqueueDMARC)
+}
+
+// dmarcReporting is the context of the dataTransaction which sends the
+// aggregate DMARC reports.
+type dmarcReporting struct {
+	mb       *mailBox
+	now      time.Time
+	interval time.Duration
+
+	// due is set by dueDMARC when the reports are to be sent, and results
+	// holds the results to report, oldest first.
+	due     bool
+	results []*DMARCResult
+}
+
+// dueDMARC is a dataTransaction action that locks the time of the last DMARC
+// reports and sets them due if the interval has passed since, recording the
+// current time as the time of the last reports. When no reports were sent
+// before, the current time is recorded and the reports are not due.
+func dueDMARC(tx *sql.Tx, ctx interface{}) error {
+	r, ok := ctx.(*dmarcReporting)
+	if !ok {
+		return errors.New("Expecting *dmarcReporting in func dueDMARC.")
+	}
+	_, err := tx.Exec(`
+		INSERT INTO dmarc_reported (id, last_report) VALUES (1, $1)
+		ON CONFLICT (id) DO NOTHING`, r.now)
+	if err != nil {
+		return err
+	}
+	var last time.Time
+	err = tx.QueryRow(`SELECT last_report FROM dmarc_reported WHERE id=1 FOR UPDATE`).Scan(&last)
+	if err != nil || r.now.Sub(last) < r.interval {
+		return err
+	}
+	r.due = true
+	_, err = tx.Exec(`UPDATE dmarc_reported SET last_report=$1 WHERE id=1`, r.now)
+	return err
+}
+
+// takeDMARC is a dataTransaction action that removes the DMARC results
+// recorded before the reports are due and loads them, oldest first.
+func takeDMARC(tx *sql.Tx, ctx interface{}) error {
+	r, ok := ctx.(*dmarcReporting)
+	if !ok {
+		return errors.New("Expecting *dmarcReporting in func takeDMARC.")
+	}
+	if !r.due {
+		return nil
+	}
+	rows, err := tx.Query(`
+		DELETE FROM dmarc_results WHERE date_added < $1
+		RETURNING domain, p, sp, pct, adkim, aspf, rua, source_ip, header_from, envelope_from,
+		disposition, dkim, spf, dkim_auth, spf_domain, spf_scope, spf_result, date_added`, r.now)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var res DMARCResult
+		var rua, auth string
+		err := rows.Scan(&res.Domain, &res.Policy.P, &res.Policy.SP, &res.Policy.Pct, &res.Policy.ADKIM,
+			&res.Policy.ASPF, &rua, &res.SourceIP, &res.HeaderFrom, &res.EnvelopeFrom, &res.Disposition,
+			&res.DKIM, &res.SPF, &auth, &res.SPFAuth.Domain, &res.SPFAuth.Selector, &res.SPFAuth.Result, &res.Date)
+		if err != nil {
+			return err
+		}
+		res.RUA = splitList(rua)
+		for _, a := range splitList(auth) {
+			if parts := strings.SplitN(a, ":", 3); len(parts) == 3 {
+				res.DKIMAuth = append(res.DKIMAuth, DMARCAuth{parts[0], parts[1], parts[2]})
+			}
+		}
+		r.results = append(r.results, &res)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(r.results, func(i, j int) bool { return r.results[i].Date.Before(r.results[j].Date) })
+	return nil
+}
+
+// enqueueDMARC is a dataTransaction action that queues the reports of the
+// results loaded by takeDMARC. Reports to domains with no deliverable
+// addresses are dropped.
+func enqueueDMARC(tx *sql.Tx, ctx interface{}) error {
+	r, ok := ctx.(*dmarcReporting)
+	if !ok {
+		return errors.New("Expecting *dmarcReporting in func enqueueDMARC.")
+	}
+	for _, rep := range dmarcReports(r.results, r.now) {
+		id, err := r.mb.GUID()
+		if err != nil {
+			return err
+		}
+		msg := &Message{ID: id, Raw: rep.compose(id)}
+		msg.SetFrom(new(mail.Address))
+		for _, addr := range rep.rua {
+			switch rcpt := (&mail.Address{Address: addr}); r.mb.Query(rcpt) {
+			case QuerySuccess:
+				msg.AddInbound(rcpt)
+			case QueryNotLocal:
+				msg.AddOutbound(rcpt)
+			}
+		}
+		if len(msg.Rcpt()) == 0 {
+			continue
+		}
+		for _, action := range []func(*sql.Tx, interface{}) error{
+			storeMessage,
+			enqueueOutbound,
+			deliverInbound,
+		} {
+			if err := action(tx, msg); err != nil {
+				return fmt.Errorf("error reporting DMARC results for %s: %s", rep.domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, which may be empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// dmarcReport holds the results to be reported to a domain.
+type dmarcReport struct {
+	domain     string
+	policy     DMARCPolicy
+	rua        []string
+	begin, end time.Time
+	rows       []*dmarcRow
+}
+
+// dmarcRow is a set of results which only differ in their date.
+type dmarcRow struct {
+	*DMARCResult
+	count int
+}
+
+// dmarcReports groups the results, which are ordered by date, into reports
+// by domain. Each report covers the time from its oldest result to end and
+// uses the most recent policy and addresses of the domain.
+func dmarcReports(results []*DMARCResult, end time.Time) []*dmarcReport {
+	var reports []*dmarcReport
+	byDomain := make(map[string]*dmarcReport)
+	rows := make(map[string]*dmarcRow)
+	for _, r := range results {
+		rep, ok := byDomain[r.Domain]
+		if !ok {
+			rep = &dmarcReport{domain: r.Domain, begin: r.Date, end: end}
+			byDomain[r.Domain] = rep
+			reports = append(reports, rep)
+		}
+		rep.policy, rep.rua = r.Policy, r.RUA
+
+		key := fmt.Sprintf("%s|%s|%s|%s|%s|%s|%s|%v|%v", r.Domain, r.SourceIP,
+			r.Disposition, r.DKIM, r.SPF, r.HeaderFrom, r.EnvelopeFrom, r.DKIMAuth, r.SPFAuth)
+		if row, ok := rows[key]; ok {
+			row.count++
+			continue
+		}
+		row := &dmarcRow{DMARCResult: r, count: 1}
+		rows[key] = row
+		rep.rows = append(rep.rows, row)
+	}
+	return reports
+}
+
+// feedback is the XML form of an aggregate report, as per RFC 7489
+// Appendix C.
+type feedback struct {
+	XMLName  xml.Name `xml:"feedback"`
+	Metadata struct {
+		OrgName   string `xml:"org_name"`
+		Email     string `xml:"email"`
+		ReportID  string `xml:"report_id"`
+		DateRange struct {
+			Begin int64 `xml:"begin"`
+			End   int64 `xml:"end"`
+		} `xml:"date_range"`
+	} `xml:"report_metadata"`
+	Policy struct {
+		Domain string `xml:"domain"`
+		ADKIM  string `xml:"adkim"`
+		ASPF   string `xml:"aspf"`
+		P      string `xml:"p"`
+		SP     string `xml:"sp"`
+		Pct    int    `xml:"pct"`
+	} `xml:"policy_published"`
+	Records []feedbackRecord `xml:"record"`
+}
+
+type feedbackRecord struct {
+	Row struct {
+		SourceIP        string `xml:"source_ip"`
+		Count           int    `xml:"count"`
+		PolicyEvaluated struct {
+			Disposition string `xml:"disposition"`
+			DKIM        string `xml:"dkim"`
+			SPF         string `xml:"spf"`
+		} `xml:"policy_evaluated"`
+	} `xml:"row"`
+	Identifiers struct {
+		EnvelopeFrom string `xml:"envelope_from"`
+		HeaderFrom   string `xml:"header_from"`
+	} `xml:"identifiers"`
+	AuthResults struct {
+		DKIM []feedbackDKIM `xml:"dkim"`
+		SPF  feedbackSPF    `xml:"spf"`
+	} `xml:"auth_results"`
+}
+
+type feedbackDKIM struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type feedbackSPF struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope"`
+	Result string `xml:"result"`
+}
+
+// reportID returns the identifier of the report with the given message ID.
+func (r dmarcReport) reportID(id uint64) string {
+	return fmt.Sprintf("%d.%d@%s", r.end.Unix(), id, Hostname)
+}
+
+// xml returns the XML document of the report.
+func (r dmarcReport) xml(id uint64) []byte {
+	var f feedback
+	f.Metadata.OrgName = Hostname
+	f.Metadata.Email = "postmaster@" + Hostname
+	f.Metadata.ReportID = r.reportID(id)
+	f.Metadata.DateRange.Begin = r.begin.Unix()
+	f.Metadata.DateRange.End = r.end.Unix()
+	f.Policy.Domain = r.domain
+	f.Policy.ADKIM = r.policy.ADKIM
+	f.Policy.ASPF = r.policy.ASPF
+	f.Policy.P = r.policy.P
+	f.Policy.SP = r.policy.SP
+	f.Policy.Pct = r.policy.Pct
+	for _, row := range r.rows {
+		var rec feedbackRecord
+		rec.Row.SourceIP = row.SourceIP
+		rec.Row.Count = row.count
+		rec.Row.PolicyEvaluated.Disposition = row.Disposition
+		rec.Row.PolicyEvaluated.DKIM = row.DKIM
+		rec.Row.PolicyEvaluated.SPF = row.SPF
+		rec.Identifiers.EnvelopeFrom = row.EnvelopeFrom
+		rec.Identifiers.HeaderFrom = row.HeaderFrom
+		for _, a := range row.DKIMAuth {
+			rec.AuthResults.DKIM = append(rec.AuthResults.DKIM, feedbackDKIM{a.Domain, a.Selector, a.Result})
+		}
+		rec.AuthResults.SPF = feedbackSPF{row.SPFAuth.Domain, row.SPFAuth.Selector, row.SPFAuth.Result}
+		f.Records = append(f.Records, rec)
+	}
+	out, _ := xml.MarshalIndent(f, "", "  ")
+	return append([]byte(xml.Header), out...)
+}
+
+// compose builds the raw report message, as per RFC 7489 7.2.1.1, which
+// carries the gzip compressed XML document as an attachment.
+func (r dmarcReport) compose(id uint64) string {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(r.xml(id))
+	zw.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=us-ascii"},
+	})
+	fmt.Fprintf(part, "This is an aggregate DMARC report for %s from %s,\r\n", r.domain, Hostname)
+	fmt.Fprintf(part, "covering %s to %s.\r\n",
+		r.begin.UTC().Format(time.RFC1123Z), r.end.UTC().Format(time.RFC1123Z))
+
+	name := fmt.Sprintf("%s!%s!%d!%d.xml.gz", Hostname, r.domain, r.begin.Unix(), r.end.Unix())
+	part, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("application/gzip; name=\"%s\"", name)},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=\"%s\"", name)},
+	})
+	enc := base64.StdEncoding.EncodeToString(gz.Bytes())
+	for len(enc) > 76 {
+		fmt.Fprintf(part, "%s\r\n", enc[:76])
+		enc = enc[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", enc)
+	mw.Close()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: DMARC Aggregate Report <postmaster@%s>\r\n", Hostname)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(r.rua, ", "))
+	fmt.Fprintf(&buf, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n",
+		r.domain, Hostname, r.reportID(id))
+	fmt.Fprintf(&buf, "Date: %s\r\n", r.end.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%x.%d@%s>\r\n", r.end.UnixNano(), id, Hostname)
+	fmt.Fprint(&buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprint(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed;\r\n\tboundary=\"%s\"\r\n\r\n", mw.Boundary())
+	buf.Write(body.Bytes())
+	return buf.String()
+}
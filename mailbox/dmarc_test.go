@@ -0,0 +1,215 @@
+package mailbox
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDMARCResults returns results for two domains, of which two only differ
+// in their dates.
+func testDMARCResults(start time.Time) []*DMARCResult {
+	policy := DMARCPolicy{P: "reject", SP: "quarantine", Pct: 100, ADKIM: "r", ASPF: "s"}
+	fail := &DMARCResult{
+		Domain: "a.test", Policy: policy, RUA: []string{"dmarc@a.test"},
+		SourceIP: "192.0.2.1", HeaderFrom: "a.test", EnvelopeFrom: "b.test",
+		Disposition: "reject", DKIM: "fail", SPF: "fail",
+		DKIMAuth: []DMARCAuth{{"b.test", "s1", "pass"}},
+		SPFAuth:  DMARCAuth{"b.test", "mfrom", "pass"},
+		Date:     start,
+	}
+	again := *fail
+	again.Date = start.Add(time.Minute)
+	pass := &DMARCResult{
+		Domain: "a.test", Policy: policy, RUA: []string{"dmarc@a.test", "x@reports.test"},
+		SourceIP: "192.0.2.2", HeaderFrom: "mail.a.test", EnvelopeFrom: "a.test",
+		Disposition: "none", DKIM: "fail", SPF: "pass",
+		SPFAuth: DMARCAuth{"a.test", "mfrom", "pass"},
+		Date:    start.Add(2 * time.Minute),
+	}
+	other := &DMARCResult{
+		Domain: "c.test", Policy: DMARCPolicy{P: "none", SP: "none", Pct: 100, ADKIM: "r", ASPF: "r"},
+		RUA:      []string{"dmarc@c.test"},
+		SourceIP: "192.0.2.3", HeaderFrom: "c.test", EnvelopeFrom: "c.test",
+		Disposition: "none", DKIM: "pass", SPF: "pass",
+		DKIMAuth: []DMARCAuth{{"c.test", "s1", "pass"}, {"d.test", "s2", "fail"}},
+		SPFAuth:  DMARCAuth{"c.test", "helo", "pass"},
+		Date:     start.Add(3 * time.Minute),
+	}
+	return []*DMARCResult{fail, &again, pass, other}
+}
+
+func TestDMARCReports(t *testing.T) {
+	start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	reports := dmarcReports(testDMARCResults(start), end)
+	if len(reports) != 2 {
+		t.Fatalf("Expected 2 reports, got %d", len(reports))
+	}
+	a, c := reports[0], reports[1]
+	if a.domain != "a.test" || !a.begin.Equal(start) || !a.end.Equal(end) ||
+		!reflect.DeepEqual(a.rua, []string{"dmarc@a.test", "x@reports.test"}) {
+		t.Errorf("Unexpected report %+v", a)
+	}
+	if len(a.rows) != 2 || a.rows[0].count != 2 || a.rows[1].count != 1 {
+		t.Errorf("Expected rows counting 2 and 1, got %+v", a.rows)
+	}
+	if c.domain != "c.test" || len(c.rows) != 1 || !c.begin.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Unexpected report %+v", c)
+	}
+}
+
+// It should compose a report message carrying the compressed XML report as
+// an attachment.
+func TestDMARCReport_Compose(t *testing.T) {
+	defer func(h string) { Hostname = h }(Hostname)
+	Hostname = "mx.test"
+	start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	r := dmarcReports(testDMARCResults(start), end)[0]
+
+	msg, err := mail.ReadMessage(strings.NewReader(r.compose(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"From":    "DMARC Aggregate Report <postmaster@mx.test>",
+		"To":      "dmarc@a.test, x@reports.test",
+		"Subject": "Report Domain: a.test Submitter: mx.test Report-ID: <1425214800.7@mx.test>",
+	} {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("Expected %s %q, got %q", name, want, got)
+		}
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := "mx.test!a.test!1425211200!1425214800.xml.gz"; part.FileName() != name {
+		t.Errorf("Expected file name %q, got %q", name, part.FileName())
+	}
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, part))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	var f feedback
+	if err := xml.Unmarshal(data, &f); err != nil {
+		t.Fatalf("Error parsing %s: %s", data, err)
+	}
+	if f.Metadata.ReportID != "1425214800.7@mx.test" || f.Metadata.Email != "postmaster@mx.test" ||
+		f.Metadata.DateRange.Begin != start.Unix() || f.Metadata.DateRange.End != end.Unix() {
+		t.Errorf("Unexpected metadata %+v", f.Metadata)
+	}
+	if p := f.Policy; p.Domain != "a.test" || p.P != "reject" || p.SP != "quarantine" || p.ASPF != "s" {
+		t.Errorf("Unexpected policy %+v", f.Policy)
+	}
+	if len(f.Records) != 2 {
+		t.Fatalf("Expected 2 records, got %+v", f.Records)
+	}
+	rec := f.Records[0]
+	if rec.Row.SourceIP != "192.0.2.1" || rec.Row.Count != 2 ||
+		rec.Row.PolicyEvaluated.Disposition != "reject" ||
+		rec.Identifiers.HeaderFrom != "a.test" || rec.Identifiers.EnvelopeFrom != "b.test" ||
+		!reflect.DeepEqual(rec.AuthResults.DKIM, []feedbackDKIM{{"b.test", "s1", "pass"}}) ||
+		rec.AuthResults.SPF != (feedbackSPF{"b.test", "mfrom", "pass"}) {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+}
+
+func TestDMARC_Record_Report(t *testing.T) {
+	EnsureTestDB()
+	mb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("could not open DB: %s", err)
+	}
+	defer mb.Close()
+	CleanDB(mb.db)
+	_, err = mb.db.Exec(`INSERT INTO users (id, name, username, host) VALUES (1, 'D', 'dmarc', 'a.test')`)
+	if err != nil {
+		t.Fatalf("error adding user: %s", err)
+	}
+
+	reports := func() (inbox, queued int) {
+		mb.db.QueryRow(`SELECT COUNT(*) FROM mailbox WHERE user_id=1`).Scan(&inbox)
+		mb.db.QueryRow(`SELECT COUNT(*) FROM queue WHERE host='reports.test' OR host='c.test'`).Scan(&queued)
+		return inbox, queued
+	}
+	results := func() (n int) {
+		mb.db.QueryRow(`SELECT COUNT(*) FROM dmarc_results`).Scan(&n)
+		return n
+	}
+
+	for _, r := range testDMARCResults(time.Now().Add(-time.Hour)) {
+		if err := mb.RecordDMARC(r); err != nil {
+			t.Fatalf("error recording: %s", err)
+		}
+	}
+	// Results are loaded as they were recorded.
+	tx, err := mb.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := &dmarcReporting{now: time.Now().Add(-time.Hour).Add(90 * time.Second), due: true}
+	if err := takeDMARC(tx, taken); err != nil || len(taken.results) != 2 {
+		t.Fatalf("Expected the 2 oldest results, got %d (%v)", len(taken.results), err)
+	}
+	tx.Rollback()
+	if want := testDMARCResults(taken.results[0].Date)[0]; !reflect.DeepEqual(taken.results[0], want) {
+		t.Errorf("Expected %+v, got %+v", want, taken.results[0])
+	}
+
+	// The first call only starts the interval.
+	if err := mb.ReportDMARC(time.Hour); err != nil {
+		t.Fatalf("error reporting: %s", err)
+	}
+	if inbox, queued := reports(); inbox != 0 || queued != 0 || results() != 4 {
+		t.Errorf("Expected no reports yet, got %d and %d", inbox, queued)
+	}
+
+	// Once the interval passed, one report is sent for each domain.
+	if _, err := mb.db.Exec(`UPDATE dmarc_reported SET last_report=NOW() - interval '2 hours'`); err != nil {
+		t.Fatalf("error setting up test: %s", err)
+	}
+	if err := mb.ReportDMARC(time.Hour); err != nil {
+		t.Fatalf("error reporting: %s", err)
+	}
+	if inbox, queued := reports(); inbox != 1 || queued != 2 {
+		t.Errorf("Expected 1 local and 2 remote reports, got %d and %d", inbox, queued)
+	}
+	if n := results(); n != 0 {
+		t.Errorf("Expected no results left, got %d", n)
+	}
+
+	// Reports are not sent again before the interval passes.
+	if err := mb.RecordDMARC(testDMARCResults(time.Now().Add(-time.Minute))[0]); err != nil {
+		t.Fatalf("error recording: %s", err)
+	}
+	if err := mb.ReportDMARC(time.Hour); err != nil {
+		t.Fatalf("error reporting: %s", err)
+	}
+	if inbox, queued := reports(); inbox != 1 || queued != 2 || results() != 1 {
+		t.Errorf("Expected no new reports, got %d and %d", inbox, queued)
+	}
+}
@@ -3,12 +3,16 @@ package mailbox
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"log"
 	"net/mail"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
-// Enqueuer is used to enqueue messages for delivery and to query for addresses.
+// Enqueuer is used to enqueue messages for delivery, to query for addresses and
+// to authenticate users.
 type Enqueuer interface {
 	// Enqueue places a message onto the queue for delivery.
 	Enqueue(msg *Message) error
@@ -17,6 +21,12 @@ type Enqueuer interface {
 	// query searches the server for an address and returns a query status, which
 	// can be QueryNotFound, QuerySuccess, QueryNotLocal or QueryError.
 	Query(addr *mail.Address) int
+	// Authenticate reports whether the given password belongs to the local
+	// user at addr.
+	Authenticate(addr *mail.Address, password string) (bool, error)
+	// RecordDMARC stores the result of evaluating a received message against
+	// the DMARC policy of its sender's domain, to be reported later.
+	RecordDMARC(r *DMARCResult) error
 }
 
 const (
@@ -36,13 +46,36 @@ func (mb mailBox) GUID() (id uint64, err error) {
 	return
 }
 
-// Enqueue delivers to local inboxes and queues remote deliveries.
+// Enqueue delivers to local inboxes and queues remote deliveries. Local
+// recipients which asked to be notified about successful deliveries are
+// reported to the sender.
 func (mb mailBox) Enqueue(msg *Message) error {
-	return mb.newTransaction(msg).do(
+	err := mb.newTransaction(msg).do(
 		storeMessage,
 		enqueueOutbound,
 		deliverInbound,
 	)
+	if err != nil || IsNullPath(msg.From()) {
+		return err
+	}
+	var notify []*mail.Address
+	for _, rcpt := range msg.Inbound() {
+		if msg.RcptDSN(rcpt).Wants("SUCCESS") {
+			notify = append(notify, rcpt)
+		}
+	}
+	if len(notify) > 0 {
+		err = mb.report(deliveryReport{
+			msg:    msg,
+			rcpt:   notify,
+			action: actionDelivered,
+			date:   time.Now(),
+		})
+		if err != nil {
+			log.Printf("error reporting delivery of message %d to %s: %s", msg.ID, msg.From(), err)
+		}
+	}
+	return nil
 }
 
 // dataTransaction can execute multiple actions within a database transaction using a context
@@ -79,9 +112,10 @@ func storeMessage(tx *sql.Tx, ctx interface{}) error {
 		return errors.New("Expecting *Message in func storeMessage.")
 	}
 	_, err := tx.Exec(
-		`INSERT INTO messages (id, "from", rcpt, raw)
-		VALUES ($1, $2, $3, $4)`,
-		msg.ID, msg.From().String(), MakeAddressList(msg.Rcpt()), msg.Raw,
+		`INSERT INTO messages (id, "from", rcpt, raw, ret, envid, utf8, "binary", authserv_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		msg.ID, PathString(msg.From()), MakeAddressList(msg.Rcpt()), msg.Raw,
+		msg.Ret, msg.EnvID, msg.UTF8, msg.Binary, msg.AuthservID,
 	)
 	return err
 }
@@ -94,8 +128,8 @@ func enqueueOutbound(tx *sql.Tx, ctx interface{}) error {
 	}
 	stmt, err := tx.Prepare(`
 		INSERT INTO queue 
-		(host, message_id, "user", date_added, attempts) 
-		VALUES ($1, $2, $3, NOW(), 0)`)
+		(host, message_id, "user", date_added, attempts, notify, orcpt) 
+		VALUES ($1, $2, $3, NOW(), 0, $4, $5)`)
 
 	if err != nil {
 		return err
@@ -104,7 +138,8 @@ func enqueueOutbound(tx *sql.Tx, ctx interface{}) error {
 
 	for _, dst := range msg.Outbound() {
 		u, h := SplitUserHost(dst)
-		_, err = stmt.Exec(h, msg.ID, u)
+		dsn := msg.RcptDSN(dst)
+		_, err = stmt.Exec(h, msg.ID, u, dsn.Notify, dsn.ORcpt)
 		if err != nil {
 			return err
 		}
@@ -118,21 +153,37 @@ func deliverInbound(tx *sql.Tx, ctx interface{}) error {
 	if !ok {
 		return errors.New("Expecting *Message in func deliverOutbound.")
 	}
+	// The message is placed into the user's INBOX folder, or the Junk folder
+	// if it is quarantined, which is created if it does not exist, and given
+	// the folder's next UID.
 	stmt, err := tx.Prepare(`
-		INSERT INTO mailbox (user_id, message_id) VALUES 
-		((SELECT id FROM users WHERE username=$1 and host=$2), $3)`)
+		WITH inbox AS (
+			INSERT INTO folders (user_id, name, uid_validity, uid_next)
+			SELECT id, $4, extract(epoch FROM now())::bigint, 2
+			FROM users WHERE username=$1 AND host=$2
+			ON CONFLICT (user_id, name) DO UPDATE SET uid_next = folders.uid_next + 1
+			RETURNING id, user_id, uid_next - 1 AS uid)
+		INSERT INTO mailbox (user_id, message_id, folder_id, uid)
+		SELECT user_id, $3, id, uid FROM inbox`)
 
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
+	folder := "INBOX"
+	if msg.Quarantine {
+		folder = "Junk"
+	}
 	for _, rcv := range msg.Inbound() {
 		u, h := SplitUserHost(rcv)
-		_, err = stmt.Exec(u, h, msg.ID)
+		res, err := stmt.Exec(u, h, msg.ID, folder)
 		if err != nil {
 			return err
 		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return fmt.Errorf("no local user %s", rcv.Address)
+		}
 	}
 	return nil
 }
@@ -165,6 +216,22 @@ func (mb mailBox) Query(addr *mail.Address) int {
 	}
 }
 
+// Authenticate checks the password against the hash stored in the users table.
+// Hashes are created and verified using pgcrypto's crypt function. Users that have
+// no password set can not authenticate.
+func (mb mailBox) Authenticate(addr *mail.Address, password string) (bool, error) {
+	var ok bool
+	user, host := SplitUserHost(addr)
+	err := mb.db.
+		QueryRow(`SELECT COALESCE(password = crypt($3, password), false)
+			FROM users WHERE username=$1 AND host=$2`, user, host, password).
+		Scan(&ok)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return ok, err
+}
+
 // Closes the database connection.
 func (mb mailBox) Close() error {
 	return mb.db.Close()
@@ -6,11 +6,18 @@ var _ Enqueuer = (*MockEnqueuer)(nil)
 
 // MockEnqueuer is a configurable mock that implements the Enqueuer interface.
 type MockEnqueuer struct {
-	GUIDMock    func() (uint64, error)
-	EnqueueMock func(*Message) error
-	QueryMock   func(*mail.Address) int
+	GUIDMock         func() (uint64, error)
+	EnqueueMock      func(*Message) error
+	QueryMock        func(*mail.Address) int
+	AuthenticateMock func(*mail.Address, string) (bool, error)
+	RecordDMARCMock  func(*DMARCResult) error
 }
 
-func (m MockEnqueuer) Enqueue(msg *Message) error   { return m.EnqueueMock(msg) }
-func (m MockEnqueuer) GUID() (uint64, error)        { return m.GUIDMock() }
-func (m MockEnqueuer) Query(addr *mail.Address) int { return m.QueryMock(addr) }
+func (m MockEnqueuer) Enqueue(msg *Message) error       { return m.EnqueueMock(msg) }
+func (m MockEnqueuer) GUID() (uint64, error)            { return m.GUIDMock() }
+func (m MockEnqueuer) Query(addr *mail.Address) int     { return m.QueryMock(addr) }
+func (m MockEnqueuer) RecordDMARC(r *DMARCResult) error { return m.RecordDMARCMock(r) }
+
+func (m MockEnqueuer) Authenticate(addr *mail.Address, pass string) (bool, error) {
+	return m.AuthenticateMock(addr, pass)
+}
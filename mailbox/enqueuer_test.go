@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 
@@ -29,8 +30,11 @@ func EnsureTestDB() {
 func CleanDB(db *sql.DB) {
 	_, err := db.Exec(`
 		DELETE FROM mailbox;
+		DELETE FROM folders;
 		DELETE FROM messages;
 		DELETE FROM queue;
+		DELETE FROM dmarc_results;
+		DELETE FROM dmarc_reported;
 		DELETE FROM users`)
 
 	if err != nil {
@@ -222,6 +226,61 @@ func TestPostBox_Enqueuer(t *testing.T) {
 	pb.Close()
 }
 
+// It should store notification requests and report successful local
+// deliveries to the sender, when requested.
+func TestEnqueue_DSN(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("Failed to initialize PostBox: %s", err)
+	}
+	defer pb.Close()
+
+	CleanDB(pb.db)
+	_, err = pb.db.Exec(`INSERT INTO users (id, name, username, host) VALUES
+		(5, 'a b', 'a', 'b.com'), (7, 'c d', 'c', 'd.com')`)
+	if err != nil {
+		t.Fatalf("Error setting up test: %s", err)
+	}
+	msg := &Message{
+		ID:         123,
+		Raw:        "Subject: Hi\r\n\r\nBody",
+		Ret:        "HDRS",
+		EnvID:      "QQ314",
+		Binary:     true,
+		AuthservID: "mx.d.com",
+		from:       &mail.Address{Address: "c@d.com"},
+		rcptIn:     []*mail.Address{{Address: "a@b.com"}},
+		rcptOut:    []*mail.Address{{Address: "x@z.com"}},
+	}
+	msg.SetRcptDSN(msg.rcptIn[0], RcptDSN{Notify: "SUCCESS"})
+	msg.SetRcptDSN(msg.rcptOut[0], RcptDSN{"DELAY", "rfc822;x@z.com"})
+	if err := pb.Enqueue(msg); err != nil {
+		t.Fatalf("Error enqueuing message: %s", err)
+	}
+
+	var ret, envid, authservID, notify, orcpt string
+	var binary bool
+	err = pb.db.QueryRow(`SELECT ret, envid, "binary", authserv_id FROM messages WHERE id=123`).Scan(&ret, &envid, &binary, &authservID)
+	if err != nil || ret != "HDRS" || envid != "QQ314" || !binary || authservID != "mx.d.com" {
+		t.Errorf("Expected RET, ENVID, BODY and authserv-id to be stored, got %q, %q, %t, %q (%v)", ret, envid, binary, authservID, err)
+	}
+	err = pb.db.QueryRow(`SELECT notify, orcpt FROM queue WHERE message_id=123`).Scan(&notify, &orcpt)
+	if err != nil || notify != "DELAY" || orcpt != "rfc822;x@z.com" {
+		t.Errorf("Expected NOTIFY and ORCPT to be queued, got %q, %q (%v)", notify, orcpt, err)
+	}
+
+	var raw string
+	err = pb.db.QueryRow(`
+		SELECT raw FROM messages
+		INNER JOIN mailbox ON mailbox.message_id=messages.id
+		WHERE mailbox.user_id=7`).Scan(&raw)
+	if err != nil || !strings.Contains(raw, "Action: delivered") {
+		t.Errorf("Expected success report in sender's inbox, got %q (%v)", raw, err)
+	}
+}
+
 func TestEnqueue_Tx_Error(t *testing.T) {
 	EnsureTestDB()
 
@@ -273,6 +332,21 @@ func TestEnqueuer_Mock(t *testing.T) {
 	if nqm.Query(&mail.Address{"", "a@b.com"}) != QueryNotLocal {
 		t.Error("Expected QueryNotLocal")
 	}
+
+	nqm = &MockEnqueuer{
+		AuthenticateMock: func(a *mail.Address, p string) (bool, error) { return p == "pass", nil },
+	}
+	if ok, err := nqm.Authenticate(&mail.Address{"", "a@b.com"}, "pass"); !ok || err != nil {
+		t.Errorf("Expected true and nil, got %t and %+v", ok, err)
+	}
+
+	var recorded *DMARCResult
+	nqm = &MockEnqueuer{
+		RecordDMARCMock: func(r *DMARCResult) error { recorded = r; return nil },
+	}
+	if r := (&DMARCResult{Domain: "a.com"}); nqm.RecordDMARC(r) != nil || recorded != r {
+		t.Error("Expected result to be recorded")
+	}
 }
 
 func TestEnqueuer_Query(t *testing.T) {
@@ -318,6 +392,47 @@ func TestEnqueuer_Query(t *testing.T) {
 	pb.Close()
 }
 
+func TestEnqueuer_Authenticate(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+
+	_, err = pb.db.Exec(`INSERT INTO users (id, username, host, password) VALUES
+		(1, 'name', 'domain.tld', crypt('secret', gen_salt('bf'))),
+		(2, 'gabe', 'yahoo.com', crypt('other', gen_salt('md5'))),
+		(3, 'john', 'carmack.co.uk', NULL)`)
+
+	if err != nil {
+		t.Errorf("Error setting up test: %s", err)
+	}
+
+	for _, test := range []struct {
+		addr   *mail.Address
+		pass   string
+		result bool
+	}{
+		{&mail.Address{Address: "name@domain.tld"}, "secret", true},
+		{&mail.Address{Address: "name@domain.tld"}, "Secret", false},
+		{&mail.Address{Address: "name@domain.tld"}, "", false},
+		{&mail.Address{Address: "gabe@yahoo.com"}, "other", true},
+		{&mail.Address{Address: "gabe@yahoo.com"}, "secret", false},
+		{&mail.Address{Address: "john@carmack.co.uk"}, "", false},
+		{&mail.Address{Address: "nobody@domain.tld"}, "secret", false},
+	} {
+		ok, err := pb.Authenticate(test.addr, test.pass)
+		if err != nil || ok != test.result {
+			t.Errorf("Authenticate(%s, %q): expected %t, got %t (%v)",
+				test.addr.Address, test.pass, test.result, ok, err)
+		}
+	}
+
+	CleanDB(pb.db)
+	pb.Close()
+}
+
 func TestRunners_BadContext(t *testing.T) {
 	if enqueueOutbound(&sql.Tx{}, 2) == nil {
 		t.Error("Expected bad context error on 'storeMessage'")
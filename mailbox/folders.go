@@ -0,0 +1,158 @@
+package mailbox
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Store is used to browse and manage the messages within users' folders, as
+// well as to authenticate their owners. It is used by the IMAP server.
+type Store interface {
+	// Authenticate reports whether the given password belongs to the local
+	// user at addr.
+	Authenticate(addr *mail.Address, password string) (bool, error)
+	// Folders returns the folders of the user at addr. The INBOX folder
+	// always exists.
+	Folders(addr *mail.Address) ([]*Folder, error)
+	// Folder returns the user's folder with the given name, or ErrNoFolder.
+	Folder(addr *mail.Address, name string) (*Folder, error)
+	// Items returns the messages in the user's folder which have a UID
+	// greater than the given one, ordered by UID.
+	Items(addr *mail.Address, folder string, since uint32) ([]*FolderItem, error)
+	// SetFlags replaces the flags of the user's message with the given ID.
+	SetFlags(addr *mail.Address, id uint64, flags []string) error
+	// Remove deletes the messages with the given IDs from the folders of the
+	// user at addr.
+	Remove(addr *mail.Address, ids []uint64) error
+}
+
+// ErrNoFolder is returned when a folder does not exist.
+var ErrNoFolder = errors.New("no such folder")
+
+// Folder describes one of a user's mail folders.
+type Folder struct {
+	// Name of the folder. Hierarchy levels are separated by "/".
+	Name string
+	// UIDValidity changes when the UIDs of the folder's messages are
+	// not guaranteed to be the same as before.
+	UIDValidity uint32
+	// UIDNext is the UID that the next message added to the folder gets.
+	UIDNext uint32
+}
+
+// FolderItem is a message within a folder.
+type FolderItem struct {
+	*Message
+	// UID of the message within its folder.
+	UID uint32
+	// Flags set on the message, such as \Seen or \Deleted.
+	Flags []string
+	// Date when the message was added to the folder.
+	Date time.Time
+}
+
+// sqlEnsureInbox creates the INBOX folder of a user if it does not exist.
+const sqlEnsureInbox = `
+	INSERT INTO folders (user_id, name, uid_validity)
+	SELECT id, 'INBOX', extract(epoch FROM now())::bigint
+	FROM users WHERE username=$1 AND host=$2
+	ON CONFLICT (user_id, name) DO NOTHING`
+
+// Folders retrieves the folders of the user at addr, ordered by name.
+func (mb mailBox) Folders(addr *mail.Address) ([]*Folder, error) {
+	user, host := SplitUserHost(addr)
+	if _, err := mb.db.Exec(sqlEnsureInbox, user, host); err != nil {
+		return nil, err
+	}
+	rows, err := mb.db.Query(`
+		SELECT folders.name, folders.uid_validity, folders.uid_next
+		FROM folders JOIN users ON users.id = folders.user_id
+		WHERE users.username=$1 AND users.host=$2
+		ORDER BY folders.name`, user, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Folder
+	for rows.Next() {
+		f := new(Folder)
+		if err := rows.Scan(&f.Name, &f.UIDValidity, &f.UIDNext); err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// Folder retrieves a folder of the user at addr. The name INBOX is case-insensitive.
+func (mb mailBox) Folder(addr *mail.Address, name string) (*Folder, error) {
+	user, host := SplitUserHost(addr)
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+		if _, err := mb.db.Exec(sqlEnsureInbox, user, host); err != nil {
+			return nil, err
+		}
+	}
+	f := &Folder{Name: name}
+	err := mb.db.QueryRow(`
+		SELECT folders.uid_validity, folders.uid_next
+		FROM folders JOIN users ON users.id = folders.user_id
+		WHERE users.username=$1 AND users.host=$2 AND folders.name=$3`,
+		user, host, name).Scan(&f.UIDValidity, &f.UIDNext)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoFolder
+	}
+	return f, err
+}
+
+// Items retrieves the messages in a folder of the user at addr, which have
+// a UID greater than since.
+func (mb mailBox) Items(addr *mail.Address, folder string, since uint32) ([]*FolderItem, error) {
+	user, host := SplitUserHost(addr)
+	rows, err := mb.db.Query(`
+		SELECT messages.id, messages."from", messages.raw,
+			mailbox.uid, mailbox.flags, mailbox.date_added
+		FROM mailbox
+		JOIN users ON users.id = mailbox.user_id
+		JOIN folders ON folders.id = mailbox.folder_id
+		JOIN messages ON messages.id = mailbox.message_id
+		WHERE users.username=$1 AND users.host=$2 AND folders.name=$3
+			AND mailbox.uid > $4
+		ORDER BY mailbox.uid`, user, host, folder, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*FolderItem
+	for rows.Next() {
+		var from, flags string
+		item := &FolderItem{Message: new(Message)}
+		err := rows.Scan(&item.ID, &from, &item.Raw, &item.UID, &flags, &item.Date)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := ParsePath(from)
+		if err != nil {
+			return nil, err
+		}
+		item.SetFrom(addr)
+		item.Flags = strings.Fields(flags)
+		list = append(list, item)
+	}
+	return list, rows.Err()
+}
+
+// SetFlags stores the flags of a message in the folders of the user at addr.
+func (mb mailBox) SetFlags(addr *mail.Address, id uint64, flags []string) error {
+	user, host := SplitUserHost(addr)
+	_, err := mb.db.Exec(`
+		UPDATE mailbox SET flags=$3 WHERE message_id=$4
+		AND user_id=(SELECT id FROM users WHERE username=$1 AND host=$2)`,
+		user, host, strings.Join(flags, " "), id)
+	return err
+}
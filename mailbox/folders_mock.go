@@ -0,0 +1,34 @@
+package mailbox
+
+import "net/mail"
+
+var _ Store = (*MockStore)(nil)
+
+// MockStore is a configurable mock that implements the Store interface.
+type MockStore struct {
+	AuthenticateMock func(*mail.Address, string) (bool, error)
+	FoldersMock      func(*mail.Address) ([]*Folder, error)
+	FolderMock       func(*mail.Address, string) (*Folder, error)
+	ItemsMock        func(*mail.Address, string, uint32) ([]*FolderItem, error)
+	SetFlagsMock     func(*mail.Address, uint64, []string) error
+	RemoveMock       func(*mail.Address, []uint64) error
+}
+
+func (m MockStore) Folders(addr *mail.Address) ([]*Folder, error) { return m.FoldersMock(addr) }
+func (m MockStore) Remove(addr *mail.Address, ids []uint64) error { return m.RemoveMock(addr, ids) }
+
+func (m MockStore) Authenticate(addr *mail.Address, pass string) (bool, error) {
+	return m.AuthenticateMock(addr, pass)
+}
+
+func (m MockStore) Folder(addr *mail.Address, name string) (*Folder, error) {
+	return m.FolderMock(addr, name)
+}
+
+func (m MockStore) Items(addr *mail.Address, folder string, since uint32) ([]*FolderItem, error) {
+	return m.ItemsMock(addr, folder, since)
+}
+
+func (m MockStore) SetFlags(addr *mail.Address, id uint64, flags []string) error {
+	return m.SetFlagsMock(addr, id, flags)
+}
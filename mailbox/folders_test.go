@@ -0,0 +1,124 @@
+package mailbox
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestStore_Folders(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+	defer pb.Close()
+	CleanDB(pb.db)
+	defer CleanDB(pb.db)
+
+	_, err = pb.db.Exec(`
+		INSERT INTO users (id, username, host) VALUES (1, 'jane', 'doe.com');
+		INSERT INTO folders (id, user_id, name, uid_validity, uid_next) VALUES (1, 1, 'Archive', 7, 3);`)
+	if err != nil {
+		t.Fatalf("Error setting up test: %s", err)
+	}
+
+	jane := &mail.Address{Address: "jane@doe.com"}
+	list, err := pb.Folders(jane)
+	if err != nil {
+		t.Fatalf("Error listing folders: %s", err)
+	}
+	if len(list) != 2 || list[0].Name != "Archive" || list[1].Name != "INBOX" {
+		t.Fatalf("Expected Archive and INBOX, got %+v", list)
+	}
+	if *list[0] != (Folder{"Archive", 7, 3}) || list[1].UIDNext != 1 {
+		t.Errorf("Bad folder status %+v and %+v", list[0], list[1])
+	}
+
+	if _, err = pb.Folder(jane, "Missing"); err != ErrNoFolder {
+		t.Errorf("Expected ErrNoFolder, got %v", err)
+	}
+	inbox, err := pb.Folder(jane, "inbox")
+	if err != nil || inbox.Name != "INBOX" || inbox.UIDValidity != list[1].UIDValidity {
+		t.Errorf("Expected INBOX, got %+v (%v)", inbox, err)
+	}
+}
+
+func TestStore_Items_SetFlags(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+	defer pb.Close()
+	CleanDB(pb.db)
+	defer CleanDB(pb.db)
+
+	_, err = pb.db.Exec(`INSERT INTO users (id, username, host) VALUES (1, 'jane', 'doe.com')`)
+	if err != nil {
+		t.Fatalf("Error setting up test: %s", err)
+	}
+	jane := &mail.Address{Address: "jane@doe.com"}
+	for _, id := range []uint64{4, 2, 9} {
+		msg := &Message{ID: id, Raw: "Message", from: &mail.Address{Address: "bob@doe.com"}}
+		msg.AddInbound(jane)
+		if err := pb.Enqueue(msg); err != nil {
+			t.Fatalf("Error enqueuing: %s", err)
+		}
+	}
+
+	items, err := pb.Items(jane, "INBOX", 1)
+	if err != nil {
+		t.Fatalf("Error getting items: %s", err)
+	}
+	var got [][2]uint64
+	for _, item := range items {
+		got = append(got, [2]uint64{uint64(item.UID), item.ID})
+	}
+	if want := [][2]uint64{{2, 2}, {3, 9}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected UIDs and IDs %v, got %v", want, got)
+	}
+	if items[0].From().Address != "bob@doe.com" || len(items[0].Flags) != 0 || items[0].Date.IsZero() {
+		t.Errorf("Bad item %+v", items[0])
+	}
+
+	if err = pb.SetFlags(jane, 9, []string{`\Seen`, `\Flagged`}); err != nil {
+		t.Fatalf("Error setting flags: %s", err)
+	}
+	items, _ = pb.Items(jane, "INBOX", 2)
+	if len(items) != 1 || !reflect.DeepEqual(items[0].Flags, []string{`\Seen`, `\Flagged`}) {
+		t.Errorf("Expected flags to be stored, got %+v", items)
+	}
+	if f, _ := pb.Folder(jane, "INBOX"); f == nil || f.UIDNext != 4 {
+		t.Errorf("Expected UIDNEXT 4, got %+v", f)
+	}
+}
+
+func TestStore_Mock(t *testing.T) {
+	var called []string
+	var st Store = &MockStore{
+		AuthenticateMock: func(*mail.Address, string) (bool, error) { called = append(called, "Authenticate"); return true, nil },
+		FoldersMock:      func(*mail.Address) ([]*Folder, error) { called = append(called, "Folders"); return nil, nil },
+		FolderMock:       func(*mail.Address, string) (*Folder, error) { called = append(called, "Folder"); return nil, nil },
+		ItemsMock: func(*mail.Address, string, uint32) ([]*FolderItem, error) {
+			called = append(called, "Items")
+			return nil, nil
+		},
+		SetFlagsMock: func(*mail.Address, uint64, []string) error { called = append(called, "SetFlags"); return nil },
+		RemoveMock:   func(*mail.Address, []uint64) error { called = append(called, "Remove"); return nil },
+	}
+
+	st.Authenticate(nil, "")
+	st.Folders(nil)
+	st.Folder(nil, "")
+	st.Items(nil, "", 0)
+	st.SetFlags(nil, 0, nil)
+	st.Remove(nil, nil)
+
+	want := []string{"Authenticate", "Folders", "Folder", "Items", "SetFlags", "Remove"}
+	if !reflect.DeepEqual(called, want) {
+		t.Errorf("Expected calls %v, got %v", want, called)
+	}
+}
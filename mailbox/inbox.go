@@ -0,0 +1,91 @@
+package mailbox
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+)
+
+// Interface is used to retrieve and manage the messages in users' inboxes and
+// to authenticate their owners. It is used by the POP3 server.
+type Interface interface {
+	// Authenticate reports whether the given password belongs to the local
+	// user at addr.
+	Authenticate(addr *mail.Address, password string) (bool, error)
+	// Inbox returns the messages in the INBOX folder of the user at addr, in
+	// the order in which they were received.
+	Inbox(addr *mail.Address) ([]*Message, error)
+	// Remove deletes the messages with the given IDs from the folders of the
+	// user at addr.
+	Remove(addr *mail.Address, ids []uint64) error
+}
+
+// inboxUpdate is the context of a removal of messages from an inbox.
+type inboxUpdate struct {
+	// The user whose inbox is updated.
+	user *mail.Address
+	// Message IDs to remove.
+	ids []uint64
+}
+
+// Inbox retrieves the messages in the INBOX folder of the user at addr.
+func (mb mailBox) Inbox(addr *mail.Address) ([]*Message, error) {
+	user, host := SplitUserHost(addr)
+	rows, err := mb.db.Query(`
+		SELECT messages.id, messages."from", messages.raw
+		FROM mailbox
+		JOIN users ON users.id = mailbox.user_id
+		JOIN folders ON folders.id = mailbox.folder_id
+		JOIN messages ON messages.id = mailbox.message_id
+		WHERE users.username=$1 AND users.host=$2 AND folders.name='INBOX'
+		ORDER BY messages.id`, user, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Message
+	for rows.Next() {
+		var from string
+		msg := new(Message)
+		if err := rows.Scan(&msg.ID, &from, &msg.Raw); err != nil {
+			return nil, err
+		}
+		addr, err := ParsePath(from)
+		if err != nil {
+			return nil, err
+		}
+		msg.SetFrom(addr)
+		list = append(list, msg)
+	}
+	return list, rows.Err()
+}
+
+// Remove deletes messages from the inbox of the user at addr. Messages which
+// are not referenced anywhere else anymore are removed altogether.
+func (mb mailBox) Remove(addr *mail.Address, ids []uint64) error {
+	return mb.newTransaction(&inboxUpdate{addr, ids}).do(removeInboxed, collectGarbage)
+}
+
+// removeInboxed is a dataTransaction action that deletes the messages of an
+// inboxUpdate from the user's inbox.
+func removeInboxed(tx *sql.Tx, ctx interface{}) error {
+	u, ok := ctx.(*inboxUpdate)
+	if !ok {
+		return errors.New("Expecting *inboxUpdate in func removeInboxed.")
+	}
+	user, host := SplitUserHost(u.user)
+	stmt, err := tx.Prepare(`
+		DELETE FROM mailbox WHERE message_id=$3
+		AND user_id=(SELECT id FROM users WHERE username=$1 AND host=$2)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, id := range u.ids {
+		if _, err = stmt.Exec(user, host, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package mailbox
+
+import "net/mail"
+
+var _ Interface = (*MockInterface)(nil)
+
+// MockInterface is a configurable mock that implements the Interface interface.
+type MockInterface struct {
+	AuthenticateMock func(*mail.Address, string) (bool, error)
+	InboxMock        func(*mail.Address) ([]*Message, error)
+	RemoveMock       func(*mail.Address, []uint64) error
+}
+
+func (m MockInterface) Inbox(addr *mail.Address) ([]*Message, error)  { return m.InboxMock(addr) }
+func (m MockInterface) Remove(addr *mail.Address, ids []uint64) error { return m.RemoveMock(addr, ids) }
+
+func (m MockInterface) Authenticate(addr *mail.Address, pass string) (bool, error) {
+	return m.AuthenticateMock(addr, pass)
+}
@@ -0,0 +1,94 @@
+package mailbox
+
+import (
+	"database/sql"
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestInterface_Inbox_Remove(t *testing.T) {
+	EnsureTestDB()
+
+	pb, err := New(dbString)
+	if err != nil {
+		t.Fatalf("Error getting mailbox: %s", err)
+	}
+	defer pb.Close()
+	CleanDB(pb.db)
+	defer CleanDB(pb.db)
+
+	_, err = pb.db.Exec(`
+		INSERT INTO users (id, username, host) VALUES (1, 'jane', 'doe.com'), (2, 'adam', 'doe.com');
+		INSERT INTO messages VALUES
+			(3, '<bob@doe.com>', 'jane@doe.com', 'Third'),
+			(1, '<>', 'jane@doe.com', 'First'),
+			(2, '<bob@doe.com>', 'jane@doe.com,adam@doe.com', 'Second'),
+			(4, '<bob@doe.com>', 'jane@doe.com', 'Archived');
+		INSERT INTO folders (id, user_id, name, uid_validity) VALUES
+			(1, 1, 'INBOX', 1), (2, 1, 'Archive', 1), (3, 2, 'INBOX', 1);
+		INSERT INTO mailbox (user_id, message_id, folder_id, uid) VALUES
+			(1, 3, 1, 3), (1, 1, 1, 1), (1, 2, 1, 2), (2, 2, 3, 1), (1, 4, 2, 1);`)
+	if err != nil {
+		t.Fatalf("Error setting up test: %s", err)
+	}
+
+	jane := &mail.Address{Address: "jane@doe.com"}
+	list, err := pb.Inbox(jane)
+	if err != nil {
+		t.Fatalf("Error getting inbox: %s", err)
+	}
+	var got []string
+	for _, msg := range list {
+		got = append(got, msg.Raw)
+	}
+	if want := []string{"First", "Second", "Third"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	if !IsNullPath(list[0].From()) || list[1].From().Address != "bob@doe.com" {
+		t.Errorf("Bad senders %s and %s", list[0].From(), list[1].From())
+	}
+
+	if err = pb.Remove(jane, []uint64{1, 2}); err != nil {
+		t.Fatalf("Error removing messages: %s", err)
+	}
+	if list, err = pb.Inbox(jane); err != nil || len(list) != 1 || list[0].ID != 3 {
+		t.Errorf("Expected only message 3 to be left, got %v (%v)", list, err)
+	}
+
+	// Message 2 is still in Adam's inbox, while message 1 is gone.
+	var n int
+	pb.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id IN (1, 2)`).Scan(&n)
+	if n != 1 {
+		t.Errorf("Expected 1 message to be kept, got %d", n)
+	}
+	if list, _ = pb.Inbox(&mail.Address{Address: "adam@doe.com"}); len(list) != 1 {
+		t.Errorf("Expected Adam's message to be kept, got %v", list)
+	}
+}
+
+func TestInterface_Mock(t *testing.T) {
+	var called []string
+	var mi Interface = &MockInterface{
+		AuthenticateMock: func(*mail.Address, string) (bool, error) { called = append(called, "Authenticate"); return true, nil },
+		InboxMock:        func(*mail.Address) ([]*Message, error) { called = append(called, "Inbox"); return nil, nil },
+		RemoveMock:       func(*mail.Address, []uint64) error { called = append(called, "Remove"); return nil },
+	}
+
+	mi.Authenticate(nil, "")
+	mi.Inbox(nil)
+	mi.Remove(nil, nil)
+
+	if want := []string{"Authenticate", "Inbox", "Remove"}; !reflect.DeepEqual(called, want) {
+		t.Errorf("Expected calls %v, got %v", want, called)
+	}
+}
+
+func TestInbox_BadContext(t *testing.T) {
+	if removeInboxed(&sql.Tx{}, 2) == nil {
+		t.Error("Expected bad context error on 'removeInboxed'")
+	}
+	if collectGarbage(&sql.Tx{}, 2) == nil {
+		t.Error("Expected bad context error on 'collectGarbage'")
+	}
+}
@@ -1,16 +1,32 @@
 package mailbox
 
-import "database/sql"
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+)
 
 // PostgreSQL implementation of the mailbox
 type mailBox struct {
 	db          *sql.DB
 	dequeueStmt *sql.Stmt
+	delivered   *deliveryLog
+	owner       string // owner identifies the mailbox's leases on the queue
+}
+
+// deliveryLog buffers successful deliveries until they are flushed.
+type deliveryLog struct {
+	sync.Mutex
+	items []*queueUpdate
 }
 
 var _ interface {
 	Dequeuer
 	Enqueuer
+	Interface
+	Store
 } = (*mailBox)(nil)
 
 // New creates a PostBox using the given connection string. Example
@@ -27,10 +43,26 @@ func New(dbString string) (*mailBox, error) {
 	return &mailBox{
 		db:          db,
 		dequeueStmt: stmt,
+		delivered:   new(deliveryLog),
+		owner:       newOwnerID(),
 	}, nil
 }
 
-// all rows in table for latest N hosts
+// newOwnerID returns an identifier which is unique to this mailbox
+// instance, to be used as the owner of queue leases.
+func newOwnerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s:%d:%x", host, os.Getpid(), b)
+}
+
+// all rows in table for latest N hosts that are due for delivery and not
+// leased by another owner. The rows are leased to the owner ($2) for the given
+// amount of seconds ($3).
 var sqlPopQueue = `
 -- RhodiumToad
 -- change order by date_added, host to order by date_added desc, host desc
@@ -42,6 +74,8 @@ with recursive
                 array[host],
                 date_added
            from queue
+          where next_attempt <= now()
+            and (lease_expires is null or lease_expires < now())
           order by date_added,host
           limit 1)
         union all
@@ -52,13 +86,27 @@ with recursive
                 lateral (select host, date_added
                            from queue q2
                           where q2.host <> ALL (qh.hosts_seen)
+                            and q2.next_attempt <= now()
+                            and (q2.lease_expires is null or q2.lease_expires < now())
                             and (q2.date_added,q2.host) > (qh.date_cutoff,qh.last_host)
                           order by q2.date_added,q2.host
                           limit 1) q
-          where array_length(qh.hosts_seen,1) < $1))
+          where array_length(qh.hosts_seen,1) < $1)),
+
+  claimed
+    as (update queue
+           set lease_owner = $2,
+               lease_expires = now() + $3 * interval '1 second'
+         where ctid in (select ctid
+                          from queue
+                         where host in (select last_host from qh)
+                           and next_attempt <= now()
+                           and (lease_expires is null or lease_expires < now())
+                           for update skip locked)
+     returning host, message_id, "user", date_added, attempts, notify, orcpt)
 
-         select queue.*, messages.raw, messages.from
-           from queue 
+         select claimed.*, messages.raw, messages.from, messages.ret, messages.envid, messages.utf8, messages."binary",
+                messages.authserv_id
+           from claimed
      inner join messages 
-             on messages.id=queue.message_id 
-          where host in (select last_host from qh);`
+             on messages.id=claimed.message_id;`
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net/mail"
 	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 // A Message represents an e-mail message and  holds information about
@@ -14,10 +17,54 @@ type Message struct {
 	ID uint64
 	// Raw holds the message in raw form.
 	Raw string
+	// Ret and EnvID hold the RET and ENVID parameters given by the sender
+	// when requesting delivery status notifications, as per RFC 3461.
+	Ret, EnvID string
+	// UTF8 is set when the message was submitted using SMTPUTF8, so that
+	// its addresses and headers may contain UTF-8, as per RFC 6531.
+	UTF8 bool
+	// Binary is set when the message was submitted with BODY=BINARYMIME,
+	// so that it may only be relayed to hosts which accept it, as per
+	// RFC 3030 3.
+	Binary bool
+	// Quarantine is set when the message failed the checks of its sender's
+	// domain, which asked for it to be treated as suspicious. Local
+	// recipients receive it in their Junk folder instead of their INBOX.
+	Quarantine bool
+	// AuthservID is the authserv-id of the Authentication-Results header
+	// which this host added to the message when it was received, or empty if
+	// none was added. It identifies the results which this host can trust.
+	AuthservID string
+
+	from    *mail.Address      // Return-Path address
+	rcptIn  []*mail.Address    // Inbound recipients
+	rcptOut []*mail.Address    // Outbount recipients
+	rcptDSN map[string]RcptDSN // Notification requests by recipient address
+}
 
-	from    *mail.Address   // Return-Path address
-	rcptIn  []*mail.Address // Inbound recipients
-	rcptOut []*mail.Address // Outbount recipients
+// RcptDSN holds the delivery status notifications requested for a recipient
+// using the NOTIFY and ORCPT parameters of RFC 3461.
+type RcptDSN struct {
+	// Notify is NEVER, or a comma separated list of the SUCCESS, FAILURE
+	// and DELAY events. It is empty if no notifications were requested.
+	Notify string
+	// ORcpt holds the original recipient as "addr-type;xtext".
+	ORcpt string
+}
+
+// Wants reports whether a notification was requested for the given event,
+// which is one of SUCCESS, FAILURE or DELAY. When no notifications were
+// requested explicitly, only failures are reported.
+func (d RcptDSN) Wants(event string) bool {
+	if d.Notify == "" {
+		return event == "FAILURE"
+	}
+	for _, e := range strings.Split(d.Notify, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
 }
 
 // From retrieves the message Return-Path.
@@ -42,6 +89,19 @@ func (m *Message) AddOutbound(rcpt ...*mail.Address) {
 	m.rcptOut = append(m.rcptOut, rcpt...)
 }
 
+// RcptDSN returns the notification request of the given recipient.
+func (m Message) RcptDSN(rcpt *mail.Address) RcptDSN {
+	return m.rcptDSN[rcpt.Address]
+}
+
+// SetRcptDSN sets the notification request of the given recipient.
+func (m *Message) SetRcptDSN(rcpt *mail.Address, d RcptDSN) {
+	if m.rcptDSN == nil {
+		m.rcptDSN = make(map[string]RcptDSN)
+	}
+	m.rcptDSN[rcpt.Address] = d
+}
+
 // Rcpt returns a list of all recipients on this message.
 func (m Message) Rcpt() []*mail.Address {
 	return append(m.rcptIn, m.rcptOut...)
@@ -76,11 +136,59 @@ func MakeAddressList(list []*mail.Address) string {
 	return r.String()
 }
 
-// SplitUserHost splits an address into user and host.
+// ParsePath parses a reverse-path or forward-path address. Unlike
+// mail.ParseAddress it accepts the null path "<>", which is returned
+// as an empty address.
+func ParsePath(path string) (*mail.Address, error) {
+	if strings.TrimSpace(path) == "<>" {
+		return new(mail.Address), nil
+	}
+	return mail.ParseAddress(path)
+}
+
+// IsNullPath reports whether addr is the null reverse-path "<>", used
+// as the sender of delivery status notifications.
+func IsNullPath(addr *mail.Address) bool {
+	return addr == nil || addr.Address == ""
+}
+
+// PathString returns the address in a form parseable by ParsePath.
+func PathString(addr *mail.Address) string {
+	if IsNullPath(addr) {
+		return "<>"
+	}
+	return addr.String()
+}
+
+// SplitUserHost splits an address into user and host. The local part may
+// itself contain "@" when quoted, so the address is split at the last one.
+// The host is normalized using NormalizeHost.
 func SplitUserHost(addr *mail.Address) (user string, host string) {
-	p := strings.Split(addr.Address, "@")
-	if len(p) != 2 {
+	i := strings.LastIndex(addr.Address, "@")
+	if i <= 0 || i == len(addr.Address)-1 {
 		return
 	}
-	return p[0], p[1]
+	return addr.Address[:i], NormalizeHost(addr.Address[i+1:])
+}
+
+// NormalizeHost returns the lower case ASCII form of a domain name, as used
+// for lookups in the users table and on the queue. Internationalized labels
+// are converted to their IDNA "xn--" form. Names which are not valid IDNs are
+// only lower cased.
+func NormalizeHost(host string) string {
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		return ascii
+	}
+	return strings.ToLower(host)
+}
+
+// IsASCII reports whether s consists only of ASCII characters. Messages with
+// addresses or headers which are not ASCII require the SMTPUTF8 extension.
+func IsASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
 }
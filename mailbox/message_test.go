@@ -188,6 +188,12 @@ func TestSplitUserHost(t *testing.T) {
 		{&mail.Address{"", "jim@yahoo.co.uk"}, "jim", "yahoo.co.uk"},
 		{&mail.Address{"", "bogus"}, "", ""},
 		{&mail.Address{}, "", ""},
+		{&mail.Address{"", "Jim@Yahoo.CO.UK"}, "Jim", "yahoo.co.uk"},
+		{&mail.Address{"", "a@b@c.com"}, "a@b", "c.com"},
+		{&mail.Address{"", "jörg@Bücher.de"}, "jörg", "xn--bcher-kva.de"},
+		{&mail.Address{"", "用户@例子.广告"}, "用户", "xn--fsqu00a.xn--4rr70v"},
+		{&mail.Address{"", "a@"}, "", ""},
+		{&mail.Address{"", "@b.com"}, "", ""},
 	} {
 		u, h := SplitUserHost(test.addr)
 		if u != test.expUser || h != test.expHost {
@@ -195,3 +201,91 @@ func TestSplitUserHost(t *testing.T) {
 		}
 	}
 }
+
+func TestIsASCII(t *testing.T) {
+	for s, want := range map[string]bool{
+		"":            true,
+		"jim@b.com":   true,
+		"jörg@b.com":  false,
+		"Subject: 你好": false,
+	} {
+		if got := IsASCII(s); got != want {
+			t.Errorf("IsASCII(%q): expected %t, got %t", s, want, got)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, test := range []struct {
+		Path   string
+		Addr   string
+		Null   bool
+		HasErr bool
+	}{
+		{"<>", "", true, false},
+		{" <> ", "", true, false},
+		{"<a@b.com>", "a@b.com", false, false},
+		{"Name <a@b.com>", "a@b.com", false, false},
+		{"<bad>", "", false, true},
+		{"", "", false, true},
+	} {
+		addr, err := ParsePath(test.Path)
+		if test.HasErr {
+			if err == nil {
+				t.Errorf("Expected error parsing %q", test.Path)
+			}
+			continue
+		}
+		if err != nil || addr.Address != test.Addr || IsNullPath(addr) != test.Null {
+			t.Errorf("Parsing %q: got %+v, %v", test.Path, addr, err)
+		}
+	}
+}
+
+func TestPathString(t *testing.T) {
+	for _, test := range []struct {
+		Addr *mail.Address
+		Path string
+	}{
+		{nil, "<>"},
+		{&mail.Address{}, "<>"},
+		{&mail.Address{Address: "a@b.com"}, "<a@b.com>"},
+		{&mail.Address{Name: "A", Address: "a@b.com"}, `"A" <a@b.com>`},
+	} {
+		if got := PathString(test.Addr); got != test.Path {
+			t.Errorf("Expected %s, got %s", test.Path, got)
+		}
+	}
+}
+
+func TestRcptDSN_Wants(t *testing.T) {
+	for _, test := range []struct {
+		Notify string
+		Wants  []string
+	}{
+		{"", []string{"FAILURE"}},
+		{"NEVER", nil},
+		{"SUCCESS", []string{"SUCCESS"}},
+		{"SUCCESS,DELAY,FAILURE", []string{"SUCCESS", "FAILURE", "DELAY"}},
+	} {
+		var got []string
+		for _, event := range []string{"SUCCESS", "FAILURE", "DELAY"} {
+			if (RcptDSN{Notify: test.Notify}).Wants(event) {
+				got = append(got, event)
+			}
+		}
+		if !reflect.DeepEqual(got, test.Wants) {
+			t.Errorf("NOTIFY=%s: expected %v, got %v", test.Notify, test.Wants, got)
+		}
+	}
+
+	m := new(Message)
+	addr := &mail.Address{Address: "a@b.com"}
+	if (m.RcptDSN(addr) != RcptDSN{}) {
+		t.Error("Expected empty request for unknown recipient")
+	}
+	m.SetRcptDSN(addr, RcptDSN{"SUCCESS", "rfc822;a@b.com"})
+	if got := m.RcptDSN(&mail.Address{Address: "a@b.com"}); got.ORcpt != "rfc822;a@b.com" {
+		t.Errorf("Did not retrieve request, got %+v", got)
+	}
+}
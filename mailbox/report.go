@@ -0,0 +1,216 @@
+package mailbox
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hostname identifies this system as the Reporting-MTA in delivery status
+// notifications. It should be set to the host name that the SMTP server uses.
+var Hostname = "localhost"
+
+// Delivery status notification actions, as per RFC 3464 2.3.3.
+const (
+	actionFailed    = "failed"
+	actionDelayed   = "delayed"
+	actionDelivered = "delivered"
+	actionRelayed   = "relayed"
+)
+
+// notifyEvent returns the RFC 3461 NOTIFY event which requests notifications
+// for the given action.
+func notifyEvent(action string) string {
+	switch action {
+	case actionDelayed:
+		return "DELAY"
+	case actionDelivered, actionRelayed:
+		return "SUCCESS"
+	}
+	return "FAILURE"
+}
+
+// deliveryReport holds the information needed to compose an RFC 3464 delivery
+// status notification for a set of recipients of a message.
+type deliveryReport struct {
+	// The message that the report is about.
+	msg *Message
+	// Recipients which the report is about.
+	rcpt []*mail.Address
+	// Action taken for the recipients. Defaults to actionFailed.
+	action string
+	// Reason holds the error that caused the report.
+	reason error
+	// Date of the report.
+	date time.Time
+}
+
+// enhancedStatus matches an RFC 3463 enhanced status code at the beginning of
+// an SMTP reply text.
+var enhancedStatus = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\b`)
+
+// status returns the RFC 3463 status code of the report, extracting it from the
+// SMTP reply or the error that caused it, if available.
+func (r deliveryReport) status() string {
+	switch r.action {
+	case actionDelivered, actionRelayed:
+		return "2.0.0"
+	}
+	switch err := r.reason.(type) {
+	case *textproto.Error:
+		if m := enhancedStatus.FindStringSubmatch(err.Msg); m != nil {
+			return m[1]
+		}
+		if class := err.Code / 100; class == 4 || class == 5 {
+			return fmt.Sprintf("%d.0.0", class)
+		}
+	case error:
+		if m := enhancedStatus.FindStringSubmatch(err.Error()); m != nil {
+			return m[1]
+		}
+	}
+	if r.action == actionDelayed {
+		return "4.0.0"
+	}
+	return "5.0.0"
+}
+
+// diagnostic returns the reason in a form suitable for a single header line.
+func (r deliveryReport) diagnostic() string {
+	var text string
+	switch err := r.reason.(type) {
+	case nil:
+		return ""
+	case *textproto.Error:
+		text = fmt.Sprintf("%d %s", err.Code, err.Msg)
+	default:
+		text = err.Error()
+	}
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// reportText holds the subject and the human readable explanation of the
+// notifications sent for each action.
+var reportText = map[string][2]string{
+	actionFailed: {"Undelivered Mail Returned to Sender",
+		"Your message could not be delivered to one or more recipients.\r\n" +
+			"It has been returned below, with the errors that occurred.\r\n"},
+	actionDelayed: {"Delayed Mail (still being retried)",
+		"Your message could not be delivered to one or more recipients yet.\r\n" +
+			"Delivery will be retried, no action is required on your part.\r\n"},
+	actionDelivered: {"Successful Mail Delivery Report",
+		"Your message was successfully delivered to the recipients below.\r\n"},
+	actionRelayed: {"Successful Mail Delivery Report",
+		"Your message was relayed to the recipients below. Their mail systems\r\n" +
+			"do not send further delivery status notifications.\r\n"},
+}
+
+// compose builds the raw delivery status notification, as a multipart/report
+// message consisting of a human readable explanation, the machine readable
+// message/delivery-status part and the headers of the original message. When
+// the sender asked for it using RET=FULL, failure notifications return the
+// entire original message instead.
+func (r deliveryReport) compose(id uint64) string {
+	action := r.action
+	if action == "" {
+		action = actionFailed
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	// Human readable explanation.
+	part, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=us-ascii"},
+	})
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", Hostname)
+	fmt.Fprintf(part, "%s\r\n", reportText[action][1])
+	for _, rcpt := range r.rcpt {
+		if diag := r.diagnostic(); diag != "" {
+			fmt.Fprintf(part, "<%s>: %s\r\n", rcpt.Address, diag)
+		} else {
+			fmt.Fprintf(part, "<%s>\r\n", rcpt.Address)
+		}
+	}
+
+	// Machine readable report.
+	part, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"message/delivery-status"},
+	})
+	if r.msg.EnvID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", decodeXtext(r.msg.EnvID))
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", Hostname)
+	for _, rcpt := range r.rcpt {
+		fmt.Fprint(part, "\r\n")
+		if orcpt := r.msg.RcptDSN(rcpt).ORcpt; orcpt != "" {
+			fmt.Fprintf(part, "Original-Recipient: %s\r\n", decodeXtext(orcpt))
+		}
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", rcpt.Address)
+		fmt.Fprintf(part, "Action: %s\r\n", action)
+		fmt.Fprintf(part, "Status: %s\r\n", r.status())
+		if _, ok := r.reason.(*textproto.Error); ok {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", r.diagnostic())
+		}
+	}
+
+	// Original message or its headers.
+	if action == actionFailed && r.msg.Ret == "FULL" {
+		part, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"message/rfc822"},
+		})
+		fmt.Fprint(part, r.msg.Raw)
+	} else {
+		part, _ = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"text/rfc822-headers"},
+		})
+		fmt.Fprint(part, headerSection(r.msg.Raw))
+	}
+	mw.Close()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", Hostname)
+	fmt.Fprintf(&buf, "To: %s\r\n", r.msg.From())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", reportText[action][0])
+	fmt.Fprintf(&buf, "Date: %s\r\n", r.date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%x.%d@%s>\r\n", r.date.UnixNano(), id, Hostname)
+	fmt.Fprint(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprint(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n"+
+		"\tboundary=\"%s\"\r\n\r\n", mw.Boundary())
+	buf.Write(body.Bytes())
+	return buf.String()
+}
+
+// headerSection returns the header section of a raw message, including the
+// line break that ends the last header.
+func headerSection(raw string) string {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := strings.Index(raw, sep); i != -1 {
+			return raw[:i+len(sep)/2]
+		}
+	}
+	return raw
+}
+
+// decodeXtext decodes the "+HH" hexadecimal escapes of an RFC 3461 xtext
+// value. Malformed escapes are left as they are.
+func decodeXtext(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '+' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				buf.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
@@ -0,0 +1,186 @@
+package mailbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveryReport_Status(t *testing.T) {
+	for _, test := range []struct {
+		Reason error
+		Status string
+	}{
+		{&textproto.Error{Code: 550, Msg: "5.1.1 No such user"}, "5.1.1"},
+		{&textproto.Error{Code: 552, Msg: "5.3.4 Message too big"}, "5.3.4"},
+		{&textproto.Error{Code: 451, Msg: "4.3.0 Try again"}, "4.3.0"},
+		{&textproto.Error{Code: 550, Msg: "No such user"}, "5.0.0"},
+		{&textproto.Error{Code: 421, Msg: "Service not available"}, "4.0.0"},
+		{&textproto.Error{Code: 550, Msg: "5.1.10 Null MX"}, "5.1.10"},
+		{errors.New("connection refused"), "5.0.0"},
+		{errors.New("5.6.7 SMTPUTF8 not supported"), "5.6.7"},
+		{nil, "5.0.0"},
+	} {
+		r := deliveryReport{reason: test.Reason}
+		if got := r.status(); got != test.Status {
+			t.Errorf("Expected status %s for '%v', got %s", test.Status, test.Reason, got)
+		}
+	}
+}
+
+func TestDeliveryReport_Compose(t *testing.T) {
+	Hostname = "mecca.local"
+	orig := &Message{
+		ID:  5,
+		Raw: "From: Jane <jane@doe.com>\r\nSubject: Hi\r\n\r\nSecret body",
+	}
+	orig.SetFrom(&mail.Address{Name: "Jane", Address: "jane@doe.com"})
+
+	r := deliveryReport{
+		msg:    orig,
+		rcpt:   addrList("x@y.com", "z@y.com"),
+		reason: &textproto.Error{Code: 550, Msg: "5.1.1 No such\nuser"},
+		date:   time.Date(2014, 10, 26, 12, 0, 0, 0, time.UTC),
+	}
+	msg, err := (&Message{Raw: r.compose(12)}).Parse()
+	if err != nil {
+		t.Fatalf("Could not parse report: %s", err)
+	}
+
+	for hdr, want := range map[string]string{
+		"From":           "Mail Delivery System <MAILER-DAEMON@mecca.local>",
+		"To":             `"Jane" <jane@doe.com>`,
+		"Auto-Submitted": "auto-replied",
+		"Date":           "Sun, 26 Oct 2014 12:00:00 +0000",
+	} {
+		if got := msg.Header.Get(hdr); got != want {
+			t.Errorf("Expected %s header '%s', got '%s'", hdr, want, got)
+		}
+	}
+	if !strings.HasSuffix(msg.Header.Get("Message-Id"), ".12@mecca.local>") {
+		t.Errorf("Bad Message-ID: %s", msg.Header.Get("Message-Id"))
+	}
+
+	mt, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mt != "multipart/report" || params["report-type"] != "delivery-status" {
+		t.Fatalf("Bad Content-Type: %s (%v)", msg.Header.Get("Content-Type"), err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(p)
+		parts = append(parts, string(b))
+		types = append(types, p.Header.Get("Content-Type"))
+	}
+	if len(parts) != 3 {
+		t.Fatalf("Expected 3 parts, got %d", len(parts))
+	}
+	if !strings.HasPrefix(types[0], "text/plain") ||
+		types[1] != "message/delivery-status" ||
+		types[2] != "text/rfc822-headers" {
+		t.Errorf("Bad part types: %v", types)
+	}
+	for _, want := range []string{
+		"Reporting-MTA: dns; mecca.local\r\n",
+		"\r\nFinal-Recipient: rfc822; x@y.com\r\nAction: failed\r\nStatus: 5.1.1\r\n" +
+			"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n",
+		"\r\nFinal-Recipient: rfc822; z@y.com\r\n",
+	} {
+		if !strings.Contains(parts[1], want) {
+			t.Errorf("Expected delivery-status to contain %q, got:\n%s", want, parts[1])
+		}
+	}
+	if parts[2] != "From: Jane <jane@doe.com>\r\nSubject: Hi\r\n" {
+		t.Errorf("Bad original headers: %q", parts[2])
+	}
+	if !strings.Contains(parts[0], "<x@y.com>: 550 5.1.1 No such user") {
+		t.Errorf("Explanation does not name recipient: %s", parts[0])
+	}
+}
+
+// It should compose notifications for each action, honoring the RET, ENVID
+// and ORCPT parameters of the reported message.
+func TestDeliveryReport_Compose_DSN(t *testing.T) {
+	Hostname = "mecca.local"
+	orig := &Message{
+		ID:    5,
+		Raw:   "Subject: Hi\r\n\r\nSecret body",
+		Ret:   "FULL",
+		EnvID: "QQ+2B314",
+	}
+	orig.SetFrom(&mail.Address{Address: "jane@doe.com"})
+	rcpt := addrList("x@y.com")
+	orig.SetRcptDSN(rcpt[0], RcptDSN{"SUCCESS,DELAY,FAILURE", "rfc822;X+2By@y.com"})
+
+	for _, test := range []struct {
+		Action, Reason, Subject, Status, Part string
+	}{
+		{actionFailed, "5.1.1 No such user", "Undelivered Mail Returned to Sender", "5.1.1", "Secret body"},
+		{actionDelayed, "4.3.0 Try again", "Delayed Mail (still being retried)", "4.3.0", ""},
+		{actionDelivered, "", "Successful Mail Delivery Report", "2.0.0", ""},
+		{actionRelayed, "", "Successful Mail Delivery Report", "2.0.0", ""},
+	} {
+		r := deliveryReport{msg: orig, rcpt: rcpt, action: test.Action, date: time.Now()}
+		if test.Reason != "" {
+			r.reason = &textproto.Error{Code: 550, Msg: test.Reason}
+		}
+		raw := r.compose(12)
+		msg, err := (&Message{Raw: raw}).Parse()
+		if err != nil {
+			t.Fatalf("%s: could not parse report: %s", test.Action, err)
+		}
+		if got := msg.Header.Get("Subject"); got != test.Subject {
+			t.Errorf("%s: expected subject %q, got %q", test.Action, test.Subject, got)
+		}
+		for _, want := range []string{
+			"Original-Envelope-Id: QQ+314\r\nReporting-MTA: dns; mecca.local\r\n",
+			"\r\nOriginal-Recipient: rfc822;X+y@y.com\r\nFinal-Recipient: rfc822; x@y.com\r\n" +
+				"Action: " + test.Action + "\r\nStatus: " + test.Status + "\r\n",
+		} {
+			if !strings.Contains(raw, want) {
+				t.Errorf("%s: expected report to contain %q, got:\n%s", test.Action, want, raw)
+			}
+		}
+		full := strings.Contains(raw, "Content-Type: message/rfc822")
+		if full != (test.Part != "") || full && !strings.Contains(raw, test.Part) {
+			t.Errorf("%s: expected full message %t, got:\n%s", test.Action, test.Part != "", raw)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	for _, test := range []struct{ In, Out string }{
+		{"abc", "abc"},
+		{"a+2Bb+3D", "a+b="},
+		{"a+2", "a+2"},
+		{"a+ZZ", "a+ZZ"},
+	} {
+		if got := decodeXtext(test.In); got != test.Out {
+			t.Errorf("decodeXtext(%q): expected %q, got %q", test.In, test.Out, got)
+		}
+	}
+}
+
+func TestHeaderSection(t *testing.T) {
+	for _, test := range []struct{ Raw, Header string }{
+		{"A: b\r\nC: d\r\n\r\nBody\r\n\r\nMore", "A: b\r\nC: d\r\n"},
+		{"A: b\n\nBody", "A: b\n"},
+		{"A: b", "A: b"},
+	} {
+		if got := headerSection(test.Raw); got != test.Header {
+			t.Errorf("Expected %q, got %q", test.Header, got)
+		}
+	}
+}
@@ -47,6 +47,20 @@ CREATE EXTENSION IF NOT EXISTS plpgsql WITH SCHEMA pg_catalog;
 COMMENT ON EXTENSION plpgsql IS 'PL/pgSQL procedural language';
 
 
+--
+-- Name: pgcrypto; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA public;
+
+
+--
+-- Name: EXTENSION pgcrypto; Type: COMMENT; Schema: -; Owner: -
+--
+
+COMMENT ON EXTENSION pgcrypto IS 'cryptographic functions';
+
+
 SET search_path = public, pg_catalog;
 
 SET default_tablespace = '';
@@ -60,10 +74,56 @@ SET default_with_oids = false;
 
 CREATE TABLE mailbox (
     user_id bigint NOT NULL,
-    message_id bigint NOT NULL
+    message_id bigint NOT NULL,
+    folder_id bigint,
+    uid bigint,
+    flags character varying DEFAULT '' NOT NULL,
+    date_added timestamp with time zone DEFAULT now() NOT NULL
 );
 
 
+--
+-- Name: dmarc_reported; Type: TABLE; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE TABLE dmarc_reported (
+    id integer DEFAULT 1 NOT NULL,
+    last_report timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: folders; Type: TABLE; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE TABLE folders (
+    id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    name character varying(255) NOT NULL,
+    uid_validity bigint NOT NULL,
+    uid_next bigint DEFAULT 1 NOT NULL
+);
+
+
+--
+-- Name: folders_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE folders_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: folders_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE folders_id_seq OWNED BY folders.id;
+
+
 --
 -- TOC entry 174 (class 1259 OID 16419)
 -- Name: message_ids; Type: SEQUENCE; Schema: public; Owner: -
@@ -86,7 +146,12 @@ CREATE TABLE messages (
     id bigint NOT NULL,
     "from" character varying(255) NOT NULL,
     rcpt character varying NOT NULL,
-    raw text NOT NULL CHECK (raw <> '')
+    raw text NOT NULL CHECK (raw <> ''),
+    ret character varying DEFAULT '' NOT NULL,
+    envid character varying DEFAULT '' NOT NULL,
+    utf8 boolean DEFAULT false NOT NULL,
+    "binary" boolean DEFAULT false NOT NULL,
+    authserv_id character varying DEFAULT '' NOT NULL
 );
 
 
@@ -100,7 +165,39 @@ CREATE TABLE queue (
     message_id bigint NOT NULL CHECK (message_id <> 0),
     "user" character varying NOT NULL,
     date_added timestamp without time zone NOT NULL,
-    attempts integer
+    attempts integer,
+    last_error text,
+    next_attempt timestamp without time zone DEFAULT now() NOT NULL,
+    lease_owner character varying,
+    lease_expires timestamp without time zone,
+    notify character varying DEFAULT '' NOT NULL,
+    orcpt character varying DEFAULT '' NOT NULL
+);
+
+
+--
+-- Name: dmarc_results; Type: TABLE; Schema: public; Owner: -; Tablespace: 
+--
+
+CREATE TABLE dmarc_results (
+    domain character varying NOT NULL,
+    p character varying NOT NULL,
+    sp character varying NOT NULL,
+    pct integer NOT NULL,
+    adkim character varying NOT NULL,
+    aspf character varying NOT NULL,
+    rua character varying NOT NULL,
+    source_ip character varying NOT NULL,
+    header_from character varying NOT NULL,
+    envelope_from character varying NOT NULL,
+    disposition character varying NOT NULL,
+    dkim character varying NOT NULL,
+    spf character varying NOT NULL,
+    dkim_auth character varying DEFAULT '' NOT NULL,
+    spf_domain character varying DEFAULT '' NOT NULL,
+    spf_scope character varying DEFAULT '' NOT NULL,
+    spf_result character varying DEFAULT '' NOT NULL,
+    date_added timestamp with time zone DEFAULT now() NOT NULL
 );
 
 
@@ -113,7 +210,8 @@ CREATE TABLE users (
     id bigint NOT NULL,
     name character varying(255),
     username character varying(255),
-    host character varying(255)
+    host character varying(255),
+    password character varying(255)
 );
 
 
@@ -147,6 +245,13 @@ ALTER SEQUENCE users_id_seq OWNED BY users.id;
 ALTER TABLE ONLY users ALTER COLUMN id SET DEFAULT nextval('users_id_seq'::regclass);
 
 
+--
+-- Name: id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY folders ALTER COLUMN id SET DEFAULT nextval('folders_id_seq'::regclass);
+
+
 --
 -- TOC entry 2108 (class 2606 OID 16398)
 -- Name: address; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
@@ -165,6 +270,30 @@ ALTER TABLE ONLY mailbox
     ADD CONSTRAINT inbox UNIQUE (message_id, user_id);
 
 
+--
+-- Name: folder_uid; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY mailbox
+    ADD CONSTRAINT folder_uid UNIQUE (folder_id, uid);
+
+
+--
+-- Name: folders_pkey; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY folders
+    ADD CONSTRAINT folders_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: folder_name; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY folders
+    ADD CONSTRAINT folder_name UNIQUE (user_id, name);
+
+
 --
 -- TOC entry 2112 (class 2606 OID 16410)
 -- Name: messages_pkey; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
@@ -174,6 +303,14 @@ ALTER TABLE ONLY messages
     ADD CONSTRAINT messages_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: dmarc_reported_pkey; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
+--
+
+ALTER TABLE ONLY dmarc_reported
+    ADD CONSTRAINT dmarc_reported_pkey PRIMARY KEY (id);
+
+
 --
 -- TOC entry 2110 (class 2606 OID 16396)
 -- Name: users_pkey; Type: CONSTRAINT; Schema: public; Owner: -; Tablespace: 
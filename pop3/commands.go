@@ -0,0 +1,246 @@
+package pop3
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+// notValid is sent when a command is used in the wrong state.
+const notValid = "command not valid in this state"
+
+// RFC 1939 7. USER name
+func cmdUSER(c *session, args []string) error {
+	switch {
+	case c.State != stateAuthorization:
+		return c.err(notValid)
+	case len(args) != 1 || args[0] == "":
+		return c.err("syntax: USER name")
+	}
+	c.Name = args[0]
+	return c.ok("send PASS")
+}
+
+// RFC 1939 7. PASS string
+func cmdPASS(c *session, args []string) error {
+	switch {
+	case c.State != stateAuthorization:
+		return c.err(notValid)
+	case c.Name == "":
+		return c.err("send USER first")
+	}
+	// The password may contain spaces.
+	pass := strings.Join(args, " ")
+	addr := &mail.Address{Address: c.host.user(c.Name)}
+	c.Name = ""
+
+	ok, err := c.host.mailbox.Authenticate(addr, pass)
+	if err != nil {
+		log.Printf("error authenticating %s: %s", addr.Address, err)
+		return c.err("[SYS/TEMP] unable to authenticate, try again later")
+	}
+	if !ok {
+		return c.err("[AUTH] invalid user name or password")
+	}
+	if !c.host.maildrops.lock(addr.Address) {
+		return c.err("[IN-USE] maildrop already locked")
+	}
+	list, err := c.host.mailbox.Inbox(addr)
+	if err != nil {
+		c.host.maildrops.unlock(addr.Address)
+		log.Printf("error opening inbox of %s: %s", addr.Address, err)
+		return c.err("[SYS/TEMP] unable to open maildrop, try again later")
+	}
+	c.User = addr
+	c.Messages = list
+	c.Deleted = make(map[int]bool)
+	c.State = stateTransaction
+	n, octets := c.stat()
+	return c.ok("maildrop has %d messages (%d octets)", n, octets)
+}
+
+// RFC 1939 5. STAT
+func cmdSTAT(c *session, args []string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	n, octets := c.stat()
+	return c.ok("%d %d", n, octets)
+}
+
+// stat returns the number of messages which are not marked as deleted, and
+// their total size.
+func (c *session) stat() (n, octets int) {
+	for i, msg := range c.Messages {
+		if !c.Deleted[i+1] {
+			n++
+			octets += size(msg)
+		}
+	}
+	return n, octets
+}
+
+// RFC 1939 5. LIST [msg]
+func cmdLIST(c *session, args []string) error {
+	return c.listing(args, func(n int, c *session) string {
+		return fmt.Sprintf("%d %d", n, size(c.Messages[n-1]))
+	})
+}
+
+// RFC 1939 7. UIDL [msg]
+func cmdUIDL(c *session, args []string) error {
+	return c.listing(args, func(n int, c *session) string {
+		return fmt.Sprintf("%d %d", n, c.Messages[n-1].ID)
+	})
+}
+
+// listing replies with a scan listing of the given message, or of all the
+// messages which are not marked as deleted.
+func (c *session) listing(args []string, line func(int, *session) string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	if len(args) > 0 {
+		n, _, ok := c.message(args[0])
+		if !ok {
+			return c.err("no such message")
+		}
+		return c.ok("%s", line(n, c))
+	}
+	if err := c.ok("listing follows"); err != nil {
+		return err
+	}
+	w := c.text.DotWriter()
+	for n := range c.Messages {
+		if !c.Deleted[n+1] {
+			fmt.Fprintf(w, "%s\r\n", line(n+1, c))
+		}
+	}
+	return w.Close()
+}
+
+// RFC 1939 5. RETR msg
+func cmdRETR(c *session, args []string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	if len(args) != 1 {
+		return c.err("syntax: RETR msg")
+	}
+	_, msg, ok := c.message(args[0])
+	if !ok {
+		return c.err("no such message")
+	}
+	if err := c.ok("%d octets", size(msg)); err != nil {
+		return err
+	}
+	w := c.text.DotWriter()
+	io.WriteString(w, msg.Raw)
+	return w.Close()
+}
+
+// RFC 1939 7. TOP msg n
+func cmdTOP(c *session, args []string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	if len(args) != 2 {
+		return c.err("syntax: TOP msg n")
+	}
+	_, msg, ok := c.message(args[0])
+	if !ok {
+		return c.err("no such message")
+	}
+	lines, err := strconv.Atoi(args[1])
+	if err != nil || lines < 0 {
+		return c.err("syntax: TOP msg n")
+	}
+	if err := c.ok("top of message follows"); err != nil {
+		return err
+	}
+	w := c.text.DotWriter()
+	io.WriteString(w, top(msg.Raw, lines))
+	return w.Close()
+}
+
+// top returns the header section of a raw message, the blank line which
+// follows it and the first n lines of its body.
+func top(raw string, n int) string {
+	lines := strings.SplitAfter(raw, "\n")
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r\n") == "" {
+			if end := i + 1 + n; end < len(lines) {
+				lines = lines[:end]
+			}
+			return strings.Join(lines, "")
+		}
+	}
+	// The message has no body.
+	return raw
+}
+
+// RFC 1939 5. DELE msg
+func cmdDELE(c *session, args []string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	if len(args) != 1 {
+		return c.err("syntax: DELE msg")
+	}
+	n, _, ok := c.message(args[0])
+	if !ok {
+		return c.err("no such message")
+	}
+	c.Deleted[n] = true
+	return c.ok("message %d deleted", n)
+}
+
+// RFC 1939 5. NOOP
+func cmdNOOP(c *session, args []string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	return c.ok("")
+}
+
+// RFC 1939 5. RSET
+func cmdRSET(c *session, args []string) error {
+	if c.State != stateTransaction {
+		return c.err(notValid)
+	}
+	c.Deleted = make(map[int]bool)
+	n, octets := c.stat()
+	return c.ok("maildrop has %d messages (%d octets)", n, octets)
+}
+
+// RFC 1939 6. QUIT
+// Messages marked as deleted are removed from the inbox when the session
+// ends via QUIT, but not when the connection is lost.
+func cmdQUIT(c *session, args []string) error {
+	if c.State == stateTransaction && len(c.Deleted) > 0 {
+		ids := make([]uint64, 0, len(c.Deleted))
+		for n := range c.Deleted {
+			ids = append(ids, c.Messages[n-1].ID)
+		}
+		if err := c.host.mailbox.Remove(c.User, ids); err != nil {
+			log.Printf("error removing messages of %s: %s", c.User.Address, err)
+			c.err("some deleted messages not removed")
+			return io.EOF
+		}
+	}
+	c.ok("%s Gomez POP3 signing off", c.host.config.Get("host"))
+	return io.EOF
+}
+
+// RFC 2449 5. CAPA
+func cmdCAPA(c *session, args []string) error {
+	if err := c.ok("capability list follows"); err != nil {
+		return err
+	}
+	w := c.text.DotWriter()
+	fmt.Fprint(w, "USER\r\nTOP\r\nUIDL\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nIMPLEMENTATION Gomez\r\n")
+	return w.Close()
+}
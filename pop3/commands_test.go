@@ -0,0 +1,78 @@
+package pop3
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+func TestTop(t *testing.T) {
+	for _, test := range []struct {
+		raw    string
+		n      int
+		expect string
+	}{
+		{"A: b\r\n\r\n1\r\n2\r\n3", 0, "A: b\r\n\r\n"},
+		{"A: b\r\n\r\n1\r\n2\r\n3", 2, "A: b\r\n\r\n1\r\n2\r\n"},
+		{"A: b\r\n\r\n1\r\n2\r\n3", 5, "A: b\r\n\r\n1\r\n2\r\n3"},
+		{"A: b\n\n1\n2", 1, "A: b\n\n1\n"},
+		{"A: b\r\nC: d", 1, "A: b\r\nC: d"},
+	} {
+		if got := top(test.raw, test.n); got != test.expect {
+			t.Errorf("top(%q, %d): expected %q, got %q", test.raw, test.n, test.expect, got)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, test := range []struct {
+		raw    string
+		expect int
+	}{
+		{"A: b\r\n\r\nBody", 14},
+		{"A: b\r\n\r\nBody\r\n", 14},
+		{"A: b\n\nBody\n", 14},
+		{"", 2},
+	} {
+		if got := size(&mailbox.Message{Raw: test.raw}); got != test.expect {
+			t.Errorf("size(%q): expected %d, got %d", test.raw, test.expect, got)
+		}
+	}
+}
+
+// Commands of the transaction state should not be available before
+// authenticating, and USER/PASS should not be available after.
+func TestCmd_States(t *testing.T) {
+	for _, fn := range []func(*session, []string) error{
+		cmdSTAT, cmdLIST, cmdUIDL, cmdRETR, cmdDELE, cmdTOP, cmdNOOP, cmdRSET,
+	} {
+		c, pipe := getTestClient(stateAuthorization)
+		go fn(c, []string{"1", "1"})
+		if line, _ := pipe.ReadLine(); line != "-ERR "+notValid {
+			t.Errorf("Expected %s, got %s", notValid, line)
+		}
+		pipe.Close()
+	}
+	for _, fn := range []func(*session, []string) error{cmdUSER, cmdPASS} {
+		c, pipe := getTestClient(stateTransaction)
+		go fn(c, []string{"name"})
+		if line, _ := pipe.ReadLine(); line != "-ERR "+notValid {
+			t.Errorf("Expected %s, got %s", notValid, line)
+		}
+		pipe.Close()
+	}
+}
+
+// getTestClient returns a session in the given state and the client end of
+// its connection.
+func getTestClient(state int) (*session, *textproto.Conn) {
+	cc, sc := net.Pipe()
+	c := &session{
+		State:   state,
+		Deleted: make(map[int]bool),
+		text:    textproto.NewConn(sc),
+	}
+	return c, textproto.NewConn(cc)
+}
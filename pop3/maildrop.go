@@ -0,0 +1,44 @@
+package pop3
+
+import (
+	"strings"
+	"sync"
+)
+
+// maildrops holds the exclusive locks which sessions take on the maildrops
+// of their users, as required by RFC 1939 8. All methods are safe to call on
+// a nil value, in which case every lock is granted.
+type maildrops struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func newMaildrops() *maildrops {
+	return &maildrops{locked: make(map[string]bool)}
+}
+
+// lock locks the maildrop of the user with the given address. It reports
+// false if it is already locked.
+func (m *maildrops) lock(addr string) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(addr)
+	if m.locked[key] {
+		return false
+	}
+	m.locked[key] = true
+	return true
+}
+
+// unlock releases the maildrop of the user with the given address.
+func (m *maildrops) unlock(addr string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.locked, strings.ToLower(addr))
+}
@@ -0,0 +1,144 @@
+// Package pop3 implements a POP3 server (RFC 1939) which gives users access
+// to the messages in their mailbox inboxes.
+package pop3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// Host server instance.
+type server struct {
+	spec      commandSpec
+	config    jamon.Group
+	mailbox   mailbox.Interface
+	active    *tracker   // open sessions
+	maildrops *maildrops // locked maildrops
+}
+
+// commandSpec holds a set of supported commands, mapping names to actions.
+type commandSpec map[string]func(*session, []string) error
+
+// ErrMinConfig is returned when the minimum configuration is not passed to the server.
+// A listen address (host:port) passed via the 'listen' and a 'host' is required.
+var ErrMinConfig = errors.New("Minimum config not met. Need at least 'listen' and 'host'")
+
+// Start initiates a new POP3 server given a mailbox and a configuration.
+// Once authenticated, a session holds an exclusive lock on the user's
+// maildrop, as per RFC 1939 8, and other sessions of the user are refused
+// with [IN-USE]. Sessions which send no command within 'timeout' seconds
+// (default 600, the least allowed by RFC 1939 3) are closed.
+func Start(mb mailbox.Interface, cfg jamon.Group) error {
+	return StartContext(context.Background(), mb, cfg)
+}
+
+// StartContext is like Start, but shuts the server down once the given context
+// is done. The server then stops accepting connections and closes idle
+// sessions, while sessions which are in the middle of a command are given
+// 'shutdown.timeout' seconds (default 30) to complete it. It returns nil once
+// all sessions have ended. Messages marked as deleted are only removed when a
+// session ends with QUIT.
+func StartContext(ctx context.Context, mb mailbox.Interface, cfg jamon.Group) error {
+	if !cfg.Has("listen") || !cfg.Has("host") {
+		return ErrMinConfig
+	}
+	ln, err := net.Listen("tcp", cfg.Get("listen"))
+	if err != nil {
+		return err
+	}
+	srv := server{mailbox: mb, config: cfg, active: newTracker(), maildrops: newMaildrops()}
+	srv.spec = commandSpec{
+		"USER": cmdUSER,
+		"PASS": cmdPASS,
+		"STAT": cmdSTAT,
+		"LIST": cmdLIST,
+		"UIDL": cmdUIDL,
+		"RETR": cmdRETR,
+		"DELE": cmdDELE,
+		"TOP":  cmdTOP,
+		"NOOP": cmdNOOP,
+		"RSET": cmdRSET,
+		"QUIT": cmdQUIT,
+		"CAPA": cmdCAPA,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				srv.active.shutdown(srv.seconds("shutdown.timeout", 30))
+				return nil
+			}
+			log.Printf("Error accepting an incoming connection: %s\r\n", err)
+			continue
+		}
+		srv.active.add()
+		go srv.createSession(conn)
+	}
+}
+
+// createSession creates a new session based on the given connection. When
+// the server is tracking sessions, add must be called beforehand.
+func (s server) createSession(conn net.Conn) {
+	defer conn.Close()
+	c := &session{
+		State:   stateAuthorization,
+		host:    s,
+		text:    textproto.NewConn(conn),
+		conn:    conn,
+		timeout: s.seconds("timeout", 600),
+	}
+	s.active.track(c)
+	defer s.active.done(c)
+	defer c.unlock()
+	c.ok("%s Gomez POP3 ready", s.config.Get("host"))
+	c.serve()
+}
+
+// run executes a command in the context of a session. Command names are
+// case-insensitive and are separated from their arguments by single spaces.
+func (s server) run(c *session, line string) error {
+	args := strings.Split(line, " ")
+	command, ok := s.spec[strings.ToUpper(args[0])]
+	if !ok {
+		return c.err("unknown command")
+	}
+	return command(c, args[1:])
+}
+
+// seconds returns the duration set by a configuration flag in seconds, or def
+// seconds if the flag is not set or is not numeric. Zero disables a timeout.
+func (s server) seconds(flag string, def int) time.Duration {
+	n, err := strconv.Atoi(s.config.Get(flag))
+	if err != nil || n < 0 {
+		n = def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// user returns the address of a user identifying with the given name. Names
+// which lack a host are considered to be local to the server's host.
+func (s server) user(name string) string {
+	if strings.Contains(name, "@") {
+		return name
+	}
+	return fmt.Sprintf("%s@%s", name, s.config.Get("host"))
+}
@@ -0,0 +1,292 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// getTestServer returns a server with the given mailbox.
+func getTestServer(mb mailbox.Interface) server {
+	return server{
+		mailbox: mb,
+		config:  jamon.Group{"host": "mecca.local"},
+		spec: commandSpec{
+			"USER": cmdUSER, "PASS": cmdPASS, "STAT": cmdSTAT, "LIST": cmdLIST,
+			"UIDL": cmdUIDL, "RETR": cmdRETR, "DELE": cmdDELE, "TOP": cmdTOP,
+			"NOOP": cmdNOOP, "RSET": cmdRSET, "QUIT": cmdQUIT, "CAPA": cmdCAPA,
+		},
+	}
+}
+
+// getTestSession returns a server with the given mailbox and the client end
+// of a session which is being served by it.
+func getTestSession(t *testing.T, mb mailbox.Interface) *textproto.Conn {
+	return startTestSession(t, getTestServer(mb))
+}
+
+// startTestSession returns the client end of a session which is being served
+// by srv.
+func startTestSession(t *testing.T, srv server) *textproto.Conn {
+	cc, sc := net.Pipe()
+	go srv.createSession(sc)
+	client := textproto.NewConn(cc)
+	if line, err := client.ReadLine(); err != nil || !strings.HasPrefix(line, "+OK mecca.local") {
+		t.Fatalf("Bad greeting %q (%v)", line, err)
+	}
+	return client
+}
+
+// exchange sends a command and returns the reply line, along with the lines
+// which follow it if multi is true.
+func exchange(t *testing.T, c *textproto.Conn, cmd string, multi bool) (string, []string) {
+	if err := c.PrintfLine("%s", cmd); err != nil {
+		t.Fatalf("Error sending %s: %s", cmd, err)
+	}
+	line, err := c.ReadLine()
+	if err != nil {
+		t.Fatalf("Error reading reply to %s: %s", cmd, err)
+	}
+	if !multi || !strings.HasPrefix(line, "+OK") {
+		return line, nil
+	}
+	lines, err := c.ReadDotLines()
+	if err != nil {
+		t.Fatalf("Error reading lines of %s: %s", cmd, err)
+	}
+	return line, lines
+}
+
+func TestServer_Session(t *testing.T) {
+	var removed []uint64
+	done := make(chan struct{})
+	mb := &mailbox.MockInterface{
+		AuthenticateMock: func(addr *mail.Address, pass string) (bool, error) {
+			return addr.Address == "jane@mecca.local" && pass == "pass word", nil
+		},
+		InboxMock: func(addr *mail.Address) ([]*mailbox.Message, error) {
+			return []*mailbox.Message{
+				{ID: 10, Raw: "Subject: A\r\n\r\nFirst\r\n.dot\r\nline"},
+				{ID: 20, Raw: "Subject: B\r\n\r\nSecond"},
+				{ID: 30, Raw: "Subject: C\r\n\r\nThird"},
+			}, nil
+		},
+		RemoveMock: func(addr *mail.Address, ids []uint64) error {
+			defer close(done)
+			if addr.Address != "jane@mecca.local" {
+				t.Errorf("Removing from wrong inbox: %s", addr)
+			}
+			removed = ids
+			return nil
+		},
+	}
+	c := getTestSession(t, mb)
+	defer c.Close()
+
+	for _, test := range []struct {
+		cmd   string
+		multi bool
+		reply string
+		lines []string
+	}{
+		{"STAT", false, "-ERR " + notValid, nil},
+		{"PASS secret", false, "-ERR send USER first", nil},
+		{"USER jane", false, "+OK send PASS", nil},
+		{"PASS wrong", false, "-ERR [AUTH] invalid user name or password", nil},
+		{"PASS pass word", false, "-ERR send USER first", nil},
+		{"USER jane", false, "+OK send PASS", nil},
+		{"PASS pass word", false, "+OK maildrop has 3 messages (76 octets)", nil},
+		{"USER jane", false, "-ERR " + notValid, nil},
+		{"STAT", false, "+OK 3 76", nil},
+		{"LIST", true, "+OK listing follows", []string{"1 33", "2 22", "3 21"}},
+		{"LIST 2", false, "+OK 2 22", nil},
+		{"LIST 4", false, "-ERR no such message", nil},
+		{"UIDL", true, "+OK listing follows", []string{"1 10", "2 20", "3 30"}},
+		{"RETR 1", true, "+OK 33 octets", []string{"Subject: A", "", "First", ".dot", "line"}},
+		{"TOP 1 1", true, "+OK top of message follows", []string{"Subject: A", "", "First"}},
+		{"TOP 1 x", false, "-ERR syntax: TOP msg n", nil},
+		{"DELE 1", false, "+OK message 1 deleted", nil},
+		{"DELE 1", false, "-ERR no such message", nil},
+		{"RETR 1", false, "-ERR no such message", nil},
+		{"STAT", false, "+OK 2 43", nil},
+		{"RSET", false, "+OK maildrop has 3 messages (76 octets)", nil},
+		{"dele 1", false, "+OK message 1 deleted", nil},
+		{"DELE 3", false, "+OK message 3 deleted", nil},
+		{"UIDL", true, "+OK listing follows", []string{"2 20"}},
+		{"NOOP", false, "+OK ", nil},
+		{"BOGUS", false, "-ERR unknown command", nil},
+		{"QUIT", false, "+OK mecca.local Gomez POP3 signing off", nil},
+	} {
+		reply, lines := exchange(t, c, test.cmd, test.multi)
+		if reply != test.reply || !reflect.DeepEqual(lines, test.lines) {
+			t.Errorf("%s: expected %q %q, got %q %q", test.cmd, test.reply, test.lines, reply, lines)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Messages were not removed")
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	if !reflect.DeepEqual(removed, []uint64{10, 30}) {
+		t.Errorf("Expected messages 10 and 30 to be removed, got %v", removed)
+	}
+}
+
+// It should not remove anything when the session is not authenticated, and
+// report failures to remove messages.
+func TestServer_Session_Quit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	mb := &mailbox.MockInterface{
+		AuthenticateMock: func(*mail.Address, string) (bool, error) { return true, nil },
+		InboxMock: func(*mail.Address) ([]*mailbox.Message, error) {
+			return []*mailbox.Message{{ID: 1, Raw: "Subject: A\r\n\r\nBody"}}, nil
+		},
+		RemoveMock: func(*mail.Address, []uint64) error { return errors.New("db down") },
+	}
+
+	c := getTestSession(t, mb)
+	if reply, _ := exchange(t, c, "QUIT", false); !strings.HasPrefix(reply, "+OK") {
+		t.Errorf("Expected +OK, got %s", reply)
+	}
+	c.Close()
+
+	c = getTestSession(t, mb)
+	defer c.Close()
+	for _, cmd := range []string{"USER jane@doe.com", "PASS x", "DELE 1"} {
+		exchange(t, c, cmd, false)
+	}
+	if reply, _ := exchange(t, c, "QUIT", false); reply != "-ERR some deleted messages not removed" {
+		t.Errorf("Expected error, got %s", reply)
+	}
+}
+
+// It should lock the maildrop of an authenticated user until the session ends.
+func TestServer_Session_InUse(t *testing.T) {
+	mb := &mailbox.MockInterface{
+		AuthenticateMock: func(*mail.Address, string) (bool, error) { return true, nil },
+		InboxMock:        func(*mail.Address) ([]*mailbox.Message, error) { return nil, nil },
+	}
+	srv := getTestServer(mb)
+	srv.maildrops = newMaildrops()
+
+	c1 := startTestSession(t, srv)
+	defer c1.Close()
+	c2 := startTestSession(t, srv)
+	defer c2.Close()
+	for _, test := range []struct {
+		c     *textproto.Conn
+		cmd   string
+		reply string
+	}{
+		{c1, "USER jane", "+OK send PASS"},
+		{c1, "PASS x", "+OK maildrop has 0 messages (0 octets)"},
+		{c2, "USER Jane@mecca.local", "+OK send PASS"},
+		{c2, "PASS x", "-ERR [IN-USE] maildrop already locked"},
+		{c2, "USER john", "+OK send PASS"},
+		{c2, "PASS x", "+OK maildrop has 0 messages (0 octets)"},
+		{c1, "QUIT", "+OK mecca.local Gomez POP3 signing off"},
+	} {
+		if reply, _ := exchange(t, test.c, test.cmd, false); reply != test.reply {
+			t.Errorf("%s: expected %q, got %q", test.cmd, test.reply, reply)
+		}
+	}
+
+	if _, err := c1.ReadLine(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	c3 := startTestSession(t, srv)
+	defer c3.Close()
+	for _, cmd := range []string{"USER jane", "PASS x"} {
+		reply, _ := exchange(t, c3, cmd, false)
+		if !strings.HasPrefix(reply, "+OK") {
+			t.Errorf("%s: expected +OK, got %q", cmd, reply)
+		}
+	}
+}
+
+// It should close sessions which send no command in time.
+func TestServer_Session_Timeout(t *testing.T) {
+	srv := getTestServer(&mailbox.MockInterface{})
+	srv.config["timeout"] = "1"
+	c := startTestSession(t, srv)
+	defer c.Close()
+
+	start := time.Now()
+	if line, _ := c.ReadLine(); line != "-ERR autologout timer expired" {
+		t.Errorf("Expected autologout, got %q", line)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+		t.Errorf("Session closed after %s", d)
+	}
+	if _, err := c.ReadLine(); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+func TestServer_Start_Error(t *testing.T) {
+	if Start(&mailbox.MockInterface{}, jamon.Group{"listen": ":1110"}) != ErrMinConfig {
+		t.Error("ErrMinConfig not returned")
+	}
+	if Start(&mailbox.MockInterface{}, jamon.Group{"host": "wha", "listen": "bad_addr"}) == nil {
+		t.Error("Expected error")
+	}
+}
+
+// It should stop accepting connections and end the open sessions once the
+// context is done.
+func TestServer_StartContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- StartContext(ctx, &mailbox.MockInterface{},
+			jamon.Group{"host": "wha", "listen": "127.0.0.1:2110"})
+	}()
+
+	var c *textproto.Conn
+	start := time.Now()
+	for {
+		var err error
+		c, err = textproto.Dial("tcp", "127.0.0.1:2110")
+		if err == nil {
+			if line, _ := c.ReadLine(); !strings.HasPrefix(line, "+OK") {
+				t.Errorf("Bad greeting: %s", line)
+			}
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal(err)
+		}
+	}
+	defer c.Close()
+
+	cancel()
+	if line, _ := c.ReadLine(); line != "-ERR [SYS/TEMP] server shutting down" {
+		t.Errorf("Expected shutdown, got %q", line)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected nil, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Server did not stop")
+	}
+}
@@ -0,0 +1,117 @@
+package pop3
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+const (
+	// stateAuthorization is the initial state. The client must identify
+	// using USER and PASS.
+	stateAuthorization = iota
+	// stateTransaction is entered once the client has authenticated. The
+	// messages in the inbox may be retrieved and marked for deletion.
+	stateTransaction
+)
+
+// session holds information about a POP3 session.
+type session struct {
+	// The current state of the session, either stateAuthorization or
+	// stateTransaction.
+	State int
+	// The name given via USER, awaiting PASS.
+	Name string
+	// The authenticated user, or nil.
+	User *mail.Address
+	// The messages in the user's inbox when the session was authenticated,
+	// numbered from 1 for the client.
+	Messages []*mailbox.Message
+	// Deleted holds the numbers of messages which are marked as deleted.
+	Deleted map[int]bool
+
+	host    server          // Host server instance
+	text    *textproto.Conn // Textproto wrapper of network connection
+	conn    net.Conn        // Network connection
+	timeout time.Duration   // time allowed for each command, or 0
+}
+
+// ok sends a positive status indicator followed by the given text.
+func (c *session) ok(format string, args ...interface{}) error {
+	return c.text.PrintfLine("+OK "+format, args...)
+}
+
+// err sends a negative status indicator followed by the given text.
+func (c *session) err(format string, args ...interface{}) error {
+	return c.text.PrintfLine("-ERR "+format, args...)
+}
+
+// serve listens for incoming commands and runs them on the host instance.
+// Sessions which do not send a command in time are closed without removing
+// the messages marked as deleted, as per RFC 1939 3.
+func (c *session) serve() {
+	for {
+		if c.host.active.idle(c) {
+			c.err("[SYS/TEMP] server shutting down")
+			return
+		}
+		line, err := c.text.ReadLine()
+		if err != nil {
+			switch {
+			case c.host.active.isClosing():
+				c.err("[SYS/TEMP] server shutting down")
+			case isTimeout(err):
+				c.err("autologout timer expired")
+			case err != io.EOF:
+				log.Printf("Error processing I/O: %s\r\n", err)
+			}
+			return
+		}
+		if err = c.host.run(c, line); err != nil {
+			if err != io.EOF {
+				log.Printf("Error processing I/O: %s\r\n", err)
+			}
+			return
+		}
+	}
+}
+
+// unlock releases the lock on the user's maildrop, if the session holds it.
+func (c *session) unlock() {
+	if c.User != nil {
+		c.host.maildrops.unlock(c.User.Address)
+	}
+}
+
+// isTimeout reports whether err was caused by a deadline being exceeded.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// message returns the message with the given number, if it exists and is
+// not marked as deleted.
+func (c *session) message(arg string) (int, *mailbox.Message, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(c.Messages) || c.Deleted[n] {
+		return 0, nil, false
+	}
+	return n, c.Messages[n-1], true
+}
+
+// size returns the size of a message in octets, with all lines ending in CRLF,
+// as it is sent to the client (excluding byte-stuffing).
+func size(msg *mailbox.Message) int {
+	n := len(msg.Raw) + strings.Count(msg.Raw, "\n") - strings.Count(msg.Raw, "\r\n")
+	if !strings.HasSuffix(msg.Raw, "\n") {
+		n += len("\r\n")
+	}
+	return n
+}
@@ -0,0 +1,112 @@
+package pop3
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tracker keeps account of the server's open sessions, so that they may be
+// ended when the server shuts down. All methods are safe to call on a nil
+// tracker, in which case they only set the sessions' deadlines.
+type tracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	conns   map[*session]net.Conn
+	closing bool
+}
+
+func newTracker() *tracker {
+	return &tracker{conns: make(map[*session]net.Conn)}
+}
+
+// add registers a new connection. It must be called before the session is
+// started, and must be followed by a call to done when it ends.
+func (tr *tracker) add() {
+	if tr == nil {
+		return
+	}
+	tr.wg.Add(1)
+}
+
+// track starts watching the session's connection.
+func (tr *tracker) track(c *session) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.conns[c] = c.conn
+}
+
+// done marks the session as ended.
+func (tr *tracker) done(c *session) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	delete(tr.conns, c)
+	tr.mu.Unlock()
+	tr.wg.Done()
+}
+
+// idle gives the session its timeout to send the next command. It reports
+// whether the server is shutting down, in which case no further command
+// should be read.
+func (tr *tracker) idle(c *session) bool {
+	if tr != nil {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		if tr.closing {
+			return true
+		}
+	}
+	var d time.Time
+	if c.timeout > 0 {
+		d = time.Now().Add(c.timeout)
+	}
+	c.conn.SetReadDeadline(d)
+	return false
+}
+
+// isClosing reports whether the server is shutting down.
+func (tr *tracker) isClosing() bool {
+	if tr == nil {
+		return false
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.closing
+}
+
+// shutdown ends all sessions. Sessions waiting for a command are interrupted
+// right away, while those processing one are given until the grace period
+// expires to finish. Connections which are still open then are closed. It
+// returns once all sessions have ended.
+func (tr *tracker) shutdown(grace time.Duration) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	tr.closing = true
+	for _, conn := range tr.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	tr.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		tr.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(grace):
+		tr.mu.Lock()
+		for _, conn := range tr.conns {
+			conn.Close()
+		}
+		tr.mu.Unlock()
+		<-finished
+	}
+}
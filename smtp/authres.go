@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/gbbr/gomez/dkim"
+)
+
+// authResults returns the value of the Authentication-Results header field
+// recording the authenticated user who submitted the message, if any, the
+// results of the sender's SPF check, of the message's DKIM signatures, of its
+// ARC chain and of its DMARC evaluation, as per RFC 8601 and RFC 8617 10.1.
+func authResults(authservID string, user *mail.Address, spf spfResult, sigs []dkim.Result, arc dkim.ChainResult, dmarc dmarcResult) string {
+	results := []string{authservID}
+	if user != nil {
+		results = append(results, "auth=pass smtp.auth="+user.Address)
+	}
+	switch spf.Identity {
+	case "mailfrom":
+		results = append(results, fmt.Sprintf("spf=%s smtp.mailfrom=%s", spf.Result, spf.Sender))
+	case "helo":
+		results = append(results, fmt.Sprintf("spf=%s smtp.helo=%s", spf.Result, spf.Domain))
+	}
+	if len(sigs) == 0 {
+		results = append(results, "dkim=none")
+	}
+	for _, sig := range sigs {
+		r := "dkim=" + sig.Status
+		if sig.Err != nil {
+			r += " (" + sig.Err.Error() + ")"
+		}
+		r += fmt.Sprintf(" header.d=%s header.s=%s header.i=%s", sig.Domain, sig.Selector, sig.Identity)
+		// RFC 6008 4: a prefix of the signature tells signatures apart.
+		if b := sig.Signature; len(b) > 8 {
+			r += " header.b=" + b[:8]
+		}
+		results = append(results, r)
+	}
+	switch {
+	case arc.Status == dkim.Pass:
+		results = append(results, fmt.Sprintf("arc=pass (i=%d)", arc.Instance))
+	case arc.Err != nil:
+		results = append(results, fmt.Sprintf("arc=%s (%s)", arc.Status, arc.Err))
+	case arc.Status != "":
+		results = append(results, "arc="+arc.Status)
+	}
+	if r := dmarc.authResult(); r != "" {
+		results = append(results, r)
+	}
+	return strings.Join(results, ";\r\n\t")
+}
+
+// stripAuthResults removes the Authentication-Results header fields of the
+// message which claim to come from authservID, as RFC 8601 5 requires before
+// adding results of our own, so that forged results are not trusted further
+// on. Lines of the message may end in either CRLF or LF.
+func stripAuthResults(raw, authservID string) string {
+	var b strings.Builder
+	field := ""
+	next := func() {
+		if !claimsAuthserv(field, authservID) {
+			b.WriteString(field)
+		}
+		field = ""
+	}
+	for raw != "" {
+		n := strings.IndexByte(raw, '\n') + 1
+		if n == 0 {
+			n = len(raw)
+		}
+		line := raw[:n]
+		if line[0] != ' ' && line[0] != '\t' {
+			next()
+			if strings.TrimRight(line, "\r\n") == "" {
+				break
+			}
+		}
+		field += line
+		raw = raw[n:]
+	}
+	next()
+	b.WriteString(raw)
+	return b.String()
+}
+
+// claimsAuthserv reports whether field is an Authentication-Results header
+// field whose authserv-id is id.
+func claimsAuthserv(field, id string) bool {
+	i := strings.IndexByte(field, ':')
+	if i == -1 || !strings.EqualFold(strings.TrimSpace(field[:i]), "Authentication-Results") {
+		return false
+	}
+	value := strings.SplitN(field[i+1:], ";", 2)[0]
+	// Drop comments, which may precede the authserv-id.
+	for {
+		open := strings.IndexByte(value, '(')
+		end := strings.IndexByte(value, ')')
+		if open == -1 || end < open {
+			break
+		}
+		value = value[:open] + " " + value[end+1:]
+	}
+	words := strings.Fields(value)
+	return len(words) > 0 && strings.EqualFold(words[0], id)
+}
@@ -0,0 +1,218 @@
+package smtp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/gbbr/gomez/dkim"
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+func TestAuthResults(t *testing.T) {
+	for _, test := range []struct {
+		user  *mail.Address
+		spf   spfResult
+		sigs  []dkim.Result
+		arc   dkim.ChainResult
+		dmarc dmarcResult
+		want  string
+	}{
+		{nil, spfResult{}, nil, dkim.ChainResult{}, dmarcResult{}, "mx.test;\r\n\tdkim=none"},
+		{nil, spfResult{}, nil, dkim.ChainResult{Status: dkim.None}, dmarcResult{}, "mx.test;\r\n\tdkim=none;\r\n\tarc=none"},
+		{
+			nil,
+			spfResult{Result: spfPass, Identity: "mailfrom", Sender: "a@b.test", Domain: "b.test"},
+			[]dkim.Result{{Status: dkim.Pass, Domain: "b.test", Selector: "s", Identity: "@b.test", Signature: "abcdefghijkl"}},
+			dkim.ChainResult{Status: dkim.Pass, Instance: 2},
+			dmarcResult{Result: dmarcPass, From: "b.test", Domain: "b.test", Record: &dmarcRecord{}, Policy: policyReject, Disposition: policyNone},
+			"mx.test;\r\n\tspf=pass smtp.mailfrom=a@b.test;\r\n\tdkim=pass header.d=b.test header.s=s header.i=@b.test header.b=abcdefgh;" +
+				"\r\n\tarc=pass (i=2);\r\n\tdmarc=pass (p=reject dis=none) header.from=b.test",
+		},
+		{
+			nil,
+			spfResult{Result: spfNone, Identity: "helo", Sender: "postmaster@c.test", Domain: "c.test"},
+			[]dkim.Result{
+				{Status: dkim.Fail, Err: errors.New("bad"), Domain: "b.test", Selector: "s", Identity: "@b.test"},
+				{Status: dkim.TempError, Err: errors.New("dns"), Domain: "d.test", Selector: "t", Identity: "u@d.test"},
+			},
+			dkim.ChainResult{Status: dkim.Fail, Err: errors.New("broken"), Instance: 1},
+			dmarcResult{Result: dmarcNone, From: "c.test"},
+			"mx.test;\r\n\tspf=none smtp.helo=c.test;\r\n\tdkim=fail (bad) header.d=b.test header.s=s header.i=@b.test;" +
+				"\r\n\tdkim=temperror (dns) header.d=d.test header.s=t header.i=u@d.test;\r\n\tarc=fail (broken);\r\n\tdmarc=none header.from=c.test",
+		},
+		{
+			&mail.Address{Address: "jane@a.test"},
+			spfResult{}, nil, dkim.ChainResult{Status: dkim.Pass, Instance: 1}, dmarcResult{},
+			"mx.test;\r\n\tauth=pass smtp.auth=jane@a.test;\r\n\tdkim=none;\r\n\tarc=pass (i=1)",
+		},
+	} {
+		if got := authResults("mx.test", test.user, test.spf, test.sigs, test.arc, test.dmarc); got != test.want {
+			t.Errorf("Expected %q, got %q", test.want, got)
+		}
+	}
+}
+
+// The ed25519-sha256 example of RFC 8463 Appendix A.
+const testSignedMessage = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe."
+
+// It should remove the Authentication-Results fields which claim the given
+// authserv-id and keep all others.
+func TestStripAuthResults(t *testing.T) {
+	for _, test := range []struct{ raw, want string }{
+		{
+			"Authentication-Results: mx.test; spf=pass\r\nFrom: a@b.c\r\n\r\nHi\r\n",
+			"From: a@b.c\r\n\r\nHi\r\n",
+		},
+		{
+			"From: a@b.c\r\nauthentication-results:\r\n\t(forged) MX.test 1;\r\n\tdkim=pass\r\nTo: d@e.f\r\n\r\nHi\r\n",
+			"From: a@b.c\r\nTo: d@e.f\r\n\r\nHi\r\n",
+		},
+		{
+			"Authentication-Results: other.test; spf=pass\nAuthentication-Results: mx.test;\n none\n\nAuthentication-Results: mx.test; spf=pass\n",
+			"Authentication-Results: other.test; spf=pass\n\nAuthentication-Results: mx.test; spf=pass\n",
+		},
+		{
+			"Authentication-Results: mx.test.other; spf=pass\r\n\r\n",
+			"Authentication-Results: mx.test.other; spf=pass\r\n\r\n",
+		},
+		{"From: a@b.c\r\n", "From: a@b.c\r\n"},
+	} {
+		if got := stripAuthResults(test.raw, "mx.test"); got != test.want {
+			t.Errorf("Expected %q, got %q", test.want, got)
+		}
+	}
+}
+
+// It should verify the DKIM signatures of messages and record the results
+// in an Authentication-Results header.
+func TestServer_Digest_DKIM(t *testing.T) {
+	server := server{
+		config: jamon.Group{"host": "TestHost"},
+		Enqueuer: &mailbox.MockEnqueuer{
+			EnqueueMock: func(*mailbox.Message) error { return nil },
+		},
+	}
+	client, _ := getTestClient()
+	client.ID = "client.test"
+	client.addrIP = "192.0.2.10"
+	client.dns = fakeResolver{txt: map[string][]string{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	}}
+	client.spf = spfResult{Result: spfPass, Identity: "mailfrom", Sender: "joe@football.example.com", Domain: "football.example.com"}
+	client.Message = &mailbox.Message{
+		Raw: "Authentication-Results: TestHost; dkim=pass header.d=bank.test\r\n" + testSignedMessage,
+		ID:  53,
+	}
+	client.Message.AddInbound(&mail.Address{Address: "suzie@shopping.example.net"})
+	msg := client.Message
+
+	if err := server.digest(client); err != nil {
+		t.Fatal(err)
+	}
+	m, err := msg.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(m.Header["Authentication-Results"]); n != 1 {
+		t.Errorf("Expected forged results to be removed, got %d fields", n)
+	}
+	ar := m.Header.Get("Authentication-Results")
+	for _, want := range []string{
+		"TestHost;",
+		"spf=pass smtp.mailfrom=joe@football.example.com;",
+		"dkim=pass header.d=football.example.com header.s=brisbane header.i=@football.example.com header.b=/gCrinpc;",
+		"arc=none",
+	} {
+		if !strings.Contains(ar, want) {
+			t.Errorf("Expected %q in %q", want, ar)
+		}
+	}
+	if msg.AuthservID != "TestHost" {
+		t.Errorf("Expected authserv-id to be recorded, got %q", msg.AuthservID)
+	}
+	if !strings.HasPrefix(msg.Raw, "Received:") {
+		t.Error("Expected Received to remain the first header")
+	}
+}
+
+// It should validate the ARC chain of forwarded messages.
+func TestServer_Digest_ARC(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer := &dkim.Signer{Domain: "list.test", Selector: "arc", Key: key}
+	raw := "From: a@b.test\r\nTo: list@list.test\r\nDate: Today\r\n\r\nHi\r\n"
+	set, err := sealer.Seal(raw, "list.test; spf=pass smtp.mailfrom=b.test", dkim.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := server{
+		config: jamon.Group{"host": "TestHost"},
+		Enqueuer: &mailbox.MockEnqueuer{
+			EnqueueMock: func(*mailbox.Message) error { return nil },
+		},
+	}
+	for want, raw := range map[string]string{
+		"arc=pass (i=1)":                      set + "\r\n" + raw,
+		"arc=fail (body hash did not verify)": set + "\r\n" + strings.Replace(raw, "Hi", "Bye", 1),
+	} {
+		client, _ := getTestClient()
+		client.dns = fakeResolver{txt: map[string][]string{
+			"arc._domainkey.list.test": {"k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+		}}
+		client.Message = &mailbox.Message{Raw: raw, ID: 1}
+		client.Message.AddInbound(&mail.Address{Address: "c@d.test"})
+		msg := client.Message
+		if err := server.digest(client); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := msg.Parse()
+		if ar := m.Header.Get("Authentication-Results"); !strings.Contains(ar, want) {
+			t.Errorf("Expected %q in %q", want, ar)
+		}
+	}
+
+	// Messages which users forward record the user along with the chain.
+	client, _ := getTestClient()
+	client.User = &mail.Address{Address: "jane@list.test"}
+	client.dns = fakeResolver{txt: map[string][]string{
+		"arc._domainkey.list.test": {"k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+	client.Message = &mailbox.Message{Raw: set + "\r\n" + raw, ID: 1}
+	client.Message.AddOutbound(&mail.Address{Address: "c@d.test"})
+	msg := client.Message
+	if err := server.digest(client); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := msg.Parse()
+	ar := m.Header.Get("Authentication-Results")
+	for _, want := range []string{"auth=pass smtp.auth=jane@list.test", "arc=pass (i=1)"} {
+		if !strings.Contains(ar, want) {
+			t.Errorf("Expected %q in %q", want, ar)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package smtp
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/mail"
+	"strconv"
 	"strings"
 
 	"github.com/gbbr/gomez/mailbox"
@@ -28,7 +33,21 @@ func cmdEHLO(ctx *transaction, param string) error {
 	ctx.ID = param
 	ctx.Mode = stateMAIL
 
-	return ctx.notify(reply{250, "Gomez SMTPd\nSMTPUTF8\n8BITMIME\nENHANCEDSTATUSCODES\nVRFY"})
+	size := "SIZE"
+	if ctx.maxSize > 0 {
+		size = fmt.Sprintf("SIZE %d", ctx.maxSize)
+	}
+	ext := []string{
+		"Gomez SMTPd", "PIPELINING", "SMTPUTF8", "8BITMIME", size,
+		"ENHANCEDSTATUSCODES", "VRFY", "CHUNKING", "BINARYMIME", "DSN",
+	}
+	if ctx.host.tlsConfig() != nil && !ctx.secure {
+		ext = append(ext, "STARTTLS")
+	}
+	if ctx.canAuth() {
+		ext = append(ext, "AUTH PLAIN LOGIN")
+	}
+	return ctx.notify(reply{250, strings.Join(ext, "\n")})
 }
 
 // RFC 2821 4.1.1.2 MAIL (MAIL)
@@ -40,12 +59,39 @@ func cmdMAIL(ctx *transaction, param string) error {
 		return ctx.notify(reply{503, "5.5.1 Error: nested MAIL command"})
 	case !strings.HasPrefix(strings.ToUpper(param), "FROM:"):
 		return ctx.notify(reply{501, "5.5.4 Syntax: MAIL FROM:<address>"})
+	case !ctx.secure && tlsRequired(ctx.host.settings()):
+		return ctx.notify(reply{530, "5.7.0 Must issue a STARTTLS command first"})
+	}
+	path, params, err := parsePath(param[len("FROM:"):])
+	if err != nil {
+		return ctx.notify(reply{501, "5.5.4 Syntax: MAIL FROM:<address> [parameters]"})
 	}
-	addr, err := mail.ParseAddress(param[len("FROM:"):])
+	addr, err := mailbox.ParsePath(path)
 	if err != nil {
 		return ctx.notify(reply{501, "5.1.7 Bad sender address syntax"})
 	}
+	if r := mailParams.check(ctx, params); r != nil {
+		return ctx.notify(*r)
+	}
+	_, utf8 := params["SMTPUTF8"]
+	if !utf8 && !mailbox.IsASCII(addr.Address) {
+		return ctx.notify(replyNeedUTF8)
+	}
+	if ctx.dns != nil && ctx.User == nil {
+		ctx.spf = ctx.checkSPF(addr)
+		if spfRejects(ctx.host.settings(), ctx.spf.Result) {
+			return ctx.notify(replySPFFail(ctx.spf.Domain, ctx.addrIP))
+		}
+	}
+	if ctx.rates.reached(ctx.senders(addr)) {
+		return ctx.notify(replyRateLimited)
+	}
+	ctx.Params = params
 	ctx.Message.SetFrom(addr)
+	ctx.Message.UTF8 = utf8
+	ctx.Message.Ret = strings.ToUpper(params["RET"])
+	ctx.Message.EnvID = params["ENVID"]
+	ctx.Message.Binary = strings.EqualFold(params["BODY"], "BINARYMIME")
 	ctx.Mode = stateRCPT
 
 	return ctx.notify(reply{250, "2.1.0 Ok"})
@@ -61,24 +107,46 @@ func cmdRCPT(ctx *transaction, param string) error {
 	case !strings.HasPrefix(strings.ToUpper(param), "TO:"):
 		return ctx.notify(reply{501, "5.5.4 Syntax: RCPT TO:<address>"})
 	}
-	addr, err := mail.ParseAddress(param[len("TO:"):])
+	path, params, err := parsePath(param[len("TO:"):])
+	if err != nil {
+		return ctx.notify(reply{501, "5.5.4 Syntax: RCPT TO:<address> [parameters]"})
+	}
+	addr, err := mail.ParseAddress(path)
 	if err != nil {
 		return ctx.notify(reply{501, "5.1.7 Bad recipient address syntax"})
 	}
+	if r := rcptParams.check(ctx, params); r != nil {
+		return ctx.notify(*r)
+	}
+	if !ctx.Message.UTF8 && !mailbox.IsASCII(addr.Address) {
+		return ctx.notify(replyNeedUTF8)
+	}
+	if max := ctx.rates.maxRcpts(ctx.senders(ctx.Message.From())); max > 0 && len(ctx.Message.Rcpt()) >= max {
+		return ctx.notify(replyTooManyRcpts)
+	}
+	if ctx.listed != "" && ctx.dnsbl == dnsblRcpt {
+		return ctx.notify(replyListed(550, ctx.addrIP, ctx.listed))
+	}
+	dsn := mailbox.RcptDSN{
+		Notify: strings.ToUpper(params["NOTIFY"]),
+		ORcpt:  params["ORCPT"],
+	}
 
 	switch ctx.host.query(addr) {
 	case mailbox.QueryNotFound:
 		return ctx.notify(reply{550, "5.1.1 No such user here."})
 	case mailbox.QueryNotLocal:
-		if flags := ctx.host.settings(); !flags.Has("relay") {
-			return ctx.notify(reply{550, "5.1.1 No such user here."})
+		if ctx.User == nil {
+			return ctx.notify(reply{550, "5.7.1 Relay access denied"})
 		}
 		ctx.Message.AddOutbound(addr)
+		ctx.Message.SetRcptDSN(addr, dsn)
 		ctx.Mode = stateDATA
 
 		return ctx.notify(reply{251, "User not local; will forward to <forward-path>"})
 	case mailbox.QuerySuccess:
 		ctx.Message.AddInbound(addr)
+		ctx.Message.SetRcptDSN(addr, dsn)
 		ctx.Mode = stateDATA
 		return ctx.notify(reply{250, "2.1.5 Ok"})
 	}
@@ -95,28 +163,69 @@ func cmdDATA(ctx *transaction, param string) error {
 	case stateRCPT:
 		return ctx.notify(reply{503, "5.5.1 RCPT first."})
 	}
+	switch {
+	case ctx.chunks != nil:
+		return ctx.notify(reply{503, "5.5.1 DATA not allowed after BDAT"})
+	case strings.EqualFold(ctx.Params["BODY"], "BINARYMIME"):
+		return ctx.notify(reply{503, "5.5.1 BINARYMIME requires BDAT"})
+	}
 	if err := ctx.notify(reply{354, "End data with <CR><LF>.<CR><LF>"}); err != nil {
 		return err
 	}
-	msg, err := ctx.text.ReadDotLines()
-	if err != nil {
+	raw, err := ctx.readData()
+	switch {
+	case err == errTooLarge:
+		ctx.reset()
+		return ctx.notify(replyTooLarge)
+	case isTimeout(err):
+		return err
+	case err != nil:
 		return ctx.notify(replyErrorProcessing)
 	}
-	ctx.Message.Raw = strings.Join(msg, "\r\n")
+	ctx.Message.Raw = raw
+	return ctx.deliver()
+}
 
-	err = ctx.host.digest(ctx)
-	switch err {
-	case errMsgNotCompliant:
-		return ctx.notify(reply{550, "Message not RFC 2822 compliant."})
-	case errEnqueuing:
-		ctx.Message.Raw = ""
-		fallthrough
-	case errProcessing:
-		return ctx.notify(replyErrorProcessing)
+// RFC 3030 2. Framework for the Chunking Extension (BDAT)
+// The chunk follows the command right away, so it is always read, even when
+// the command is refused, as long as its size could be parsed.
+func cmdBDAT(ctx *transaction, param string) error {
+	replySyntax := reply{501, "5.5.4 Syntax: BDAT size [LAST]"}
+	args := strings.Fields(param)
+	if len(args) == 0 {
+		return ctx.notify(replySyntax)
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		return ctx.notify(replySyntax)
+	}
+	skip := func(r reply) error {
+		if _, err := io.CopyN(ioutil.Discard, ctx.text.R, size); err != nil {
+			return err
+		}
+		return ctx.notify(r)
+	}
+	last := len(args) == 2 && strings.EqualFold(args[1], "LAST")
+	if len(args) > 2 || len(args) == 2 && !last {
+		return skip(replySyntax)
+	}
+	if ctx.Mode != stateDATA {
+		return skip(reply{503, "5.5.1 Bad sequence of commands."})
+	}
+	switch err := ctx.readChunk(size); err {
+	case nil:
+	case errTooLarge:
+		ctx.reset()
+		return ctx.notify(replyTooLarge)
 	default:
-		reply := reply{250, fmt.Sprintf("message queued (%x)", ctx.Message.ID)}
-		return ctx.notify(reply)
+		return err
+	}
+	if !last {
+		return ctx.notify(reply{250, fmt.Sprintf("2.0.0 %d octets received", size)})
 	}
+	ctx.Message.Raw = ctx.chunks.String()
+	ctx.chunks = nil
+	return ctx.deliver()
 }
 
 // RFC 2821 4.1.1.5 RESET (RSET)
@@ -135,6 +244,153 @@ func cmdVRFY(ctx *transaction, param string) error {
 	return ctx.notify(reply{252, "2.1.5 Send some mail, I'll try my best"})
 }
 
+// RFC 3207 4 The STARTTLS Keyword (STARTTLS)
+func cmdSTARTTLS(ctx *transaction, param string) error {
+	cfg := ctx.host.tlsConfig()
+	switch {
+	case ctx.secure:
+		return ctx.notify(reply{503, "5.5.1 TLS already active"})
+	case cfg == nil:
+		return ctx.notify(reply{454, "4.7.0 TLS not available"})
+	case len(param) > 0:
+		return ctx.notify(reply{501, "5.5.4 Syntax: STARTTLS"})
+	}
+	if err := ctx.notify(reply{220, "2.0.0 Ready to start TLS"}); err != nil {
+		return err
+	}
+	if err := ctx.startTLS(cfg); err != nil {
+		// The state of the connection is unknown after a failed
+		// handshake, so it can not be used any further.
+		log.Printf("Error negotiating TLS with %s: %s\r\n", ctx.addrIP, err)
+		return io.EOF
+	}
+	return nil
+}
+
+// RFC 4954 4 The AUTH Command (AUTH)
+func cmdAUTH(ctx *transaction, param string) error {
+	switch {
+	case ctx.Mode == stateHELO:
+		return ctx.notify(reply{503, "5.5.1 Say EHLO first."})
+	case ctx.Mode > stateMAIL:
+		return ctx.notify(reply{503, "5.5.1 Error: MAIL transaction in progress"})
+	case ctx.User != nil:
+		return ctx.notify(reply{503, "5.5.1 Error: already authenticated"})
+	case !ctx.canAuth():
+		return ctx.notify(reply{538, "5.7.11 Encryption required for requested authentication mechanism"})
+	}
+	parts := strings.SplitN(param, " ", 2)
+	initial, hasInitial := "", len(parts) == 2
+	if hasInitial {
+		initial = parts[1]
+	}
+	var user, pass string
+	var err error
+	switch strings.ToUpper(parts[0]) {
+	case "PLAIN":
+		user, pass, err = authPLAIN(ctx, initial, hasInitial)
+	case "LOGIN":
+		user, pass, err = authLOGIN(ctx, initial, hasInitial)
+	default:
+		return ctx.notify(reply{504, "5.5.4 Unrecognized authentication type"})
+	}
+	switch err {
+	case nil:
+	case errAuthCancelled:
+		return ctx.notify(reply{501, "5.0.0 Authentication cancelled"})
+	case errAuthDecoding:
+		return ctx.notify(reply{501, "5.5.2 Cannot decode response"})
+	case errAuthInvalid:
+		return ctx.notify(reply{535, "5.7.8 Authentication credentials invalid"})
+	default:
+		return err
+	}
+	addr, err := mail.ParseAddress("<" + user + ">")
+	if err != nil {
+		return ctx.notify(reply{535, "5.7.8 Authentication credentials invalid"})
+	}
+	ok, err := ctx.host.authenticate(addr, pass)
+	switch {
+	case err != nil:
+		log.Printf("Error authenticating %s: %s\r\n", addr.Address, err)
+		return ctx.notify(reply{454, "4.7.0 Temporary authentication failure"})
+	case !ok:
+		return ctx.notify(reply{535, "5.7.8 Authentication credentials invalid"})
+	}
+	ctx.User = addr
+	return ctx.notify(reply{235, "2.7.0 Authentication successful"})
+}
+
+var (
+	errAuthCancelled = errors.New("authentication cancelled by client")
+	errAuthDecoding  = errors.New("authentication response not base64")
+	errAuthInvalid   = errors.New("malformed authentication response")
+)
+
+// authPLAIN reads credentials as specified by RFC 4616. The authorization
+// identity, if present, must match the authentication identity.
+func authPLAIN(ctx *transaction, initial string, hasInitial bool) (user, pass string, err error) {
+	if !hasInitial {
+		if initial, err = authChallenge(ctx, ""); err != nil {
+			return
+		}
+	}
+	resp, err := authDecode(initial)
+	if err != nil {
+		return
+	}
+	p := strings.Split(resp, "\x00")
+	if len(p) != 3 || (p[0] != "" && p[0] != p[1]) {
+		return "", "", errAuthInvalid
+	}
+	return p[1], p[2], nil
+}
+
+// authLOGIN reads credentials using the obsolete, but widely deployed,
+// LOGIN mechanism. The username may be given as an initial response.
+func authLOGIN(ctx *transaction, initial string, hasInitial bool) (user, pass string, err error) {
+	if !hasInitial {
+		if initial, err = authChallenge(ctx, "Username:"); err != nil {
+			return
+		}
+	}
+	if user, err = authDecode(initial); err != nil {
+		return
+	}
+	resp, err := authChallenge(ctx, "Password:")
+	if err != nil {
+		return
+	}
+	pass, err = authDecode(resp)
+	return
+}
+
+// authChallenge sends a base64 encoded server challenge and returns the
+// client's response.
+func authChallenge(ctx *transaction, challenge string) (string, error) {
+	err := ctx.notify(reply{334, base64.StdEncoding.EncodeToString([]byte(challenge))})
+	if err != nil {
+		return "", err
+	}
+	return ctx.text.ReadLine()
+}
+
+// authDecode decodes a client response. A single "=" stands for an empty
+// response and "*" cancels the exchange.
+func authDecode(resp string) (string, error) {
+	switch resp {
+	case "*":
+		return "", errAuthCancelled
+	case "=":
+		return "", nil
+	}
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return "", errAuthDecoding
+	}
+	return string(b), nil
+}
+
 // RFC 2821 4.1.1.10 QUIT (QUIT)
 func cmdQUIT(ctx *transaction, param string) error {
 	ctx.notify(reply{221, "2.0.0 Adeus"})
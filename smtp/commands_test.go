@@ -1,14 +1,26 @@
 package smtp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gbbr/gomez/mailbox"
 	"github.com/gbbr/jamon"
@@ -110,6 +122,299 @@ func TestCmdEHLO_Param_Passing(t *testing.T) {
 	pipe.Close()
 }
 
+func TestCmdEHLO_STARTTLS_Advertised(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		TLS    *tls.Config
+		Secure bool
+		Expect bool
+	}{
+		{nil, false, false},
+		{&tls.Config{}, false, true},
+		{&tls.Config{}, true, false},
+	} {
+		client.secure = test.Secure
+		client.host = &mockHost{TLSConfigMock: func() *tls.Config { return test.TLS }}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdEHLO(client, "name")
+			wg.Done()
+		}()
+		_, msg, err := pipe.ReadResponse(250)
+		if err != nil {
+			t.Errorf("Expected 250, got %s", err)
+		}
+		if got := strings.Contains(msg, "STARTTLS"); got != test.Expect {
+			t.Errorf("Expected STARTTLS advertised to be %t, got: %s", test.Expect, msg)
+		}
+		wg.Wait()
+	}
+}
+
+func TestCmdMAIL_TLS_Required(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	client.host = &mockHost{
+		SettingsMock: func() jamon.Group { return jamon.Group{"tls.required": "true"} },
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	client.Mode = stateMAIL
+	go func() {
+		cmdMAIL(client, "FROM:<good@address.com>")
+		wg.Done()
+	}()
+	_, _, err := pipe.ReadResponse(530)
+	if err != nil || client.Mode != stateMAIL {
+		t.Errorf("Expected 530 on insecure connection, got %s", err)
+	}
+	wg.Wait()
+
+	client.secure = true
+	go cmdMAIL(client, "FROM:<good@address.com>")
+	_, _, err = pipe.ReadResponse(250)
+	if err != nil || client.Mode != stateRCPT {
+		t.Errorf("Expected 250 on secure connection, got %s", err)
+	}
+
+	client.secure = false
+	client.Mode = stateMAIL
+	client.host = &mockHost{
+		SettingsMock: func() jamon.Group { return jamon.Group{"tls.required": "false"} },
+	}
+	go cmdMAIL(client, "FROM:<good@address.com>")
+	_, _, err = pipe.ReadResponse(250)
+	if err != nil || client.Mode != stateRCPT {
+		t.Errorf("Expected 250 when TLS is not required, got %s", err)
+	}
+}
+
+func TestCmdSTARTTLS_Errors(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		TLS     *tls.Config
+		Secure  bool
+		Param   string
+		ExpCode int
+	}{
+		{nil, false, "", 454},
+		{&tls.Config{}, true, "", 503},
+		{&tls.Config{}, false, "param", 501},
+	} {
+		client.secure = test.Secure
+		client.host = &mockHost{TLSConfigMock: func() *tls.Config { return test.TLS }}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdSTARTTLS(client, test.Param)
+			wg.Done()
+		}()
+		if _, _, err := pipe.ReadResponse(test.ExpCode); err != nil {
+			t.Errorf("Expected %d, got %s", test.ExpCode, err)
+		}
+		wg.Wait()
+	}
+}
+
+// It should negotiate TLS and reset the transaction to its initial state.
+func TestCmdSTARTTLS_Upgrade(t *testing.T) {
+	sc, cc := net.Pipe()
+	cfg := getTestTLSConfig(t)
+	client := &transaction{
+		ID:      "name",
+		Mode:    stateRCPT,
+		Message: new(mailbox.Message),
+		conn:    sc,
+		text:    textproto.NewConn(sc),
+		host:    &mockHost{TLSConfigMock: func() *tls.Config { return cfg }},
+	}
+	client.Message.Raw = "ABCD"
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmdSTARTTLS(client, "") }()
+
+	if _, _, err := textproto.NewConn(cc).ReadResponse(220); err != nil {
+		t.Fatalf("Expected 220, got %s", err)
+	}
+	tc := tls.Client(cc, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("Error during handshake: %s", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !client.secure || client.Mode != stateHELO || client.ID != "" || client.Message.Raw != "" {
+		t.Errorf("Did not reset transaction after STARTTLS: %+v", client)
+	}
+
+	go client.notify(reply{250, "Hello"})
+	msg, err := textproto.NewConn(tc).ReadLine()
+	if err != nil || msg != "250 Hello" {
+		t.Errorf("Expected reply over TLS, got '%s' (%v)", msg, err)
+	}
+	if client.protocol() != "ESMTPS" {
+		t.Errorf("Expected ESMTPS protocol, got %s", client.protocol())
+	}
+}
+
+// It should end the transaction if the handshake fails.
+func TestCmdSTARTTLS_Handshake_Error(t *testing.T) {
+	sc, cc := net.Pipe()
+	client := &transaction{
+		Mode:    stateMAIL,
+		Message: new(mailbox.Message),
+		conn:    sc,
+		text:    textproto.NewConn(sc),
+		host:    &mockHost{TLSConfigMock: func() *tls.Config { return getTestTLSConfig(t) }},
+	}
+
+	log.SetOutput(ioutil.Discard)
+	errc := make(chan error, 1)
+	go func() { errc <- cmdSTARTTLS(client, "") }()
+
+	cconn := textproto.NewConn(cc)
+	cconn.ReadResponse(220)
+	cconn.PrintfLine("not a handshake")
+	cc.Close()
+
+	if err := <-errc; err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+	if client.secure {
+		t.Error("Transaction should not be secure after failed handshake")
+	}
+}
+
+func TestCmdAUTH(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	authMock := func(addr *mail.Address, pass string) (bool, error) {
+		switch {
+		case addr.Address == "error@host.tld":
+			return false, errors.New("db error")
+		case addr.Address == "user@host.tld" && pass == "secret":
+			return true, nil
+		}
+		return false, nil
+	}
+
+	for _, test := range []struct {
+		Param    string
+		Mode     int
+		TLS      *tls.Config
+		Secure   bool
+		Exchange []string // alternating client responses and expected codes
+		ExpCode  int
+		ExpUser  string
+	}{
+		{"PLAIN " + b64("\x00user@host.tld\x00secret"), stateMAIL, nil, false, nil, 235, "user@host.tld"},
+		{"plain " + b64("user@host.tld\x00user@host.tld\x00secret"), stateMAIL, nil, false, nil, 235, "user@host.tld"},
+		{"PLAIN " + b64("other@host.tld\x00user@host.tld\x00secret"), stateMAIL, nil, false, nil, 535, ""},
+		{"PLAIN " + b64("\x00user@host.tld\x00wrong"), stateMAIL, nil, false, nil, 535, ""},
+		{"PLAIN " + b64("\x00error@host.tld\x00secret"), stateMAIL, nil, false, nil, 454, ""},
+		{"PLAIN " + b64("garbage"), stateMAIL, nil, false, nil, 535, ""},
+		{"PLAIN !!!", stateMAIL, nil, false, nil, 501, ""},
+		{"PLAIN", stateMAIL, nil, false, []string{b64("\x00user@host.tld\x00secret")}, 235, "user@host.tld"},
+		{"PLAIN", stateMAIL, nil, false, []string{"*"}, 501, ""},
+		{"LOGIN", stateMAIL, nil, false, []string{b64("user@host.tld"), b64("secret")}, 235, "user@host.tld"},
+		{"LOGIN " + b64("user@host.tld"), stateMAIL, nil, false, []string{b64("secret")}, 235, "user@host.tld"},
+		{"LOGIN", stateMAIL, nil, false, []string{b64("user@host.tld"), "*"}, 501, ""},
+		{"LOGIN", stateMAIL, nil, false, []string{b64("user@host.tld"), b64("wrong")}, 535, ""},
+		{"CRAM-MD5", stateMAIL, nil, false, nil, 504, ""},
+		{"PLAIN", stateHELO, nil, false, nil, 503, ""},
+		{"PLAIN", stateRCPT, nil, false, nil, 503, ""},
+		{"PLAIN", stateMAIL, &tls.Config{}, false, nil, 538, ""},
+		{"PLAIN " + b64("\x00user@host.tld\x00secret"), stateMAIL, &tls.Config{}, true, nil, 235, "user@host.tld"},
+	} {
+		client, pipe := getTestClient()
+		client.Mode = test.Mode
+		client.secure = test.Secure
+		client.host = &mockHost{
+			TLSConfigMock: func() *tls.Config { return test.TLS },
+			AuthMock:      authMock,
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdAUTH(client, test.Param)
+			wg.Done()
+		}()
+
+		for _, resp := range test.Exchange {
+			if _, _, err := pipe.ReadResponse(334); err != nil {
+				t.Errorf("AUTH %s: expected 334, got %s", test.Param, err)
+			}
+			pipe.PrintfLine(resp)
+		}
+		if _, _, err := pipe.ReadResponse(test.ExpCode); err != nil {
+			t.Errorf("AUTH %s: expected %d, got %s", test.Param, test.ExpCode, err)
+		}
+		wg.Wait()
+		pipe.Close()
+
+		switch {
+		case test.ExpUser == "" && client.User != nil:
+			t.Errorf("AUTH %s: expected no user, got %s", test.Param, client.User)
+		case test.ExpUser != "" && (client.User == nil || client.User.Address != test.ExpUser):
+			t.Errorf("AUTH %s: expected user %s, got %v", test.Param, test.ExpUser, client.User)
+		}
+	}
+}
+
+func TestCmdAUTH_Already_Authenticated(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	client.Mode = stateMAIL
+	client.User = &mail.Address{Address: "user@host.tld"}
+	go cmdAUTH(client, "PLAIN")
+	if _, _, err := pipe.ReadResponse(503); err != nil {
+		t.Errorf("Expected 503, got %s", err)
+	}
+}
+
+func TestCmdEHLO_AUTH_Advertised(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		TLS    *tls.Config
+		Secure bool
+		Expect bool
+	}{
+		{nil, false, true},
+		{&tls.Config{}, false, false},
+		{&tls.Config{}, true, true},
+	} {
+		client.secure = test.Secure
+		client.host = &mockHost{TLSConfigMock: func() *tls.Config { return test.TLS }}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdEHLO(client, "name")
+			wg.Done()
+		}()
+		_, msg, err := pipe.ReadResponse(250)
+		if err != nil {
+			t.Errorf("Expected 250, got %s", err)
+		}
+		if got := strings.Contains(msg, "AUTH PLAIN LOGIN"); got != test.Expect {
+			t.Errorf("Expected AUTH advertised to be %t, got: %s", test.Expect, msg)
+		}
+		wg.Wait()
+	}
+}
+
 func TestCmdMAIL_Param_Passing(t *testing.T) {
 	client, pipe := getTestClient()
 	client.Mode = stateMAIL
@@ -125,15 +430,224 @@ func TestCmdMAIL_Param_Passing(t *testing.T) {
 	pipe.Close()
 }
 
+func TestCmdMAIL_Size(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+	client.maxSize = 100
+
+	for _, test := range []struct {
+		param string
+		code  int
+	}{
+		{"FROM:<asd@box.com> SIZE=100", 250},
+		{"FROM:First Last <asd@box.com> size=10", 250},
+		{"FROM:asd@box.com SIZE=50", 250},
+		{"FROM:<asd@box.com> SIZE=101", 552},
+		{"FROM:<asd@box.com> SIZE=abc", 501},
+		{"FROM:<asd@box.com> SIZE=-1", 501},
+	} {
+		client.Mode = stateMAIL
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdMAIL(client, test.param)
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(test.code); err != nil {
+			t.Errorf("%s: expected %d, got %s (%v)", test.param, test.code, msg, err)
+		}
+		wg.Wait()
+	}
+}
+
+func TestCmdMAIL_Params(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		param  string
+		code   int
+		from   string
+		params map[string]string
+	}{
+		{"FROM:<> BODY=8BITMIME", 250, "", map[string]string{"BODY": "8BITMIME"}},
+		{"FROM:<a@b.c> BODY=7BIT SMTPUTF8", 250, "a@b.c", map[string]string{"BODY": "7BIT", "SMTPUTF8": ""}},
+		{"FROM:<a@b.c> X-UNKNOWN=1", 555, "", nil},
+		{"FROM:<a@b.c>BODY=7BIT", 501, "", nil},
+		{"FROM:<a@b.c> BODY=8BITMIME body=7BIT", 501, "", nil},
+		{"FROM:<jörg@bücher.de>", 553, "", nil},
+		{"FROM:<jörg@bücher.de> SMTPUTF8", 250, "jörg@bücher.de", map[string]string{"SMTPUTF8": ""}},
+		{"FROM:<a@b.c> BODY=binarymime", 250, "a@b.c", map[string]string{"BODY": "binarymime"}},
+	} {
+		client.Mode = stateMAIL
+		client.Message = new(mailbox.Message)
+		client.Params = nil
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdMAIL(client, test.param)
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(test.code); err != nil {
+			t.Errorf("%s: expected %d, got %s (%v)", test.param, test.code, msg, err)
+		}
+		wg.Wait()
+		if test.code != 250 {
+			if client.Mode != stateMAIL || client.Params != nil {
+				t.Errorf("%s: expected command to be rejected", test.param)
+			}
+			continue
+		}
+		if client.Message.From().Address != test.from || !reflect.DeepEqual(client.Params, test.params) {
+			t.Errorf("%s: expected %q %v, got %q %v", test.param, test.from, test.params,
+				client.Message.From().Address, client.Params)
+		}
+		if _, utf8 := test.params["SMTPUTF8"]; client.Message.UTF8 != utf8 {
+			t.Errorf("%s: expected UTF8 to be %t", test.param, utf8)
+		}
+		if binary := test.params["BODY"] == "binarymime"; client.Message.Binary != binary {
+			t.Errorf("%s: expected Binary to be %t", test.param, binary)
+		}
+	}
+}
+
+func TestCmdRCPT_Params(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		param string
+		code  int
+	}{
+		{"TO:<success@host.tld> X-UNKNOWN=1", 555},
+		{"TO:<success@host.tld> NOTIFY=BOGUS", 501},
+		{"TO:<>", 501},
+		{"TO:<success@host.tld", 501},
+		{"TO:<success@hôst.tld>", 553},
+	} {
+		client.Mode = stateRCPT
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdRCPT(client, test.param)
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(test.code); err != nil {
+			t.Errorf("%s: expected %d, got %s (%v)", test.param, test.code, msg, err)
+		}
+		wg.Wait()
+		if client.Mode != stateRCPT || len(client.Message.Rcpt()) != 0 {
+			t.Errorf("%s: expected recipient to be rejected", test.param)
+		}
+	}
+}
+
+// It should accept UTF-8 recipients in SMTPUTF8 transactions.
+func TestCmdRCPT_UTF8(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	client.Mode = stateRCPT
+	client.Message.UTF8 = true
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		cmdRCPT(client, "TO:<success@hôst.tld>")
+		wg.Done()
+	}()
+	if _, msg, err := pipe.ReadResponse(250); err != nil {
+		t.Errorf("Expected 250, got %s (%v)", msg, err)
+	}
+	wg.Wait()
+	if rcpt := client.Message.Inbound(); len(rcpt) != 1 || rcpt[0].Address != "success@hôst.tld" {
+		t.Errorf("Expected UTF-8 recipient, got %v", rcpt)
+	}
+}
+
+// It should record the notification requests of the sender and recipients.
+func TestCmdMAIL_RCPT_DSN(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		cmd   func(*transaction, string) error
+		param string
+	}{
+		{cmdMAIL, "FROM:<a@b.c> RET=hdrs ENVID=QQ+2B314"},
+		{cmdRCPT, "TO:<success@host.tld> NOTIFY=success,failure ORCPT=rfc822;success@host.tld"},
+		{cmdRCPT, "TO:<success@other.tld>"},
+	} {
+		client.Mode = stateRCPT
+		if test.param[0] == 'F' {
+			client.Mode = stateMAIL
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			test.cmd(client, test.param)
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(250); err != nil {
+			t.Errorf("%s: expected 250, got %s (%v)", test.param, msg, err)
+		}
+		wg.Wait()
+	}
+	if msg := client.Message; msg.Ret != "HDRS" || msg.EnvID != "QQ+2B314" {
+		t.Errorf("Expected RET and ENVID to be recorded, got %q and %q", msg.Ret, msg.EnvID)
+	}
+	rcpt := client.Message.Inbound()
+	if len(rcpt) != 2 {
+		t.Fatalf("Expected 2 recipients, got %v", rcpt)
+	}
+	want := mailbox.RcptDSN{Notify: "SUCCESS,FAILURE", ORcpt: "rfc822;success@host.tld"}
+	if got := client.Message.RcptDSN(rcpt[0]); got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if got := client.Message.RcptDSN(rcpt[1]); got != (mailbox.RcptDSN{}) {
+		t.Errorf("Expected no request, got %+v", got)
+	}
+}
+
+func TestCmdEHLO_SIZE_Advertised(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	for _, test := range []struct {
+		max    int64
+		expect string
+	}{
+		{0, "SIZE\n"},
+		{1024, "SIZE 1024\n"},
+	} {
+		client.maxSize = test.max
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdEHLO(client, "name")
+			wg.Done()
+		}()
+		_, msg, err := pipe.ReadResponse(250)
+		if err != nil || !strings.Contains(msg, test.expect) {
+			t.Errorf("Expected %q advertised, got: %s (%v)", test.expect, msg, err)
+		}
+		wg.Wait()
+	}
+}
+
 func TestCmdRCPT_User_Not_Local(t *testing.T) {
 	client, pipe := getTestClient()
 
 	client.Mode = stateRCPT
 
-	// Relay is enabled
+	// Client is authenticated
+	client.User = &mail.Address{Address: "user@host.tld"}
 	client.host = &mockHost{
-		QueryMock:    func(addr *mail.Address) int { return mailbox.QueryNotLocal },
-		SettingsMock: func() jamon.Group { return jamon.Group{"relay": "true"} },
+		QueryMock: func(addr *mail.Address) int { return mailbox.QueryNotLocal },
 	}
 
 	var wg sync.WaitGroup
@@ -150,14 +664,15 @@ func TestCmdRCPT_User_Not_Local(t *testing.T) {
 		t.Errorf("Expected to get a 251 response and a recipient, got: %s and '%s'", err, client.Message.Rcpt()[0])
 	}
 
-	// Relay is disabled
+	wg.Wait()
+
+	// Client is not authenticated, even though the relay flag is set
+	client.User = nil
 	client.host = &mockHost{
 		QueryMock:    func(addr *mail.Address) int { return mailbox.QueryNotLocal },
-		SettingsMock: func() jamon.Group { return jamon.Group{} },
+		SettingsMock: func() jamon.Group { return jamon.Group{"relay": "true"} },
 	}
 
-	wg.Wait()
-
 	go cmdRCPT(client, "TO:<not_local@host.tld>")
 	_, _, err = pipe.ReadResponse(550)
 	if err != nil || client.Mode != stateDATA || len(client.Message.Rcpt()) != 1 {
@@ -224,6 +739,114 @@ func TestCmdDATA_Digest(t *testing.T) {
 	}
 }
 
+// It should refuse messages which exceed the maximum size, after reading them
+// up to the terminating dot.
+func TestCmdDATA_Too_Large(t *testing.T) {
+	var calledDigest bool
+	client, pipe := getTestClient()
+	defer pipe.Close()
+	client.host = &mockHost{
+		DigestMock: func(c *transaction) error {
+			calledDigest = true
+			return nil
+		},
+	}
+	client.maxSize = 20
+
+	done := make(chan error)
+	go func() {
+		client.Mode = stateDATA
+		done <- cmdDATA(client, "")
+	}()
+	pipe.ReadResponse(354)
+	go func() {
+		for i := 0; i < 100; i++ {
+			pipe.PrintfLine("Line %d of a message which is too long", i)
+		}
+		pipe.PrintfLine(".")
+	}()
+	if _, msg, err := pipe.ReadResponse(552); err != nil {
+		t.Errorf("Expected 552, got %s (%v)", msg, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected nil, got %s", err)
+	}
+	if calledDigest || client.Mode != stateMAIL || client.Message.Raw != "" {
+		t.Error("Expected message to be discarded")
+	}
+}
+
+func TestCmdBDAT(t *testing.T) {
+	var digested []string
+	client, pipe := getTestClient()
+	defer pipe.Close()
+	client.host = &mockHost{
+		DigestMock: func(c *transaction) error {
+			digested = append(digested, c.Message.Raw)
+			c.reset()
+			return nil
+		},
+	}
+	client.maxSize = 20
+
+	for _, test := range []struct {
+		mode int
+		cmd  func(*transaction, string) error
+		arg  string
+		data string
+		code int
+	}{
+		{stateDATA, cmdBDAT, "", "", 501},
+		{stateDATA, cmdBDAT, "5 MORE", "skip!", 501},
+		{stateDATA, cmdBDAT, "-1", "", 501},
+		{stateRCPT, cmdBDAT, "4", "skip", 503},
+		{stateDATA, cmdBDAT, "8", "A: b\r\n\r\n", 250},
+		{stateDATA, cmdDATA, "", "", 503},
+		{stateDATA, cmdBDAT, "6 last", ".\r\nBin", 250},
+		{stateDATA, cmdBDAT, "0 LAST", "", 250},
+		{stateDATA, cmdBDAT, "17", "A: b\r\n\r\n123456789", 250},
+		{stateDATA, cmdBDAT, "6", "toobig", 552},
+		{stateMAIL, cmdBDAT, "1 LAST", "x", 503},
+	} {
+		client.Mode = test.mode
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			test.cmd(client, test.arg)
+			wg.Done()
+		}()
+		if test.data != "" {
+			pipe.W.WriteString(test.data)
+			pipe.W.Flush()
+		}
+		if _, msg, err := pipe.ReadResponse(test.code); err != nil {
+			t.Errorf("BDAT %s: expected %d, got %s (%v)", test.arg, test.code, msg, err)
+		}
+		wg.Wait()
+	}
+	expect := []string{"A: b\r\n\r\n.\r\nBin", ""}
+	if !reflect.DeepEqual(digested, expect) {
+		t.Errorf("Expected messages %q, got %q", expect, digested)
+	}
+	if client.chunks != nil || client.Mode != stateMAIL {
+		t.Error("Expected transaction to be reset after exceeding the size")
+	}
+}
+
+// Messages with binary content can not be sent using DATA.
+func TestCmdDATA_BINARYMIME(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+	client.Mode = stateDATA
+	client.Params = map[string]string{"BODY": "binarymime"}
+
+	go cmdDATA(client, "")
+	if _, msg, err := pipe.ReadResponse(503); err != nil {
+		t.Errorf("Expected 503, got %s (%v)", msg, err)
+	}
+}
+
 func TestCmdDATA_Error_Notify(t *testing.T) {
 	client, pipe := getTestClient()
 	client.Mode = stateDATA
@@ -282,10 +905,35 @@ func getTestClient() (*transaction, *textproto.Conn) {
 
 				return mailbox.QueryError
 			},
-			SettingsMock: func() jamon.Group { return jamon.Group{} },
-			DigestMock:   func(c *transaction) error { return nil },
+			SettingsMock:  func() jamon.Group { return jamon.Group{} },
+			DigestMock:    func(c *transaction) error { return nil },
+			TLSConfigMock: func() *tls.Config { return nil },
 		},
 	}
 
 	return client, cconn
 }
+
+// Returns a TLS configuration holding a freshly generated self-signed
+// certificate for the host "mecca.local".
+func getTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mecca.local"},
+		DNSNames:     []string{"mecca.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}}}
+}
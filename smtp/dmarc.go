@@ -0,0 +1,317 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbbr/gomez/dkim"
+	"github.com/gbbr/gomez/mailbox"
+	"golang.org/x/net/publicsuffix"
+)
+
+// RFC 7489 11.2 Authentication-Results results for DMARC
+const (
+	dmarcNone      = "none"
+	dmarcPass      = "pass"
+	dmarcFail      = "fail"
+	dmarcTempError = "temperror"
+)
+
+// RFC 7489 6.3 policies, which are also the dispositions applied to messages.
+const (
+	policyNone       = "none"
+	policyQuarantine = "quarantine"
+	policyReject     = "reject"
+)
+
+// replyDMARCReject is sent at the end of DATA for messages refused by the
+// DMARC policy of their sender's domain.
+var replyDMARCReject = reply{550, "5.7.1 Message rejected due to the DMARC policy of its From domain"}
+
+// We declare inline so we can mock the sampling in tests. It returns a
+// number in [0, 100), which is compared against the pct tag.
+var dmarcSample = func() int { return rand.Intn(100) }
+
+// dmarcRecord is a parsed DMARC record, as per RFC 7489 6.3.
+type dmarcRecord struct {
+	mailbox.DMARCPolicy
+	// RUA holds the URIs which aggregate reports are sent to.
+	RUA []string
+}
+
+// errDMARCSyntax is returned for records which are not valid DMARC records.
+var errDMARCSyntax = errors.New("invalid DMARC record")
+
+// parseDMARC parses a DMARC record. Unknown tags are ignored and tags with
+// invalid values take their defaults, as per RFC 7489 6.3. A record with no
+// valid policy is only accepted if it asks for aggregate reports, in which
+// case its policy is none, as per RFC 7489 6.6.3.
+func parseDMARC(txt string) (*dmarcRecord, error) {
+	r := &dmarcRecord{DMARCPolicy: mailbox.DMARCPolicy{Pct: 100, ADKIM: "r", ASPF: "r"}}
+	for i, spec := range strings.Split(txt, ";") {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			if strings.TrimSpace(spec) == "" {
+				continue
+			}
+			return nil, errDMARCSyntax
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if i == 0 {
+			if name != "v" || value != "DMARC1" {
+				return nil, errDMARCSyntax
+			}
+			continue
+		}
+		switch name {
+		case "p", "sp":
+			switch value = strings.ToLower(value); value {
+			case policyNone, policyQuarantine, policyReject:
+				if name == "p" {
+					r.P = value
+				} else {
+					r.SP = value
+				}
+			}
+		case "pct":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= 100 {
+				r.Pct = n
+			}
+		case "adkim", "aspf":
+			if value = strings.ToLower(value); value == "r" || value == "s" {
+				if name == "adkim" {
+					r.ADKIM = value
+				} else {
+					r.ASPF = value
+				}
+			}
+		case "rua":
+			for _, uri := range strings.Split(value, ",") {
+				if uri = strings.TrimSpace(uri); uri != "" {
+					r.RUA = append(r.RUA, uri)
+				}
+			}
+		}
+	}
+	if r.P == "" {
+		if len(r.RUA) == 0 {
+			return nil, errDMARCSyntax
+		}
+		r.P = policyNone
+	}
+	if r.SP == "" {
+		r.SP = r.P
+	}
+	return r, nil
+}
+
+// orgDomain returns the organizational domain of a domain, as per RFC 7489
+// 3.2, which is the domain right below its public suffix.
+func orgDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return org
+}
+
+// aligned reports whether two domains are aligned in the given mode, as per
+// RFC 7489 3.1: in strict mode ("s") they must be the same, while in relaxed
+// mode they only need the same organizational domain.
+func aligned(a, b, mode string) bool {
+	if mode == "s" {
+		return strings.EqualFold(a, b)
+	}
+	return orgDomain(a) == orgDomain(b)
+}
+
+// dmarcResult holds the outcome of a DMARC evaluation.
+type dmarcResult struct {
+	// Result is one of the DMARC results, or empty if no evaluation was done.
+	Result string
+	// From is the domain of the From header.
+	From string
+	// Domain is the domain whose record was applied, which is From or its
+	// organizational domain, and Record is that record.
+	Domain string
+	Record *dmarcRecord
+	// Policy is the policy requested for From, and Disposition the policy
+	// applied to the message, which may be less strict because of sampling.
+	Policy, Disposition string
+	// DKIM and SPF report whether the checks passed for an aligned domain.
+	DKIM, SPF bool
+}
+
+// lookupDMARC returns the DMARC record which applies to the domain and the
+// domain which published it, as per RFC 7489 6.6.3. If the domain has no
+// record, the record of its organizational domain is used.
+func (c *transaction) lookupDMARC(domain string) (*dmarcRecord, string, error) {
+	domains := []string{domain}
+	if org := orgDomain(domain); org != domain {
+		domains = append(domains, org)
+	}
+	for _, d := range domains {
+		txts, err := c.dns.LookupTXT("_dmarc." + d)
+		if err != nil && !isNotFound(err) {
+			return nil, "", err
+		}
+		var found []*dmarcRecord
+		for _, txt := range txts {
+			if !strings.HasPrefix(txt, "v=DMARC1") {
+				continue
+			}
+			if r, err := parseDMARC(txt); err == nil {
+				found = append(found, r)
+			}
+		}
+		// Several records are treated as none at all.
+		if len(found) == 1 {
+			return found[0], d, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// checkDMARC evaluates the DMARC policy of the domain in the From header of
+// the message, given the SPF result of the sender and the results of the
+// message's DKIM signatures, as per RFC 7489 6.6.
+func (c *transaction) checkDMARC(msg *mail.Message, sigs []dkim.Result) dmarcResult {
+	var r dmarcResult
+	from, err := mail.ParseAddressList(msg.Header.Get("From"))
+	if err != nil || len(from) != 1 || len(msg.Header["From"]) != 1 {
+		// RFC 7489 6.6.1: messages which do not have exactly one author
+		// can not be evaluated.
+		return r
+	}
+	if _, r.From = mailbox.SplitUserHost(from[0]); r.From == "" {
+		return r
+	}
+	rec, domain, err := c.lookupDMARC(r.From)
+	switch {
+	case err != nil:
+		r.Result = dmarcTempError
+		return r
+	case rec == nil:
+		r.Result = dmarcNone
+		return r
+	}
+	r.Record, r.Domain = rec, domain
+	for _, sig := range sigs {
+		if sig.Status == dkim.Pass && aligned(sig.Domain, r.From, rec.ADKIM) {
+			r.DKIM = true
+		}
+	}
+	r.SPF = c.spf.Result == spfPass && aligned(c.spf.Domain, r.From, rec.ASPF)
+	r.Policy = rec.P
+	if !strings.EqualFold(r.From, domain) {
+		r.Policy = rec.SP
+	}
+	r.Disposition = policyNone
+	if r.DKIM || r.SPF {
+		r.Result = dmarcPass
+		return r
+	}
+	r.Result = dmarcFail
+	r.Disposition = r.Policy
+	// RFC 7489 6.6.4: messages which are not sampled get the next policy
+	// which is less strict.
+	if rec.Pct < 100 && dmarcSample() >= rec.Pct {
+		switch r.Policy {
+		case policyReject:
+			r.Disposition = policyQuarantine
+		case policyQuarantine:
+			r.Disposition = policyNone
+		}
+	}
+	return r
+}
+
+// authResult returns the DMARC part of the Authentication-Results header
+// field, or "" if no evaluation was done.
+func (r dmarcResult) authResult() string {
+	switch {
+	case r.Result == "":
+		return ""
+	case r.Record == nil:
+		return fmt.Sprintf("dmarc=%s header.from=%s", r.Result, r.From)
+	}
+	return fmt.Sprintf("dmarc=%s (p=%s dis=%s) header.from=%s", r.Result, r.Policy, r.Disposition, r.From)
+}
+
+// reportTo returns the addresses of the mailto URIs in the rua tag of the
+// record which accept reports about its domain. Addresses outside of the
+// domain's organization must confirm that they do, as per RFC 7489 7.1.
+func (c *transaction) reportTo(r dmarcResult) []string {
+	var list []string
+	for _, uri := range r.Record.RUA {
+		if len(uri) < 7 || !strings.EqualFold(uri[:7], "mailto:") {
+			continue
+		}
+		// Drop the size limit, as reports are small.
+		addr := strings.SplitN(uri[7:], "!", 2)[0]
+		_, host := mailbox.SplitUserHost(&mail.Address{Address: addr})
+		if host == "" {
+			continue
+		}
+		if orgDomain(host) != orgDomain(r.Domain) {
+			txts, err := c.dns.LookupTXT(r.Domain + "._report._dmarc." + host)
+			var ok bool
+			for _, txt := range txts {
+				ok = ok || strings.HasPrefix(txt, "v=DMARC1")
+			}
+			if err != nil || !ok {
+				continue
+			}
+		}
+		list = append(list, addr)
+	}
+	return list
+}
+
+// recordDMARC stores the result of the evaluation for the aggregate reports
+// of the domain, if it asked for them.
+func (s server) recordDMARC(c *transaction, r dmarcResult, sigs []dkim.Result) {
+	if r.Record == nil {
+		return
+	}
+	rua := c.reportTo(r)
+	if len(rua) == 0 {
+		return
+	}
+	res := &mailbox.DMARCResult{
+		Domain:      r.Domain,
+		Policy:      r.Record.DMARCPolicy,
+		RUA:         rua,
+		SourceIP:    c.addrIP,
+		HeaderFrom:  r.From,
+		Disposition: r.Disposition,
+		DKIM:        dmarcFail,
+		SPF:         dmarcFail,
+		SPFAuth:     mailbox.DMARCAuth{Domain: c.spf.Domain, Selector: "mfrom", Result: c.spf.Result},
+		Date:        time.Now(),
+	}
+	if from := c.Message.From(); from != nil {
+		_, res.EnvelopeFrom = mailbox.SplitUserHost(from)
+	}
+	if c.spf.Identity == "helo" {
+		res.SPFAuth.Selector = "helo"
+	}
+	if r.DKIM {
+		res.DKIM = dmarcPass
+	}
+	if r.SPF {
+		res.SPF = dmarcPass
+	}
+	for _, sig := range sigs {
+		res.DKIMAuth = append(res.DKIMAuth, mailbox.DMARCAuth{Domain: sig.Domain, Selector: sig.Selector, Result: sig.Status})
+	}
+	if err := s.Enqueuer.RecordDMARC(res); err != nil {
+		log.Printf("Error recording DMARC result for %s: %s\r\n", r.Domain, err)
+	}
+}
@@ -0,0 +1,253 @@
+package smtp
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/dkim"
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+func TestParseDMARC(t *testing.T) {
+	for _, test := range []struct {
+		txt  string
+		want *dmarcRecord
+	}{
+		{"v=DMARC1; p=reject", &dmarcRecord{DMARCPolicy: mailbox.DMARCPolicy{
+			P: "reject", SP: "reject", Pct: 100, ADKIM: "r", ASPF: "r"}}},
+		{"v=DMARC1;p=Quarantine; sp=none; pct=20; adkim=s; aspf=x; rua=mailto:a@b.test, mailto:c@d.test!10m; fo=1",
+			&dmarcRecord{
+				DMARCPolicy: mailbox.DMARCPolicy{P: "quarantine", SP: "none", Pct: 20, ADKIM: "s", ASPF: "r"},
+				RUA:         []string{"mailto:a@b.test", "mailto:c@d.test!10m"},
+			}},
+		// A record with no valid policy applies none, if it asks for reports.
+		{"v=DMARC1; p=bogus; pct=200; rua=mailto:a@b.test", &dmarcRecord{
+			DMARCPolicy: mailbox.DMARCPolicy{P: "none", SP: "none", Pct: 100, ADKIM: "r", ASPF: "r"},
+			RUA:         []string{"mailto:a@b.test"},
+		}},
+		{"v=DMARC1; p=bogus", nil},
+		{"p=reject; v=DMARC1", nil},
+		{"v=DMARC2; p=reject", nil},
+		{"v=DMARC1; p", nil},
+	} {
+		got, err := parseDMARC(test.txt)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, got %+v", test.txt, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %+v, got %+v (%v)", test.txt, test.want, got, err)
+		}
+	}
+}
+
+func TestAligned(t *testing.T) {
+	for _, test := range []struct {
+		a, b, mode string
+		want       bool
+	}{
+		{"example.com", "EXAMPLE.com", "s", true},
+		{"mail.example.com", "example.com", "s", false},
+		{"mail.example.com", "news.example.com", "r", true},
+		{"a.example.co.uk", "b.example.co.uk", "r", true},
+		{"example.co.uk", "other.co.uk", "r", false},
+		{"example.com", "example.net", "r", false},
+	} {
+		if got := aligned(test.a, test.b, test.mode); got != test.want {
+			t.Errorf("aligned(%q, %q, %q): expected %t", test.a, test.b, test.mode, test.want)
+		}
+	}
+}
+
+func TestTransaction_CheckDMARC(t *testing.T) {
+	defer func(fn func() int) { dmarcSample = fn }(dmarcSample)
+	dmarcSample = func() int { return 50 }
+
+	dns := fakeResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com":      {"v=DMARC1; p=reject; sp=quarantine; aspf=s"},
+			"_dmarc.news.example.com": {"v=spf1 -all", "v=DMARC1; p=none"},
+			"_dmarc.sampled.test":     {"v=DMARC1; p=reject; pct=50"},
+			"_dmarc.unsampled.test":   {"v=DMARC1; p=reject; pct=51"},
+			"_dmarc.twice.test":       {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+		},
+		temp: map[string]bool{"_dmarc.temp.test": true},
+	}
+	pass := func(domain string) []dkim.Result {
+		return []dkim.Result{{Status: dkim.Pass, Domain: domain}}
+	}
+	for i, test := range []struct {
+		from string
+		spf  spfResult
+		sigs []dkim.Result
+		want dmarcResult
+	}{
+		{
+			// Aligned DKIM signature (relaxed).
+			"a@example.com", spfResult{Result: spfFail, Domain: "example.com"}, pass("mail.example.com"),
+			dmarcResult{Result: dmarcPass, From: "example.com", Domain: "example.com",
+				Policy: policyReject, Disposition: policyNone, DKIM: true},
+		},
+		{
+			// Aligned SPF (strict).
+			"a@example.com", spfResult{Result: spfPass, Domain: "example.com"}, nil,
+			dmarcResult{Result: dmarcPass, From: "example.com", Domain: "example.com",
+				Policy: policyReject, Disposition: policyNone, SPF: true},
+		},
+		{
+			// SPF passes for a domain which is not aligned in strict mode,
+			// and DKIM for a domain which is not aligned at all.
+			"a@example.com", spfResult{Result: spfPass, Domain: "bounce.example.com"}, pass("example.net"),
+			dmarcResult{Result: dmarcFail, From: "example.com", Domain: "example.com",
+				Policy: policyReject, Disposition: policyReject},
+		},
+		{
+			// Subdomains without a record get the sp policy of the
+			// organizational domain.
+			"a@shop.example.com", spfResult{Result: spfFail}, nil,
+			dmarcResult{Result: dmarcFail, From: "shop.example.com", Domain: "example.com",
+				Policy: policyQuarantine, Disposition: policyQuarantine},
+		},
+		{
+			// Subdomains with a record use their own.
+			"a@news.example.com", spfResult{}, nil,
+			dmarcResult{Result: dmarcFail, From: "news.example.com", Domain: "news.example.com",
+				Policy: policyNone, Disposition: policyNone},
+		},
+		{
+			"a@sampled.test", spfResult{}, nil,
+			dmarcResult{Result: dmarcFail, From: "sampled.test", Domain: "sampled.test",
+				Policy: policyReject, Disposition: policyQuarantine},
+		},
+		{
+			"a@unsampled.test", spfResult{}, nil,
+			dmarcResult{Result: dmarcFail, From: "unsampled.test", Domain: "unsampled.test",
+				Policy: policyReject, Disposition: policyReject},
+		},
+		{"a@twice.test", spfResult{}, nil, dmarcResult{Result: dmarcNone, From: "twice.test"}},
+		{"a@none.test", spfResult{}, nil, dmarcResult{Result: dmarcNone, From: "none.test"}},
+		{"a@temp.test", spfResult{}, nil, dmarcResult{Result: dmarcTempError, From: "temp.test"}},
+		{"a@b.test, c@d.test", spfResult{}, nil, dmarcResult{}},
+	} {
+		c := &transaction{dns: dns, spf: test.spf}
+		msg := &mail.Message{Header: mail.Header{"From": {test.from}}}
+		got := c.checkDMARC(msg, test.sigs)
+		got.Record = nil
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d: expected %+v, got %+v", i, test.want, got)
+		}
+	}
+}
+
+func TestTransaction_ReportTo(t *testing.T) {
+	c := &transaction{dns: fakeResolver{txt: map[string][]string{
+		"example.com._report._dmarc.reports.test": {"v=DMARC1"},
+	}}}
+	r := dmarcResult{Domain: "example.com", Record: &dmarcRecord{RUA: []string{
+		"mailto:dmarc@example.com!10m",
+		"mailto:agg@mail.example.com",
+		"mailto:a@reports.test",
+		"mailto:a@unverified.test",
+		"https://example.com/dmarc",
+		"mailto:bogus",
+	}}}
+	want := []string{"dmarc@example.com", "agg@mail.example.com", "a@reports.test"}
+	if got := c.reportTo(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// It should act on the DMARC policy of the From domain at the end of DATA
+// and record the results for domains which ask for reports.
+func TestServer_Digest_DMARC(t *testing.T) {
+	var (
+		recorded []*mailbox.DMARCResult
+		queued   []*mailbox.Message
+	)
+	server := server{
+		config: jamon.Group{"host": "TestHost"},
+		Enqueuer: &mailbox.MockEnqueuer{
+			GUIDMock: func() (uint64, error) { return 1, nil },
+			EnqueueMock: func(msg *mailbox.Message) error {
+				queued = append(queued, msg)
+				return nil
+			},
+			RecordDMARCMock: func(r *mailbox.DMARCResult) error {
+				recorded = append(recorded, r)
+				return nil
+			},
+		},
+	}
+	dns := fakeResolver{txt: map[string][]string{
+		"_dmarc.reject.test":     {"v=DMARC1; p=reject; rua=mailto:dmarc@reject.test"},
+		"_dmarc.quarantine.test": {"v=DMARC1; p=quarantine"},
+	}}
+	want := &mailbox.DMARCResult{
+		Domain:       "reject.test",
+		Policy:       mailbox.DMARCPolicy{P: "reject", SP: "reject", Pct: 100, ADKIM: "r", ASPF: "r"},
+		RUA:          []string{"dmarc@reject.test"},
+		SourceIP:     "192.0.2.10",
+		HeaderFrom:   "reject.test",
+		EnvelopeFrom: "other.test",
+		Disposition:  "reject",
+		DKIM:         "fail",
+		SPF:          "fail",
+		SPFAuth:      mailbox.DMARCAuth{Domain: "other.test", Selector: "mfrom", Result: "fail"},
+	}
+	for _, test := range []struct {
+		from       string
+		err        error
+		quarantine bool
+		recorded   int
+	}{
+		{"a@reject.test", errDMARCReject, false, 1},
+		{"a@quarantine.test", nil, true, 0},
+		{"a@none.test", nil, false, 0},
+	} {
+		recorded, queued = nil, nil
+		client, _ := getTestClient()
+		client.ID = "client.test"
+		client.addrIP = "192.0.2.10"
+		client.dns = dns
+		client.spf = spfResult{Result: spfFail, Identity: "mailfrom", Sender: "b@other.test", Domain: "other.test"}
+		client.Message = &mailbox.Message{Raw: "From: " + test.from + "\r\nDate: Today\r\n\r\nHi"}
+		client.Message.SetFrom(&mail.Address{Address: "b@other.test"})
+		client.Message.AddInbound(&mail.Address{Address: "c@d.test"})
+
+		err := server.digest(client)
+		if err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.from, test.err, err)
+		}
+		if len(recorded) != test.recorded {
+			t.Fatalf("%s: expected %d results recorded, got %d", test.from, test.recorded, len(recorded))
+		}
+		if test.err != nil {
+			if len(queued) != 0 {
+				t.Errorf("%s: expected message not to be queued", test.from)
+			}
+			got := recorded[0]
+			if got.Date.IsZero() {
+				t.Error("Expected the date of the result to be set")
+			}
+			got.Date = time.Time{}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %+v, got %+v", want, got)
+			}
+			continue
+		}
+		if len(queued) != 1 || queued[0].Quarantine != test.quarantine {
+			t.Fatalf("%s: expected message queued with quarantine %t", test.from, test.quarantine)
+		}
+		m, _ := queued[0].Parse()
+		domain := strings.SplitN(test.from, "@", 2)[1]
+		if ar := m.Header.Get("Authentication-Results"); !strings.Contains(ar, "header.from="+domain) {
+			t.Errorf("%s: expected DMARC result in %q", test.from, ar)
+		}
+	}
+}
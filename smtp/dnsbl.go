@@ -0,0 +1,122 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gbbr/jamon"
+)
+
+// Policies for clients listed on a DNS blocklist, as set by 'dnsbl.policy'.
+const (
+	// dnsblGreeting refuses listed clients in the greeting.
+	dnsblGreeting = "greeting"
+	// dnsblRcpt refuses every recipient of listed clients.
+	dnsblRcpt = "rcpt"
+	// dnsblTag accepts messages from listed clients, marking them with the
+	// X-DNSBL header.
+	dnsblTag = "tag"
+)
+
+// loadDNSBLPolicy returns the policy for listed clients set by 'dnsbl.policy',
+// which is dnsblTag if none is set.
+func loadDNSBLPolicy(cfg jamon.Group) (string, error) {
+	switch p := strings.ToLower(cfg.Get("dnsbl.policy")); p {
+	case "":
+		return dnsblTag, nil
+	case dnsblGreeting, dnsblRcpt, dnsblTag:
+		return p, nil
+	}
+	return "", ErrDNSBLPolicy
+}
+
+// dnsblZones returns the comma separated zones set by 'dnsbl.zones'.
+func (s server) dnsblZones() []string {
+	var zones []string
+	for _, z := range strings.Split(s.config.Get("dnsbl.zones"), ",") {
+		if z = strings.Trim(strings.TrimSpace(z), "."); z != "" {
+			zones = append(zones, z)
+		}
+	}
+	return zones
+}
+
+// dnsblListed queries the given zones for ip using r, as per RFC 5782, and
+// returns the first zone (in the given order) which lists it, or an empty
+// string. Zones are queried at once and failed queries count as not listed.
+func dnsblListed(r resolver, ip string, zones []string) string {
+	name := dnsblName(ip)
+	if name == "" || len(zones) == 0 {
+		return ""
+	}
+	listed := make([]bool, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			addrs, _ := r.LookupIP(name + "." + zone)
+			for _, a := range addrs {
+				// RFC 5782 2.1: listings are answered with addresses
+				// in 127.0.0.0/8.
+				if ip := a.To4(); ip != nil && ip[0] == 127 {
+					listed[i] = true
+				}
+			}
+		}(i, zone)
+	}
+	wg.Wait()
+	for i, zone := range zones {
+		if listed[i] {
+			return zone
+		}
+	}
+	return ""
+}
+
+// dnsblName returns the name under which ip is listed in a zone, which is
+// its reversed octets for IPv4 and its reversed nibbles for IPv6, as per
+// RFC 5782 2.1 and 2.4. It returns an empty string for invalid addresses.
+func dnsblName(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	name := make([]byte, 0, 64)
+	for i := len(addr) - 1; i >= 0; i-- {
+		name = append(name, hex[addr[i]&0xf], '.', hex[addr[i]>>4], '.')
+	}
+	return string(name[:len(name)-1])
+}
+
+// replyListed returns the reply which refuses a client listed in the given
+// zone.
+func replyListed(code int, ip, zone string) reply {
+	return reply{code, fmt.Sprintf("5.7.1 Client host [%s] blocked using %s", ip, zone)}
+}
+
+// refused answers the commands of a client which was refused in the
+// greeting with 503 until it sends QUIT, as required by RFC 5321 3.1.
+func (c *transaction) refused() {
+	c.timer.expect(c.timeouts.command, 0)
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			c.expired(err)
+			return
+		}
+		if strings.EqualFold(strings.TrimSpace(line), "QUIT") {
+			c.notify(reply{221, "2.0.0 Adeus"})
+			return
+		}
+		if c.notify(reply{503, "5.5.1 Bad sequence of commands."}) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+func TestDNSBLName(t *testing.T) {
+	for _, test := range []struct{ ip, name string }{
+		{"192.0.2.99", "99.2.0.192"},
+		{"::ffff:192.0.2.1", "1.2.0.192"},
+		{"2001:db8:1:2:3:4:567:89ab", "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2"},
+		{"bogus", ""},
+	} {
+		if name := dnsblName(test.ip); name != test.name {
+			t.Errorf("%s: expected %q, got %q", test.ip, test.name, name)
+		}
+	}
+}
+
+// It should return the first zone in order which lists the IP with an
+// address in 127.0.0.0/8.
+func TestDNSBLListed(t *testing.T) {
+	dns := fakeResolver{ip: map[string][]string{
+		"4.3.2.1.a.test": {"10.0.0.1"},
+		"4.3.2.1.b.test": {"127.0.0.2"},
+		"4.3.2.1.c.test": {"127.0.0.4"},
+	}}
+	for _, test := range []struct {
+		ip    string
+		zones []string
+		zone  string
+	}{
+		{"1.2.3.4", []string{"a.test", "c.test", "b.test"}, "c.test"},
+		{"1.2.3.4", []string{"a.test", "d.test"}, ""},
+		{"5.6.7.8", []string{"b.test"}, ""},
+		{"1.2.3.4", nil, ""},
+		{"bogus", []string{"b.test"}, ""},
+	} {
+		if zone := dnsblListed(dns, test.ip, test.zones); zone != test.zone {
+			t.Errorf("%s %v: expected %q, got %q", test.ip, test.zones, test.zone, zone)
+		}
+	}
+}
+
+func TestLoadDNSBLPolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		want   string
+		err    error
+	}{
+		{"", dnsblTag, nil},
+		{"Greeting", dnsblGreeting, nil},
+		{"rcpt", dnsblRcpt, nil},
+		{"drop", "", ErrDNSBLPolicy},
+	} {
+		p, err := loadDNSBLPolicy(jamon.Group{"dnsbl.policy": test.policy})
+		if p != test.want || err != test.err {
+			t.Errorf("%q: expected %q (%v), got %q (%v)", test.policy, test.want, test.err, p, err)
+		}
+	}
+	if StartContext(context.Background(), &mailbox.MockEnqueuer{}, jamon.Group{
+		"listen": "127.0.0.1:0", "host": "TestHost", "dnsbl.policy": "drop",
+	}) != ErrDNSBLPolicy {
+		t.Error("Expected ErrDNSBLPolicy")
+	}
+}
+
+// It should refuse recipients of listed clients when the policy is "rcpt".
+func TestCmdRCPT_DNSBL(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	client.Mode = stateRCPT
+	client.addrIP = "1.2.3.4"
+	client.listed = "b.test"
+	for _, test := range []struct {
+		policy string
+		code   int
+	}{
+		{dnsblTag, 250},
+		{dnsblRcpt, 550},
+	} {
+		client.dnsbl = test.policy
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdRCPT(client, "TO:<success@host.tld>")
+			wg.Done()
+		}()
+		_, msg, err := pipe.ReadResponse(test.code)
+		if err != nil {
+			t.Errorf("%s: expected %d, got %s (%v)", test.policy, test.code, msg, err)
+		}
+		if test.code == 550 && msg != "5.7.1 Client host [1.2.3.4] blocked using b.test" {
+			t.Errorf("Unexpected message: %s", msg)
+		}
+		wg.Wait()
+	}
+}
+
+// It should add the X-DNSBL header to messages of listed clients when the
+// policy is "tag".
+func TestServer_Digest_DNSBL_Tag(t *testing.T) {
+	server := server{
+		config: jamon.Group{"host": "TestHost"},
+		Enqueuer: &mailbox.MockEnqueuer{
+			EnqueueMock: func(*mailbox.Message) error { return nil },
+		},
+	}
+	client, _ := getTestClient()
+	client.addrIP = "1.2.3.4"
+	client.listed = "b.test"
+	client.dnsbl = dnsblTag
+	client.Message = &mailbox.Message{
+		Raw: "From: Mary\r\nMessage-ID: My_ID\r\nDate: Today\r\n\r\nHi",
+		ID:  53,
+	}
+	client.Message.AddInbound(&mail.Address{Address: "a@b.c"})
+	msg := client.Message
+
+	if err := server.digest(client); err != nil {
+		t.Fatal(err)
+	}
+	m, err := msg.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := m.Header.Get("X-DNSBL"); h != "1.2.3.4 listed in b.test" {
+		t.Errorf("Expected X-DNSBL header, got %q", h)
+	}
+	if !strings.HasPrefix(msg.Raw, "Received:") {
+		t.Error("Expected Received to remain the first header")
+	}
+}
+
+// It should refuse listed clients in the greeting when the policy is
+// "greeting", answering all commands with 503 until QUIT.
+func TestServer_DNSBL_Greeting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := server{
+		config: jamon.Group{
+			"host":         "TestHost",
+			"dnsbl.zones":  "a.test, b.test",
+			"dnsbl.policy": "greeting",
+		},
+		dns: fakeResolver{ip: map[string][]string{"1.0.0.127.b.test": {"127.0.0.2"}}},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.createTransaction(conn)
+	}()
+	c, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, msg, err := c.ReadResponse(554); err != nil || !strings.HasSuffix(msg, "blocked using b.test") {
+		t.Errorf("Expected 554 greeting, got %s (%v)", msg, err)
+	}
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"EHLO client", 503},
+		{"MAIL FROM:<a@b.c>", 503},
+		{"QUIT", 221},
+	} {
+		c.PrintfLine("%s", cmd.line)
+		if _, msg, err := c.ReadResponse(cmd.code); err != nil {
+			t.Errorf("%s: expected %d, got %s (%v)", cmd.line, cmd.code, msg, err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// limiter bounds the number of simultaneous transactions, both in total and
+// for each remote IP address. All methods are safe to call on a nil limiter,
+// in which case there are no limits.
+type limiter struct {
+	mu    sync.Mutex
+	max   int            // maximum number of transactions, or 0 for no limit
+	perIP int            // maximum number of transactions per IP, or 0 for no limit
+	total int            // number of open transactions
+	byIP  map[string]int // number of open transactions by IP
+}
+
+func newLimiter(max, perIP int) *limiter {
+	return &limiter{max: max, perIP: perIP, byIP: make(map[string]int)}
+}
+
+// acquire reserves a transaction for the given IP. It reports false if this
+// would exceed any of the limits, in which case nothing is reserved. Every
+// successful call must be followed by a call to release.
+func (l *limiter) acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max || l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return false
+	}
+	l.total++
+	l.byIP[ip]++
+	return true
+}
+
+// release frees a transaction reserved for the given IP.
+func (l *limiter) release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// remoteIP returns the IP address of the connection's remote end, or an
+// empty string if it can not be determined.
+func remoteIP(conn net.Conn) string {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return ip
+}
+
+// refuse greets a client which is over the connection limits with a 421
+// reply and closes the connection, as per RFC 5321 3.1.
+func (s server) refuse(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "%s\r\n", reply{421, "4.7.0 " + s.config.Get("host") +
+		" Too many connections, try again later"})
+}
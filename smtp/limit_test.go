@@ -0,0 +1,120 @@
+package smtp
+
+import (
+	"context"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// It should enforce both the total and the per-IP limit, and free the
+// reserved transactions on release.
+func TestLimiter(t *testing.T) {
+	l := newLimiter(3, 2)
+	for _, test := range []struct {
+		ip string
+		ok bool
+	}{
+		{"1.1.1.1", true},
+		{"1.1.1.1", true},
+		{"1.1.1.1", false},
+		{"2.2.2.2", true},
+		{"3.3.3.3", false},
+	} {
+		if ok := l.acquire(test.ip); ok != test.ok {
+			t.Errorf("%s: expected %t, got %t", test.ip, test.ok, ok)
+		}
+	}
+	l.release("1.1.1.1")
+	if !l.acquire("3.3.3.3") {
+		t.Error("Expected released transaction to be available")
+	}
+	l.release("2.2.2.2")
+	if _, ok := l.byIP["2.2.2.2"]; ok || l.total != 2 {
+		t.Errorf("Expected counts to be freed, got %d %v", l.total, l.byIP)
+	}
+
+	unlimited := newLimiter(0, 0)
+	for i := 0; i < 5; i++ {
+		if !unlimited.acquire("1.1.1.1") {
+			t.Fatal("Expected no limits")
+		}
+	}
+
+	var nilLimiter *limiter
+	if !nilLimiter.acquire("1.1.1.1") {
+		t.Error("Expected nil limiter to accept")
+	}
+	nilLimiter.release("1.1.1.1")
+}
+
+// It should greet clients over the per-IP limit with 421 and close their
+// connection, accepting them again once a transaction ends.
+func TestServer_StartContext_Limits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- startContext(ctx, &mailbox.MockEnqueuer{
+			QueryMock: func(addr *mail.Address) int { return mailbox.QuerySuccess },
+		}, jamon.Group{"listen": "127.0.0.1:2527", "host": "TestHost", "conn.max.ip": "1"}, fakeResolver{})
+	}()
+
+	dial := func() *textproto.Conn {
+		start := time.Now()
+		for {
+			c, err := textproto.Dial("tcp", "127.0.0.1:2527")
+			if err == nil {
+				return c
+			}
+			if time.Since(start) > time.Second {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	first := dial()
+	defer first.Close()
+	if _, _, err := first.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	second := dial()
+	defer second.Close()
+	_, msg, err := second.ReadResponse(421)
+	if err != nil || !strings.HasPrefix(msg, "4.7.0 TestHost") {
+		t.Errorf("Expected 421 greeting, got %s (%v)", msg, err)
+	}
+	if _, err := second.ReadLine(); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+
+	first.PrintfLine("QUIT")
+	if _, _, err := first.ReadResponse(221); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for {
+		third := dial()
+		code, _, err := third.ReadResponse(220)
+		third.Close()
+		if err == nil {
+			break
+		}
+		if code != 421 || time.Since(start) > time.Second {
+			t.Fatalf("Expected 220 after release, got %d (%v)", code, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not stop")
+	}
+}
@@ -0,0 +1,183 @@
+package smtp
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// paramSpec holds the ESMTP parameters supported by a command, mapping their
+// names to functions which validate their values. A validator returns nil
+// if the value is accepted, or the reply which rejects the command.
+type paramSpec map[string]func(ctx *transaction, value string) *reply
+
+// RFC 5321 4.1.2 Command Argument Syntax
+var (
+	paramKeyword = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-]*$")
+	paramValue   = regexp.MustCompile("^[\x21-\x3c\x3e-\x7e]+$")
+)
+
+// RFC 3461 4. Additional parameters for RCPT and MAIL commands
+var (
+	xtext    = regexp.MustCompile("^([\x21-\x2a\x2c-\x3c\x3e-\x7e]|\\+[0-9A-F]{2})+$")
+	addrType = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-]*$")
+)
+
+// errParamSyntax is returned when the path or parameters of a command can
+// not be parsed.
+var errParamSyntax = errors.New("bad path or parameter syntax")
+
+// mailParams are the parameters supported by the MAIL command.
+var mailParams = paramSpec{
+	"SIZE":     checkSIZE,
+	"BODY":     checkBODY,
+	"SMTPUTF8": checkSMTPUTF8,
+	"AUTH":     checkAUTH,
+	"RET":      checkRET,
+	"ENVID":    checkENVID,
+}
+
+// rcptParams are the parameters supported by the RCPT command.
+var rcptParams = paramSpec{
+	"NOTIFY": checkNOTIFY,
+	"ORCPT":  checkORCPT,
+}
+
+// parsePath splits the argument of a MAIL or RCPT command into its path and
+// its ESMTP parameters. Parameter names are returned in upper case, mapping
+// to their values, which are empty for parameters without a value.
+func parsePath(arg string) (string, map[string]string, error) {
+	arg = strings.TrimSpace(arg)
+	var end int
+	if start := strings.IndexByte(arg, '<'); start != -1 {
+		end = strings.IndexByte(arg[start:], '>')
+		if end == -1 {
+			return "", nil, errParamSyntax
+		}
+		end += start + 1
+	} else if end = strings.IndexByte(arg, ' '); end == -1 {
+		end = len(arg)
+	}
+	path, rest := arg[:end], arg[end:]
+	if rest != "" && rest[0] != ' ' {
+		return "", nil, errParamSyntax
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Fields(rest) {
+		kv := strings.SplitN(p, "=", 2)
+		name := strings.ToUpper(kv[0])
+		if _, ok := params[name]; ok || !paramKeyword.MatchString(name) {
+			return "", nil, errParamSyntax
+		}
+		if len(kv) == 2 && !paramValue.MatchString(kv[1]) {
+			return "", nil, errParamSyntax
+		}
+		params[name] = ""
+		if len(kv) == 2 {
+			params[name] = kv[1]
+		}
+	}
+	return path, params, nil
+}
+
+// check validates the given parameters against the spec. It returns the
+// reply which rejects the command, or nil if all parameters are accepted.
+func (spec paramSpec) check(ctx *transaction, params map[string]string) *reply {
+	for name, value := range params {
+		validate, ok := spec[name]
+		if !ok {
+			return &reply{555, "5.5.4 Unsupported parameter " + name}
+		}
+		if r := validate(ctx, value); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// RFC 1870 6.2 Changes to the MAIL FROM command
+func checkSIZE(ctx *transaction, value string) *reply {
+	size, err := strconv.ParseInt(value, 10, 64)
+	switch {
+	case err != nil || size < 0:
+		return &reply{501, "5.5.4 Syntax: SIZE=<size>"}
+	case ctx.maxSize > 0 && size > ctx.maxSize:
+		r := replyTooLarge
+		return &r
+	}
+	return nil
+}
+
+// RFC 6152 2. Framework for the 8-bit MIME Transport Extension
+// RFC 3030 3. Framework for the Binary Service Extension
+func checkBODY(ctx *transaction, value string) *reply {
+	switch strings.ToUpper(value) {
+	case "7BIT", "8BITMIME", "BINARYMIME":
+		return nil
+	}
+	return &reply{501, "5.5.4 Syntax: BODY=7BIT|8BITMIME|BINARYMIME"}
+}
+
+// RFC 6531 3.4 The SMTPUTF8 Parameter to the MAIL Command
+func checkSMTPUTF8(ctx *transaction, value string) *reply {
+	if value != "" {
+		return &reply{501, "5.5.4 SMTPUTF8 takes no value"}
+	}
+	return nil
+}
+
+// RFC 4954 5. The AUTH Parameter to the MAIL FROM command
+// The submitter is only recorded, as messages are not relayed with AUTH.
+func checkAUTH(ctx *transaction, value string) *reply {
+	if value == "" {
+		return &reply{501, "5.5.4 Syntax: AUTH=<mailbox>"}
+	}
+	return nil
+}
+
+// RFC 3461 4.3 The RET parameter of the ESMTP MAIL command
+func checkRET(ctx *transaction, value string) *reply {
+	switch strings.ToUpper(value) {
+	case "FULL", "HDRS":
+		return nil
+	}
+	return &reply{501, "5.5.4 Syntax: RET=FULL|HDRS"}
+}
+
+// RFC 3461 4.4 The ENVID parameter to the ESMTP MAIL command
+func checkENVID(ctx *transaction, value string) *reply {
+	if len(value) > 100 || !xtext.MatchString(value) {
+		return &reply{501, "5.5.4 Syntax: ENVID=<xtext>"}
+	}
+	return nil
+}
+
+// RFC 3461 4.1 The NOTIFY parameter of the ESMTP RCPT command
+func checkNOTIFY(ctx *transaction, value string) *reply {
+	bad := &reply{501, "5.5.4 Syntax: NOTIFY=NEVER|SUCCESS,FAILURE,DELAY"}
+	if strings.EqualFold(value, "NEVER") {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, event := range strings.Split(strings.ToUpper(value), ",") {
+		switch {
+		case seen[event]:
+			return bad
+		case event == "SUCCESS", event == "FAILURE", event == "DELAY":
+			seen[event] = true
+		default:
+			return bad
+		}
+	}
+	return nil
+}
+
+// RFC 3461 4.2 The ORCPT parameter to the ESMTP RCPT command
+func checkORCPT(ctx *transaction, value string) *reply {
+	kv := strings.SplitN(value, ";", 2)
+	if len(value) > 500 || len(kv) != 2 || !addrType.MatchString(kv[0]) || !xtext.MatchString(kv[1]) {
+		return &reply{501, "5.5.4 Syntax: ORCPT=<addr-type>;<xtext>"}
+	}
+	return nil
+}
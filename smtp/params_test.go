@@ -0,0 +1,82 @@
+package smtp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	for _, test := range []struct {
+		arg    string
+		path   string
+		params map[string]string
+		err    error
+	}{
+		{"<a@b.c>", "<a@b.c>", map[string]string{}, nil},
+		{" <> ", "<>", map[string]string{}, nil},
+		{"a@b.c", "a@b.c", map[string]string{}, nil},
+		{"First Last <a@b.c>", "First Last <a@b.c>", map[string]string{}, nil},
+		{"<a@b.c> BODY=8BITMIME size=100", "<a@b.c>", map[string]string{"BODY": "8BITMIME", "SIZE": "100"}, nil},
+		{"<a@b.c>  SMTPUTF8 AUTH=<>", "<a@b.c>", map[string]string{"SMTPUTF8": "", "AUTH": "<>"}, nil},
+		{"a@b.c SIZE=1", "a@b.c", map[string]string{"SIZE": "1"}, nil},
+		{"<a@b.c", "", nil, errParamSyntax},
+		{"<a@b.c>SIZE=1", "", nil, errParamSyntax},
+		{"<a@b.c> SIZE=", "", nil, errParamSyntax},
+		{"<a@b.c> SIZE=1=2", "", nil, errParamSyntax},
+		{"<a@b.c> -X=1", "", nil, errParamSyntax},
+		{"<a@b.c> SIZE=1 size=2", "", nil, errParamSyntax},
+	} {
+		path, params, err := parsePath(test.arg)
+		if path != test.path || !reflect.DeepEqual(params, test.params) || err != test.err {
+			t.Errorf("%q: expected %q %v (%v), got %q %v (%v)",
+				test.arg, test.path, test.params, test.err, path, params, err)
+		}
+	}
+}
+
+func TestParamSpec_Check(t *testing.T) {
+	client := &transaction{maxSize: 100}
+	for _, test := range []struct {
+		params map[string]string
+		code   int
+	}{
+		{map[string]string{}, 0},
+		{map[string]string{"SIZE": "100", "BODY": "7bit", "SMTPUTF8": "", "AUTH": "<>"}, 0},
+		{map[string]string{"BODY": "8BITMIME"}, 0},
+		{map[string]string{"BODY": "BINARY"}, 501},
+		{map[string]string{"SIZE": "101"}, 552},
+		{map[string]string{"SIZE": "x"}, 501},
+		{map[string]string{"SMTPUTF8": "yes"}, 501},
+		{map[string]string{"AUTH": ""}, 501},
+		{map[string]string{"BOGUS": "1"}, 555},
+		{map[string]string{"RET": "hdrs", "ENVID": "QQ+2B314"}, 0},
+		{map[string]string{"RET": "BODY"}, 501},
+		{map[string]string{"ENVID": "a+2b"}, 501},
+		{map[string]string{"ENVID": strings.Repeat("x", 101)}, 501},
+	} {
+		r := mailParams.check(client, test.params)
+		if test.code == 0 && r != nil || test.code != 0 && (r == nil || r.Code != test.code) {
+			t.Errorf("%v: expected code %d, got %v", test.params, test.code, r)
+		}
+	}
+	for _, test := range []struct {
+		params map[string]string
+		code   int
+	}{
+		{map[string]string{"NOTIFY": "never"}, 0},
+		{map[string]string{"NOTIFY": "SUCCESS,DELAY,FAILURE", "ORCPT": "rfc822;a+2Bb@c.d"}, 0},
+		{map[string]string{"NOTIFY": "NEVER,SUCCESS"}, 501},
+		{map[string]string{"NOTIFY": "SUCCESS,SUCCESS"}, 501},
+		{map[string]string{"NOTIFY": "SUCCESS,"}, 501},
+		{map[string]string{"ORCPT": "a@b.c"}, 501},
+		{map[string]string{"ORCPT": "rfc822;"}, 501},
+		{map[string]string{"ORCPT": ";a@b.c"}, 501},
+		{map[string]string{"SIZE": "1"}, 555},
+	} {
+		r := rcptParams.check(client, test.params)
+		if test.code == 0 && r != nil || test.code != 0 && (r == nil || r.Code != test.code) {
+			t.Errorf("%v: expected code %d, got %v", test.params, test.code, r)
+		}
+	}
+}
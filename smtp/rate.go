@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+)
+
+var (
+	// replyRateLimited is sent to MAIL, and to the end of the message data,
+	// when the client, the user it has authenticated as or the sender's
+	// domain has sent too many messages.
+	replyRateLimited = reply{450, "4.7.1 Message rate limit exceeded, try again later"}
+	// replyTooManyRcpts is sent to RCPT when a message has more recipients
+	// than its senders may address, as per RFC 5321 4.5.3.1.10.
+	replyTooManyRcpts = reply{452, "4.5.3 Too many recipients"}
+)
+
+// rateWindow is the period over which messages are counted.
+const rateWindow = time.Minute
+
+// Kinds of senders which are rate limited.
+const (
+	rateIP     = "ip"
+	rateUser   = "user"
+	rateDomain = "domain"
+)
+
+// rateLimiter limits the number of messages which may be sent within each
+// rateWindow, and the number of recipients of each message, by every client
+// IP, authenticated user and sender domain. All methods are safe to call on a
+// nil rateLimiter, in which case there are no limits.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limits map[string]int        // messages per window, by kind of sender, or 0 for no limit
+	rcpts  map[string]int        // recipients per message, by kind of sender, or 0 for no limit
+	counts map[string]*rateCount // messages in the current window, by kind and sender
+	swept  time.Time             // time at which expired counts were last removed
+	now    func() time.Time
+}
+
+// rateCount holds the number of messages sent in a window.
+type rateCount struct {
+	start time.Time // start of the window
+	n     int       // messages sent since start
+}
+
+func newRateLimiter(limits, rcpts map[string]int) *rateLimiter {
+	return &rateLimiter{
+		limits: limits,
+		rcpts:  rcpts,
+		counts: make(map[string]*rateCount),
+		now:    time.Now,
+	}
+}
+
+// allow records a message from the given senders, which map kinds of senders
+// to their names. It reports false if any of them has already reached its
+// limit, in which case nothing is recorded. Senders with empty names are
+// ignored.
+func (r *rateLimiter) allow(senders map[string]string) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.sweep(now)
+	var counts []*rateCount
+	for kind, name := range senders {
+		limit := r.limits[kind]
+		if limit <= 0 || name == "" {
+			continue
+		}
+		key := rateKey(kind, name)
+		c, ok := r.counts[key]
+		if !ok || now.Sub(c.start) >= rateWindow {
+			c = &rateCount{start: now}
+			r.counts[key] = c
+		}
+		if c.n >= limit {
+			return false
+		}
+		counts = append(counts, c)
+	}
+	for _, c := range counts {
+		c.n++
+	}
+	return true
+}
+
+// reached reports whether any of the given senders has reached its limit in
+// the current window, without recording anything.
+func (r *rateLimiter) reached(senders map[string]string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.sweep(now)
+	for kind, name := range senders {
+		limit := r.limits[kind]
+		if limit <= 0 || name == "" {
+			continue
+		}
+		if c, ok := r.counts[rateKey(kind, name)]; ok && now.Sub(c.start) < rateWindow && c.n >= limit {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRcpts returns the most recipients which a message from the given
+// senders may have, which is the lowest of their limits, or 0 if there is no
+// limit. Senders with empty names are ignored.
+func (r *rateLimiter) maxRcpts(senders map[string]string) int {
+	if r == nil {
+		return 0
+	}
+	max := 0
+	for kind, name := range senders {
+		if limit := r.rcpts[kind]; limit > 0 && name != "" && (max == 0 || limit < max) {
+			max = limit
+		}
+	}
+	return max
+}
+
+// rateKey returns the key of the count of a sender.
+func rateKey(kind, name string) string {
+	return kind + ":" + strings.ToLower(name)
+}
+
+// sweep removes the counts of windows which have ended, at most once per
+// window.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.swept) < rateWindow {
+		return
+	}
+	for key, c := range r.counts {
+		if now.Sub(c.start) >= rateWindow {
+			delete(r.counts, key)
+		}
+	}
+	r.swept = now
+}
+
+// senders returns the senders of a message which the client sends from the
+// given address, keyed by kind, for use with rateLimiter.allow.
+func (c *transaction) senders(from *mail.Address) map[string]string {
+	s := map[string]string{rateIP: c.addrIP}
+	if c.User != nil {
+		s[rateUser] = c.User.Address
+	}
+	if from == nil {
+		return s
+	}
+	if _, host := mailbox.SplitUserHost(from); host != "" {
+		s[rateDomain] = host
+	}
+	return s
+}
@@ -0,0 +1,152 @@
+package smtp
+
+import (
+	"fmt"
+	"net/mail"
+	"sync"
+	"testing"
+	"time"
+)
+
+// It should limit each kind of sender separately, forget counts once their
+// window ends and record nothing for refused messages.
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(map[string]int{rateIP: 2, rateDomain: 3}, nil)
+	r.now = func() time.Time { return now }
+
+	for i, test := range []struct {
+		senders map[string]string
+		ok      bool
+	}{
+		{map[string]string{rateIP: "1.1.1.1", rateDomain: "a.com"}, true},
+		{map[string]string{rateIP: "1.1.1.1", rateDomain: "A.com"}, true},
+		{map[string]string{rateIP: "1.1.1.1", rateDomain: "a.com"}, false},
+		{map[string]string{rateIP: "2.2.2.2", rateDomain: "a.com"}, true},
+		{map[string]string{rateIP: "3.3.3.3", rateDomain: "a.com"}, false},
+		{map[string]string{rateIP: "3.3.3.3", rateDomain: "b.com"}, true},
+		{map[string]string{rateIP: "3.3.3.3", rateUser: "a@b.c"}, true},
+		{map[string]string{rateIP: "", rateDomain: ""}, true},
+	} {
+		if ok := r.allow(test.senders); ok != test.ok {
+			t.Errorf("%d. %v: expected %t, got %t", i, test.senders, test.ok, ok)
+		}
+	}
+	if n := r.counts["ip:3.3.3.3"].n; n != 2 {
+		t.Errorf("Expected refused message not to be counted, got %d", n)
+	}
+	if !r.reached(map[string]string{rateIP: "1.1.1.1"}) || r.reached(map[string]string{rateIP: "4.4.4.4"}) {
+		t.Error("Expected only 1.1.1.1 to have reached its limit")
+	}
+	if r.counts["ip:4.4.4.4"] != nil {
+		t.Error("Expected reached not to record anything")
+	}
+
+	now = now.Add(rateWindow)
+	if !r.allow(map[string]string{rateIP: "1.1.1.1", rateDomain: "a.com"}) {
+		t.Error("Expected limit to reset after window")
+	}
+	if len(r.counts) != 2 {
+		t.Errorf("Expected expired counts to be removed, got %v", r.counts)
+	}
+
+	var nilLimiter *rateLimiter
+	if !nilLimiter.allow(map[string]string{rateIP: "1.1.1.1"}) || nilLimiter.reached(nil) || nilLimiter.maxRcpts(nil) != 0 {
+		t.Error("Expected nil limiter to allow")
+	}
+}
+
+// It should limit the recipients of a message to the lowest limit of its
+// senders.
+func TestRateLimiter_maxRcpts(t *testing.T) {
+	r := newRateLimiter(nil, map[string]int{rateIP: 100, rateUser: 20, rateDomain: 0})
+	for i, test := range []struct {
+		senders map[string]string
+		max     int
+	}{
+		{map[string]string{rateIP: "1.1.1.1"}, 100},
+		{map[string]string{rateIP: "1.1.1.1", rateUser: "a@b.c", rateDomain: "b.c"}, 20},
+		{map[string]string{rateIP: "1.1.1.1", rateUser: ""}, 100},
+		{map[string]string{rateDomain: "b.c"}, 0},
+	} {
+		if max := r.maxRcpts(test.senders); max != test.max {
+			t.Errorf("%d. %v: expected %d, got %d", i, test.senders, test.max, max)
+		}
+	}
+}
+
+// It should count messages once their data is received, refusing the data
+// and any further MAIL with 450 once the client exceeds its message rate.
+func TestCmdMAIL_RateLimit(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	client.addrIP = "1.2.3.4"
+	client.User = &mail.Address{Address: "me@host.tld"}
+	client.rates = newRateLimiter(map[string]int{rateUser: 1}, nil)
+	run := func(fn func() error, code int) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			fn()
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(code); err != nil {
+			t.Errorf("Expected %d, got %s (%v)", code, msg, err)
+		}
+		wg.Wait()
+	}
+	mail := func() error { return cmdMAIL(client, "FROM:<me@host.tld>") }
+
+	// Transactions which are given up are not counted.
+	for i := 0; i < 2; i++ {
+		client.Mode = stateMAIL
+		run(mail, 250)
+		run(func() error { return cmdRSET(client, "") }, 250)
+	}
+
+	// Once a message is delivered, the next is refused.
+	run(mail, 250)
+	run(client.deliver, 250)
+	client.Mode = stateMAIL
+	run(mail, 450)
+	if client.Mode != stateMAIL {
+		t.Errorf("Expected refused MAIL to keep state, got %d", client.Mode)
+	}
+
+	// Messages which were begun before the limit was reached are refused
+	// once their data is received.
+	client.rates = newRateLimiter(map[string]int{rateUser: 1}, nil)
+	run(mail, 250)
+	client.rates.allow(client.senders(client.Message.From()))
+	run(client.deliver, 450)
+	if client.Mode != stateMAIL {
+		t.Errorf("Expected refused message to be reset, got %d", client.Mode)
+	}
+}
+
+// It should refuse recipients with 452 once a message has as many as its
+// senders may address.
+func TestCmdRCPT_TooMany(t *testing.T) {
+	client, pipe := getTestClient()
+	defer pipe.Close()
+
+	client.Mode = stateRCPT
+	client.addrIP = "1.2.3.4"
+	client.rates = newRateLimiter(nil, map[string]int{rateIP: 2})
+	for i, code := range []int{250, 250, 452} {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdRCPT(client, fmt.Sprintf("TO:<success@host%d.tld>", i))
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(code); err != nil {
+			t.Errorf("%d. Expected %d, got %s (%v)", i, code, msg, err)
+		}
+		wg.Wait()
+	}
+	if n := len(client.Message.Rcpt()); n != 2 {
+		t.Errorf("Expected 2 recipients, got %d", n)
+	}
+}
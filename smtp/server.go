@@ -1,15 +1,19 @@
 package smtp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
 	"net/mail"
 	"net/textproto"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gbbr/gomez/dkim"
 	"github.com/gbbr/gomez/mailbox"
 	"github.com/gbbr/jamon"
 )
@@ -23,74 +27,279 @@ type host interface {
 	settings() jamon.Group
 	// query searches on the server for a given address.
 	query(addr *mail.Address) int
+	// tlsConfig returns the server's TLS configuration, or nil if STARTTLS
+	// is not available.
+	tlsConfig() *tls.Config
+	// authenticate verifies a user's credentials.
+	authenticate(addr *mail.Address, password string) (bool, error)
 }
 
 // Host server instance.
 type server struct {
 	spec     commandSpec
 	config   jamon.Group
+	tls      *tls.Config
+	active   *tracker
+	limits   *limiter
+	rates    *rateLimiter
+	dns      resolver
 	Enqueuer mailbox.Enqueuer
 }
 
 // commandSpec holds a set of supported commands, mapping names to actions.
 type commandSpec map[string]func(*transaction, string) error
 
-// Valid command format. Currently commands must be exactly 4 letters, optionally
-// followed by a parameter.
-var commandFormat = regexp.MustCompile("^([a-zA-Z]{4})(?:[ ](.*))?$")
+// Valid command format. Currently commands must be between 4 and 8 letters (to
+// allow STARTTLS), optionally followed by a parameter.
+var commandFormat = regexp.MustCompile("^([a-zA-Z]{4,8})(?:[ ](.*))?$")
 
 // ErrMinConfig is returned when the minimum configuration is not passed to the server.
 // A listen address (host:port) passed via the 'listen' and a 'host' is required.
 var ErrMinConfig = errors.New("Minimum config not met. Need at least 'listen' and 'host'")
 
+// ErrTLSConfig is returned when only one of 'tls.cert' and 'tls.key' is configured,
+// or when 'tls.required' is set without either of them.
+var ErrTLSConfig = errors.New("TLS needs both 'tls.cert' and 'tls.key'")
+
+// ErrTLSRequired is returned when 'tls.required' is not a boolean.
+var ErrTLSRequired = errors.New("'tls.required' must be true or false")
+
+// ErrDNSBLPolicy is returned when 'dnsbl.policy' is not one of the known
+// policies.
+var ErrDNSBLPolicy = errors.New("'dnsbl.policy' must be one of greeting, rcpt or tag")
+
 // Start initiates a new SMTP server given an Enqueuer and a configuration.
+// If 'tls.cert' and 'tls.key' are set, the STARTTLS extension is enabled
+// and if 'tls.required' is also true, clients must use it before MAIL.
+// Messages larger than 'size.max' bytes are refused, as per RFC 1870.
+// Clients which do not complete a command within the 'timeout.*' limits
+// are disconnected, as per RFC 5321 4.5.3.2. At most 'conn.max' (default
+// 100) clients are served at once, and at most 'conn.max.ip' (default 10)
+// from the same IP address. Clients over these limits are greeted with 421.
+// Each client IP and authenticated user may send 'rate.ip' and 'rate.user'
+// messages per minute (default 60), and each sender domain 'rate.domain'
+// (default 0, no limit). Messages are counted once their data is received
+// and messages over these rates are refused with 450. Likewise, messages from
+// each client IP and authenticated user may have 'rcpt.ip' and 'rcpt.user'
+// recipients (default 100), and those from each sender domain 'rcpt.domain'
+// (default 0, no limit). Recipients beyond the lowest of these are refused
+// with 452.
+// Client IPs are looked up in the comma separated DNS blocklists set by
+// 'dnsbl.zones', and listed clients are handled as set by 'dnsbl.policy':
+// "greeting" refuses them with 554, "rcpt" refuses their recipients with 550
+// and "tag" (the default) adds an X-DNSBL header to their messages.
+// Unauthenticated senders are checked using SPF, as per RFC 7208, and a
+// Received-SPF header is added to their messages. Senders which fail are
+// refused with 550 unless 'spf.fail' is "tag", and senders which soft fail
+// are refused only if 'spf.softfail' is "reject". The DKIM signatures of
+// all messages are verified, as per RFC 6376, and the results are recorded
+// in an Authentication-Results header, along with the result of validating
+// their ARC chain, as per RFC 8617. Messages from unauthenticated senders are
+// then evaluated against the DMARC policy of their From domain, as per
+// RFC 7489: they are refused with 550 or quarantined if the domain asks for
+// it, and the results are recorded for the domain's aggregate reports. Setting 'auth.checks' to
+// "off" disables the SPF, DKIM, ARC and DMARC checks.
 func Start(mq mailbox.Enqueuer, cfg jamon.Group) error {
+	return StartContext(context.Background(), mq, cfg)
+}
+
+// StartContext is like Start, but shuts the server down once the given context
+// is done. The server then stops accepting connections and disconnects idle
+// clients, while clients which are in the middle of a command (such as DATA)
+// are given 'shutdown.timeout' seconds (default 30) to complete it. It returns
+// nil once all clients have been disconnected.
+func StartContext(ctx context.Context, mq mailbox.Enqueuer, cfg jamon.Group) error {
+	return startContext(ctx, mq, cfg, netResolver{})
+}
+
+// startContext is like StartContext, but performs DNS lookups using dns.
+func startContext(ctx context.Context, mq mailbox.Enqueuer, cfg jamon.Group, dns resolver) error {
 	if !cfg.Has("listen") || !cfg.Has("host") {
 		return ErrMinConfig
 	}
+	tlsConf, err := loadTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := loadDNSBLPolicy(cfg); err != nil {
+		return err
+	}
 	ln, err := net.Listen("tcp", cfg.Get("listen"))
 	if err != nil {
 		return err
 	}
-	srv := server{Enqueuer: mq, config: cfg}
+	srv := server{Enqueuer: mq, config: cfg, tls: tlsConf, active: newTracker(), dns: dns}
+	srv.limits = newLimiter(srv.intFlag("conn.max", 100), srv.intFlag("conn.max.ip", 10))
+	srv.rates = newRateLimiter(map[string]int{
+		rateIP:     srv.intFlag("rate.ip", 60),
+		rateUser:   srv.intFlag("rate.user", 60),
+		rateDomain: srv.intFlag("rate.domain", 0),
+	}, map[string]int{
+		rateIP:     srv.intFlag("rcpt.ip", 100),
+		rateUser:   srv.intFlag("rcpt.user", 100),
+		rateDomain: srv.intFlag("rcpt.domain", 0),
+	})
 	srv.spec = commandSpec{
-		"HELO": cmdHELO,
-		"EHLO": cmdEHLO,
-		"MAIL": cmdMAIL,
-		"RCPT": cmdRCPT,
-		"DATA": cmdDATA,
-		"RSET": cmdRSET,
-		"NOOP": cmdNOOP,
-		"VRFY": cmdVRFY,
-		"QUIT": cmdQUIT,
+		"HELO":     cmdHELO,
+		"EHLO":     cmdEHLO,
+		"MAIL":     cmdMAIL,
+		"RCPT":     cmdRCPT,
+		"DATA":     cmdDATA,
+		"BDAT":     cmdBDAT,
+		"RSET":     cmdRSET,
+		"NOOP":     cmdNOOP,
+		"VRFY":     cmdVRFY,
+		"QUIT":     cmdQUIT,
+		"AUTH":     cmdAUTH,
+		"STARTTLS": cmdSTARTTLS,
 	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				srv.active.shutdown(srv.shutdownTimeout())
+				return nil
+			}
 			log.Printf("Error accepting an incoming connection: %s\r\n", err)
 			continue
 		}
-		go srv.createTransaction(conn)
+		ip := remoteIP(conn)
+		if !srv.limits.acquire(ip) {
+			go srv.refuse(conn)
+			continue
+		}
+		srv.active.add()
+		go func() {
+			defer srv.limits.release(ip)
+			srv.createTransaction(conn)
+		}()
+	}
+}
+
+// intFlag returns the numeric value of a configuration flag, or def if the
+// flag is not set or is negative.
+func (s server) intFlag(name string, def int) int {
+	n, err := strconv.Atoi(s.config.Get(name))
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+// shutdownTimeout returns the time given to clients to finish their current
+// command when the server shuts down.
+func (s server) shutdownTimeout() time.Duration {
+	n, err := strconv.Atoi(s.config.Get("shutdown.timeout"))
+	if err != nil {
+		n = 30
+	}
+	return time.Duration(n) * time.Second
+}
+
+// maxSize returns the largest message size accepted by the server, as set
+// by 'size.max' (default 10MB). A value of 0 means that there is no limit.
+func (s server) maxSize() int64 {
+	n, err := strconv.ParseInt(s.config.Get("size.max"), 10, 64)
+	if err != nil || n < 0 {
+		n = 10 << 20
+	}
+	return n
+}
+
+// timeouts returns the time given to clients for each phase of a transaction,
+// in seconds, as set by 'timeout.greeting' (default 300), 'timeout.command'
+// (default 300), 'timeout.data.block' (default 180) and 'timeout.data.end'
+// (default 600). A value of 0 disables the timeout.
+func (s server) timeouts() timeouts {
+	seconds := func(name string, def int) time.Duration {
+		return time.Duration(s.intFlag(name, def)) * time.Second
+	}
+	return timeouts{
+		greeting:  seconds("timeout.greeting", 300),
+		command:   seconds("timeout.command", 300),
+		dataBlock: seconds("timeout.data.block", 180),
+		dataEnd:   seconds("timeout.data.end", 600),
+	}
+}
+
+// loadTLSConfig reads the certificate and key pair from the paths given by
+// the 'tls.cert' and 'tls.key' flags. It returns nil if TLS is not configured.
+func loadTLSConfig(cfg jamon.Group) (*tls.Config, error) {
+	if cfg.Has("tls.required") {
+		if _, err := strconv.ParseBool(cfg.Get("tls.required")); err != nil {
+			return nil, ErrTLSRequired
+		}
 	}
+	switch {
+	case !cfg.Has("tls.cert") && !cfg.Has("tls.key") && !tlsRequired(cfg):
+		return nil, nil
+	case !cfg.Has("tls.cert") || !cfg.Has("tls.key"):
+		return nil, ErrTLSConfig
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.Get("tls.cert"), cfg.Get("tls.key"))
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   cfg.Get("host"),
+	}, nil
+}
+
+// tlsRequired reports whether 'tls.required' is true, in which case clients
+// must use STARTTLS before MAIL. A false value is the same as none.
+func tlsRequired(cfg jamon.Group) bool {
+	ok, _ := strconv.ParseBool(cfg.Get("tls.required"))
+	return ok
 }
 
 // createTransaction creates a new client based on the given connection.
+// When the server is tracking connections, add must be called beforehand.
 func (s server) createTransaction(conn net.Conn) {
 	defer conn.Close()
+	timer := &timeoutConn{Conn: conn}
+	t := &transaction{
+		Message:  new(mailbox.Message),
+		Mode:     stateHELO,
+		host:     s,
+		text:     textproto.NewConn(timer),
+		conn:     timer,
+		tracker:  s.active,
+		maxSize:  s.maxSize(),
+		timeouts: s.timeouts(),
+		timer:    timer,
+		rates:    s.rates,
+	}
+	if !strings.EqualFold(s.config.Get("auth.checks"), "off") {
+		t.dns = s.dns
+	}
+	s.active.track(t)
+	defer s.active.done(t)
 	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
 		return
 	}
-	t := transaction{
-		Message: new(mailbox.Message),
-		Mode:    stateHELO,
-		host:    s,
-		text:    textproto.NewConn(conn),
-		conn:    conn,
-		addrIP:  ip,
+	t.addrIP = ip
+	t.dnsbl, _ = loadDNSBLPolicy(s.config)
+	if s.dns != nil {
+		if hosts, _ := s.dns.LookupAddr(ip); len(hosts) > 0 {
+			t.addrHost = strings.TrimRight(hosts[0], ".") + " "
+		}
+		t.listed = dnsblListed(s.dns, ip, s.dnsblZones())
 	}
-	if hosts, _ := net.LookupAddr(ip); len(hosts) > 0 {
-		t.addrHost = strings.TrimRight(hosts[0], ".") + " "
+	if t.listed != "" && t.dnsbl == dnsblGreeting {
+		t.notify(replyListed(554, ip, t.listed))
+		t.refused()
+		return
 	}
 	t.notify(reply{220, s.config.Get("host") + " Gomez SMTP"})
 	t.serve()
@@ -99,11 +308,19 @@ func (s server) createTransaction(conn net.Conn) {
 // settings returns the configuration of the server.
 func (s server) settings() jamon.Group { return s.config }
 
+// tlsConfig returns the TLS configuration used by STARTTLS.
+func (s server) tlsConfig() *tls.Config { return s.tls }
+
 // query asks the attached enqueuer to search for an address.
 func (s server) query(addr *mail.Address) int {
 	return s.Enqueuer.Query(addr)
 }
 
+// authenticate asks the attached enqueuer to verify a user's credentials.
+func (s server) authenticate(addr *mail.Address, password string) (bool, error) {
+	return s.Enqueuer.Authenticate(addr, password)
+}
+
 // run executes a command in the context of a child connection.
 func (s server) run(ctx *transaction, msg string) error {
 	if !commandFormat.MatchString(msg) {
@@ -123,6 +340,7 @@ var (
 	errMsgNotCompliant = errors.New("message not RFC 2822 compliant")
 	errProcessing      = errors.New("error during processing")
 	errEnqueuing       = errors.New("error occurred while trying to enqueue")
+	errDMARCReject     = errors.New("message rejected by DMARC policy")
 )
 
 // digest finalizes the SMTP transaction by validating the message and attempting
@@ -143,18 +361,61 @@ func (s server) digest(client *transaction) error {
 		}
 		client.Message.ID = id
 	}
+	// Verify DKIM signatures before any header is added, as the signers
+	// may have signed the absence of fields such as Message-ID.
+	var sigs []dkim.Result
+	if client.dns != nil {
+		sigs = dkim.Verify(client.Message.Raw, client.dns)
+	}
+	// Validate the ARC chain of messages, which may have been forwarded,
+	// so that the agent can extend it when users forward them on, and apply
+	// the DMARC policy of their author's domain to unauthenticated senders.
+	var (
+		arc   dkim.ChainResult
+		dmarc dmarcResult
+	)
+	if client.dns != nil {
+		arc = dkim.VerifyARC(client.Message.Raw, client.dns)
+	}
+	if client.dns != nil && client.User == nil {
+		dmarc = client.checkDMARC(msg, sigs)
+		s.recordDMARC(client, dmarc, sigs)
+		switch dmarc.Disposition {
+		case policyReject:
+			return errDMARCReject
+		case policyQuarantine:
+			client.Message.Quarantine = true
+		}
+	}
 	// Check if the message has the Message-ID header and add it if it doesn't.
 	if len(msg.Header["Message-Id"]) == 0 {
 		client.Message.PrependHeader(
 			"Message-ID", "<%x.%d@%s>",
 			time.Now().UnixNano(), client.Message.ID, s.config.Get("host"))
 	}
+	// Remove results which claim to be ours, as they can not be trusted.
+	client.Message.Raw = stripAuthResults(client.Message.Raw, s.config.Get("host"))
+	// Record the results of authenticating the sender and the message.
+	if client.dns != nil {
+		client.Message.PrependHeader("Authentication-Results", "%s",
+			authResults(s.config.Get("host"), client.User, client.spf, sigs, arc, dmarc))
+		client.Message.AuthservID = s.config.Get("host")
+	}
+	// Record the SPF result of the sender.
+	if client.spf.Result != "" {
+		client.Message.PrependHeader("Received-SPF", "%s",
+			client.spf.header(s.config.Get("host"), client.addrIP, client.ID))
+	}
+	// Mark messages from listed clients.
+	if client.listed != "" && client.dnsbl == dnsblTag {
+		client.Message.PrependHeader("X-DNSBL", "%s listed in %s", client.addrIP, client.listed)
+	}
 	// Add Received header.
 	client.Message.PrependHeader(
 		"Received",
-		"from %s (%s[%s])\r\n\tby %s (Gomez) with ESMTP id %d for %s; %s",
+		"from %s (%s[%s])\r\n\tby %s (Gomez) with %s id %d for %s; %s",
 		client.ID, client.addrHost, client.addrIP, s.config.Get("host"),
-		client.Message.ID, client.Message.Rcpt()[0], time.Now())
+		client.protocol(), client.Message.ID, client.Message.Rcpt()[0], time.Now())
 
 	err = s.Enqueuer.Enqueue(client.Message)
 	if err != nil {
@@ -1,16 +1,19 @@
 package smtp
 
 import (
+	"crypto/tls"
 	"net/mail"
 
 	"github.com/gbbr/jamon"
 )
 
 type mockHost struct {
-	RunMock      func(*transaction, string) error
-	DigestMock   func(*transaction) error
-	SettingsMock func() jamon.Group
-	QueryMock    func(*mail.Address) int
+	RunMock       func(*transaction, string) error
+	DigestMock    func(*transaction) error
+	SettingsMock  func() jamon.Group
+	QueryMock     func(*mail.Address) int
+	TLSConfigMock func() *tls.Config
+	AuthMock      func(*mail.Address, string) (bool, error)
 }
 
 func (h mockHost) run(c *transaction, m string) error {
@@ -28,3 +31,11 @@ func (h mockHost) settings() jamon.Group {
 func (h mockHost) query(addr *mail.Address) int {
 	return h.QueryMock(addr)
 }
+
+func (h mockHost) tlsConfig() *tls.Config {
+	return h.TLSConfigMock()
+}
+
+func (h mockHost) authenticate(addr *mail.Address, pass string) (bool, error) {
+	return h.AuthMock(addr, pass)
+}
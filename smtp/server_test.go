@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -108,6 +109,125 @@ func TestServerCreateClient(t *testing.T) {
 	wg.Wait()
 }
 
+// It should only authenticate senders of new clients if the checks are not
+// turned off.
+func TestServerCreateClient_AuthChecks(t *testing.T) {
+	for _, test := range []struct {
+		checks string
+		dns    bool
+	}{
+		{"", true},
+		{"on", true},
+		{"Off", false},
+	} {
+		cc, sc := mocks.Pipe(
+			&mocks.Conn{RAddr: "1.1.1.1:123"},
+			&mocks.Conn{RAddr: "1.1.1.1:123"},
+		)
+		var got resolver
+		testServer := server{
+			spec: commandSpec{
+				"EXIT": func(ctx *transaction, params string) error {
+					got = ctx.dns
+					return io.EOF
+				},
+			},
+			config: jamon.Group{"host": "mecca.local", "auth.checks": test.checks},
+			dns:    fakeResolver{},
+		}
+		done := make(chan struct{})
+		go func() {
+			testServer.createTransaction(sc)
+			close(done)
+		}()
+		cconn := textproto.NewConn(cc)
+		if _, _, err := cconn.ReadResponse(220); err != nil {
+			t.Fatalf("Expected code 220 but got %+v", err)
+		}
+		cconn.PrintfLine("EXIT")
+		<-done
+		if (got != nil) != test.dns {
+			t.Errorf("%q: expected checks %t, got resolver %v", test.checks, test.dns, got)
+		}
+	}
+}
+
+// It should answer pipelined commands with a single group of replies, sent
+// once all commands in the group were processed.
+func TestServer_Pipelining(t *testing.T) {
+	cc, sc := mocks.Pipe(
+		&mocks.Conn{RAddr: "127.0.0.1:123"},
+		&mocks.Conn{RAddr: "127.0.0.1:123"},
+	)
+	defer cc.Close()
+	cconn := textproto.NewConn(cc)
+
+	var enqueued *mailbox.Message
+	testServer := server{
+		spec: commandSpec{
+			"EHLO": cmdEHLO, "MAIL": cmdMAIL, "RCPT": cmdRCPT,
+			"DATA": cmdDATA, "QUIT": cmdQUIT,
+		},
+		config: jamon.Group{"host": "mecca.local"},
+		Enqueuer: &mailbox.MockEnqueuer{
+			QueryMock: func(addr *mail.Address) int {
+				if strings.HasPrefix(addr.Address, "nobody@") {
+					return mailbox.QueryNotFound
+				}
+				return mailbox.QuerySuccess
+			},
+			GUIDMock: func() (uint64, error) { return 1, nil },
+			EnqueueMock: func(msg *mailbox.Message) error {
+				enqueued = msg
+				return nil
+			},
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		testServer.createTransaction(sc)
+		close(done)
+	}()
+	if _, _, err := cconn.ReadResponse(220); err != nil {
+		t.Fatalf("Expected code 220 but got %+v", err)
+	}
+
+	for _, group := range []struct {
+		send  string
+		codes []int
+	}{
+		{
+			"EHLO client\r\nMAIL FROM:<a@b.c> BODY=8BITMIME\r\nRCPT TO:<d@e.f>\r\n" +
+				"RCPT TO:<nobody@e.f>\r\nRCPT TO:<g@h.i>\r\nDATA\r\n",
+			[]int{250, 250, 250, 550, 250, 354},
+		},
+		{
+			"From: a@b.c\r\nDate: Today\r\n\r\nBody\r\n.\r\nQUIT\r\n",
+			[]int{250, 221},
+		},
+	} {
+		go cc.Write([]byte(group.send))
+		for i, code := range group.codes {
+			if _, msg, err := cconn.ReadResponse(code); err != nil {
+				t.Fatalf("Expected code %d but got %s (%v)", code, msg, err)
+			}
+			// All replies of the group must have arrived together.
+			if last := i == len(group.codes)-1; last != (cconn.R.Buffered() == 0) {
+				t.Errorf("Reply %d of %q was not sent as part of its group", i, group.send)
+			}
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Transaction did not end after QUIT")
+	}
+	if enqueued == nil || len(enqueued.Rcpt()) != 2 {
+		t.Errorf("Expected message with 2 recipients to be enqueued, got %+v", enqueued)
+	}
+}
+
 func TestServer_Settings(t *testing.T) {
 	testServer := server{
 		config: jamon.Group{"host": "test", "relay": "true"},
@@ -136,6 +256,21 @@ func TestServer_Query_Calls_MailBox(t *testing.T) {
 	}
 }
 
+func TestServer_Authenticate_Calls_MailBox(t *testing.T) {
+	testServer := server{
+		Enqueuer: mailbox.MockEnqueuer{
+			AuthenticateMock: func(addr *mail.Address, pass string) (bool, error) {
+				return addr.Address == "a@b.com" && pass == "pass", nil
+			},
+		},
+	}
+
+	ok, err := testServer.authenticate(&mail.Address{Address: "a@b.com"}, "pass")
+	if !ok || err != nil {
+		t.Error("server authenticate did not call Enqueuer authenticate")
+	}
+}
+
 func TestServer_Digest_Responses(t *testing.T) {
 	server := server{config: jamon.Group{"hostname": "TestHost"}}
 
@@ -311,13 +446,38 @@ func TestServer_Start_Error(t *testing.T) {
 	if Start(&mailbox.MockEnqueuer{}, jamon.Group{"listen": "bad_addr"}) != ErrMinConfig {
 		t.Error("ErrMinConfig not returned")
 	}
+
+	for _, cfg := range []jamon.Group{
+		{"host": "wha", "listen": ":1234", "tls.cert": "cert.pem"},
+		{"host": "wha", "listen": ":1234", "tls.key": "key.pem"},
+		{"host": "wha", "listen": ":1234", "tls.required": "true"},
+	} {
+		if Start(&mailbox.MockEnqueuer{}, cfg) != ErrTLSConfig {
+			t.Errorf("ErrTLSConfig not returned for %v", cfg)
+		}
+	}
+	if Start(&mailbox.MockEnqueuer{}, jamon.Group{"host": "wha", "listen": ":1234", "tls.required": "yes"}) != ErrTLSRequired {
+		t.Error("ErrTLSRequired not returned")
+	}
+	if _, err := loadTLSConfig(jamon.Group{"tls.required": "false"}); err != nil {
+		t.Errorf("Expected false to be the same as unset, got %s", err)
+	}
+
+	err := Start(&mailbox.MockEnqueuer{}, jamon.Group{
+		"host": "wha", "listen": ":1234", "tls.cert": "missing.pem", "tls.key": "missing.pem"})
+	if err == nil {
+		t.Error("Expected error loading missing key pair")
+	}
 }
 
 func TestServer_SMTP_Sending(t *testing.T) {
 	var err error
 
 	go func() {
-		err = Start(&mailbox.MockEnqueuer{
+		// The SPF record of example.org is answered locally, so that the
+		// test does not depend on the network.
+		dns := fakeResolver{txt: map[string][]string{"example.org": {"v=spf1 ip4:127.0.0.1 -all"}}}
+		err = startContext(context.Background(), &mailbox.MockEnqueuer{
 			EnqueueMock: func(msg *mailbox.Message) error {
 				buf := make([]byte, 22) // Exact length of "This is the email body"
 
@@ -342,6 +502,9 @@ func TestServer_SMTP_Sending(t *testing.T) {
 
 				case string(buf) != "This is the email body":
 					t.Errorf("Got wrong email body: '%s'", string(buf))
+
+				case !strings.HasPrefix(m.Header.Get("Received-Spf"), "pass"):
+					t.Errorf("Expected SPF to pass, got %q", m.Header.Get("Received-Spf"))
 				}
 
 				return nil
@@ -350,7 +513,7 @@ func TestServer_SMTP_Sending(t *testing.T) {
 				return mailbox.QuerySuccess
 			},
 			GUIDMock: func() (uint64, error) { return 555, nil },
-		}, jamon.Group{"listen": ":1234", "host": "TestHost"})
+		}, jamon.Group{"listen": ":1234", "host": "TestHost"}, dns)
 	}()
 
 	if err != nil {
@@ -387,7 +550,7 @@ func TestServer_SMTP_Sending(t *testing.T) {
 	// Send the email body.
 	wc, err := c.Data()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	_, err = fmt.Fprintf(wc, "From: Me\r\nDate: Today\r\n\r\nThis is the email body")
 	if err != nil {
@@ -404,3 +567,72 @@ func TestServer_SMTP_Sending(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// It should disconnect idle clients when shutting down, while letting
+// clients that are sending a message finish doing so.
+func TestServer_StartContext_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- startContext(ctx, &mailbox.MockEnqueuer{
+			EnqueueMock: func(msg *mailbox.Message) error { return nil },
+			QueryMock:   func(addr *mail.Address) int { return mailbox.QuerySuccess },
+			GUIDMock:    func() (uint64, error) { return 1, nil },
+		}, jamon.Group{"listen": "127.0.0.1:2526", "host": "TestHost", "shutdown.timeout": "5"}, fakeResolver{})
+	}()
+
+	dial := func() *textproto.Conn {
+		start := time.Now()
+		for {
+			c, err := textproto.Dial("tcp", "127.0.0.1:2526")
+			if err == nil {
+				if _, _, err = c.ReadResponse(220); err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+			if time.Since(start) > time.Second {
+				t.Fatal(err)
+			}
+		}
+	}
+	expect := func(c *textproto.Conn, code int) {
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("Expected %d, got %s (%v)", code, msg, err)
+		}
+	}
+
+	idle, busy := dial(), dial()
+	defer idle.Close()
+	defer busy.Close()
+
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"EHLO client", 250},
+		{"MAIL FROM:<a@b.c>", 250},
+		{"RCPT TO:<d@e.f>", 250},
+		{"DATA", 354},
+	} {
+		busy.PrintfLine(cmd.line)
+		expect(busy, cmd.code)
+	}
+	busy.PrintfLine("From: Me")
+
+	cancel()
+	expect(idle, 421)
+
+	busy.PrintfLine("Date: Today\r\n\r\nBody\r\n.")
+	expect(busy, 250)
+	expect(busy, 421)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Expected nil, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Server did not stop")
+	}
+}
@@ -0,0 +1,136 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// replyShutdown is sent to clients which are disconnected because the server
+// is shutting down.
+var replyShutdown = reply{421, "4.3.2 Service shutting down, closing transmission channel"}
+
+// tracker keeps account of the server's open transactions, so that they may
+// be ended gracefully when the server shuts down. All methods are safe to
+// call on a nil tracker, in which case they have no effect.
+type tracker struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	conns   map[*transaction]*trackedConn
+	closing bool
+}
+
+// trackedConn is the state of a transaction, as seen by the tracker.
+type trackedConn struct {
+	// conn is the underlying network connection. It is kept separately because
+	// the transaction's own connection is replaced after STARTTLS.
+	conn net.Conn
+	// idle is true while the transaction is waiting for a command.
+	idle bool
+}
+
+func newTracker() *tracker {
+	return &tracker{conns: make(map[*transaction]*trackedConn)}
+}
+
+// add registers a new connection. It must be called before the transaction
+// is started, and must be followed by a call to done when it ends.
+func (tr *tracker) add() {
+	if tr == nil {
+		return
+	}
+	tr.wg.Add(1)
+}
+
+// track starts watching the given transaction's connection.
+func (tr *tracker) track(c *transaction) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.conns[c] = &trackedConn{conn: c.conn}
+}
+
+// done marks the transaction as ended.
+func (tr *tracker) done(c *transaction) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	delete(tr.conns, c)
+	tr.mu.Unlock()
+	tr.wg.Done()
+}
+
+// idle marks the transaction as waiting for a command. It reports whether the
+// server is shutting down, in which case no further command should be read.
+func (tr *tracker) idle(c *transaction) bool {
+	if tr == nil {
+		return false
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tc, ok := tr.conns[c]; ok {
+		tc.idle = true
+	}
+	return tr.closing
+}
+
+// busy marks the transaction as processing a command.
+func (tr *tracker) busy(c *transaction) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tc, ok := tr.conns[c]; ok {
+		tc.idle = false
+	}
+}
+
+// isClosing reports whether the server is shutting down.
+func (tr *tracker) isClosing() bool {
+	if tr == nil {
+		return false
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.closing
+}
+
+// shutdown ends all transactions. Transactions waiting for a command are
+// interrupted right away, while those processing one (such as receiving a
+// message via DATA) are given until the grace period expires to finish.
+// Connections which are still open shortly after that are closed.
+func (tr *tracker) shutdown(grace time.Duration) {
+	if tr == nil {
+		return
+	}
+	deadline := time.Now().Add(grace)
+	tr.mu.Lock()
+	tr.closing = true
+	for _, tc := range tr.conns {
+		if tc.idle {
+			tc.conn.SetReadDeadline(time.Now())
+		} else {
+			tc.conn.SetDeadline(deadline)
+		}
+	}
+	tr.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		tr.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(grace + time.Second):
+		tr.mu.Lock()
+		for _, tc := range tr.conns {
+			tc.conn.Close()
+		}
+		tr.mu.Unlock()
+	}
+}
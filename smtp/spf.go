@@ -0,0 +1,691 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// resolver performs the DNS lookups of the server, which are needed to
+// authenticate senders and to look up clients. The server uses netResolver,
+// while tests may answer from memory.
+type resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// netResolver is a resolver which uses the system's DNS resolver.
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error)  { return net.LookupTXT(name) }
+func (netResolver) LookupIP(host string) ([]net.IP, error)   { return net.LookupIP(host) }
+func (netResolver) LookupMX(name string) ([]*net.MX, error)  { return net.LookupMX(name) }
+func (netResolver) LookupAddr(addr string) ([]string, error) { return net.LookupAddr(addr) }
+
+// isNotFound reports whether err was caused by a name which has no records,
+// which RFC 7208 4.6.4 counts as a void lookup rather than an error.
+func isNotFound(err error) bool {
+	de, ok := err.(*net.DNSError)
+	return ok && de.IsNotFound
+}
+
+// RFC 7208 2.6 Results of Evaluation
+const (
+	spfNone      = "none"
+	spfNeutral   = "neutral"
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfTempError = "temperror"
+	spfPermError = "permerror"
+)
+
+// replySPFFail is sent to MAIL when the policy refuses a sender which is not
+// authorized by SPF, using the code of RFC 7372 3.2.
+func replySPFFail(domain, ip string) reply {
+	return reply{550, fmt.Sprintf("5.7.23 SPF: %s is not allowed to send mail from %s", ip, domain)}
+}
+
+// spfResult holds the outcome of an SPF check.
+type spfResult struct {
+	// Result is one of the RFC 7208 results, or empty if no check was done.
+	Result string
+	// Identity is "mailfrom", or "helo" if the reverse-path was null.
+	Identity string
+	// Sender is the checked address, which is postmaster at the HELO name
+	// for the "helo" identity.
+	Sender string
+	// Domain is the domain whose policy was evaluated.
+	Domain string
+}
+
+// checkSPF evaluates the SPF policy of the domain of the reverse-path for the
+// client's IP, as per RFC 7208. If the reverse-path is null, the name given
+// in HELO is checked instead, as per RFC 7208 2.4.
+func (c *transaction) checkSPF(from *mail.Address) spfResult {
+	r := spfResult{Identity: "mailfrom", Sender: from.Address}
+	_, r.Domain = mailbox.SplitUserHost(from)
+	if mailbox.IsNullPath(from) {
+		r.Identity = "helo"
+		r.Domain = mailbox.NormalizeHost(c.ID)
+		r.Sender = "postmaster@" + r.Domain
+	}
+	e := &spfEval{dns: c.dns, ip: net.ParseIP(c.addrIP), sender: r.Sender, helo: c.ID}
+	if e.ip == nil {
+		r.Result = spfNone
+		return r
+	}
+	r.Result = e.checkHost(r.Domain)
+	return r
+}
+
+// header returns the Received-SPF header field value recording the result,
+// as per RFC 7208 9.1.
+func (r spfResult) header(receiver, ip, helo string) string {
+	var comment string
+	switch r.Result {
+	case spfPass:
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", r.Sender, ip)
+	case spfFail:
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", r.Sender, ip)
+	case spfSoftFail:
+		comment = fmt.Sprintf("transitioning domain of %s does not designate %s as permitted sender", r.Sender, ip)
+	case spfNeutral:
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", ip, r.Sender)
+	case spfNone:
+		comment = fmt.Sprintf("domain of %s does not designate permitted sender hosts", r.Sender)
+	case spfTempError:
+		comment = fmt.Sprintf("error in processing during lookup of %s", r.Sender)
+	case spfPermError:
+		comment = fmt.Sprintf("domain of %s has a malformed SPF record", r.Sender)
+	}
+	return fmt.Sprintf("%s (%s: %s) receiver=%s; client-ip=%s; envelope-from=%q; helo=%s; identity=%s;",
+		r.Result, receiver, comment, receiver, ip, r.Sender, helo, r.Identity)
+}
+
+// spfRejects reports whether the configured policy refuses senders with the
+// given result. Senders which fail are refused unless 'spf.fail' is "tag",
+// while senders which soft fail are only refused if 'spf.softfail' is
+// "reject". All others are accepted.
+func spfRejects(cfg jamon.Group, result string) bool {
+	switch result {
+	case spfFail:
+		return !strings.EqualFold(cfg.Get("spf.fail"), "tag")
+	case spfSoftFail:
+		return strings.EqualFold(cfg.Get("spf.softfail"), "reject")
+	}
+	return false
+}
+
+// RFC 7208 4.6.4 DNS Lookup Limits
+const (
+	spfMaxLookups = 10
+	spfMaxVoid    = 2
+	spfMaxNames   = 10
+)
+
+var (
+	// errSPFPerm ends an evaluation with a permerror result.
+	errSPFPerm = errors.New("spf: permanent error")
+	// errSPFTemp ends an evaluation with a temperror result.
+	errSPFTemp = errors.New("spf: temporary error")
+)
+
+// spfModifier matches the name of a modifier, as per RFC 7208 12.
+var spfModifier = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9._-]*$")
+
+// spfCIDR splits the argument of an "a" or "mx" mechanism into its
+// domain-spec and its optional IPv4 and IPv6 prefix lengths.
+var spfCIDR = regexp.MustCompile("^(.*?)(?:/([0-9]+))?(?://([0-9]+))?$")
+
+// spfEval holds the state of an evaluation of the check_host() function
+// described in RFC 7208 4, which is shared by nested evaluations.
+type spfEval struct {
+	dns     resolver
+	ip      net.IP // client IP
+	sender  string // <sender>, as local-part@domain
+	helo    string // name given in HELO
+	lookups int    // terms which caused DNS lookups
+	voids   int    // DNS lookups which returned no records
+}
+
+// spfMechanism is a directive of an SPF record.
+type spfMechanism struct {
+	qualifier byte   // one of "+-~?"
+	name      string // lower case mechanism name
+	arg       string // text following the name, such as ":example.com/24"
+}
+
+// checkHost returns the result of evaluating the SPF record of domain.
+func (e *spfEval) checkHost(domain string) string {
+	result, err := e.evaluate(domain)
+	switch err {
+	case errSPFPerm:
+		return spfPermError
+	case errSPFTemp:
+		return spfTempError
+	}
+	return result
+}
+
+func (e *spfEval) evaluate(domain string) (string, error) {
+	if !validDomain(domain) {
+		return spfNone, nil
+	}
+	record, err := e.record(domain)
+	if err != nil || record == "" {
+		return spfNone, err
+	}
+	// Parse the whole record first, as syntax errors anywhere make it
+	// invalid (RFC 7208 4.6).
+	var (
+		mechanisms       []spfMechanism
+		redirect         string
+		hasRedirect, exp bool
+	)
+	for _, term := range strings.Fields(record)[1:] {
+		if i := strings.IndexAny(term, ":/="); i > 0 && term[i] == '=' {
+			name := strings.ToLower(term[:i])
+			switch {
+			case !spfModifier.MatchString(name):
+				return "", errSPFPerm
+			case name == "redirect":
+				if hasRedirect {
+					return "", errSPFPerm
+				}
+				redirect, hasRedirect = term[i+1:], true
+			case name == "exp":
+				// Explanations are not used.
+				if exp {
+					return "", errSPFPerm
+				}
+				exp = true
+			}
+			continue
+		}
+		m, err := parseSPFMechanism(term)
+		if err != nil {
+			return "", err
+		}
+		mechanisms = append(mechanisms, m)
+	}
+	for _, m := range mechanisms {
+		match, err := e.match(m, domain)
+		if err != nil {
+			return "", err
+		}
+		if match {
+			return map[byte]string{
+				'+': spfPass,
+				'-': spfFail,
+				'~': spfSoftFail,
+				'?': spfNeutral,
+			}[m.qualifier], nil
+		}
+	}
+	// RFC 7208 6.1: redirect is used only if no mechanism matched, and
+	// "all" makes it unreachable.
+	if !hasRedirect {
+		return spfNeutral, nil
+	}
+	if err := e.count(); err != nil {
+		return "", err
+	}
+	target, err := e.expandDomain(redirect, domain)
+	if err != nil {
+		return "", err
+	}
+	switch result := e.checkHost(target); result {
+	case spfNone:
+		return "", errSPFPerm
+	default:
+		return result, nil
+	}
+}
+
+// record returns the SPF record published by domain, or an empty string if
+// there is none.
+func (e *spfEval) record(domain string) (string, error) {
+	txts, err := e.dns.LookupTXT(domain)
+	switch {
+	case isNotFound(err):
+		return "", nil
+	case err != nil:
+		return "", errSPFTemp
+	}
+	var record string
+	var n int
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ") {
+			record = txt
+			n++
+		}
+	}
+	if n > 1 {
+		// RFC 7208 4.5: more than one record is an error.
+		return "", errSPFPerm
+	}
+	return record, nil
+}
+
+// parseSPFMechanism parses a directive, checking the syntax of its argument.
+func parseSPFMechanism(term string) (spfMechanism, error) {
+	m := spfMechanism{qualifier: '+'}
+	if strings.IndexByte("+-~?", term[0]) != -1 {
+		m.qualifier, term = term[0], term[1:]
+	}
+	m.name = term
+	if i := strings.IndexAny(term, ":/"); i != -1 {
+		m.name, m.arg = term[:i], term[i:]
+	}
+	m.name = strings.ToLower(m.name)
+	hasSpec := len(m.arg) > 1 && m.arg[0] == ':'
+	var ok bool
+	switch m.name {
+	case "all":
+		ok = m.arg == ""
+	case "include", "exists":
+		ok = hasSpec
+	case "a", "mx":
+		ok = m.arg == "" || m.arg[0] == '/' || hasSpec
+	case "ptr":
+		ok = m.arg == "" || hasSpec
+	case "ip4", "ip6":
+		ok = hasSpec
+	}
+	if !ok {
+		return m, errSPFPerm
+	}
+	return m, nil
+}
+
+// count records a term which causes DNS lookups, failing once there are too
+// many of them.
+func (e *spfEval) count() error {
+	if e.lookups++; e.lookups > spfMaxLookups {
+		return errSPFPerm
+	}
+	return nil
+}
+
+// void records a DNS lookup which returned no records, failing once there
+// are too many of them.
+func (e *spfEval) void() error {
+	if e.voids++; e.voids > spfMaxVoid {
+		return errSPFPerm
+	}
+	return nil
+}
+
+// lookupIP returns the addresses of host, counting void lookups.
+func (e *spfEval) lookupIP(host string) ([]net.IP, error) {
+	ips, err := e.dns.LookupIP(host)
+	switch {
+	case isNotFound(err) || err == nil && len(ips) == 0:
+		return nil, e.void()
+	case err != nil:
+		return nil, errSPFTemp
+	}
+	return ips, nil
+}
+
+// match reports whether the client IP matches the mechanism, as per
+// RFC 7208 5.
+func (e *spfEval) match(m spfMechanism, domain string) (bool, error) {
+	switch m.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return e.matchIP(m)
+	}
+	if err := e.count(); err != nil {
+		return false, err
+	}
+	switch m.name {
+	case "include":
+		target, err := e.expandDomain(m.arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		switch e.checkHost(target) {
+		case spfPass:
+			return true, nil
+		case spfTempError:
+			return false, errSPFTemp
+		case spfPermError, spfNone:
+			return false, errSPFPerm
+		}
+		return false, nil
+	case "exists":
+		target, err := e.expandDomain(m.arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := e.lookupIP(target)
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, err
+	case "a", "mx":
+		target, v4, v6, err := e.targetCIDR(m.arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if m.name == "mx" {
+			if hosts, err = e.lookupMX(target); err != nil {
+				return false, err
+			}
+		}
+		for _, host := range hosts {
+			ips, err := e.lookupIP(host)
+			if err != nil {
+				return false, err
+			}
+			if e.inCIDR(ips, v4, v6) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "ptr":
+		target := domain
+		if m.arg != "" {
+			var err error
+			if target, err = e.expandDomain(m.arg[1:], domain); err != nil {
+				return false, err
+			}
+		}
+		return e.matchPTR(target), nil
+	}
+	return false, errSPFPerm
+}
+
+// lookupMX returns the names of the mail exchangers of domain.
+func (e *spfEval) lookupMX(domain string) ([]string, error) {
+	mxs, err := e.dns.LookupMX(domain)
+	switch {
+	case isNotFound(err) || err == nil && len(mxs) == 0:
+		return nil, e.void()
+	case err != nil:
+		return nil, errSPFTemp
+	case len(mxs) > spfMaxNames:
+		return nil, errSPFPerm
+	}
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// matchPTR reports whether a validated name of the client IP is target or
+// one of its subdomains, as per RFC 7208 5.5. Lookup errors do not match.
+func (e *spfEval) matchPTR(target string) bool {
+	names, err := e.dns.LookupAddr(e.ip.String())
+	if err != nil {
+		return false
+	}
+	target = strings.ToLower(target)
+	for i, name := range names {
+		if i == spfMaxNames {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		ips, err := e.dns.LookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(e.ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchIP reports whether the client IP is within the network of an "ip4"
+// or "ip6" mechanism.
+func (e *spfEval) matchIP(m spfMechanism) (bool, error) {
+	cidr := m.arg[1:]
+	if !strings.Contains(cidr, "/") {
+		cidr += map[string]string{"ip4": "/32", "ip6": "/128"}[m.name]
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil || (m.name == "ip4") == strings.Contains(cidr, ":") {
+		return false, errSPFPerm
+	}
+	isV4 := e.ip.To4() != nil
+	if isV4 != (m.name == "ip4") {
+		return false, nil
+	}
+	return network.Contains(e.ip), nil
+}
+
+// targetCIDR returns the domain and the IPv4 and IPv6 prefix lengths given
+// by the argument of an "a" or "mx" mechanism.
+func (e *spfEval) targetCIDR(arg, domain string) (target string, v4, v6 int, err error) {
+	parts := spfCIDR.FindStringSubmatch(arg)
+	v4, v6 = 32, 128
+	if parts[2] != "" {
+		if v4, err = strconv.Atoi(parts[2]); err != nil || v4 > 32 {
+			return "", 0, 0, errSPFPerm
+		}
+	}
+	if parts[3] != "" {
+		if v6, err = strconv.Atoi(parts[3]); err != nil || v6 > 128 {
+			return "", 0, 0, errSPFPerm
+		}
+	}
+	switch spec := parts[1]; {
+	case spec == "":
+		target = domain
+	case len(spec) > 1 && spec[0] == ':':
+		target, err = e.expandDomain(spec[1:], domain)
+	default:
+		err = errSPFPerm
+	}
+	return target, v4, v6, err
+}
+
+// inCIDR reports whether the client IP is within the given prefix length of
+// any of ips of the same family.
+func (e *spfEval) inCIDR(ips []net.IP, v4, v6 int) bool {
+	bits, ones := 128, v6
+	if e.ip.To4() != nil {
+		bits, ones = 32, v4
+	}
+	mask := net.CIDRMask(ones, bits)
+	for _, ip := range ips {
+		if (ip.To4() != nil) != (bits == 32) {
+			continue
+		}
+		n := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if n.Contains(e.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validDomain reports whether domain is a fully qualified domain name which
+// can be looked up, as per RFC 7208 4.3.
+func validDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	labels := strings.Split(domain, ".")
+	if len(domain) > 253 || len(labels) < 2 || strings.HasPrefix(domain, "[") {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" || len(l) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// expandDomain expands the macros of a domain-spec, shortening the result
+// to at most 253 characters by removing labels from the left, as per
+// RFC 7208 7.3.
+func (e *spfEval) expandDomain(spec, domain string) (string, error) {
+	s, err := e.expand(spec, domain)
+	for len(s) > 253 {
+		i := strings.IndexByte(s, '.')
+		if i == -1 {
+			break
+		}
+		s = s[i+1:]
+	}
+	return s, err
+}
+
+// expand expands the macros of a macro-string, as per RFC 7208 7.
+func (e *spfEval) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", errSPFPerm
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", errSPFPerm
+			}
+			v, err := e.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(v)
+			i += end
+		default:
+			return "", errSPFPerm
+		}
+	}
+	return b.String(), nil
+}
+
+// macro returns the value of a single macro, given as the text between
+// "%{" and "}", applying its transformers.
+func (e *spfEval) macro(m, domain string) (string, error) {
+	if m == "" {
+		return "", errSPFPerm
+	}
+	local, senderDomain := e.sender, ""
+	if i := strings.LastIndex(e.sender, "@"); i != -1 {
+		local, senderDomain = e.sender[:i], e.sender[i+1:]
+	}
+	var v string
+	switch m[0] | 0x20 {
+	case 's':
+		v = e.sender
+	case 'l':
+		v = local
+	case 'o':
+		v = senderDomain
+	case 'd':
+		v = domain
+	case 'i':
+		v = spfIP(e.ip)
+	case 'p':
+		// RFC 7208 7.3 discourages this macro, as it is expensive to
+		// validate the name.
+		v = "unknown"
+	case 'v':
+		v = "ip6"
+		if e.ip.To4() != nil {
+			v = "in-addr"
+		}
+	case 'h':
+		v = e.helo
+	default:
+		return "", errSPFPerm
+	}
+	rest := m[1:]
+	var keep int
+	if n := len(rest) - len(strings.TrimLeft(rest, "0123456789")); n > 0 {
+		keep, _ = strconv.Atoi(rest[:n])
+		if keep == 0 {
+			return "", errSPFPerm
+		}
+		rest = rest[n:]
+	}
+	reverse := rest != "" && rest[0]|0x20 == 'r'
+	if reverse {
+		rest = rest[1:]
+	}
+	delims := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errSPFPerm
+		}
+		delims = rest
+	}
+	parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	v = strings.Join(parts, ".")
+	if m[0] >= 'A' && m[0] <= 'Z' {
+		v = spfEscape(v)
+	}
+	return v, nil
+}
+
+// spfIP returns the form of ip used by the "i" macro, which is dotted
+// nibbles for IPv6 addresses.
+func spfIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, hex[b>>4:b>>4+1], hex[b&0xf:b&0xf+1])
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// spfEscape URL-encodes the characters of s which are not unreserved, as
+// done for upper case macros.
+func spfEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) != -1 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package smtp
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// fakeResolver answers DNS lookups from memory. Names which are not found
+// fail with a "not found" error, except those in temp, which fail with a
+// temporary error.
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	temp map[string]bool
+}
+
+func (r fakeResolver) lookup(records map[string][]string, name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if r.temp[name] {
+		return nil, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	if v, ok := records[name]; ok {
+		return v, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) { return r.lookup(r.txt, name) }
+
+func (r fakeResolver) LookupAddr(addr string) ([]string, error) { return r.lookup(r.ptr, addr) }
+
+func (r fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	addrs, err := r.lookup(r.ip, host)
+	var ips []net.IP
+	for _, a := range addrs {
+		ips = append(ips, net.ParseIP(a))
+	}
+	return ips, err
+}
+
+func (r fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	hosts, err := r.lookup(r.mx, name)
+	var mxs []*net.MX
+	for _, h := range hosts {
+		mxs = append(mxs, &net.MX{Host: h + ".", Pref: 10})
+	}
+	return mxs, err
+}
+
+// The examples of RFC 7208 7.4.
+func TestSPFEval_Expand(t *testing.T) {
+	e := &spfEval{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	for _, test := range []struct{ spec, want string }{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"%{h}%%%_%-", "mx.example.org% %20"},
+		{"%{S}", "strong-bad%40email.example.com"},
+	} {
+		if got, err := e.expand(test.spec, "email.example.com"); err != nil || got != test.want {
+			t.Errorf("%s: expected %q, got %q (%v)", test.spec, test.want, got, err)
+		}
+	}
+	for _, spec := range []string{"%", "%x", "%{", "%{x}", "%{d0}", "%{d2!}"} {
+		if _, err := e.expand(spec, "email.example.com"); err != errSPFPerm {
+			t.Errorf("%s: expected permerror, got %v", spec, err)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestSPFEval_CheckHost(t *testing.T) {
+	dns := fakeResolver{
+		txt: map[string][]string{
+			"pass.test":      {"some text", "v=spf1 ip4:192.0.2.0/24 -all"},
+			"fail.test":      {"v=spf1 ip4:198.51.100.1 -all"},
+			"soft.test":      {"v=spf1 ~all"},
+			"neutral.test":   {"v=spf1"},
+			"two.test":       {"v=spf1 -all", "v=spf1 +all"},
+			"syntax.test":    {"v=spf1 ip4:192.0.2.10 bogus -all"},
+			"badcidr.test":   {"v=spf1 ip4:1.2.3.4/33"},
+			"a.test":         {"v=spf1 a -all"},
+			"acidr.test":     {"v=spf1 a:host.a.test/24 -all"},
+			"mx.test":        {"v=spf1 mx -all"},
+			"ptr.test":       {"v=spf1 ptr -all"},
+			"exists.test":    {"v=spf1 exists:%{ir}.list.test -all"},
+			"include.test":   {"v=spf1 include:pass.test -all"},
+			"incnone.test":   {"v=spf1 include:nothing.test -all"},
+			"inctemp.test":   {"v=spf1 include:temp.test -all"},
+			"redirect.test":  {"v=spf1 redirect=pass.test"},
+			"redirnone.test": {"v=spf1 redirect=nothing.test"},
+			"redirall.test":  {"v=spf1 ?all redirect=pass.test"},
+			"loop.test":      {"v=spf1 include:loop.test -all"},
+			"void.test":      {"v=spf1 a:n1.test a:n2.test a:n3.test -all"},
+			"ip6.test":       {"v=spf1 ip6:2001:db8::/32 -all"},
+			"qual.test":      {"v=spf1 ?ip4:192.0.2.10 -all"},
+			"mod.test":       {"v=spf1 unknown=%{d} exp=explain.%{d} ~all"},
+		},
+		ip: map[string][]string{
+			"a.test":               {"192.0.2.10"},
+			"host.a.test":          {"192.0.2.99"},
+			"mx1.mx.test":          {"198.51.100.1"},
+			"mx2.mx.test":          {"2001:db8::1", "192.0.2.10"},
+			"client.ptr.test":      {"192.0.2.10"},
+			"10.2.0.192.list.test": {"127.0.0.2"},
+			"forged.ptr.test":      {"198.51.100.7"},
+		},
+		mx:   map[string][]string{"mx.test": {"mx1.mx.test", "mx2.mx.test"}},
+		ptr:  map[string][]string{"192.0.2.10": {"forged.ptr.test.", "client.ptr.test."}},
+		temp: map[string]bool{"temp.test": true},
+	}
+	for _, test := range []struct {
+		ip, domain, want string
+	}{
+		{"192.0.2.10", "pass.test", spfPass},
+		{"203.0.113.1", "pass.test", spfFail},
+		{"192.0.2.10", "fail.test", spfFail},
+		{"192.0.2.10", "soft.test", spfSoftFail},
+		{"192.0.2.10", "neutral.test", spfNeutral},
+		{"192.0.2.10", "nothing.test", spfNone},
+		{"192.0.2.10", "localhost", spfNone},
+		{"192.0.2.10", "[192.0.2.10]", spfNone},
+		{"192.0.2.10", "temp.test", spfTempError},
+		{"192.0.2.10", "two.test", spfPermError},
+		{"192.0.2.10", "syntax.test", spfPermError},
+		{"192.0.2.10", "badcidr.test", spfPermError},
+		{"192.0.2.10", "a.test", spfPass},
+		{"192.0.2.11", "a.test", spfFail},
+		{"192.0.2.11", "acidr.test", spfPass},
+		{"192.0.2.10", "mx.test", spfPass},
+		{"2001:db8::1", "mx.test", spfPass},
+		{"203.0.113.1", "mx.test", spfFail},
+		{"192.0.2.10", "ptr.test", spfPass},
+		{"203.0.113.1", "ptr.test", spfFail},
+		{"192.0.2.10", "exists.test", spfPass},
+		{"192.0.2.11", "exists.test", spfFail},
+		{"192.0.2.10", "include.test", spfPass},
+		{"203.0.113.1", "include.test", spfFail},
+		{"192.0.2.10", "incnone.test", spfPermError},
+		{"192.0.2.10", "inctemp.test", spfTempError},
+		{"192.0.2.10", "redirect.test", spfPass},
+		{"192.0.2.10", "redirnone.test", spfPermError},
+		{"192.0.2.10", "redirall.test", spfNeutral},
+		{"192.0.2.10", "loop.test", spfPermError},
+		{"192.0.2.10", "void.test", spfPermError},
+		{"2001:db8::5", "ip6.test", spfPass},
+		{"192.0.2.10", "ip6.test", spfFail},
+		{"192.0.2.10", "qual.test", spfNeutral},
+		{"192.0.2.10", "mod.test", spfSoftFail},
+	} {
+		e := &spfEval{dns: dns, ip: net.ParseIP(test.ip), sender: "a@" + test.domain}
+		if got := e.checkHost(test.domain); got != test.want {
+			t.Errorf("%s from %s: expected %s, got %s", test.domain, test.ip, test.want, got)
+		}
+	}
+}
+
+// It should refuse senders which fail SPF at MAIL, unless the policy only
+// tags them, and skip the check for authenticated users.
+func TestCmdMAIL_SPF(t *testing.T) {
+	for _, test := range []struct {
+		config jamon.Group
+		user   *mail.Address
+		from   string
+		code   int
+		result string
+	}{
+		{jamon.Group{}, nil, "<a@fail.test>", 550, spfFail},
+		{jamon.Group{"spf.fail": "tag"}, nil, "<a@fail.test>", 250, spfFail},
+		{jamon.Group{}, &mail.Address{Address: "me@fail.test"}, "<a@fail.test>", 250, ""},
+		{jamon.Group{}, nil, "<a@soft.test>", 250, spfSoftFail},
+		{jamon.Group{"spf.softfail": "reject"}, nil, "<a@soft.test>", 550, spfSoftFail},
+		{jamon.Group{}, nil, "<a@pass.test>", 250, spfPass},
+		{jamon.Group{}, nil, "<>", 250, spfPass},
+	} {
+		client, pipe := getTestClient()
+		client.host.(*mockHost).SettingsMock = func() jamon.Group { return test.config }
+		client.dns = fakeResolver{txt: map[string][]string{
+			"fail.test":   {"v=spf1 -all"},
+			"soft.test":   {"v=spf1 ~all"},
+			"pass.test":   {"v=spf1 +all"},
+			"client.test": {"v=spf1 ip4:192.0.2.10"},
+		}}
+		client.Mode = stateMAIL
+		client.ID = "client.test"
+		client.addrIP = "192.0.2.10"
+		client.User = test.user
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			cmdMAIL(client, "FROM:"+test.from)
+			wg.Done()
+		}()
+		if _, msg, err := pipe.ReadResponse(test.code); err != nil {
+			t.Errorf("%s %v: expected %d, got %s (%v)", test.from, test.config, test.code, msg, err)
+		}
+		wg.Wait()
+		pipe.Close()
+		if client.spf.Result != test.result {
+			t.Errorf("%s %v: expected result %q, got %q", test.from, test.config, test.result, client.spf.Result)
+		}
+	}
+}
+
+// It should check postmaster at the HELO name when the reverse-path is null.
+func TestTransaction_CheckSPF_Helo(t *testing.T) {
+	client := &transaction{
+		ID:     "Client.Test",
+		addrIP: "192.0.2.10",
+		dns:    fakeResolver{txt: map[string][]string{"client.test": {"v=spf1 -all"}}},
+	}
+	r := client.checkSPF(new(mail.Address))
+	want := spfResult{Result: spfFail, Identity: "helo", Sender: "postmaster@client.test", Domain: "client.test"}
+	if r != want {
+		t.Errorf("Expected %+v, got %+v", want, r)
+	}
+}
+
+// It should prepend the Received-SPF header below the Received header.
+func TestServer_Digest_SPF(t *testing.T) {
+	server := server{
+		config: jamon.Group{"host": "TestHost"},
+		Enqueuer: &mailbox.MockEnqueuer{
+			EnqueueMock: func(*mailbox.Message) error { return nil },
+		},
+	}
+	client, _ := getTestClient()
+	client.ID = "client.test"
+	client.addrIP = "192.0.2.10"
+	client.spf = spfResult{Result: spfPass, Identity: "mailfrom", Sender: "a@pass.test", Domain: "pass.test"}
+	client.Message = &mailbox.Message{
+		Raw: "From: Mary\r\nMessage-ID: My_ID\r\nDate: Today\r\n\r\nHi",
+		ID:  53,
+	}
+	client.Message.AddInbound(&mail.Address{Address: "a@b.c"})
+	msg := client.Message
+
+	if err := server.digest(client); err != nil {
+		t.Fatal(err)
+	}
+	m, err := msg.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `pass (TestHost: domain of a@pass.test designates 192.0.2.10 as permitted sender) ` +
+		`receiver=TestHost; client-ip=192.0.2.10; envelope-from="a@pass.test"; helo=client.test; identity=mailfrom;`
+	if h := m.Header.Get("Received-SPF"); h != want {
+		t.Errorf("Expected %q, got %q", want, h)
+	}
+	if !strings.HasPrefix(msg.Raw, "Received:") {
+		t.Error("Expected Received to remain the first header")
+	}
+	if client.spf.Result != "" {
+		t.Error("Expected SPF result to be reset")
+	}
+}
+
+func TestSPFRejects(t *testing.T) {
+	for _, test := range []struct {
+		config jamon.Group
+		result string
+		reject bool
+	}{
+		{jamon.Group{}, spfFail, true},
+		{jamon.Group{"spf.fail": "TAG"}, spfFail, false},
+		{jamon.Group{}, spfSoftFail, false},
+		{jamon.Group{"spf.softfail": "reject"}, spfSoftFail, true},
+		{jamon.Group{"spf.fail": "reject", "spf.softfail": "reject"}, spfPermError, false},
+		{jamon.Group{}, spfTempError, false},
+	} {
+		if got := spfRejects(test.config, test.result); got != test.reject {
+			t.Errorf("%s %v: expected %t, got %t", test.result, test.config, test.reject, got)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// replyTimeout is sent to clients which are disconnected because they did not
+// complete a command in time.
+var replyTimeout = reply{421, "4.4.2 Timeout exceeded, closing transmission channel"}
+
+// timeouts holds the time given to clients for each phase of a transaction,
+// as recommended by RFC 5321 4.5.3.2. A zero value disables a timeout.
+type timeouts struct {
+	// greeting is the time allowed for the first command after the greeting.
+	greeting time.Duration
+	// command is the time allowed for every following command.
+	command time.Duration
+	// dataBlock is the time allowed for each read of the message data.
+	dataBlock time.Duration
+	// dataEnd is the time allowed for the entire message data to arrive.
+	dataEnd time.Duration
+}
+
+// timeoutConn is a network connection which renews its deadlines before every
+// read and write, so that a client is only given the time allowed for the
+// current phase of the transaction. Deadlines which are set explicitly (such
+// as those set by the tracker on shutdown) are never extended.
+type timeoutConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	timeout time.Duration // time allowed for each read or write, or 0
+	end     time.Time     // time by which the current phase must end, or zero
+	rd, wd  time.Time     // read and write deadlines which were set explicitly
+}
+
+// expect sets the time allowed for each read or write, and the time allowed
+// for the entire phase which is starting. Zero values mean no limit.
+func (c *timeoutConn) expect(timeout, total time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+	c.end = time.Time{}
+	if total > 0 {
+		c.end = time.Now().Add(total)
+	}
+}
+
+// deadline returns the earliest of the given times and the one resulting from
+// the current timeout. Zero times are ignored.
+func (c *timeoutConn) deadline(times ...time.Time) time.Time {
+	var d time.Time
+	if c.timeout > 0 {
+		d = time.Now().Add(c.timeout)
+	}
+	for _, t := range times {
+		if !t.IsZero() && (d.IsZero() || t.Before(d)) {
+			d = t
+		}
+	}
+	return d
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	d := c.deadline(c.end, c.rd)
+	c.mu.Unlock()
+	if err := c.Conn.SetReadDeadline(d); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	d := c.deadline(c.wd)
+	c.mu.Unlock()
+	if err := c.Conn.SetWriteDeadline(d); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rd, c.wd = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rd = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wd = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// isTimeout reports whether err was caused by a deadline of the connection.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"net"
+	"net/mail"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/gbbr/gomez/mailbox"
+	"github.com/gbbr/jamon"
+)
+
+// It should renew the read deadline on every read, without exceeding the end
+// of the phase or a deadline that was set explicitly.
+func TestTimeoutConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := &timeoutConn{Conn: a}
+	defer c.Close()
+	go func() {
+		// Keep the connection busy for a while, one byte at a time.
+		for i := 0; i < 20; i++ {
+			if _, err := b.Write([]byte{'x'}); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	buf := make([]byte, 1)
+	read := func() (time.Duration, error) {
+		start := time.Now()
+		for {
+			if _, err := c.Read(buf); err != nil {
+				return time.Since(start), err
+			}
+		}
+	}
+
+	c.expect(50*time.Millisecond, 100*time.Millisecond)
+	if d, err := read(); !isTimeout(err) || d > time.Second {
+		t.Errorf("Expected phase to end after 100ms, got %s (%v)", d, err)
+	}
+
+	c.expect(time.Hour, 0)
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if d, err := read(); !isTimeout(err) || d > time.Second {
+		t.Errorf("Expected explicit deadline to hold, got %s (%v)", d, err)
+	}
+
+	var nilConn *timeoutConn
+	nilConn.expect(time.Second, time.Second)
+}
+
+// testTimeoutServer returns a connection to a transaction which is served
+// using the given configuration.
+func testTimeoutServer(t *testing.T, cfg jamon.Group) (*textproto.Conn, <-chan struct{}) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg["host"] = "mecca.local"
+	srv := server{
+		spec:   commandSpec{"EHLO": cmdEHLO, "MAIL": cmdMAIL, "RCPT": cmdRCPT, "DATA": cmdDATA},
+		config: cfg,
+		Enqueuer: &mailbox.MockEnqueuer{
+			QueryMock: func(*mail.Address) int { return mailbox.QuerySuccess },
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.createTransaction(conn)
+	}()
+	c, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatalf("Bad greeting: %s", err)
+	}
+	return c, done
+}
+
+// It should disconnect clients which do not send a command in time.
+func TestServer_Timeout_Command(t *testing.T) {
+	c, done := testTimeoutServer(t, jamon.Group{"timeout.greeting": "1"})
+	defer c.Close()
+
+	start := time.Now()
+	if _, msg, err := c.ReadResponse(421); err != nil || msg != replyTimeout.Msg {
+		t.Errorf("Expected timeout reply, got %s (%v)", msg, err)
+	}
+	if d := time.Since(start); d < 900*time.Millisecond || d > 3*time.Second {
+		t.Errorf("Expected timeout after 1s, got %s", d)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Transaction did not end")
+	}
+}
+
+// It should disconnect clients which do not complete the message data in
+// time, even if they keep sending it slowly.
+func TestServer_Timeout_Data(t *testing.T) {
+	c, done := testTimeoutServer(t, jamon.Group{"timeout.data.end": "1"})
+	defer c.Close()
+
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{
+		{"EHLO client", 250},
+		{"MAIL FROM:<a@b.c>", 250},
+		{"RCPT TO:<d@e.f>", 250},
+		{"DATA", 354},
+	} {
+		c.PrintfLine("%s", cmd.line)
+		if _, msg, err := c.ReadResponse(cmd.code); err != nil {
+			t.Fatalf("%s: expected %d, got %s (%v)", cmd.line, cmd.code, msg, err)
+		}
+	}
+	go func() {
+		for {
+			if _, err := c.W.WriteString("x"); err != nil || c.W.Flush() != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	if _, msg, err := c.ReadResponse(421); err != nil || msg != replyTimeout.Msg {
+		t.Errorf("Expected timeout reply, got %s (%v)", msg, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Transaction did not end")
+	}
+}
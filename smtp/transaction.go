@@ -1,10 +1,15 @@
 package smtp
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/mail"
 	"net/textproto"
 	"strings"
 
@@ -31,40 +36,233 @@ type transaction struct {
 	// The current state of the transaction. A transaction can be in the following
 	// states: stateHELO, stateMAIL, stateRCPT and stateDATA.
 	Mode int
+	// The address the client has authenticated as, or nil.
+	User *mail.Address
+	// The ESMTP parameters of the MAIL command, keyed by their upper-case
+	// names.
+	Params map[string]string
 
 	host     host            // Host server instance
 	conn     net.Conn        // Network connection
 	text     *textproto.Conn // Textproto wrapper of network connection
 	addrHost string          // addrHost holds the first result of the IP reverse-lookup
 	addrIP   string          // addrIP is the connection's IP address
+	secure   bool            // secure is true once STARTTLS has succeeded
+	tracker  *tracker        // tracker is notified of the transaction's activity
+	maxSize  int64           // maxSize is the largest accepted message, or 0 if unlimited
+	chunks   *bytes.Buffer   // chunks holds the data received using BDAT, or nil
+	timeouts timeouts        // timeouts of the transaction's phases
+	timer    *timeoutConn    // timer enforces the timeouts on the connection, or nil
+	rates    *rateLimiter    // rates limits the messages sent per minute, or nil
+	listed   string          // listed is the DNSBL zone which lists the client's IP, or ""
+	dnsbl    string          // dnsbl is the policy for listed clients
+	dns      resolver        // dns is used to authenticate senders, or nil to skip it
+	spf      spfResult       // spf is the result of the SPF check of the current sender
 }
 
-// notify sends the given reply back to the connected client.
-func (c *transaction) notify(r reply) error { return c.text.PrintfLine("%s", r) }
+// notify sends the given reply back to the connected client. As per RFC 2920,
+// replies are held back while pipelined commands are waiting to be read, so
+// that they are sent as a group. Intermediate replies (such as 354 to DATA)
+// and replies after which the connection changes or closes are always sent
+// right away, as the client waits for them before going on.
+func (c *transaction) notify(r reply) error {
+	if _, err := fmt.Fprintf(c.text.W, "%s\r\n", r); err != nil {
+		return err
+	}
+	switch {
+	case !c.pipelined(),
+		r.Code/100 == 3,
+		r.Code == 220, r.Code == 221, r.Code == 421:
+		return c.text.W.Flush()
+	}
+	return nil
+}
+
+// pipelined reports whether a complete command line sent by the client is
+// waiting to be read.
+func (c *transaction) pipelined() bool {
+	n := c.text.R.Buffered()
+	if n == 0 {
+		return false
+	}
+	buf, err := c.text.R.Peek(n)
+	return err == nil && bytes.IndexByte(buf, '\n') != -1
+}
 
 // serve listens for incoming commands and runs them on the host instance.
+// If the server shuts down or the client does not send a command in time,
+// the client is notified and serve returns.
 func (c *transaction) serve() {
+	c.timer.expect(c.timeouts.greeting, 0)
 	for {
+		if c.tracker.idle(c) {
+			c.notify(replyShutdown)
+			break
+		}
 		msg, err := c.text.ReadLine()
-		if isEOF(err) {
+		if err != nil {
+			switch {
+			case c.expired(err):
+			case err != io.EOF:
+				log.Printf("Error processing I/O: %s\r\n", err)
+			}
 			break
 		}
 
+		c.tracker.busy(c)
+		c.timer.expect(c.timeouts.command, 0)
 		err = c.host.run(c, msg)
-		if isEOF(err) {
+		if c.expired(err) || isEOF(err) {
 			break
 		}
 	}
 }
 
+// expired reports whether err was caused by a deadline of the connection
+// passing, in which case the client is told why it is being disconnected.
+// This happens when the client is too slow, or when the server shuts down.
+func (c *transaction) expired(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case c.tracker.isClosing():
+		c.notify(replyShutdown)
+	case isTimeout(err):
+		c.notify(replyTimeout)
+	default:
+		return false
+	}
+	return true
+}
+
+// errTooLarge is returned by readData when a message exceeds the maximum size.
+var errTooLarge = errors.New("message exceeds maximum size")
+
+// readData reads the message which follows the DATA command, up to the line
+// holding a single dot. If the message exceeds the maximum size, the rest of
+// it is read and discarded so that the client can be answered, and
+// errTooLarge is returned.
+func (c *transaction) readData() (string, error) {
+	c.timer.expect(c.timeouts.dataBlock, c.timeouts.dataEnd)
+	defer c.timer.expect(c.timeouts.command, 0)
+	dot := c.text.DotReader()
+	r := dot
+	if c.maxSize > 0 {
+		r = io.LimitReader(dot, c.maxSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	if c.maxSize > 0 && int64(len(data)) > c.maxSize {
+		if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+			return "", err
+		}
+		return "", errTooLarge
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	return strings.Join(lines, "\r\n"), nil
+}
+
+// readChunk appends a BDAT chunk of the given size to the message data. If
+// the message would exceed the maximum size, the chunk is read and discarded
+// and errTooLarge is returned.
+func (c *transaction) readChunk(size int64) error {
+	c.timer.expect(c.timeouts.dataBlock, c.timeouts.dataEnd)
+	defer c.timer.expect(c.timeouts.command, 0)
+	if c.chunks == nil {
+		c.chunks = new(bytes.Buffer)
+	}
+	if c.maxSize > 0 && int64(c.chunks.Len())+size > c.maxSize {
+		if _, err := io.CopyN(ioutil.Discard, c.text.R, size); err != nil {
+			return err
+		}
+		return errTooLarge
+	}
+	_, err := io.CopyN(c.chunks, c.text.R, size)
+	return err
+}
+
+// deliver hands the message received by DATA or BDAT to the host and
+// notifies the client about the outcome.
+func (c *transaction) deliver() error {
+	// Messages only count towards the rates once their data is received,
+	// so that transactions which are given up do not use them up.
+	if !c.rates.allow(c.senders(c.Message.From())) {
+		c.reset()
+		return c.notify(replyRateLimited)
+	}
+	err := c.host.digest(c)
+	switch err {
+	case errMsgNotCompliant:
+		return c.notify(reply{550, "Message not RFC 2822 compliant."})
+	case errDMARCReject:
+		c.reset()
+		return c.notify(replyDMARCReject)
+	case errEnqueuing:
+		c.Message.Raw = ""
+		fallthrough
+	case errProcessing:
+		return c.notify(replyErrorProcessing)
+	default:
+		reply := reply{250, fmt.Sprintf("message queued (%x)", c.Message.ID)}
+		return c.notify(reply)
+	}
+}
+
 // reset empties the message buffer and sets the state back to HELO.
 func (c *transaction) reset() {
 	c.Message = new(mailbox.Message)
+	c.Params = nil
+	c.chunks = nil
+	c.spf = spfResult{}
 	if c.Mode > stateHELO {
 		c.Mode = stateMAIL
 	}
 }
 
+// startTLS upgrades the connection to TLS using the given configuration. As
+// required by RFC 3207, all knowledge obtained from the client prior to the
+// negotiation is discarded and the transaction is put back into HELO mode.
+func (c *transaction) startTLS(cfg *tls.Config) error {
+	conn := tls.Server(c.conn, cfg)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+	c.secure = true
+	c.ID = ""
+	c.User = nil
+	c.Params = nil
+	c.chunks = nil
+	c.Message = new(mailbox.Message)
+	c.Mode = stateHELO
+	return nil
+}
+
+// protocol returns the protocol name used for the "with" clause of the
+// Received header, as registered by RFC 3848.
+func (c *transaction) protocol() string {
+	p := "ESMTP"
+	if c.Message.UTF8 {
+		p = "UTF8SMTP"
+	}
+	if c.secure {
+		p += "S"
+	}
+	if c.User != nil {
+		p += "A"
+	}
+	return p
+}
+
+// canAuth reports whether the client may authenticate. When STARTTLS is
+// available, credentials are only accepted over an encrypted connection.
+func (c *transaction) canAuth() bool {
+	return c.secure || c.host.tlsConfig() == nil
+}
+
 // Logs error and validates whether it was EOF.
 func isEOF(err error) bool {
 	if err == io.EOF {
@@ -103,4 +301,6 @@ func (r reply) String() string {
 var (
 	replyBadCommand      = reply{502, "5.5.2 Error: command not recoginized"}
 	replyErrorProcessing = reply{451, "Requested action aborted: error in processing"}
+	replyTooLarge        = reply{552, "5.3.4 Message size exceeds fixed maximum message size"}
+	replyNeedUTF8        = reply{553, "5.6.7 Non-ASCII addresses require SMTPUTF8"}
 )
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/mail"
 	"net/textproto"
 	"sync"
 	"testing"
@@ -171,3 +172,26 @@ func TestClientNotify(t *testing.T) {
 		t.Errorf("Got '%s' but expected '%s'", msg, "200 Hello")
 	}
 }
+
+// It should name the protocol according to RFC 3848 and RFC 6531.
+func TestClientProtocol(t *testing.T) {
+	for _, test := range []struct {
+		Secure bool
+		User   *mail.Address
+		UTF8   bool
+		Expect string
+	}{
+		{false, nil, false, "ESMTP"},
+		{true, nil, false, "ESMTPS"},
+		{false, &mail.Address{Address: "a@b.c"}, false, "ESMTPA"},
+		{true, &mail.Address{Address: "a@b.c"}, false, "ESMTPSA"},
+		{false, nil, true, "UTF8SMTP"},
+		{true, &mail.Address{Address: "a@b.c"}, true, "UTF8SMTPSA"},
+	} {
+		c := &transaction{secure: test.Secure, User: test.User,
+			Message: &mailbox.Message{UTF8: test.UTF8}}
+		if got := c.protocol(); got != test.Expect {
+			t.Errorf("Expected %s, got %s", test.Expect, got)
+		}
+	}
+}